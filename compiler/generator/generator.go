@@ -40,6 +40,7 @@ var Languages = LanguageOptions{
 		"frugal_import":  "Override Frugal package import path (default: github.com/Workiva/frugal/lib/go)",
 		"package_prefix": "Package prefix for generated files",
 		"async":          "Generate async client code using channels",
+		"context":        "Generate client methods accepting a context.Context",
 		"use_vendor":     "Use specified import references for vendored includes and do not generate code for them",
 	},
 	"java": Options{
@@ -25,6 +25,7 @@ const (
 	thriftImportOption  = "thrift_import"
 	frugalImportOption  = "frugal_import"
 	asyncOption         = "async"
+	contextOption       = "context"
 	useVendorOption     = "use_vendor"
 )
 
@@ -1050,6 +1051,9 @@ func (g *Generator) GenerateServiceResultArgsImports(file *os.File) error {
 func (g *Generator) GenerateServiceImports(file *os.File, s *parser.Service) error {
 	imports := "import (\n"
 	imports += "\t\"bytes\"\n"
+	if g.generateContext() {
+		imports += "\t\"context\"\n"
+	}
 	imports += "\t\"fmt\"\n"
 	imports += "\t\"sync\"\n"
 	if len(s.TwowayMethods()) > 0 {
@@ -1261,7 +1265,11 @@ func (g *Generator) generatePublishMethod(scope *parser.Scope, op *parser.Operat
 	}
 	publisher += fmt.Sprintf("func (p *%sPublisher) Publish%s(ctx frugal.FContext, %sreq %s) error {\n",
 		scopeLower, op.Name, args, g.getGoTypeFromThriftType(op.Type))
-	publisher += fmt.Sprintf("\tret := p.methods[\"publish%s\"].Invoke(%s)\n", op.Name, g.generateScopeArgs(scope))
+	publisher += fmt.Sprintf("\tmethod := p.methods[\"publish%s\"]\n", op.Name)
+	publisher += "\tif !method.HasMiddleware() {\n"
+	publisher += fmt.Sprintf("\t\treturn p.publish%s(%s)\n", op.Name, g.generateScopeCallArgs(scope))
+	publisher += "\t}\n"
+	publisher += fmt.Sprintf("\tret := method.Invoke(%s)\n", g.generateScopeArgs(scope))
 	publisher += "\tif ret[0] != nil {\n"
 	publisher += "\t\treturn ret[0].(error)\n"
 	publisher += "\t}\n"
@@ -1280,9 +1288,11 @@ func (g *Generator) generateInternalPublishMethod(scope *parser.Scope, op *parse
 		publisher  = ""
 	)
 
-	publisher += fmt.Sprintf("func (p *%sPublisher) publish%s(ctx frugal.FContext, %sreq %s) error {\n",
+	publisher += fmt.Sprintf("func (p *%sPublisher) publish%s(ctx frugal.FContext, %sreq %s) (err error) {\n",
 		scopeLower, op.Name, args, g.getGoTypeFromThriftType(op.Type))
 	publisher += fmt.Sprintf("\top := \"%s\"\n", op.Name)
+	publisher += "\tspan := frugal.StartSpan(ctx, op, frugal.SpanKindProducer)\n"
+	publisher += "\tdefer func() { span.Finish(err) }()\n"
 	publisher += fmt.Sprintf("\tprefix := %s\n", generatePrefixStringTemplate(scope))
 	publisher += "\ttopic := fmt.Sprintf(\"%s" + scopeTitle + "%s%s\", prefix, delimiter, op)\n"
 	publisher += "\tbuffer := frugal.NewTMemoryOutputBuffer(p.transport.GetPublishSizeLimit())\n"
@@ -1419,7 +1429,13 @@ func (g *Generator) generateSubscribeMethod(scope *parser.Scope, op *parser.Oper
 	subscriber += "\t\t}\n"
 	subscriber += g.generateReadFieldRec(parser.FieldFromType(op.Type, "req"), false)
 	subscriber += "\t\tiprot.ReadMessageEnd()\n\n"
-	subscriber += "\t\tmethod.Invoke([]interface{}{ctx, req})\n"
+	subscriber += "\t\tspan := frugal.StartSpan(ctx, op, frugal.SpanKindConsumer)\n"
+	subscriber += "\t\tdefer span.Finish(nil)\n"
+	subscriber += "\t\tif method.HasMiddleware() {\n"
+	subscriber += "\t\t\tmethod.Invoke([]interface{}{ctx, req})\n"
+	subscriber += "\t\t} else {\n"
+	subscriber += "\t\t\thandler(ctx, req)\n"
+	subscriber += "\t\t}\n"
 	subscriber += "\t\treturn nil\n"
 	subscriber += "\t}\n"
 	subscriber += "}"
@@ -1535,6 +1551,13 @@ func (g *Generator) generateClient(service *parser.Service) string {
 	for _, method := range service.Methods {
 		name := parser.LowercaseFirstLetter(method.Name)
 		contents += fmt.Sprintf("\tmethods[\"%s\"] = frugal.NewMethod(client, client.%s, \"%s\", middleware)\n", name, name, name)
+		if len(method.Annotations) > 0 {
+			contents += fmt.Sprintf("\tmethods[\"%s\"].SetAnnotations(map[string]string{\n", name)
+			for _, annotation := range method.Annotations {
+				contents += fmt.Sprintf("\t\t\"%s\": \"%s\",\n", annotation.Name, annotation.Value)
+			}
+			contents += "\t})\n"
+		}
 	}
 	contents += "\treturn client\n"
 	contents += "}\n\n"
@@ -1544,10 +1567,29 @@ func (g *Generator) generateClient(service *parser.Service) string {
 		if g.generateAsync() {
 			contents += g.generateAsyncClientMethod(service, method)
 		}
+		if g.generateContext() {
+			contents += g.generateContextClientMethod(service, method)
+		}
 	}
 	return contents
 }
 
+func (g *Generator) generateContextClientMethod(service *parser.Service, method *parser.Method) string {
+	var (
+		servTitle = snakeToCamel(service.Name)
+		nameTitle = snakeToCamel(method.Name)
+	)
+
+	contents := fmt.Sprintf("// %sContext calls %s with the FContext linked to goCtx, so the\n", nameTitle, nameTitle)
+	contents += "// request is aborted once goCtx is done.\n"
+	contents += fmt.Sprintf("func (f *F%sClient) %sContext(goCtx context.Context, ctx frugal.FContext%s) %s {\n",
+		servTitle, nameTitle, g.generateInputArgs(method.Arguments), g.generateReturnArgs(method))
+	contents += "\tctx = frugal.WithContext(ctx, goCtx)\n"
+	contents += fmt.Sprintf("\treturn f.%s(%s)\n", nameTitle, g.generateCallArgs(method))
+	contents += "}\n\n"
+	return contents
+}
+
 func (g *Generator) generateAsyncClientMethod(service *parser.Service, method *parser.Method) string {
 	var (
 		servTitle = snakeToCamel(service.Name)
@@ -1598,7 +1640,11 @@ func (g *Generator) generateClientMethod(service *parser.Service, method *parser
 	}
 	contents += fmt.Sprintf("func (f *F%sClient) %s(ctx frugal.FContext%s) %s {\n",
 		servTitle, nameTitle, g.generateInputArgs(method.Arguments), g.generateReturnArgs(method))
-	contents += fmt.Sprintf("\tret := f.methods[\"%s\"].Invoke(%s)\n", nameLower, g.generateClientArgs(method))
+	contents += fmt.Sprintf("\tmethod := f.methods[\"%s\"]\n", nameLower)
+	contents += "\tif !method.HasMiddleware() {\n"
+	contents += fmt.Sprintf("\t\treturn f.%s(%s)\n", nameLower, g.generateCallArgs(method))
+	contents += "\t}\n"
+	contents += fmt.Sprintf("\tret := method.Invoke(%s)\n", g.generateClientArgs(method))
 	numReturn := "2"
 	if method.ReturnType == nil {
 		numReturn = "1"
@@ -1634,6 +1680,8 @@ func (g *Generator) generateInternalClientMethod(service *parser.Service, method
 	contents += fmt.Sprintf("func (f *F%sClient) %s(ctx frugal.FContext%s) %s {\n",
 		servTitle, nameLower, g.generateInputArgs(method.Arguments), g.generateReturnArgs(method))
 
+	contents += fmt.Sprintf("\tspan := frugal.StartSpan(ctx, \"%s\", frugal.SpanKindClient)\n", nameLower)
+	contents += "\tdefer func() { span.Finish(err) }()\n"
 	contents += "\tbuffer := frugal.NewTMemoryOutputBuffer(f.transport.GetRequestSizeLimit())\n"
 	contents += "\toprot := f.protocolFactory.GetProtocol(buffer)\n"
 	contents += "\tif err = oprot.WriteRequestHeader(ctx); err != nil {\n"
@@ -1767,7 +1815,7 @@ func (g *Generator) generateProcessor(service *parser.Service) string {
 	for _, method := range service.Methods {
 		methodLower := parser.LowercaseFirstLetter(method.Name)
 		contents += fmt.Sprintf(
-			"\tp.AddToProcessorMap(\"%s\", &%sF%s{frugal.NewFBaseProcessorFunction(p.GetWriteMutex(), frugal.NewMethod(handler, handler.%s, \"%s\", middleware))})\n",
+			"\tp.AddToProcessorMap(\"%s\", &%sF%s{frugal.NewFBaseProcessorFunction(p.GetWriteMutex(), frugal.NewMethod(handler, handler.%s, \"%s\", middleware)), handler})\n",
 			methodLower, servLower, snakeToCamel(method.Name), snakeToCamel(method.Name), snakeToCamel(method.Name))
 		if len(method.Annotations) > 0 {
 			contents += fmt.Sprintf("\tp.AddToAnnotationsMap(\"%s\", map[string]string{\n", methodLower)
@@ -1794,6 +1842,7 @@ func (g *Generator) generateMethodProcessor(service *parser.Service, method *par
 
 	contents := fmt.Sprintf("type %sF%s struct {\n", servLower, nameTitle)
 	contents += "\t*frugal.FBaseProcessorFunction\n"
+	contents += fmt.Sprintf("\thandler F%s\n", servTitle)
 	contents += "}\n\n"
 
 	contents += fmt.Sprintf("func (p *%sF%s) Process(ctx frugal.FContext, iprot, oprot *frugal.FProtocol) error {\n", servLower, nameTitle)
@@ -1815,25 +1864,35 @@ func (g *Generator) generateMethodProcessor(service *parser.Service, method *par
 	}
 	contents += "\tvar err2 error\n"
 	if method.ReturnType != nil {
+		contents += fmt.Sprintf("\tvar retval %s\n", g.getGoTypeFromThriftType(method.ReturnType))
 	}
-	contents += fmt.Sprintf("\tret := p.InvokeMethod(%s)\n", g.generateHandlerArgs(method))
+	contents += "\tif p.HasMiddleware() {\n"
+	contents += fmt.Sprintf("\t\tret := p.InvokeMethod(%s)\n", g.generateHandlerArgs(method))
 	numReturn := "2"
 	if method.ReturnType == nil {
 		numReturn = "1"
 	}
-	contents += fmt.Sprintf("\tif len(ret) != %s {\n", numReturn)
-	contents += fmt.Sprintf("\t\tpanic(fmt.Sprintf(\"Middleware returned %%d arguments, expected %s\", len(ret)))\n", numReturn)
-	contents += "\t}\n"
+	contents += fmt.Sprintf("\t\tif len(ret) != %s {\n", numReturn)
+	contents += fmt.Sprintf("\t\t\tpanic(fmt.Sprintf(\"Middleware returned %%d arguments, expected %s\", len(ret)))\n", numReturn)
+	contents += "\t\t}\n"
 	if method.ReturnType != nil {
-		contents += "\tif ret[1] != nil {\n"
-		contents += "\t\terr2 = ret[1].(error)\n"
-		contents += "\t}\n"
+		contents += "\t\tif ret[1] != nil {\n"
+		contents += "\t\t\terr2 = ret[1].(error)\n"
+		contents += "\t\t} else {\n"
+		contents += fmt.Sprintf("\t\t\tretval = ret[0].(%s)\n", g.getGoTypeFromThriftType(method.ReturnType))
+		contents += "\t\t}\n"
+		contents += "\t} else {\n"
+		contents += fmt.Sprintf("\t\tretval, err2 = p.handler.%s(%s)\n", nameTitle, g.generateHandlerCallArgs(method))
 	} else {
-		contents += "\tif ret[0] != nil {\n"
-		contents += "\t\terr2 = ret[0].(error)\n"
-		contents += "\t}\n"
+		contents += "\t\tif ret[0] != nil {\n"
+		contents += "\t\t\terr2 = ret[0].(error)\n"
+		contents += "\t\t}\n"
+		contents += "\t} else {\n"
+		contents += fmt.Sprintf("\t\terr2 = p.handler.%s(%s)\n", nameTitle, g.generateHandlerCallArgs(method))
 	}
+	contents += "\t}\n"
 	contents += "\tif err2 != nil {\n"
+	contents += "\t\tfrugal.SetResponseError(ctx, err2)\n"
 	contents += "\t\tif err3, ok := err2.(thrift.TApplicationException); ok {\n"
 	contents += "\t\t\tp.GetWriteMutex().Lock()\n"
 	contents += "\t\t\toprot.WriteResponseHeader(ctx)\n"
@@ -1858,8 +1917,6 @@ func (g *Generator) generateMethodProcessor(service *parser.Service, method *par
 	}
 	if method.ReturnType != nil {
 		contents += "\t} else {\n"
-		contents += fmt.Sprintf("\t\tvar retval %s = ret[0].(%s)\n",
-			g.getGoTypeFromThriftType(method.ReturnType), g.getGoTypeFromThriftType(method.ReturnType))
 		if g.isPrimitive(method.ReturnType) || g.Frugal.IsEnum(method.ReturnType) {
 			contents += "\t\tresult.Success = &retval\n"
 		} else {
@@ -1917,6 +1974,15 @@ func (g *Generator) generateScopeArgs(scope *parser.Scope) string {
 	return args
 }
 
+func (g *Generator) generateScopeCallArgs(scope *parser.Scope) string {
+	args := "ctx"
+	for _, v := range scope.Prefix.Variables {
+		args += ", " + v
+	}
+	args += ", req"
+	return args
+}
+
 func (g *Generator) generateHandlerArgs(method *parser.Method) string {
 	args := "[]interface{}{ctx"
 	for _, arg := range method.Arguments {
@@ -1925,6 +1991,15 @@ func (g *Generator) generateHandlerArgs(method *parser.Method) string {
 	args += "}"
 	return args
 }
+
+func (g *Generator) generateHandlerCallArgs(method *parser.Method) string {
+	args := "ctx"
+	for _, arg := range method.Arguments {
+		args += ", args." + snakeToCamel(arg.Name)
+	}
+	return args
+}
+
 func (g *Generator) generateCallArgs(method *parser.Method) string {
 	args := "ctx"
 	for _, arg := range method.Arguments {
@@ -1971,6 +2046,7 @@ func (g *Generator) generateWriteApplicationError(service *parser.Service) strin
 	contents += "\tx.Write(oprot)\n"
 	contents += "\toprot.WriteMessageEnd()\n"
 	contents += "\toprot.Flush()\n"
+	contents += "\tfrugal.SetResponseError(ctx, x)\n"
 	contents += "\treturn x\n"
 	contents += "}\n\n"
 	return contents
@@ -2157,6 +2233,11 @@ func (g *Generator) generateAsync() bool {
 	return ok
 }
 
+func (g *Generator) generateContext() bool {
+	_, ok := g.Options[contextOption]
+	return ok
+}
+
 func (g *Generator) useVendor() bool {
 	_, ok := g.Options[useVendorOption]
 	return ok
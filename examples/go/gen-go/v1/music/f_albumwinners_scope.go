@@ -53,15 +53,21 @@ func (p *albumWinnersPublisher) Close() error {
 }
 
 func (p *albumWinnersPublisher) PublishContestStart(ctx frugal.FContext, req []*Album) error {
-	ret := p.methods["publishContestStart"].Invoke([]interface{}{ctx, req})
+	method := p.methods["publishContestStart"]
+	if !method.HasMiddleware() {
+		return p.publishContestStart(ctx, req)
+	}
+	ret := method.Invoke([]interface{}{ctx, req})
 	if ret[0] != nil {
 		return ret[0].(error)
 	}
 	return nil
 }
 
-func (p *albumWinnersPublisher) publishContestStart(ctx frugal.FContext, req []*Album) error {
+func (p *albumWinnersPublisher) publishContestStart(ctx frugal.FContext, req []*Album) (err error) {
 	op := "ContestStart"
+	span := frugal.StartSpan(ctx, op, frugal.SpanKindProducer)
+	defer func() { span.Finish(err) }()
 	prefix := "v1.music."
 	topic := fmt.Sprintf("%sAlbumWinners%s%s", prefix, delimiter, op)
 	buffer := frugal.NewTMemoryOutputBuffer(p.transport.GetPublishSizeLimit())
@@ -93,15 +99,21 @@ func (p *albumWinnersPublisher) publishContestStart(ctx frugal.FContext, req []*
 }
 
 func (p *albumWinnersPublisher) PublishTimeLeft(ctx frugal.FContext, req Minutes) error {
-	ret := p.methods["publishTimeLeft"].Invoke([]interface{}{ctx, req})
+	method := p.methods["publishTimeLeft"]
+	if !method.HasMiddleware() {
+		return p.publishTimeLeft(ctx, req)
+	}
+	ret := method.Invoke([]interface{}{ctx, req})
 	if ret[0] != nil {
 		return ret[0].(error)
 	}
 	return nil
 }
 
-func (p *albumWinnersPublisher) publishTimeLeft(ctx frugal.FContext, req Minutes) error {
+func (p *albumWinnersPublisher) publishTimeLeft(ctx frugal.FContext, req Minutes) (err error) {
 	op := "TimeLeft"
+	span := frugal.StartSpan(ctx, op, frugal.SpanKindProducer)
+	defer func() { span.Finish(err) }()
 	prefix := "v1.music."
 	topic := fmt.Sprintf("%sAlbumWinners%s%s", prefix, delimiter, op)
 	buffer := frugal.NewTMemoryOutputBuffer(p.transport.GetPublishSizeLimit())
@@ -125,15 +137,21 @@ func (p *albumWinnersPublisher) publishTimeLeft(ctx frugal.FContext, req Minutes
 }
 
 func (p *albumWinnersPublisher) PublishWinner(ctx frugal.FContext, req *Album) error {
-	ret := p.methods["publishWinner"].Invoke([]interface{}{ctx, req})
+	method := p.methods["publishWinner"]
+	if !method.HasMiddleware() {
+		return p.publishWinner(ctx, req)
+	}
+	ret := method.Invoke([]interface{}{ctx, req})
 	if ret[0] != nil {
 		return ret[0].(error)
 	}
 	return nil
 }
 
-func (p *albumWinnersPublisher) publishWinner(ctx frugal.FContext, req *Album) error {
+func (p *albumWinnersPublisher) publishWinner(ctx frugal.FContext, req *Album) (err error) {
 	op := "Winner"
+	span := frugal.StartSpan(ctx, op, frugal.SpanKindProducer)
+	defer func() { span.Finish(err) }()
 	prefix := "v1.music."
 	topic := fmt.Sprintf("%sAlbumWinners%s%s", prefix, delimiter, op)
 	buffer := frugal.NewTMemoryOutputBuffer(p.transport.GetPublishSizeLimit())
@@ -225,7 +243,13 @@ func (l *albumWinnersSubscriber) recvContestStart(op string, pf *frugal.FProtoco
 		}
 		iprot.ReadMessageEnd()
 
-		method.Invoke([]interface{}{ctx, req})
+		span := frugal.StartSpan(ctx, op, frugal.SpanKindConsumer)
+		defer span.Finish(nil)
+		if method.HasMiddleware() {
+			method.Invoke([]interface{}{ctx, req})
+		} else {
+			handler(ctx, req)
+		}
 		return nil
 	}
 }
@@ -272,7 +296,13 @@ func (l *albumWinnersSubscriber) recvTimeLeft(op string, pf *frugal.FProtocolFac
 		}
 		iprot.ReadMessageEnd()
 
-		method.Invoke([]interface{}{ctx, req})
+		span := frugal.StartSpan(ctx, op, frugal.SpanKindConsumer)
+		defer span.Finish(nil)
+		if method.HasMiddleware() {
+			method.Invoke([]interface{}{ctx, req})
+		} else {
+			handler(ctx, req)
+		}
 		return nil
 	}
 }
@@ -316,7 +346,13 @@ func (l *albumWinnersSubscriber) recvWinner(op string, pf *frugal.FProtocolFacto
 		}
 		iprot.ReadMessageEnd()
 
-		method.Invoke([]interface{}{ctx, req})
+		span := frugal.StartSpan(ctx, op, frugal.SpanKindConsumer)
+		defer span.Finish(nil)
+		if method.HasMiddleware() {
+			method.Invoke([]interface{}{ctx, req})
+		} else {
+			handler(ctx, req)
+		}
 		return nil
 	}
 }
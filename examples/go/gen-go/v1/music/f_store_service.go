@@ -29,6 +29,7 @@ type FStoreClient struct {
 	transport       frugal.FTransport
 	protocolFactory *frugal.FProtocolFactory
 	methods         map[string]*frugal.Method
+	annotations     map[string]map[string]string
 }
 
 func NewFStoreClient(provider *frugal.FServiceProvider, middleware ...frugal.ServiceMiddleware) *FStoreClient {
@@ -37,6 +38,7 @@ func NewFStoreClient(provider *frugal.FServiceProvider, middleware ...frugal.Ser
 		transport:       provider.GetTransport(),
 		protocolFactory: provider.GetProtocolFactory(),
 		methods:         methods,
+		annotations:     make(map[string]map[string]string),
 	}
 	middleware = append(middleware, provider.GetMiddleware()...)
 	methods["buyAlbum"] = frugal.NewMethod(client, client.buyAlbum, "buyAlbum", middleware)
@@ -44,8 +46,19 @@ func NewFStoreClient(provider *frugal.FServiceProvider, middleware ...frugal.Ser
 	return client
 }
 
+// Annotations returns a map of method name to annotations as defined in the
+// service IDL. Middleware can look up the annotations of the invoked method
+// using the method's name.
+func (f *FStoreClient) Annotations() map[string]map[string]string {
+	return f.annotations
+}
+
 func (f *FStoreClient) BuyAlbum(ctx frugal.FContext, asin string, acct string) (r *Album, err error) {
-	ret := f.methods["buyAlbum"].Invoke([]interface{}{ctx, asin, acct})
+	method := f.methods["buyAlbum"]
+	if !method.HasMiddleware() {
+		return f.buyAlbum(ctx, asin, acct)
+	}
+	ret := method.Invoke([]interface{}{ctx, asin, acct})
 	if len(ret) != 2 {
 		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
 	}
@@ -57,6 +70,8 @@ func (f *FStoreClient) BuyAlbum(ctx frugal.FContext, asin string, acct string) (
 }
 
 func (f *FStoreClient) buyAlbum(ctx frugal.FContext, asin string, acct string) (r *Album, err error) {
+	span := frugal.StartSpan(ctx, "buyAlbum", frugal.SpanKindClient)
+	defer func() { span.Finish(err) }()
 	buffer := frugal.NewTMemoryOutputBuffer(f.transport.GetRequestSizeLimit())
 	oprot := f.protocolFactory.GetProtocol(buffer)
 	if err = oprot.WriteRequestHeader(ctx); err != nil {
@@ -132,7 +147,11 @@ func (f *FStoreClient) buyAlbum(ctx frugal.FContext, asin string, acct string) (
 }
 
 func (f *FStoreClient) EnterAlbumGiveaway(ctx frugal.FContext, email string, name string) (r bool, err error) {
-	ret := f.methods["enterAlbumGiveaway"].Invoke([]interface{}{ctx, email, name})
+	method := f.methods["enterAlbumGiveaway"]
+	if !method.HasMiddleware() {
+		return f.enterAlbumGiveaway(ctx, email, name)
+	}
+	ret := method.Invoke([]interface{}{ctx, email, name})
 	if len(ret) != 2 {
 		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
 	}
@@ -144,6 +163,8 @@ func (f *FStoreClient) EnterAlbumGiveaway(ctx frugal.FContext, email string, nam
 }
 
 func (f *FStoreClient) enterAlbumGiveaway(ctx frugal.FContext, email string, name string) (r bool, err error) {
+	span := frugal.StartSpan(ctx, "enterAlbumGiveaway", frugal.SpanKindClient)
+	defer func() { span.Finish(err) }()
 	buffer := frugal.NewTMemoryOutputBuffer(f.transport.GetRequestSizeLimit())
 	oprot := f.protocolFactory.GetProtocol(buffer)
 	if err = oprot.WriteRequestHeader(ctx); err != nil {
@@ -220,13 +241,14 @@ type FStoreProcessor struct {
 
 func NewFStoreProcessor(handler FStore, middleware ...frugal.ServiceMiddleware) *FStoreProcessor {
 	p := &FStoreProcessor{frugal.NewFBaseProcessor()}
-	p.AddToProcessorMap("buyAlbum", &storeFBuyAlbum{frugal.NewFBaseProcessorFunction(p.GetWriteMutex(), frugal.NewMethod(handler, handler.BuyAlbum, "BuyAlbum", middleware))})
-	p.AddToProcessorMap("enterAlbumGiveaway", &storeFEnterAlbumGiveaway{frugal.NewFBaseProcessorFunction(p.GetWriteMutex(), frugal.NewMethod(handler, handler.EnterAlbumGiveaway, "EnterAlbumGiveaway", middleware))})
+	p.AddToProcessorMap("buyAlbum", &storeFBuyAlbum{frugal.NewFBaseProcessorFunction(p.GetWriteMutex(), frugal.NewMethod(handler, handler.BuyAlbum, "BuyAlbum", middleware)), handler})
+	p.AddToProcessorMap("enterAlbumGiveaway", &storeFEnterAlbumGiveaway{frugal.NewFBaseProcessorFunction(p.GetWriteMutex(), frugal.NewMethod(handler, handler.EnterAlbumGiveaway, "EnterAlbumGiveaway", middleware)), handler})
 	return p
 }
 
 type storeFBuyAlbum struct {
 	*frugal.FBaseProcessorFunction
+	handler FStore
 }
 
 func (p *storeFBuyAlbum) Process(ctx frugal.FContext, iprot, oprot *frugal.FProtocol) error {
@@ -243,12 +265,19 @@ func (p *storeFBuyAlbum) Process(ctx frugal.FContext, iprot, oprot *frugal.FProt
 	iprot.ReadMessageEnd()
 	result := StoreBuyAlbumResult{}
 	var err2 error
-	ret := p.InvokeMethod([]interface{}{ctx, args.ASIN, args.Acct})
-	if len(ret) != 2 {
-		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
-	}
-	if ret[1] != nil {
-		err2 = ret[1].(error)
+	var retval *Album
+	if p.HasMiddleware() {
+		ret := p.InvokeMethod([]interface{}{ctx, args.ASIN, args.Acct})
+		if len(ret) != 2 {
+			panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
+		}
+		if ret[1] != nil {
+			err2 = ret[1].(error)
+		} else {
+			retval = ret[0].(*Album)
+		}
+	} else {
+		retval, err2 = p.handler.BuyAlbum(ctx, args.ASIN, args.Acct)
 	}
 	if err2 != nil {
 		if err3, ok := err2.(thrift.TApplicationException); ok {
@@ -271,7 +300,6 @@ func (p *storeFBuyAlbum) Process(ctx frugal.FContext, iprot, oprot *frugal.FProt
 			return err2
 		}
 	} else {
-		var retval *Album = ret[0].(*Album)
 		result.Success = retval
 	}
 	p.GetWriteMutex().Lock()
@@ -316,6 +344,7 @@ func (p *storeFBuyAlbum) Process(ctx frugal.FContext, iprot, oprot *frugal.FProt
 
 type storeFEnterAlbumGiveaway struct {
 	*frugal.FBaseProcessorFunction
+	handler FStore
 }
 
 func (p *storeFEnterAlbumGiveaway) Process(ctx frugal.FContext, iprot, oprot *frugal.FProtocol) error {
@@ -332,12 +361,19 @@ func (p *storeFEnterAlbumGiveaway) Process(ctx frugal.FContext, iprot, oprot *fr
 	iprot.ReadMessageEnd()
 	result := StoreEnterAlbumGiveawayResult{}
 	var err2 error
-	ret := p.InvokeMethod([]interface{}{ctx, args.Email, args.Name})
-	if len(ret) != 2 {
-		panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
-	}
-	if ret[1] != nil {
-		err2 = ret[1].(error)
+	var retval bool
+	if p.HasMiddleware() {
+		ret := p.InvokeMethod([]interface{}{ctx, args.Email, args.Name})
+		if len(ret) != 2 {
+			panic(fmt.Sprintf("Middleware returned %d arguments, expected 2", len(ret)))
+		}
+		if ret[1] != nil {
+			err2 = ret[1].(error)
+		} else {
+			retval = ret[0].(bool)
+		}
+	} else {
+		retval, err2 = p.handler.EnterAlbumGiveaway(ctx, args.Email, args.Name)
 	}
 	if err2 != nil {
 		if err3, ok := err2.(thrift.TApplicationException); ok {
@@ -355,7 +391,6 @@ func (p *storeFEnterAlbumGiveaway) Process(ctx frugal.FContext, iprot, oprot *fr
 		p.GetWriteMutex().Unlock()
 		return err2
 	} else {
-		var retval bool = ret[0].(bool)
 		result.Success = &retval
 	}
 	p.GetWriteMutex().Lock()
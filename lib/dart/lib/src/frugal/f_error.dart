@@ -40,6 +40,17 @@ class FrugalTApplicationErrorType extends TApplicationErrorType {
 
   /// Indicates the response was too large for the transport.
   static const int RESPONSE_TOO_LARGE = 100;
+
+  /// Indicates the request timed out before the server processed it.
+  static const int DEADLINE_EXCEEDED = 101;
+
+  /// Indicates the request was not authenticated or not authorized to call
+  /// the method.
+  static const int UNAUTHORIZED = 102;
+
+  /// Indicates the server rejected the request without processing it
+  /// because it's overloaded.
+  static const int OVERLOADED = 103;
 }
 
 /// Contains [TTransportError] types used in frugal instantiated
@@ -65,4 +76,7 @@ class FrugalTTransportErrorType extends TTransportErrorType {
 
   /// Indicates the response was too large for the transport.
   static const int RESPONSE_TOO_LARGE = 101;
+
+  /// Indicates the request was not sent because the circuit breaker is open.
+  static const int CIRCUIT_OPEN = 102;
 }
@@ -73,7 +73,7 @@ func (f *fAdapterTransport) Open() error {
 func (f *fAdapterTransport) readLoop() {
 	framedTransport := NewTFramedTransport(f.transport)
 	for {
-		frame, err := f.readFrame(framedTransport)
+		frame, err := readFrame(framedTransport, nil)
 		if err != nil {
 			// First check if the transport was closed.
 			select {
@@ -103,12 +103,20 @@ func (f *fAdapterTransport) readLoop() {
 	}
 }
 
-func (f *fAdapterTransport) readFrame(framedTransport *TFramedTransport) ([]byte, error) {
+// readFrame reads the next frame from the TFramedTransport, excluding the
+// frame size. The frame is read into buff if it has enough capacity, allowing
+// callers which are done with the previous frame to reuse its memory.
+func readFrame(framedTransport *TFramedTransport, buff []byte) ([]byte, error) {
 	_, err := framedTransport.Read([]byte{})
 	if err != nil {
 		return nil, err
 	}
-	buff := make([]byte, framedTransport.RemainingBytes())
+	size := int(framedTransport.RemainingBytes())
+	if cap(buff) >= size {
+		buff = buff[:size]
+	} else {
+		buff = make([]byte, size)
+	}
 	_, err = io.ReadFull(framedTransport, buff)
 	if err != nil {
 		return nil, err
@@ -178,6 +186,8 @@ func (f *fAdapterTransport) Oneway(ctx FContext, payload []byte) error {
 	select {
 	case err := <-errorC:
 		return err
+	case <-goContext(ctx).Done():
+		return contextError(ctx)
 	case <-time.After(ctx.Timeout()):
 		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: request timed out")
 	}
@@ -200,6 +210,8 @@ func (f *fAdapterTransport) Request(ctx FContext, payload []byte) (thrift.TTrans
 		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
 	case err := <-errorC:
 		return nil, err
+	case <-goContext(ctx).Done():
+		return nil, contextError(ctx)
 	case <-time.After(ctx.Timeout()):
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: request timed out")
 	}
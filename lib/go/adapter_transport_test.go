@@ -1,6 +1,7 @@
 package frugal
 
 import (
+	"context"
 	"errors"
 	"testing"
 	"time"
@@ -223,3 +224,34 @@ func TestAdapterTransportSetMonitor(t *testing.T) {
 	mockMonitor.AssertExpectations(t)
 	mockMonitor2.AssertExpectations(t)
 }
+
+// Ensures Request returns a TIMED_OUT TTransportException when the deadline
+// of the FContext's context.Context is exceeded.
+func TestAdapterTransportRequestContextDeadline(t *testing.T) {
+	assert := assert.New(t)
+	mockTr := new(mockTTransport)
+	mockTr.reads = make(chan []byte)
+	mockTr.On("Open").Return(nil)
+	mockTr.On("Write", []byte{1, 2, 3}).Return(3, nil)
+	mockTr.On("Flush").Return(nil)
+	mockTr.On("Close").Return(nil)
+	// Use the real registry since mocks format their arguments, which would
+	// race with the timer of the FContext's context.Context.
+	tr := NewAdapterTransport(mockTr).(*fAdapterTransport)
+	registry := newFRegistry().(*fRegistryImpl)
+	tr.registry = registry
+
+	goCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ctx := NewFContextWithContext(goCtx, "")
+	ctx.SetTimeout(time.Second)
+	assert.Nil(tr.Open())
+
+	_, err := tr.Request(ctx, []byte{1, 2, 3})
+	assert.Equal(TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+	registry.mu.RLock()
+	assert.Len(registry.channels, 0)
+	registry.mu.RUnlock()
+	assert.Nil(tr.Close())
+	close(mockTr.reads)
+}
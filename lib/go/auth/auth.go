@@ -0,0 +1,155 @@
+// Package auth provides ServiceMiddleware for processors which authenticates
+// requests with a bearer token and authorizes them using method annotations
+// defined in the IDL.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/Workiva/frugal/lib/go"
+)
+
+const (
+	// ScopesAnnotation is the method annotation listing the comma-separated
+	// scopes a token must have to call the method, e.g.
+	// (auth.scopes="read,write").
+	ScopesAnnotation = "auth.scopes"
+
+	// PublicAnnotation is the method annotation which allows calls without a
+	// token, e.g. (auth.public="true").
+	PublicAnnotation = "auth.public"
+
+	// DefaultHeader is the request header containing the bearer token, e.g.
+	// "Bearer eyJhbGciOiJIUzI1NiJ9...".
+	DefaultHeader = "authorization"
+
+	bearerPrefix = "bearer "
+)
+
+// Claims are the verified claims of a token.
+type Claims struct {
+	// Subject identifies the caller.
+	Subject string
+
+	// Scopes are the scopes granted to the caller.
+	Scopes []string
+
+	// ExpiresAt is when the token expires, or the zero time if it doesn't.
+	ExpiresAt time.Time
+
+	// Raw contains all of the token's claims.
+	Raw map[string]interface{}
+}
+
+// HasScope returns true if the claims grant the scope.
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifier verifies bearer tokens.
+type Verifier interface {
+	// Verify returns the claims of the token, or an error if the token is
+	// invalid or expired.
+	Verify(token string) (*Claims, error)
+}
+
+// Policy configures the ServiceMiddleware returned by NewMiddleware.
+type Policy struct {
+	// Verifier verifies the bearer tokens of requests. Required.
+	Verifier Verifier
+
+	// Header is the request header containing the bearer token. Defaults to
+	// DefaultHeader.
+	Header string
+}
+
+// claimsKey is the context.Context key of the verified Claims.
+type claimsKey struct{}
+
+// NewMiddleware returns ServiceMiddleware for processors which requires
+// requests to carry a bearer token the Verifier accepts, unless the method
+// is annotated with auth.public="true", and the token to grant the scopes
+// listed in the method's auth.scopes annotation. Rejected requests fail with
+// a TApplicationException of type APPLICATION_EXCEPTION_UNAUTHORIZED without
+// invoking the handler, which clients can detect with
+// frugal.IsErrUnauthorized. Handlers can get the verified claims with
+// ClaimsFromContext.
+func NewMiddleware(policy Policy) frugal.ServiceMiddleware {
+	if policy.Verifier == nil {
+		panic("auth: Policy requires a Verifier")
+	}
+	if policy.Header == "" {
+		policy.Header = DefaultHeader
+	}
+	return func(next frugal.InvocationHandler) frugal.InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args frugal.Arguments) frugal.Results {
+			annotations := frugal.MethodAnnotations(service, method, args)
+			if annotations[PublicAnnotation] == "true" {
+				return next(service, method, args)
+			}
+
+			ctx := args.Context()
+			claims, err := policy.authorize(ctx, annotations)
+			if err != nil {
+				return frugal.ErrorResults(method, thrift.NewTApplicationException(
+					frugal.APPLICATION_EXCEPTION_UNAUTHORIZED,
+					fmt.Sprintf("frugal: unauthorized call to %s: %s", method.Name, err)))
+			}
+
+			// The claims are linked to a copy of the FContext for this
+			// invocation, since the FContext may be used by other calls.
+			if withContext, ok := ctx.(frugal.FContextWithContext); ok {
+				args[0] = frugal.WithContext(ctx, context.WithValue(withContext.Context(), claimsKey{}, claims))
+			}
+			return next(service, method, args)
+		}
+	}
+}
+
+// ClaimsFromContext returns the verified claims of the request being
+// processed with the FContext, or false if the request wasn't authenticated,
+// e.g. because the method is public. The claims are carried by the
+// FContext's context.Context, so they're only available for FContexts
+// created by Frugal.
+func ClaimsFromContext(ctx frugal.FContext) (*Claims, bool) {
+	withContext, ok := ctx.(frugal.FContextWithContext)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := withContext.Context().Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// authorize verifies the FContext's bearer token and checks it grants the
+// scopes in the method annotations.
+func (p Policy) authorize(ctx frugal.FContext, annotations map[string]string) (*Claims, error) {
+	header, ok := ctx.RequestHeader(p.Header)
+	if !ok || header == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return nil, errors.New("malformed bearer token")
+	}
+	claims, err := p.Verifier.Verify(strings.TrimSpace(header[len(bearerPrefix):]))
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range strings.Split(annotations[ScopesAnnotation], ",") {
+		scope = strings.TrimSpace(scope)
+		if scope != "" && !claims.HasScope(scope) {
+			return nil, fmt.Errorf("missing scope %s", scope)
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Workiva/frugal/lib/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testService is a service whose methods are annotated like a generated
+// client's.
+type testService struct {
+	claims *Claims
+	called bool
+}
+
+var testAnnotations = map[string]map[string]string{
+	"Read":   {ScopesAnnotation: "read"},
+	"Write":  {ScopesAnnotation: "read, write"},
+	"Health": {PublicAnnotation: "true"},
+}
+
+// newTestMethod returns a Method for the testService method with its
+// annotations, like a generated client's.
+func newTestMethod(service *testService, method interface{}, name string, middleware ...frugal.ServiceMiddleware) *frugal.Method {
+	m := frugal.NewMethod(service, method, name, middleware)
+	m.SetAnnotations(testAnnotations[name])
+	return m
+}
+
+func (s *testService) Read(ctx frugal.FContext) (string, error) {
+	s.called = true
+	s.claims, _ = ClaimsFromContext(ctx)
+	return "data", nil
+}
+
+func (s *testService) Write(ctx frugal.FContext) error {
+	s.called = true
+	return nil
+}
+
+func (s *testService) Health(ctx frugal.FContext) error {
+	s.called = true
+	_, ok := ClaimsFromContext(ctx)
+	if ok {
+		return errors.New("unexpected claims")
+	}
+	return nil
+}
+
+func (s *testService) Other(ctx frugal.FContext) error {
+	s.called = true
+	return nil
+}
+
+func newTestMiddleware() frugal.ServiceMiddleware {
+	return NewMiddleware(Policy{Verifier: newTestVerifier()})
+}
+
+func bearerContext(t *testing.T, claims map[string]interface{}) frugal.FContext {
+	ctx := frugal.NewFContext("")
+	ctx.AddRequestHeader(DefaultHeader, "Bearer "+signToken(t, testSecret, claims))
+	return ctx
+}
+
+// Ensures requests with a valid token with the required scopes are processed
+// and the handler can get the claims.
+func TestMiddlewareAuthorized(t *testing.T) {
+	service := &testService{}
+	method := newTestMethod(service, service.Read, "Read", newTestMiddleware())
+	ctx := bearerContext(t, map[string]interface{}{"sub": "user", "scope": "read"})
+
+	ret := method.Invoke([]interface{}{ctx})
+	assert.Nil(t, ret.Error())
+	assert.Equal(t, "data", ret[0])
+	assert.Equal(t, "user", service.claims.Subject)
+}
+
+// Ensures requests without the required scopes are rejected.
+func TestMiddlewareMissingScope(t *testing.T) {
+	service := &testService{}
+	method := newTestMethod(service, service.Write, "Write", newTestMiddleware())
+	ctx := bearerContext(t, map[string]interface{}{"scope": "read"})
+
+	err := method.Invoke([]interface{}{ctx}).Error()
+	assert.True(t, frugal.IsErrUnauthorized(err))
+	assert.Equal(t, "frugal: unauthorized call to Write: missing scope write", err.Error())
+	assert.False(t, service.called)
+}
+
+// Ensures requests without a valid token are rejected, even for methods
+// without annotations, and return zero values.
+func TestMiddlewareUnauthenticated(t *testing.T) {
+	service := &testService{}
+	middleware := []frugal.ServiceMiddleware{newTestMiddleware()}
+	read := newTestMethod(service, service.Read, "Read", middleware...)
+	other := newTestMethod(service, service.Other, "Other", middleware...)
+
+	ret := read.Invoke([]interface{}{frugal.NewFContext("")})
+	assert.True(t, frugal.IsErrUnauthorized(ret.Error()))
+	assert.Contains(t, ret.Error().Error(), "missing bearer token")
+	assert.Equal(t, "", ret[0])
+
+	ctx := frugal.NewFContext("")
+	ctx.AddRequestHeader(DefaultHeader, "Basic dXNlcjpwYXNz")
+	err := other.Invoke([]interface{}{ctx}).Error()
+	assert.True(t, frugal.IsErrUnauthorized(err))
+	assert.Contains(t, err.Error(), "malformed bearer token")
+
+	ctx = frugal.NewFContext("")
+	ctx.AddRequestHeader(DefaultHeader, "bearer "+signToken(t, []byte("wrong"), nil))
+	err = other.Invoke([]interface{}{ctx}).Error()
+	assert.True(t, frugal.IsErrUnauthorized(err))
+	assert.Contains(t, err.Error(), "invalid token signature")
+	assert.False(t, service.called)
+}
+
+// Ensures public methods are processed without a token.
+func TestMiddlewarePublic(t *testing.T) {
+	service := &testService{}
+	method := newTestMethod(service, service.Health, "Health", newTestMiddleware())
+
+	assert.Nil(t, method.Invoke([]interface{}{frugal.NewFContext("")}).Error())
+	assert.True(t, service.called)
+}
+
+// Ensures the token is read from the configured header.
+func TestMiddlewareHeader(t *testing.T) {
+	service := &testService{}
+	middleware := NewMiddleware(Policy{Verifier: newTestVerifier(), Header: "token"})
+	method := newTestMethod(service, service.Other, "Other", middleware)
+	ctx := frugal.NewFContext("")
+	ctx.AddRequestHeader("token", "Bearer "+signToken(t, testSecret, nil))
+
+	assert.Nil(t, method.Invoke([]interface{}{ctx}).Error())
+	assert.Panics(t, func() { NewMiddleware(Policy{}) })
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// HMACVerifier is a Verifier for JSON Web Tokens signed with HMAC using
+// HS256, HS384 or HS512. The token's exp and nbf claims are enforced. Scopes
+// are read from the space-separated scope claim or the scopes array claim.
+type HMACVerifier struct {
+	secret []byte
+
+	// Issuer, if set, must match the token's iss claim.
+	Issuer string
+
+	// Audience, if set, must be one of the token's aud claim values.
+	Audience string
+
+	// Leeway allows for clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+// NewHMACVerifier creates an HMACVerifier which verifies token signatures
+// with the secret. It panics if the secret is empty, since anyone could sign
+// tokens with it.
+func NewHMACVerifier(secret []byte) *HMACVerifier {
+	if len(secret) == 0 {
+		panic("auth: HMACVerifier requires a secret")
+	}
+	return &HMACVerifier{secret: secret, now: time.Now}
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// Verify checks the token's signature and claims and returns its claims.
+func (h *HMACVerifier) Verify(token string) (*Claims, error) {
+	if len(h.secret) == 0 {
+		return nil, errors.New("verifier has no secret")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err)
+	}
+	newHash, ok := hmacAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(newHash, h.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var raw map[string]interface{}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %s", err)
+	}
+	return h.checkClaims(raw)
+}
+
+// checkClaims validates the registered claims and returns the Claims.
+func (h *HMACVerifier) checkClaims(raw map[string]interface{}) (*Claims, error) {
+	now := h.now()
+	claims := &Claims{Raw: raw}
+	if exp, ok := raw["exp"].(float64); ok {
+		claims.ExpiresAt = time.Unix(int64(exp), 0)
+		if now.After(claims.ExpiresAt.Add(h.Leeway)) {
+			return nil, errors.New("token expired")
+		}
+	}
+	if nbf, ok := raw["nbf"].(float64); ok {
+		if now.Add(h.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return nil, errors.New("token not valid yet")
+		}
+	}
+	if h.Issuer != "" && raw["iss"] != h.Issuer {
+		return nil, errors.New("invalid token issuer")
+	}
+	if h.Audience != "" && !hasAudience(raw["aud"], h.Audience) {
+		return nil, errors.New("invalid token audience")
+	}
+	claims.Subject, _ = raw["sub"].(string)
+	if scope, ok := raw["scope"].(string); ok {
+		claims.Scopes = strings.Fields(scope)
+	}
+	if scopes, ok := raw["scopes"].([]interface{}); ok {
+		for _, scope := range scopes {
+			if s, ok := scope.(string); ok {
+				claims.Scopes = append(claims.Scopes, s)
+			}
+		}
+	}
+	return claims, nil
+}
+
+// hasAudience returns true if the aud claim, which is a string or an array
+// of strings, contains the audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testSecret = []byte("secret")
+	testNow    = time.Unix(1500000000, 0)
+)
+
+// signToken returns an HS256 token with the claims signed with the secret.
+func signToken(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	return signTokenWithHeader(t, secret, `{"alg":"HS256","typ":"JWT"}`, claims)
+}
+
+func signTokenWithHeader(t *testing.T, secret []byte, header string, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	assert.Nil(t, err)
+	return signSegments(secret, header, string(payload))
+}
+
+func signSegments(secret []byte, header, payload string) string {
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(payload))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newTestVerifier() *HMACVerifier {
+	verifier := NewHMACVerifier(testSecret)
+	verifier.now = func() time.Time { return testNow }
+	return verifier
+}
+
+// Ensures valid tokens are verified and their claims returned.
+func TestHMACVerifier(t *testing.T) {
+	verifier := newTestVerifier()
+	verifier.Issuer = "issuer"
+	verifier.Audience = "service"
+	token := signToken(t, testSecret, map[string]interface{}{
+		"sub":   "user",
+		"iss":   "issuer",
+		"aud":   []string{"other", "service"},
+		"exp":   testNow.Add(time.Minute).Unix(),
+		"nbf":   testNow.Add(-time.Minute).Unix(),
+		"scope": "read write",
+	})
+
+	claims, err := verifier.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "user", claims.Subject)
+	assert.Equal(t, []string{"read", "write"}, claims.Scopes)
+	assert.Equal(t, testNow.Add(time.Minute), claims.ExpiresAt)
+	assert.Equal(t, "user", claims.Raw["sub"])
+	assert.True(t, claims.HasScope("write"))
+	assert.False(t, claims.HasScope("admin"))
+}
+
+// Ensures scopes are read from the scopes array claim.
+func TestHMACVerifierScopesArray(t *testing.T) {
+	token := signToken(t, testSecret, map[string]interface{}{"scopes": []string{"read", "admin"}})
+
+	claims, err := newTestVerifier().Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"read", "admin"}, claims.Scopes)
+	assert.True(t, claims.ExpiresAt.IsZero())
+}
+
+// Ensures invalid tokens are rejected.
+func TestHMACVerifierInvalid(t *testing.T) {
+	verifier := newTestVerifier()
+	verifier.Issuer = "issuer"
+	verifier.Audience = "service"
+	verifier.Leeway = time.Second
+	valid := map[string]interface{}{"iss": "issuer", "aud": "service"}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"iss": "issuer", "aud": "service"}
+		claims[name] = value
+		return claims
+	}
+
+	cases := []struct {
+		token string
+		err   string
+	}{
+		{"abc.def", "malformed token"},
+		{"!!!.e30.sig", "malformed token header"},
+		{signTokenWithHeader(t, testSecret, `{"alg":"none"}`, valid), "unsupported token algorithm"},
+		{signToken(t, testSecret, valid) + "!", "malformed token signature"},
+		{signToken(t, []byte("wrong"), valid), "invalid token signature"},
+		{signSegments(testSecret, `{"alg":"HS256"}`, "not json"), "malformed token claims"},
+		{signToken(t, testSecret, with("exp", testNow.Add(-2*time.Second).Unix())), "token expired"},
+		{signToken(t, testSecret, with("nbf", testNow.Add(2*time.Second).Unix())), "token not valid yet"},
+		{signToken(t, testSecret, with("iss", "other")), "invalid token issuer"},
+		{signToken(t, testSecret, with("aud", []string{"other"})), "invalid token audience"},
+	}
+	for _, c := range cases {
+		_, err := verifier.Verify(c.token)
+		if assert.NotNil(t, err, c.err) {
+			assert.Contains(t, err.Error(), c.err)
+		}
+	}
+
+	// Within the leeway.
+	_, err := verifier.Verify(signToken(t, testSecret, with("exp", testNow.Add(-500*time.Millisecond).Unix())))
+	assert.Nil(t, err)
+}
+
+// Ensures verifiers without a secret are rejected, since anyone could sign
+// tokens they accept.
+func TestHMACVerifierEmptySecret(t *testing.T) {
+	assert.Panics(t, func() { NewHMACVerifier(nil) })
+	assert.Panics(t, func() { NewHMACVerifier([]byte{}) })
+
+	_, err := (&HMACVerifier{}).Verify(signToken(t, []byte{}, nil))
+	assert.Equal(t, "verifier has no secret", err.Error())
+}
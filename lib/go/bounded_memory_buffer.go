@@ -19,13 +19,26 @@ var emptyFrameSize = []byte{0, 0, 0, 0}
 
 // NewTMemoryOutputBuffer returns a new TFramedMemoryBuffer with the given
 // size limit. If the provided limit is non-positive, the buffer is allowed
-// to grow unbounded.
+// to grow unbounded. The buffer's memory is taken from a pool and can be
+// returned to it with Release.
 func NewTMemoryOutputBuffer(size uint) *TMemoryOutputBuffer {
-	buffer := &TMemoryOutputBuffer{size, thrift.NewTMemoryBuffer()}
+	buffer := &TMemoryOutputBuffer{size, &thrift.TMemoryBuffer{Buffer: acquireBuffer()}}
 	buffer.Write(emptyFrameSize)
 	return buffer
 }
 
+// Release returns the buffer's memory to the pool so it can be reused by
+// another TMemoryOutputBuffer. Neither the buffer nor any slice returned by
+// Bytes may be used after calling Release. Calling Release is optional;
+// buffers which are not released are garbage collected as usual.
+func (f *TMemoryOutputBuffer) Release() {
+	if f.TMemoryBuffer == nil {
+		return
+	}
+	releaseBuffer(f.TMemoryBuffer.Buffer)
+	f.TMemoryBuffer = nil
+}
+
 // Write the data to the buffer. Returns ErrTooLarge if the write would cause
 // the buffer to exceed its limit.
 func (f *TMemoryOutputBuffer) Write(buf []byte) (int, error) {
@@ -44,7 +57,8 @@ func (f *TMemoryOutputBuffer) Reset() {
 	f.Write(emptyFrameSize)
 }
 
-// Bytes retrieves the framed contents of the buffer.
+// Bytes retrieves the framed contents of the buffer. The frame size is
+// written in place, so the returned slice shares the buffer's memory.
 func (f *TMemoryOutputBuffer) Bytes() []byte {
 	data := f.TMemoryBuffer.Bytes()
 	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
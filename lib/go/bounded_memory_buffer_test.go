@@ -24,3 +24,17 @@ func TestTFramedMemoryBufferWrite(t *testing.T) {
 	assert.Equal(t, TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
 	assert.Equal(t, 4, buff.Len())
 }
+
+// Ensures Bytes writes the frame size in place and Release can safely be
+// called more than once.
+func TestTMemoryOutputBufferRelease(t *testing.T) {
+	buff := NewTMemoryOutputBuffer(0)
+	buff.Write([]byte{1, 2, 3})
+	assert.Equal(t, []byte{0, 0, 0, 3, 1, 2, 3}, buff.Bytes())
+	buff.Release()
+	buff.Release()
+
+	buff = NewTMemoryOutputBuffer(0)
+	assert.Equal(t, []byte{0, 0, 0, 0}, buff.Bytes())
+	assert.False(t, buff.HasWriteData())
+}
@@ -0,0 +1,62 @@
+package frugal
+
+import (
+	"bytes"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// maxPooledBufferSize is the largest buffer capacity which is returned to the
+// pool. Larger buffers are left for the garbage collector so an occasional
+// large message doesn't pin memory.
+const maxPooledBufferSize = natsMaxMessageSize
+
+var (
+	// bufferPool holds the byte buffers which back TMemoryOutputBuffers and
+	// encoded HTTP payloads.
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+
+	// frameTransportPool holds the TMemoryBuffers used to read received
+	// frames in place.
+	frameTransportPool = sync.Pool{
+		New: func() interface{} {
+			return &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+		},
+	}
+)
+
+// acquireBuffer returns an empty buffer from the pool.
+func acquireBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// releaseBuffer returns the buffer to the pool. The buffer must not be used
+// after it's released.
+func releaseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// acquireFrameTransport returns a TTransport from the pool which reads the
+// given frame without copying it.
+func acquireFrameTransport(frame []byte) *thrift.TMemoryBuffer {
+	transport := frameTransportPool.Get().(*thrift.TMemoryBuffer)
+	*transport.Buffer = *bytes.NewBuffer(frame)
+	return transport
+}
+
+// releaseFrameTransport returns the TTransport to the pool, dropping its
+// reference to the frame so the frame can be reused. The TTransport must not
+// be used after it's released.
+func releaseFrameTransport(transport *thrift.TMemoryBuffer) {
+	*transport.Buffer = bytes.Buffer{}
+	frameTransportPool.Put(transport)
+}
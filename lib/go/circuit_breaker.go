@@ -0,0 +1,258 @@
+package frugal
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultSuccessThreshold = 1
+	defaultCoolDown         = 10 * time.Second
+)
+
+// CircuitState is the state of a method's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed allows calls and counts consecutive failures.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen fails calls without invoking the method until the
+	// cool-down window has passed.
+	CircuitOpen
+
+	// CircuitHalfOpen allows a single trial call at a time to determine
+	// whether the circuit should close or open again.
+	CircuitHalfOpen
+)
+
+// String returns the name of the state.
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(c))
+	}
+}
+
+// CircuitBreakerPolicy configures the ServiceMiddleware returned by
+// NewCircuitBreakerMiddleware. Zero values are replaced with their defaults.
+type CircuitBreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failed calls which opens
+	// the circuit. Defaults to 5.
+	FailureThreshold int
+
+	// SuccessThreshold is the number of consecutive successful trial calls
+	// in the half-open state which closes the circuit. Defaults to 1.
+	SuccessThreshold int
+
+	// CoolDown is how long the circuit stays open before allowing a trial
+	// call. Defaults to 10s.
+	CoolDown time.Duration
+
+	// IsFailure returns true if the error returned by a call counts as a
+	// failure. Defaults to treating TTransportExceptions, other than those
+	// for oversized requests and responses, and TApplicationExceptions of
+	// type APPLICATION_EXCEPTION_DEADLINE_EXCEEDED or
+	// APPLICATION_EXCEPTION_OVERLOADED as failures. Errors
+	// declared in the IDL indicate the service is healthy and are not
+	// failures.
+	IsFailure func(error) bool
+
+	// OnStateChange, if set, is called when a method's circuit changes
+	// state, e.g. to raise alerts. The method is named by its service type
+	// and method name, e.g. "FFooClient.blah". It's called synchronously by
+	// the call which caused the change, so it should not block.
+	OnStateChange func(method string, from, to CircuitState)
+}
+
+// NewCircuitBreakerMiddleware returns ServiceMiddleware which tracks a
+// circuit breaker for each method it's applied to. While a method's circuit
+// is open, calls fail immediately with a TTransportException of type
+// TRANSPORT_EXCEPTION_CIRCUIT_OPEN, which can be detected with
+// IsErrCircuitOpen, rather than waiting on a degraded service.
+func NewCircuitBreakerMiddleware(policy CircuitBreakerPolicy) ServiceMiddleware {
+	if policy.FailureThreshold == 0 {
+		policy.FailureThreshold = defaultFailureThreshold
+	}
+	if policy.SuccessThreshold == 0 {
+		policy.SuccessThreshold = defaultSuccessThreshold
+	}
+	if policy.CoolDown == 0 {
+		policy.CoolDown = defaultCoolDown
+	}
+	if policy.IsFailure == nil {
+		policy.IsFailure = isCircuitFailure
+	}
+	return func(next InvocationHandler) InvocationHandler {
+		// Middleware is applied to each method separately, so each gets its
+		// own circuit breaker.
+		breaker := &circuitBreaker{policy: policy}
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			name := qualifiedMethodName(service, method)
+			epoch, allowed := breaker.allow(name)
+			if !allowed {
+				return ErrorResults(method, thrift.NewTTransportException(TRANSPORT_EXCEPTION_CIRCUIT_OPEN,
+					fmt.Sprintf("frugal: circuit open for %s", name)))
+			}
+			return breaker.call(name, epoch, next, service, method, args)
+		}
+	}
+}
+
+// call invokes the method allowed in the given epoch and records its
+// outcome. A panic counts as a failure, so a half-open circuit's trial call
+// always completes.
+func (c *circuitBreaker) call(name string, epoch uint64, next InvocationHandler, service reflect.Value,
+	method reflect.Method, args Arguments) (results Results) {
+
+	failed := true
+	defer func() {
+		c.record(name, epoch, failed)
+	}()
+	results = next(service, method, args)
+	// Methods without return values, such as subscriber handlers, can't
+	// fail.
+	failed = len(results) > 0 && c.policy.IsFailure(results.Error())
+	return results
+}
+
+// circuitBreaker tracks the circuit state of a single method.
+type circuitBreaker struct {
+	policy    CircuitBreakerPolicy
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	successes int
+	openedAt  time.Time
+	trial     bool
+
+	// epoch is incremented on every state change, so the outcome of a call
+	// allowed in an earlier state, e.g. a slow call allowed while the circuit
+	// was closed which completes once it's half-open, is ignored.
+	epoch uint64
+}
+
+// allow returns true and the current epoch if a call may be made,
+// transitioning an open circuit whose cool-down has passed to half-open.
+func (c *circuitBreaker) allow(name string) (uint64, bool) {
+	c.mu.Lock()
+	from := c.state
+	allowed := true
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < c.policy.CoolDown {
+			allowed = false
+			break
+		}
+		c.setState(CircuitHalfOpen)
+		c.successes = 0
+		c.trial = true
+	case CircuitHalfOpen:
+		if c.trial {
+			allowed = false
+			break
+		}
+		c.trial = true
+	}
+	to, epoch := c.state, c.epoch
+	c.mu.Unlock()
+
+	c.notify(name, from, to)
+	return epoch, allowed
+}
+
+// record updates the circuit with the outcome of a call allowed in the given
+// epoch. Outcomes of calls allowed in an earlier epoch are ignored.
+func (c *circuitBreaker) record(name string, epoch uint64, failed bool) {
+	c.mu.Lock()
+	if epoch != c.epoch {
+		c.mu.Unlock()
+		return
+	}
+	from := c.state
+	switch c.state {
+	case CircuitClosed:
+		if !failed {
+			c.failures = 0
+			break
+		}
+		c.failures++
+		if c.failures >= c.policy.FailureThreshold {
+			c.open()
+		}
+	case CircuitHalfOpen:
+		c.trial = false
+		if failed {
+			c.open()
+			break
+		}
+		c.successes++
+		if c.successes >= c.policy.SuccessThreshold {
+			c.setState(CircuitClosed)
+			c.failures = 0
+		}
+	}
+	to := c.state
+	c.mu.Unlock()
+
+	c.notify(name, from, to)
+}
+
+// open opens the circuit. The caller must hold the lock.
+func (c *circuitBreaker) open() {
+	c.setState(CircuitOpen)
+	c.openedAt = time.Now()
+	c.trial = false
+}
+
+// setState changes the state of the circuit and starts a new epoch. The
+// caller must hold the lock.
+func (c *circuitBreaker) setState(state CircuitState) {
+	c.state = state
+	c.epoch++
+}
+
+func (c *circuitBreaker) notify(name string, from, to CircuitState) {
+	if from == to {
+		return
+	}
+	logger().Debugf("frugal: circuit for %s changed from %s to %s", name, from, to)
+	if c.policy.OnStateChange != nil {
+		c.policy.OnStateChange(name, from, to)
+	}
+}
+
+// isCircuitFailure is the default CircuitBreakerPolicy IsFailure function.
+func isCircuitFailure(err error) bool {
+	if err == nil || IsErrTooLarge(err) {
+		return false
+	}
+	if _, ok := err.(thrift.TTransportException); ok {
+		return true
+	}
+	return IsErrDeadlineExceeded(err) || IsErrOverloaded(err)
+}
+
+// qualifiedMethodName returns the method name prefixed with the name of the
+// service type, e.g. "FFooClient.blah".
+func qualifiedMethodName(service reflect.Value, method reflect.Method) string {
+	if !service.IsValid() {
+		return method.Name
+	}
+	serviceType := service.Type()
+	if serviceType.Kind() == reflect.Ptr {
+		serviceType = serviceType.Elem()
+	}
+	return serviceType.Name() + "." + method.Name
+}
@@ -0,0 +1,235 @@
+package frugal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// breakerClient is a client whose methods return the next queued error.
+type breakerClient struct {
+	errs  []error
+	calls int
+}
+
+func (b *breakerClient) ping(ctx FContext) error {
+	b.calls++
+	if len(b.errs) == 0 {
+		return nil
+	}
+	err := b.errs[0]
+	b.errs = b.errs[1:]
+	return err
+}
+
+func (b *breakerClient) getThing(ctx FContext) (string, error) {
+	return "thing", b.ping(ctx)
+}
+
+func (b *breakerClient) onThing(ctx FContext, thing string) {
+	b.calls++
+}
+
+func (b *breakerClient) panics(ctx FContext) error {
+	b.calls++
+	panic("boom")
+}
+
+type stateChange struct {
+	method   string
+	from, to CircuitState
+}
+
+// Ensures the circuit opens after consecutive failures, fails fast while
+// open, allows a trial call after the cool-down, and closes on success.
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	var changes []stateChange
+	client := &breakerClient{errs: []error{timedOutErr, notOpenErr}}
+	policy := CircuitBreakerPolicy{
+		FailureThreshold: 2,
+		CoolDown:         10 * time.Millisecond,
+		OnStateChange: func(method string, from, to CircuitState) {
+			changes = append(changes, stateChange{method, from, to})
+		},
+	}
+	method := NewMethod(client, client.ping, "ping", []ServiceMiddleware{NewCircuitBreakerMiddleware(policy)})
+
+	assert.Equal(t, timedOutErr, method.Invoke([]interface{}{NewFContext("")}).Error())
+	assert.Equal(t, notOpenErr, method.Invoke([]interface{}{NewFContext("")}).Error())
+
+	err := method.Invoke([]interface{}{NewFContext("")}).Error()
+	assert.True(t, IsErrCircuitOpen(err))
+	assert.Equal(t, "frugal: circuit open for breakerClient.ping", err.Error())
+	assert.Equal(t, 2, client.calls)
+
+	time.Sleep(15 * time.Millisecond)
+	assert.Nil(t, method.Invoke([]interface{}{NewFContext("")}).Error())
+	assert.Nil(t, method.Invoke([]interface{}{NewFContext("")}).Error())
+	assert.Equal(t, 4, client.calls)
+
+	assert.Equal(t, []stateChange{
+		{"breakerClient.ping", CircuitClosed, CircuitOpen},
+		{"breakerClient.ping", CircuitOpen, CircuitHalfOpen},
+		{"breakerClient.ping", CircuitHalfOpen, CircuitClosed},
+	}, changes)
+}
+
+// Ensures a failed trial call in the half-open state opens the circuit again.
+func TestCircuitBreakerMiddlewareHalfOpenFailure(t *testing.T) {
+	client := &breakerClient{errs: []error{timedOutErr, timedOutErr}}
+	policy := CircuitBreakerPolicy{FailureThreshold: 1, CoolDown: 10 * time.Millisecond}
+	method := NewMethod(client, client.ping, "ping", []ServiceMiddleware{NewCircuitBreakerMiddleware(policy)})
+
+	assert.Equal(t, timedOutErr, method.Invoke([]interface{}{NewFContext("")}).Error())
+	time.Sleep(15 * time.Millisecond)
+	assert.Equal(t, timedOutErr, method.Invoke([]interface{}{NewFContext("")}).Error())
+	assert.True(t, IsErrCircuitOpen(method.Invoke([]interface{}{NewFContext("")}).Error()))
+	assert.Equal(t, 2, client.calls)
+}
+
+// Ensures only one trial call is allowed at a time in the half-open state.
+func TestCircuitBreakerHalfOpenSingleTrial(t *testing.T) {
+	breaker := &circuitBreaker{policy: CircuitBreakerPolicy{FailureThreshold: 1, SuccessThreshold: 2}}
+	epoch, allowed := breaker.allow("ping")
+	assert.True(t, allowed)
+	breaker.record("ping", epoch, true)
+	assert.Equal(t, CircuitOpen, breaker.state)
+
+	epoch, allowed = breaker.allow("ping")
+	assert.True(t, allowed)
+	assert.Equal(t, CircuitHalfOpen, breaker.state)
+	_, allowed = breaker.allow("ping")
+	assert.False(t, allowed)
+	breaker.record("ping", epoch, false)
+	assert.Equal(t, CircuitHalfOpen, breaker.state)
+	epoch, allowed = breaker.allow("ping")
+	assert.True(t, allowed)
+	breaker.record("ping", epoch, false)
+	assert.Equal(t, CircuitClosed, breaker.state)
+}
+
+// Ensures the outcome of a call allowed while the circuit was closed which
+// completes once it's half-open doesn't decide the trial.
+func TestCircuitBreakerStaleOutcome(t *testing.T) {
+	breaker := &circuitBreaker{policy: CircuitBreakerPolicy{FailureThreshold: 1, SuccessThreshold: 1}}
+	slowEpoch, allowed := breaker.allow("ping")
+	assert.True(t, allowed)
+	epoch, _ := breaker.allow("ping")
+	breaker.record("ping", epoch, true)
+	assert.Equal(t, CircuitOpen, breaker.state)
+
+	trialEpoch, allowed := breaker.allow("ping")
+	assert.True(t, allowed)
+	assert.Equal(t, CircuitHalfOpen, breaker.state)
+
+	// The slow call succeeds, which must not close the circuit or end the
+	// trial.
+	breaker.record("ping", slowEpoch, false)
+	assert.Equal(t, CircuitHalfOpen, breaker.state)
+	_, allowed = breaker.allow("ping")
+	assert.False(t, allowed)
+
+	// Nor does a failure reopen it.
+	breaker.record("ping", slowEpoch, true)
+	assert.Equal(t, CircuitHalfOpen, breaker.state)
+
+	breaker.record("ping", trialEpoch, false)
+	assert.Equal(t, CircuitClosed, breaker.state)
+}
+
+// Ensures successes reset the failure count and errors which aren't failures,
+// such as IDL exceptions, don't open the circuit.
+func TestCircuitBreakerMiddlewareNonFailures(t *testing.T) {
+	client := &breakerClient{errs: []error{
+		timedOutErr,
+		nil,
+		timedOutErr,
+		errors.New("idl exception"),
+		thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, "too large"),
+		timedOutErr,
+	}}
+	policy := CircuitBreakerPolicy{FailureThreshold: 2}
+	method := NewMethod(client, client.ping, "ping", []ServiceMiddleware{NewCircuitBreakerMiddleware(policy)})
+
+	for i := 0; i < 6; i++ {
+		assert.False(t, IsErrCircuitOpen(method.Invoke([]interface{}{NewFContext("")}).Error()))
+	}
+	assert.Equal(t, 6, client.calls)
+}
+
+// Ensures fast-failed calls return the zero value of the method's other
+// return types.
+func TestCircuitBreakerMiddlewareZeroResults(t *testing.T) {
+	client := &breakerClient{errs: []error{timedOutErr}}
+	policy := CircuitBreakerPolicy{FailureThreshold: 1}
+	method := NewMethod(client, client.getThing, "getThing", []ServiceMiddleware{NewCircuitBreakerMiddleware(policy)})
+
+	assert.Equal(t, timedOutErr, method.Invoke([]interface{}{NewFContext("")}).Error())
+	ret := method.Invoke([]interface{}{NewFContext("")})
+	assert.Equal(t, "", ret[0].(string))
+	assert.True(t, IsErrCircuitOpen(ret.Error()))
+}
+
+// Ensures methods without return values, such as subscriber handlers, are
+// never failures.
+func TestCircuitBreakerMiddlewareNoResults(t *testing.T) {
+	client := &breakerClient{}
+	policy := CircuitBreakerPolicy{FailureThreshold: 1}
+	method := NewMethod(client, client.onThing, "onThing", []ServiceMiddleware{NewCircuitBreakerMiddleware(policy)})
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 0, len(method.Invoke([]interface{}{NewFContext(""), "thing"})))
+	}
+	assert.Equal(t, 3, client.calls)
+}
+
+// Ensures a panicking call counts as a failure, so a half-open circuit's
+// trial call completes and the circuit opens again.
+func TestCircuitBreakerMiddlewarePanic(t *testing.T) {
+	client := &breakerClient{}
+	policy := CircuitBreakerPolicy{FailureThreshold: 1, CoolDown: 10 * time.Millisecond}
+	method := NewMethod(client, client.panics, "panics", []ServiceMiddleware{NewCircuitBreakerMiddleware(policy)})
+
+	invoke := func() {
+		defer func() {
+			assert.Equal(t, "boom", recover())
+		}()
+		method.Invoke([]interface{}{NewFContext("")})
+	}
+	invoke()
+	assert.True(t, IsErrCircuitOpen(method.Invoke([]interface{}{NewFContext("")}).Error()))
+	time.Sleep(15 * time.Millisecond)
+	invoke()
+	assert.True(t, IsErrCircuitOpen(method.Invoke([]interface{}{NewFContext("")}).Error()))
+	time.Sleep(15 * time.Millisecond)
+	invoke()
+	assert.Equal(t, 3, client.calls)
+}
+
+// Ensures each method has its own circuit.
+func TestCircuitBreakerMiddlewarePerMethod(t *testing.T) {
+	client := &breakerClient{errs: []error{timedOutErr}}
+	middleware := NewCircuitBreakerMiddleware(CircuitBreakerPolicy{FailureThreshold: 1})
+	ping := NewMethod(client, client.ping, "ping", []ServiceMiddleware{middleware})
+	getThing := NewMethod(client, client.getThing, "getThing", []ServiceMiddleware{middleware})
+
+	assert.Equal(t, timedOutErr, ping.Invoke([]interface{}{NewFContext("")}).Error())
+	assert.True(t, IsErrCircuitOpen(ping.Invoke([]interface{}{NewFContext("")}).Error()))
+	assert.Nil(t, getThing.Invoke([]interface{}{NewFContext("")}).Error())
+}
+
+func TestIsErrCircuitOpen(t *testing.T) {
+	assert.True(t, IsErrCircuitOpen(thrift.NewTTransportException(TRANSPORT_EXCEPTION_CIRCUIT_OPEN, "")))
+	assert.False(t, IsErrCircuitOpen(timedOutErr))
+	assert.False(t, IsErrCircuitOpen(errors.New("error")))
+}
+
+func TestCircuitStateString(t *testing.T) {
+	assert.Equal(t, "closed", CircuitClosed.String())
+	assert.Equal(t, "open", CircuitOpen.String())
+	assert.Equal(t, "half-open", CircuitHalfOpen.String())
+	assert.Equal(t, "CircuitState(7)", CircuitState(7).String())
+}
@@ -0,0 +1,535 @@
+package frugal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// GzipCompression is the name of the gzip CompressionCodec.
+	GzipCompression = "gzip"
+
+	// LZ4Compression is the name of the LZ4 CompressionCodec, which trades
+	// compression ratio for speed.
+	LZ4Compression = "lz4"
+
+	// Header containing the name of the codec which compressed the payload
+	compressionHeader = "_compression"
+
+	// Header containing the comma-separated names of the codecs the sender
+	// can decompress
+	acceptCompressionHeader = "_accept_compression"
+
+	// Default payload size in bytes below which payloads aren't compressed
+	defaultMinCompressionSize = 1024
+
+	// Largest payload the built-in codecs decompress
+	maxDecompressedSize = 64 * 1024 * 1024
+)
+
+var (
+	codecs   = map[string]CompressionCodec{}
+	codecsMu sync.RWMutex
+)
+
+func init() {
+	RegisterCompressionCodec(&gzipCodec{})
+	RegisterCompressionCodec(&lz4Codec{})
+}
+
+// CompressionCodec compresses and decompresses message payloads, i.e. the
+// TProtocol-serialized message following the headers of a frame.
+type CompressionCodec interface {
+	// Name returns the name of the codec, which is sent in headers to
+	// identify it. Names must not contain commas.
+	Name() string
+
+	// Compress returns the compressed data.
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress returns the decompressed data. Implementations should
+	// bound the size of the decompressed data.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// RegisterCompressionCodec makes a CompressionCodec available to FProtocols,
+// replacing any codec with the same name. The gzip and LZ4 codecs are
+// registered by default.
+func RegisterCompressionCodec(codec CompressionCodec) {
+	codecsMu.Lock()
+	codecs[codec.Name()] = codec
+	codecsMu.Unlock()
+}
+
+// getCompressionCodec returns the registered CompressionCodec with the given
+// name or nil if there isn't one.
+func getCompressionCodec(name string) CompressionCodec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[name]
+}
+
+// acceptedCodecs returns the comma-separated names of the registered
+// CompressionCodecs.
+func acceptedCodecs() string {
+	codecsMu.RLock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	codecsMu.RUnlock()
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// acceptsCodec returns true if the comma-separated names of an
+// acceptCompressionHeader contain the codec name.
+func acceptsCodec(accepted, name string) bool {
+	for _, accept := range strings.Split(accepted, ",") {
+		if strings.TrimSpace(accept) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCompressionHeaders removes the compression headers from headers
+// copied from an FContext, since they describe the frame the FContext was
+// received in rather than the frame being written.
+func removeCompressionHeaders(headers map[string]string) map[string]string {
+	delete(headers, compressionHeader)
+	delete(headers, acceptCompressionHeader)
+	return headers
+}
+
+// CompressionPolicy configures compression of the payloads written by the
+// FProtocols of an FProtocolFactory. Zero values are replaced with their
+// defaults.
+//
+// Compression is negotiated with request headers. FProtocols with a
+// CompressionPolicy advertise the codecs they accept in the headers they
+// write. A server compresses a response only if the request accepts the
+// codec, and a client compresses requests only once a response from the
+// server accepts the codec, so peers without compression support keep
+// receiving uncompressed frames. Compressed payloads are always
+// decompressed, whether or not a CompressionPolicy is set.
+type CompressionPolicy struct {
+	// Codec is the name of the CompressionCodec which compresses payloads,
+	// e.g. GzipCompression.
+	Codec string
+
+	// MinSize is the payload size in bytes below which payloads aren't
+	// compressed. Defaults to 1024.
+	MinSize int
+
+	// SkipNegotiation compresses requests without waiting for the server to
+	// accept the codec. Publishers can't negotiate, so published messages
+	// are only compressed if this is set. Only set it once every peer, e.g.
+	// every subscriber of a scope, decompresses the codec.
+	SkipNegotiation bool
+}
+
+// compressionState is the CompressionPolicy of an FProtocolFactory and the
+// codecs its peer accepts.
+type compressionState struct {
+	policy CompressionPolicy
+	codec  CompressionCodec
+
+	// peerCodecs holds the acceptCompressionHeader of the last response.
+	peerCodecs atomic.Value
+}
+
+// WithCompression sets the CompressionPolicy of FProtocols returned by the
+// FProtocolFactory. Since a client remembers which codecs its server
+// accepts, clients of different services shouldn't share an
+// FProtocolFactory with a CompressionPolicy. It must be set before the
+// FProtocolFactory is used.
+func (f *FProtocolFactory) WithCompression(policy CompressionPolicy) *FProtocolFactory {
+	codec := getCompressionCodec(policy.Codec)
+	if codec == nil {
+		logger().Warnf("frugal: unknown compression codec %q, payloads won't be compressed", policy.Codec)
+		f.compression = nil
+		return f
+	}
+	if policy.MinSize <= 0 {
+		policy.MinSize = defaultMinCompressionSize
+	}
+	f.compression = &compressionState{policy: policy, codec: codec}
+	return f
+}
+
+// peerAccepts returns true if the last response accepted the codec.
+func (c *compressionState) peerAccepts() bool {
+	accepted, _ := c.peerCodecs.Load().(string)
+	return acceptsCodec(accepted, c.codec.Name())
+}
+
+// fCompressionProtocol is the TProtocol of the FProtocols returned by an
+// FProtocolFactory with a CompressionPolicy or other options. It buffers
+// payloads which may be compressed until they're flushed, and replaces itself
+// with a TProtocol reading the decompressed payload when a compressed payload
+// is read.
+type fCompressionProtocol struct {
+	thrift.TProtocol
+	factory *FProtocolFactory
+	pending *pendingPayload
+}
+
+// pendingPayload is a payload buffered until it's flushed, along with the
+// headers which precede it.
+type pendingPayload struct {
+	marshaler protocolMarshaler
+	headers   map[string]string
+	codec     CompressionCodec
+	body      *thrift.TMemoryBuffer
+	protocol  thrift.TProtocol
+}
+
+// requestCodec returns the CompressionCodec which compresses requests, or nil
+// if requests aren't compressed.
+func (p *fCompressionProtocol) requestCodec() CompressionCodec {
+	c := p.factory.compression
+	if c == nil || !(c.policy.SkipNegotiation || c.peerAccepts()) {
+		return nil
+	}
+	return c.codec
+}
+
+// responseCodec returns the CompressionCodec which compresses the response
+// to the request of the FContext, or nil if the response isn't compressed.
+func (p *fCompressionProtocol) responseCodec(ctx FContext) CompressionCodec {
+	c := p.factory.compression
+	if c == nil {
+		return nil
+	}
+	accepted, _ := ctx.RequestHeader(acceptCompressionHeader)
+	if !acceptsCodec(accepted, c.codec.Name()) {
+		return nil
+	}
+	return c.codec
+}
+
+// writeHeader writes the headers, advertising the accepted codecs if a
+// CompressionPolicy is set. If the codec isn't nil, the headers are buffered
+// along with the payload until it's flushed, so the payload can be
+// compressed.
+func (p *fCompressionProtocol) writeHeader(marshaler protocolMarshaler, headers map[string]string, codec CompressionCodec) error {
+	if p.factory.compression != nil {
+		headers[acceptCompressionHeader] = acceptedCodecs()
+	}
+	if codec == nil {
+		return writeHeaders(p.Transport(), marshaler, headers)
+	}
+
+	// A payload which wasn't flushed is discarded.
+	if p.pending != nil {
+		releaseBuffer(p.pending.body.Buffer)
+		p.TProtocol = p.pending.protocol
+	}
+	body := &thrift.TMemoryBuffer{Buffer: acquireBuffer()}
+	p.pending = &pendingPayload{
+		marshaler: marshaler,
+		headers:   headers,
+		codec:     codec,
+		body:      body,
+		protocol:  p.TProtocol,
+	}
+	p.TProtocol = p.factory.protoFactory.GetProtocol(body)
+	return nil
+}
+
+// Flush writes the buffered headers and payload, compressing the payload if
+// it's at least the minimum size, and flushes the underlying TProtocol.
+func (p *fCompressionProtocol) Flush() error {
+	pending := p.pending
+	if pending == nil {
+		return p.TProtocol.Flush()
+	}
+	p.pending = nil
+	defer releaseBuffer(pending.body.Buffer)
+	err := p.TProtocol.Flush()
+	p.TProtocol = pending.protocol
+	if err != nil {
+		return err
+	}
+
+	payload := pending.body.Bytes()
+	if len(payload) >= p.factory.compression.policy.MinSize {
+		compressed, err := pending.codec.Compress(payload)
+		if err != nil {
+			logger().Warnf("frugal: error compressing payload with %s: %s", pending.codec.Name(), err)
+		} else if len(compressed) < len(payload) {
+			pending.headers[compressionHeader] = pending.codec.Name()
+			payload = compressed
+		}
+	}
+	if err := writeHeaders(p.Transport(), pending.marshaler, pending.headers); err != nil {
+		return err
+	}
+	if _, err := p.Transport().Write(payload); err != nil {
+		return err
+	}
+	return p.TProtocol.Flush()
+}
+
+// decompress replaces the TProtocol with one reading the decompressed
+// remainder of the transport.
+func (p *fCompressionProtocol) decompress(name string) error {
+	payload, err := decompressPayload(name, p.Transport())
+	if err != nil {
+		return err
+	}
+	p.TProtocol = p.factory.protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(payload)})
+	return nil
+}
+
+// decompressPayload returns the remainder of the transport decompressed with
+// the codec of the given name.
+func decompressPayload(name string, transport io.Reader) ([]byte, error) {
+	codec := getCompressionCodec(name)
+	if codec == nil {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: unsupported compression codec %q", name))
+	}
+	compressed, err := ioutil.ReadAll(transport)
+	if err != nil {
+		if e, ok := err.(thrift.TTransportException); !ok || e.TypeId() != TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+				fmt.Sprintf("frugal: error reading compressed payload: %s", err))
+		}
+	}
+	payload, err := codec.Decompress(compressed)
+	if err != nil {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: error decompressing payload with %s: %s", name, err))
+	}
+	return payload, nil
+}
+
+// gzipWriterPool holds gzip writers, which are expensive to allocate.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+// gzipCodec is the gzip CompressionCodec.
+type gzipCodec struct{}
+
+// Name returns GzipCompression.
+func (g *gzipCodec) Name() string {
+	return GzipCompression
+}
+
+// Compress returns the gzip-compressed data.
+func (g *gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	writer := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(writer)
+	writer.Reset(&buff)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// Decompress returns the gzip-decompressed data.
+func (g *gzipCodec) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxDecompressedSize {
+		return nil, errors.New("decompressed payload too large")
+	}
+	return payload, nil
+}
+
+// LZ4 block format constants. See
+// https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md.
+const (
+	lz4MinMatch     = 4
+	lz4LastLiterals = 5
+	lz4MFLimit      = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 14
+)
+
+var errInvalidLZ4 = errors.New("invalid lz4 block")
+
+// lz4Codec is the LZ4 CompressionCodec. Compressed data is the size of the
+// decompressed data as a 4-byte big-endian integer followed by an LZ4 block.
+type lz4Codec struct{}
+
+// Name returns LZ4Compression.
+func (l *lz4Codec) Name() string {
+	return LZ4Compression
+}
+
+// Compress returns the LZ4-compressed data.
+func (l *lz4Codec) Compress(data []byte) ([]byte, error) {
+	dst := make([]byte, 4, 4+len(data)+len(data)/255+16)
+	binary.BigEndian.PutUint32(dst, uint32(len(data)))
+
+	// table holds the position plus one of the last sequence of 4 bytes with
+	// each hash.
+	table := make([]int32, 1<<lz4HashLog)
+	anchor := 0
+	for i := 0; i+lz4MFLimit <= len(data); {
+		sequence := binary.LittleEndian.Uint32(data[i:])
+		hash := (sequence * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[hash]) - 1
+		table[hash] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(data[ref:]) != sequence {
+			i++
+			continue
+		}
+
+		// The match can't extend into the last literals.
+		length := lz4MinMatch
+		for max := len(data) - lz4LastLiterals - i; length < max && data[ref+length] == data[i+length]; {
+			length++
+		}
+		dst = appendLZ4Sequence(dst, data[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+	return appendLZ4Sequence(dst, data[anchor:], 0, 0), nil
+}
+
+// appendLZ4Sequence appends a sequence of literals followed by a match to the
+// block. The last sequence has only literals, indicated by a zero offset.
+func appendLZ4Sequence(dst, literals []byte, offset, length int) []byte {
+	tokenPos := len(dst)
+	dst = append(dst, 0)
+	token := byte(len(literals)) << 4
+	if len(literals) >= 15 {
+		token = 15 << 4
+		dst = appendLZ4Length(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if offset > 0 {
+		dst = append(dst, byte(offset), byte(offset>>8))
+		length -= lz4MinMatch
+		if length >= 15 {
+			token |= 15
+			dst = appendLZ4Length(dst, length-15)
+		} else {
+			token |= byte(length)
+		}
+	}
+	dst[tokenPos] = token
+	return dst
+}
+
+// appendLZ4Length appends the remainder of a length which doesn't fit in its
+// token.
+func appendLZ4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// Decompress returns the LZ4-decompressed data.
+func (l *lz4Codec) Decompress(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errInvalidLZ4
+	}
+	size := binary.BigEndian.Uint32(data)
+	if size > maxDecompressedSize {
+		return nil, errors.New("decompressed payload too large")
+	}
+	src := data[4:]
+	// The size is sent by the peer, so the buffer is bounded by the most an
+	// LZ4 block of this length can decompress to and grows while decoding.
+	bound := int(size)
+	if len(src) < bound/255 {
+		bound = len(src) * 255
+	}
+	dst := make([]byte, 0, bound)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		literals, n, ok := readLZ4Length(src[i:], int(token>>4))
+		if !ok {
+			return nil, errInvalidLZ4
+		}
+		i += n
+		if literals > len(src)-i || literals > int(size)-len(dst) {
+			return nil, errInvalidLZ4
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, errInvalidLZ4
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		length, n, ok := readLZ4Length(src[i:], int(token&15))
+		if !ok {
+			return nil, errInvalidLZ4
+		}
+		i += n
+		length += lz4MinMatch
+		if offset == 0 || offset > len(dst) || length > int(size)-len(dst) {
+			return nil, errInvalidLZ4
+		}
+		start := len(dst) - offset
+		if offset >= length {
+			dst = append(dst, dst[start:start+length]...)
+			continue
+		}
+		// Matches may overlap the bytes they produce, in which case they're
+		// copied byte by byte.
+		for ; length > 0; length-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if len(dst) != int(size) {
+		return nil, errInvalidLZ4
+	}
+	return dst, nil
+}
+
+// readLZ4Length returns the length starting with the given token nibble, and
+// the number of bytes of src which extend it.
+func readLZ4Length(src []byte, nibble int) (int, int, bool) {
+	if nibble != 15 {
+		return nibble, 0, true
+	}
+	length := nibble
+	for i, b := range src {
+		length += int(b)
+		if b != 255 {
+			return length, i + 1, true
+		}
+		if length > maxDecompressedSize {
+			return 0, 0, false
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,343 @@
+package frugal
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoProcessor is an FProcessor which responds to requests with the string
+// they contain.
+type echoProcessor struct{}
+
+func (e *echoProcessor) Process(iprot, oprot *FProtocol) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	body, err := iprot.ReadString()
+	if err != nil {
+		return err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	ctx.AddResponseHeader("request_compression", ctx.RequestHeaders()[compressionHeader])
+	if err := oprot.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageBegin(name, thrift.REPLY, 0); err != nil {
+		return err
+	}
+	if err := oprot.WriteString(body); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return oprot.Flush()
+}
+
+func (e *echoProcessor) AddMiddleware(middleware ServiceMiddleware) {}
+
+func (e *echoProcessor) Annotations() map[string]map[string]string {
+	return nil
+}
+
+// stringMessage returns a frame containing a message with the given string.
+func stringMessage(t *testing.T, protoFactory *FProtocolFactory, ctx FContext, body string) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteMessageBegin("echo", thrift.CALL, 0))
+	assert.Nil(t, proto.WriteString(body))
+	assert.Nil(t, proto.WriteMessageEnd())
+	assert.Nil(t, proto.Flush())
+	return buffer.Bytes()
+}
+
+// echo sends the string to the FTransport and returns the response headers
+// and string.
+func echo(t *testing.T, tr FTransport, protoFactory *FProtocolFactory, body string) (map[string]string, string) {
+	ctx := NewFContext("")
+	result, err := tr.Request(ctx, stringMessage(t, protoFactory, ctx, body))
+	assert.Nil(t, err)
+	iprot := protoFactory.GetProtocol(result)
+	assert.Nil(t, iprot.ReadResponseHeader(ctx))
+	_, _, _, err = iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	response, err := iprot.ReadString()
+	assert.Nil(t, err)
+	return ctx.ResponseHeaders(), response
+}
+
+// compressibleString returns a string of the given length which compresses
+// well.
+func compressibleString(n int) string {
+	return strings.Repeat("frugal ", n/7+1)[:n]
+}
+
+// Ensures the codecs decompress the data they compress.
+func TestCompressionCodecsRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("hello"),
+		[]byte(compressibleString(100)),
+		[]byte(compressibleString(100000)),
+		bytes.Repeat([]byte{0}, 70000),
+		random,
+		append(random[:1000:1000], bytes.Repeat(random[:300], 300)...),
+	}
+	for _, name := range []string{GzipCompression, LZ4Compression} {
+		codec := getCompressionCodec(name)
+		for _, input := range inputs {
+			compressed, err := codec.Compress(input)
+			assert.Nil(t, err)
+			output, err := codec.Decompress(compressed)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(input, output), "%s failed to round trip %d bytes", name, len(input))
+		}
+		compressed, err := codec.Compress([]byte(compressibleString(100000)))
+		assert.Nil(t, err)
+		assert.True(t, len(compressed) < 10000, "%s compressed to %d bytes", name, len(compressed))
+	}
+}
+
+// Ensures the LZ4 codec rejects invalid data.
+func TestLZ4DecompressInvalid(t *testing.T) {
+	codec := &lz4Codec{}
+	valid, err := codec.Compress([]byte(compressibleString(1000)))
+	assert.Nil(t, err)
+
+	for _, data := range [][]byte{
+		{},
+		{0, 0, 0},
+		{0xff, 0xff, 0xff, 0xff},
+		valid[:len(valid)-1],
+		append([]byte{0, 0, 0, 1}, valid[4:]...),
+		// A match offset before the start of the data.
+		{0, 0, 0, 9, 0x14, 'a', 0x09, 0x00, 0x00},
+	} {
+		_, err := codec.Decompress(data)
+		assert.NotNil(t, err)
+	}
+}
+
+// Ensures responses are compressed once the client accepts the codec and
+// requests once the server accepts it.
+func TestCompressionNegotiation(t *testing.T) {
+	for _, codec := range []string{GzipCompression, LZ4Compression} {
+		serverFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithCompression(CompressionPolicy{Codec: codec})
+		clientFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithCompression(CompressionPolicy{Codec: codec})
+		tr := NewFInMemoryTransport(&echoProcessor{}, serverFactory)
+		assert.Nil(t, tr.Open())
+
+		body := compressibleString(10000)
+		headers, response := echo(t, tr, clientFactory, body)
+		assert.Equal(t, body, response)
+		assert.Equal(t, codec, headers[compressionHeader])
+		assert.Equal(t, "", headers["request_compression"])
+		assert.Equal(t, "gzip,lz4", headers[acceptCompressionHeader])
+
+		headers, response = echo(t, tr, clientFactory, body)
+		assert.Equal(t, body, response)
+		assert.Equal(t, codec, headers[compressionHeader])
+		assert.Equal(t, codec, headers["request_compression"])
+		assert.Nil(t, tr.Close())
+	}
+}
+
+// Ensures peers without a CompressionPolicy receive uncompressed frames and
+// still decompress compressed frames.
+func TestCompressionOldPeers(t *testing.T) {
+	plainFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	compressingFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithCompression(CompressionPolicy{Codec: GzipCompression})
+	body := compressibleString(10000)
+
+	// A client which doesn't accept compression receives uncompressed
+	// responses.
+	tr := NewFInMemoryTransport(&echoProcessor{}, compressingFactory)
+	assert.Nil(t, tr.Open())
+	headers, response := echo(t, tr, plainFactory, body)
+	assert.Equal(t, body, response)
+	_, ok := headers[compressionHeader]
+	assert.False(t, ok)
+	assert.Nil(t, tr.Close())
+
+	// A server which doesn't accept compression receives uncompressed
+	// requests.
+	tr = NewFInMemoryTransport(&echoProcessor{}, plainFactory)
+	assert.Nil(t, tr.Open())
+	for i := 0; i < 2; i++ {
+		headers, response = echo(t, tr, compressingFactory, body)
+		assert.Equal(t, body, response)
+		assert.Equal(t, "", headers["request_compression"])
+		_, ok = headers[compressionHeader]
+		assert.False(t, ok)
+	}
+	assert.Nil(t, tr.Close())
+
+	// Without a CompressionPolicy, compressed payloads are decompressed.
+	ctx := NewFContext("")
+	frame := stringMessage(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithCompression(CompressionPolicy{Codec: LZ4Compression, SkipNegotiation: true}), ctx, body)
+	iprot := plainFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	received, err := iprot.ReadRequestHeader()
+	assert.Nil(t, err)
+	name, _ := received.RequestHeader(compressionHeader)
+	assert.Equal(t, LZ4Compression, name)
+	_, _, _, err = iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	response, err = iprot.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, body, response)
+}
+
+// Ensures the compression headers of a received FContext aren't written when
+// it's forwarded.
+func TestCompressionHeadersNotForwarded(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	frame := stringMessage(t, NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithCompression(CompressionPolicy{Codec: GzipCompression, SkipNegotiation: true}),
+		NewFContext(""), compressibleString(10000))
+	received, err := protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])}).ReadRequestHeader()
+	assert.Nil(t, err)
+	_, ok := received.RequestHeader(compressionHeader)
+	assert.True(t, ok)
+
+	forwarded := stringMessage(t, protoFactory, received, "hello")
+	headers, err := getHeadersFromFrame(forwarded[4:])
+	assert.Nil(t, err)
+	_, ok = headers[compressionHeader]
+	assert.False(t, ok)
+	_, ok = headers[acceptCompressionHeader]
+	assert.False(t, ok)
+}
+
+// Ensures payloads smaller than MinSize, or which don't shrink, aren't
+// compressed.
+func TestCompressionMinSize(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithCompression(CompressionPolicy{Codec: GzipCompression, MinSize: 500, SkipNegotiation: true})
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for body, compressed := range map[string]bool{
+		compressibleString(100):  false,
+		compressibleString(1000): true,
+		string(random):           false,
+	} {
+		frame := stringMessage(t, protoFactory, NewFContext(""), body)
+		name, err := getHeaderFromFrame(frame[4:], compressionHeader)
+		assert.Nil(t, err)
+		assert.Equal(t, compressed, name == GzipCompression)
+		assert.True(t, len(frame) < len(body)+200)
+	}
+}
+
+// Ensures published messages are compressed when negotiation is skipped, and
+// received by subscribers.
+func TestCompressionPublish(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithCompression(CompressionPolicy{Codec: LZ4Compression, SkipNegotiation: true})
+	body := compressibleString(100000)
+	frame := stringMessage(t, protoFactory, NewFContext(""), body)
+	assert.True(t, len(frame) < 10000)
+
+	iprot := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])})
+	_, err := iprot.ReadRequestHeader()
+	assert.Nil(t, err)
+	_, _, _, err = iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	received, err := iprot.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, body, received)
+}
+
+// Ensures compressed payloads which can't be decompressed are rejected.
+func TestDecompressInvalid(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ctx := NewFContext("")
+	frame := stringMessage(t, protoFactory, ctx, "hello")
+
+	// Unsupported codec.
+	unsupported, err := addHeadersToFrame(frame, map[string]string{compressionHeader: "zstd"})
+	assert.Nil(t, err)
+	_, err = protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(unsupported[4:])}).ReadRequestHeader()
+	assert.Equal(t, thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+
+	// Payload which isn't compressed.
+	invalid, err := addHeadersToFrame(frame, map[string]string{compressionHeader: GzipCompression})
+	assert.Nil(t, err)
+	_, err = protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(invalid[4:])}).ReadRequestHeader()
+	assert.Equal(t, thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+
+	// FProtocols without a CompressionPolicy can only decompress frames.
+	valid, err := addHeadersToFrame(stringMessage(t,
+		NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+			WithCompression(CompressionPolicy{Codec: GzipCompression, SkipNegotiation: true}),
+		ctx, compressibleString(10000)), nil)
+	assert.Nil(t, err)
+	_, err = protoFactory.GetProtocol(thrift.NewStreamTransportR(bytes.NewReader(valid[4:]))).ReadRequestHeader()
+	assert.Equal(t, thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId())
+}
+
+// Ensures only FProtocolFactories with a CompressionPolicy wrap their
+// TProtocols, and compressed LZ4 blocks can't claim an unbounded size.
+func TestCompressionProtocolWrapping(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	proto := protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)})
+	_, ok := proto.TProtocol.(*fCompressionProtocol)
+	assert.False(t, ok)
+	protoFactory.WithCompression(CompressionPolicy{Codec: GzipCompression})
+	proto = protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)})
+	_, ok = proto.TProtocol.(*fCompressionProtocol)
+	assert.True(t, ok)
+
+	// A block of one literal claiming the maximum size.
+	_, err := (&lz4Codec{}).Decompress([]byte{0x04, 0x00, 0x00, 0x00, 0x10, 'a'})
+	assert.Equal(t, errInvalidLZ4, err)
+}
+
+// Ensures an unknown codec disables compression.
+func TestWithCompressionUnknownCodec(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithCompression(CompressionPolicy{Codec: "zstd", SkipNegotiation: true})
+	assert.Nil(t, protoFactory.compression)
+	frame := stringMessage(t, protoFactory, NewFContext(""), compressibleString(10000))
+	headers, err := getHeadersFromFrame(frame[4:])
+	assert.Nil(t, err)
+	_, ok := headers[compressionHeader]
+	assert.False(t, ok)
+	_, ok = headers[acceptCompressionHeader]
+	assert.False(t, ok)
+}
+
+func BenchmarkCompressionCodecs(b *testing.B) {
+	data := []byte(compressibleString(100000))
+	for _, name := range []string{GzipCompression, LZ4Compression} {
+		codec := getCompressionCodec(name)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				compressed, _ := codec.Compress(data)
+				codec.Decompress(compressed)
+			}
+		})
+	}
+}
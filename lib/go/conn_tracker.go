@@ -0,0 +1,137 @@
+package frugal
+
+import (
+	"context"
+	"sync"
+)
+
+// trackedConn is a client connection of a server which is tracked by a
+// connTracker.
+type trackedConn interface {
+	// interrupt stops the connection from processing further requests and
+	// closes it. It's called while the connTracker is locked, so it must not
+	// block.
+	interrupt()
+}
+
+// connTracker tracks the client connections of a server and the number of
+// requests each is processing, so the server can shut down gracefully.
+type connTracker struct {
+	mu          sync.Mutex
+	conns       map[trackedConn]int
+	draining    bool
+	connChanged chan struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns:       make(map[trackedConn]int),
+		connChanged: make(chan struct{}, 1),
+	}
+}
+
+// track registers the connection. It returns false if the server is shutting
+// down, in which case the connection should be closed.
+func (t *connTracker) track(conn trackedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.conns[conn] = 0
+	return true
+}
+
+// untrack removes the connection once it's closed and its requests are
+// processed.
+func (t *connTracker) untrack(conn trackedConn) {
+	t.mu.Lock()
+	delete(t.conns, conn)
+	t.mu.Unlock()
+	select {
+	case t.connChanged <- struct{}{}:
+	default:
+	}
+}
+
+// begin marks the connection as processing another request. It returns false
+// if the server is shutting down, in which case the request should not be
+// processed.
+func (t *connTracker) begin(conn trackedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.conns[conn]++
+	return true
+}
+
+// finish marks a request of the connection as processed. It returns false if
+// the server is shutting down and the connection has no other requests in
+// flight, in which case the connection should be interrupted. Connections
+// which were idle when the server started shutting down have already been
+// interrupted.
+func (t *connTracker) finish(conn trackedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conns[conn]--
+	return !t.draining || t.conns[conn] > 0
+}
+
+// isDraining returns true if the server is shutting down.
+func (t *connTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// interruptAll interrupts every connection and returns the number of requests
+// they were processing. If drain is true, the server is marked as shutting
+// down first so no more connections or requests are accepted.
+func (t *connTracker) interruptAll(drain bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if drain {
+		t.draining = true
+	}
+	abandoned := 0
+	for conn, inFlight := range t.conns {
+		abandoned += inFlight
+		conn.interrupt()
+	}
+	return abandoned
+}
+
+// drain marks the server as shutting down, interrupts idle connections, and
+// waits for the connections processing a request to finish it until the
+// context is done. If the context is done first, all remaining connections
+// are interrupted and the number of requests which were abandoned is returned
+// along with the context's error.
+func (t *connTracker) drain(ctx context.Context) (int, error) {
+	// Idle connections are interrupted while holding the lock so they can't
+	// begin another request first.
+	t.mu.Lock()
+	t.draining = true
+	for conn, inFlight := range t.conns {
+		if inFlight == 0 {
+			conn.interrupt()
+		}
+	}
+	t.mu.Unlock()
+
+	for {
+		t.mu.Lock()
+		remaining := len(t.conns)
+		t.mu.Unlock()
+		if remaining == 0 {
+			return 0, nil
+		}
+
+		select {
+		case <-t.connChanged:
+		case <-ctx.Done():
+			return t.interruptAll(true), ctx.Err()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package frugal
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -8,6 +9,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"git.apache.org/thrift.git/lib/go/thrift"
 	"github.com/mattrobenolt/gocql/uuid"
 )
 
@@ -30,6 +32,9 @@ const (
 // timeout. The default timeout is five seconds. An FContext is also sent with
 // every publish message which is then received by subscribers.
 //
+// FContexts created by Frugal are linked to a Go context.Context, see
+// FContextWithContext.
+//
 // In addition to headers, the FContext also contains a correlation ID which
 // can be used for distributed tracing purposes. A random correlation ID is
 // generated for each FContext if one is not provided.
@@ -53,8 +58,8 @@ type FContext interface {
 	CorrelationID() string
 
 	// AddRequestHeader adds a request header to the context for the given
-	// name. The headers _cid and _opid are reserved. Returns the same FContext
-	// to allow for chaining calls.
+	// name. The headers _cid, _opid and _traceparent are reserved. Returns
+	// the same FContext to allow for chaining calls.
 	AddRequestHeader(name, value string) FContext
 
 	// RequestHeader gets the named request header.
@@ -82,6 +87,24 @@ type FContext interface {
 	Timeout() time.Duration
 }
 
+// FContextWithContext is an FContext linked to a Go context.Context which can
+// be used to observe deadlines and cancellation. It's implemented by
+// FContextImpl and can be type asserted from an FContext.
+//
+// On the client, the context.Context bound with NewFContextWithContext is
+// honored by FTransports, which abort requests when it's done. On the server,
+// the context.Context of an FContext passed to a handler has a deadline
+// derived from the request timeout at the time the request was received and
+// is cancelled once the request has been processed. The context.Context of
+// an FContext passed to a subscriber has no deadline.
+type FContextWithContext interface {
+	FContext
+
+	// Context returns the context.Context linked to the FContext. This is
+	// never nil.
+	Context() context.Context
+}
+
 var nextOpID uint64
 
 // FContextImpl is an implementation of FContext.
@@ -89,6 +112,20 @@ type FContextImpl struct {
 	requestHeaders  map[string]string
 	responseHeaders map[string]string
 	mu              sync.RWMutex
+	goCtx           context.Context
+	cancel          context.CancelFunc
+
+	// requestMarshaler is the protocolMarshaler of the request headers read
+	// by a server, which is used to write the response headers.
+	requestMarshaler protocolMarshaler
+
+	// propagatedHeaders are the request headers NewFContextFrom copies, as
+	// set on the FProtocolFactory which read the request headers.
+	propagatedHeaders []string
+
+	// responseErr is the error of the response to the request, as set by
+	// SetResponseError.
+	responseErr error
 }
 
 // NewFContext returns a Context for the given correlation id. If an empty
@@ -106,6 +143,7 @@ func NewFContext(correlationID string) FContext {
 			timeoutHeader: strconv.FormatInt(int64(defaultTimeout/time.Millisecond), 10),
 		},
 		responseHeaders: make(map[string]string),
+		goCtx:           context.Background(),
 	}
 
 	opID := atomic.AddUint64(&nextOpID, 1)
@@ -113,6 +151,122 @@ func NewFContext(correlationID string) FContext {
 	return ctx
 }
 
+// NewFContextWithContext returns a Context for the given correlation id which
+// is linked to the given context.Context. If the context.Context has a
+// deadline, the request timeout is set to the time remaining until the
+// deadline. FTransports abort requests made with the returned FContext when
+// the context.Context is done.
+func NewFContextWithContext(goCtx context.Context, correlationID string) FContext {
+	ctx := NewFContext(correlationID).(*FContextImpl)
+	ctx.goCtx = goCtx
+	if deadline, ok := goCtx.Deadline(); ok {
+		timeout := deadline.Sub(time.Now())
+		if timeout < 0 {
+			timeout = 0
+		}
+		ctx.SetTimeout(timeout)
+	}
+	return ctx
+}
+
+// WithContext returns an FContext which shares the headers of the given
+// FContext and is linked to the given context.Context. Its timeout is limited
+// to the time remaining until the context.Context's deadline. Generated
+// clients use this for the methods which accept a context.Context.
+func WithContext(ctx FContext, goCtx context.Context) FContext {
+	return &fContextWithGoContext{FContext: ctx, goCtx: goCtx}
+}
+
+// fContextWithGoContext is the FContext returned by WithContext.
+type fContextWithGoContext struct {
+	FContext
+	goCtx context.Context
+}
+
+// Context returns the linked context.Context.
+func (c *fContextWithGoContext) Context() context.Context {
+	return c.goCtx
+}
+
+// Timeout returns the request timeout, limited to the time remaining until
+// the context.Context's deadline.
+func (c *fContextWithGoContext) Timeout() time.Duration {
+	timeout := c.FContext.Timeout()
+	if deadline, ok := c.goCtx.Deadline(); ok {
+		remaining := deadline.Sub(time.Now())
+		if remaining < 0 {
+			remaining = 0
+		}
+		if remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout
+}
+
+// WithPropagatedHeaders sets the request headers which NewFContextFrom copies
+// from FContexts read by the FProtocols returned by the FProtocolFactory,
+// e.g. tenant and user ids. The reserved headers are ignored. By default only
+// the correlation id and trace context are copied. It must be set before the
+// FProtocolFactory is used.
+func (f *FProtocolFactory) WithPropagatedHeaders(headers ...string) *FProtocolFactory {
+	f.propagatedHeaders = append([]string(nil), headers...)
+	return f
+}
+
+// NewFContextFrom returns an FContext for an outbound request made while
+// handling the request of the inbound FContext. The returned FContext has the
+// inbound correlation id, trace context and the request headers set with
+// WithPropagatedHeaders on the server's FProtocolFactory. It's linked to the
+// inbound context.Context, so its timeout is the time remaining until the
+// inbound request's deadline, and the outbound request is aborted if the
+// inbound request is cancelled or finishes processing. If the inbound
+// context.Context has no deadline, the inbound timeout is used.
+func NewFContextFrom(inbound FContext) FContext {
+	ctx := NewFContextWithContext(goContext(inbound), inbound.CorrelationID())
+	if _, ok := goContext(inbound).Deadline(); !ok {
+		ctx.SetTimeout(inbound.Timeout())
+	}
+	if traceparent, ok := inbound.RequestHeader(traceparentHeader); ok {
+		ctx.AddRequestHeader(traceparentHeader, traceparent)
+	}
+
+	for _, name := range propagatedHeaders(inbound) {
+		switch name {
+		case cidHeader, opIDHeader, timeoutHeader, traceparentHeader:
+			continue
+		}
+		if value, ok := inbound.RequestHeader(name); ok {
+			ctx.AddRequestHeader(name, value)
+		}
+	}
+	return ctx
+}
+
+// propagatedHeaders returns the request headers NewFContextFrom copies from
+// the FContext.
+func propagatedHeaders(ctx FContext) []string {
+	if impl := unwrapFContext(ctx); impl != nil {
+		return impl.propagatedHeaders
+	}
+	return nil
+}
+
+// unwrapFContext returns the FContextImpl wrapped by the FContext, or nil if
+// it isn't an FContextImpl.
+func unwrapFContext(ctx FContext) *FContextImpl {
+	for {
+		switch c := ctx.(type) {
+		case *FContextImpl:
+			return c
+		case *fContextWithGoContext:
+			ctx = c.FContext
+		default:
+			return nil
+		}
+	}
+}
+
 // CorrelationID returns the correlation id for the context.
 func (c *FContextImpl) CorrelationID() string {
 	c.mu.RLock()
@@ -121,8 +275,8 @@ func (c *FContextImpl) CorrelationID() string {
 }
 
 // AddRequestHeader adds a request header to the context for the given name.
-// The headers _cid and _opid are reserved. Returns the same FContext to allow
-// for chaining calls.
+// The headers _cid, _opid and _traceparent are reserved. Returns the same
+// FContext to allow for chaining calls.
 func (c *FContextImpl) AddRequestHeader(name, value string) FContext {
 	c.mu.Lock()
 	c.requestHeaders[name] = value
@@ -199,12 +353,145 @@ func (c *FContextImpl) Timeout() time.Duration {
 	return time.Millisecond * time.Duration(timeoutMillis)
 }
 
+// Context returns the context.Context linked to the FContext.
+func (c *FContextImpl) Context() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.goCtx == nil {
+		return context.Background()
+	}
+	return c.goCtx
+}
+
+// SetContextValue links the FContext to a copy of its context.Context which
+// carries the value for the key, as with context.WithValue. ServiceMiddleware
+// can use this to pass request-scoped values, such as verified credentials,
+// to handlers.
+func (c *FContextImpl) SetContextValue(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.goCtx == nil {
+		c.goCtx = context.Background()
+	}
+	c.goCtx = context.WithValue(c.goCtx, key, value)
+}
+
+// setDeadline links the context with a new context.Context whose deadline is
+// the request timeout from the time the request was received.
+func (c *FContextImpl) setDeadline(received time.Time) {
+	goCtx, cancel := context.WithDeadline(c.Context(), received.Add(c.Timeout()))
+	c.mu.Lock()
+	c.goCtx = goCtx
+	c.cancel = cancel
+	c.mu.Unlock()
+}
+
+// receivedFrame is the transport of a request frame which may have been
+// queued before it was processed, e.g. by the NATS FServer. The deadline of
+// the request is derived from the time the frame was received.
+type receivedFrame struct {
+	*thrift.TMemoryBuffer
+	received time.Time
+}
+
+// setRequestDeadline links the FContext of a request read from the FProtocol
+// with a context.Context whose deadline is the request timeout from the time
+// the request was received. It must be followed by cancelContext once the
+// request has been processed. This is called by FProcessors rather than when
+// the request header is read, since subscribers read headers too but have no
+// deadline.
+func setRequestDeadline(ctx FContext, iprot *FProtocol) {
+	impl, ok := ctx.(*FContextImpl)
+	if !ok {
+		return
+	}
+	received := time.Now()
+	if frame, ok := iprot.Transport().(*receivedFrame); ok {
+		received = frame.received
+	}
+	impl.setDeadline(received)
+}
+
+// cancelContext cancels the context.Context linked to the given FContext if
+// it was created by setRequestDeadline. This is called once the request has
+// been processed.
+func cancelContext(ctx FContext) {
+	impl, ok := ctx.(*FContextImpl)
+	if !ok {
+		return
+	}
+	impl.mu.RLock()
+	cancel := impl.cancel
+	impl.mu.RUnlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// goContext returns the context.Context linked to the FContext, or
+// context.Background() if it isn't an FContextWithContext.
+func goContext(ctx FContext) context.Context {
+	if withContext, ok := ctx.(FContextWithContext); ok {
+		return withContext.Context()
+	}
+	return context.Background()
+}
+
+// contextError returns the error for a request whose context.Context is done.
+func contextError(ctx FContext) error {
+	if goContext(ctx).Err() == context.DeadlineExceeded {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: request timed out")
+	}
+	return thrift.NewTTransportExceptionFromError(goContext(ctx).Err())
+}
+
+// copyFContext returns a copy of the FContext with the same request headers
+// and context.Context but a new operation id, so the request can be sent
+// again, e.g. as a retry, without changing the FContext.
+func copyFContext(ctx FContext) FContext {
+	headers := make(map[string]string)
+	for name, value := range ctx.RequestHeaders() {
+		headers[name] = value
+	}
+	c := &FContextImpl{
+		requestHeaders:  headers,
+		responseHeaders: make(map[string]string),
+		goCtx:           goContext(ctx),
+	}
+	setRequestOpID(c, atomic.AddUint64(&nextOpID, 1))
+	return c
+}
+
+// copyResponseHeaders adds the response headers of a copy made with
+// copyFContext, except its operation id, to the original FContext.
+func copyResponseHeaders(dst, src FContext) {
+	for name, value := range src.ResponseHeaders() {
+		if name != opIDHeader {
+			dst.AddResponseHeader(name, value)
+		}
+	}
+}
+
 // setRequestOpID sets the request operation id for context.
 func setRequestOpID(ctx FContext, id uint64) {
 	opIDStr := strconv.FormatUint(id, 10)
 	ctx.AddRequestHeader(opIDHeader, opIDStr)
 }
 
+// removeRequestHeader removes the named request header from the FContext.
+// FContext implementations other than FContextImpl can't remove headers, so
+// the header is set to an empty value instead.
+func removeRequestHeader(ctx FContext, name string) {
+	c, ok := ctx.(*FContextImpl)
+	if !ok {
+		ctx.AddRequestHeader(name, "")
+		return
+	}
+	c.mu.Lock()
+	delete(c.requestHeaders, name)
+	c.mu.Unlock()
+}
+
 // opID returns the request operation id for the given context.
 func getOpID(ctx FContext) (uint64, error) {
 	opIDStr, ok := ctx.RequestHeader(opIDHeader)
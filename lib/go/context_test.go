@@ -1,10 +1,12 @@
 package frugal
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
+	"git.apache.org/thrift.git/lib/go/thrift"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -104,3 +106,158 @@ func TestResponseHeader(t *testing.T) {
 	assert.Equal(t, ctx, ctx.AddResponseHeader(opIDHeader, "1"))
 	assert.Equal(t, "1", ctx.ResponseHeaders()[opIDHeader])
 }
+
+// Ensures NewFContext links the FContext to a background context.Context.
+func TestContextDefault(t *testing.T) {
+	ctx := NewFContext("")
+	assert.Equal(t, context.Background(), goContext(ctx))
+}
+
+// Ensures NewFContextWithContext links the FContext to the given
+// context.Context and derives the request timeout from its deadline.
+func TestNewFContextWithContext(t *testing.T) {
+	assert := assert.New(t)
+	goCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ctx := NewFContextWithContext(goCtx, "fooid")
+
+	assert.Equal("fooid", ctx.CorrelationID())
+	assert.Equal(goCtx, goContext(ctx))
+	assert.True(ctx.Timeout() <= time.Second)
+	assert.True(ctx.Timeout() > 900*time.Millisecond)
+}
+
+// Ensures NewFContextWithContext keeps the default timeout if the
+// context.Context has no deadline.
+func TestNewFContextWithContextNoDeadline(t *testing.T) {
+	goCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ctx := NewFContextWithContext(goCtx, "")
+
+	assert.Equal(t, defaultTimeout, ctx.Timeout())
+}
+
+// Ensures WithContext shares the headers of the FContext, links it to the
+// context.Context and limits the timeout to the context.Context's deadline.
+func TestWithContext(t *testing.T) {
+	assert := assert.New(t)
+	goCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	inner := NewFContext("fooid")
+	inner.SetTimeout(time.Minute)
+
+	ctx := WithContext(inner, goCtx)
+
+	assert.Equal("fooid", ctx.CorrelationID())
+	assert.True(ctx.Timeout() <= time.Second)
+	assert.Equal(time.Minute, inner.Timeout())
+	assert.Equal(goCtx, goContext(ctx))
+	ctx.AddResponseHeader("foo", "bar")
+	foo, _ := inner.ResponseHeader("foo")
+	assert.Equal("bar", foo)
+
+	inner.SetTimeout(time.Millisecond)
+	assert.Equal(time.Millisecond, ctx.Timeout())
+}
+
+// Ensures a processed FContext has a deadline derived from its timeout and the
+// time the request was received which is cancelled by cancelContext.
+func TestReceivedContextDeadline(t *testing.T) {
+	assert := assert.New(t)
+	sent := NewFContext("")
+	sent.SetTimeout(time.Minute)
+	buff := thrift.NewTMemoryBuffer()
+	proto := &FProtocol{thrift.NewTBinaryProtocolTransport(buff)}
+	assert.Nil(proto.WriteRequestHeader(sent))
+	received := time.Now().Add(-10 * time.Second)
+	iprot := &FProtocol{thrift.NewTBinaryProtocolTransport(&receivedFrame{TMemoryBuffer: buff, received: received})}
+
+	// Reading the header alone doesn't set a deadline since subscribers
+	// read headers too.
+	ctx, err := iprot.ReadRequestHeader()
+	assert.Nil(err)
+	_, ok := goContext(ctx).Deadline()
+	assert.False(ok)
+
+	setRequestDeadline(ctx, iprot)
+	deadline, ok := goContext(ctx).Deadline()
+	assert.True(ok)
+	assert.Equal(received.Add(time.Minute), deadline)
+	assert.Nil(goContext(ctx).Err())
+
+	cancelContext(ctx)
+	assert.Equal(context.Canceled, goContext(ctx).Err())
+}
+
+// Ensures NewFContextFrom copies the correlation id, trace context and
+// propagated headers from a received FContext and uses the time remaining
+// until its deadline as the timeout.
+func TestNewFContextFrom(t *testing.T) {
+	assert := assert.New(t)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).
+		WithPropagatedHeaders("tenant", "user", "missing", opIDHeader)
+
+	sent := NewFContext("fooid")
+	sent.SetTimeout(time.Minute)
+	sent.AddRequestHeader("tenant", "t1")
+	sent.AddRequestHeader("user", "u1")
+	sent.AddRequestHeader("other", "o1")
+	sent.AddRequestHeader(traceparentHeader, testTraceparent)
+	buff := thrift.NewTMemoryBuffer()
+	proto := protoFactory.GetProtocol(buff)
+	assert.Nil(proto.WriteRequestHeader(sent))
+	inbound, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	setRequestDeadline(inbound, proto)
+	sentOpID, _ := sent.RequestHeader(opIDHeader)
+
+	ctx := NewFContextFrom(inbound)
+
+	assert.Equal("fooid", ctx.CorrelationID())
+	assert.True(ctx.Timeout() <= time.Minute)
+	assert.True(ctx.Timeout() > 59*time.Second)
+	assert.Equal(goContext(inbound), goContext(ctx))
+	tenant, _ := ctx.RequestHeader("tenant")
+	assert.Equal("t1", tenant)
+	user, _ := ctx.RequestHeader("user")
+	assert.Equal("u1", user)
+	traceparent, _ := ctx.RequestHeader(traceparentHeader)
+	assert.Equal(testTraceparent, traceparent)
+	_, ok := ctx.RequestHeader("other")
+	assert.False(ok)
+	_, ok = ctx.RequestHeader("missing")
+	assert.False(ok)
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	assert.NotEqual(sentOpID, opID)
+
+	// The headers are propagated from FContexts with another context.Context
+	// too, but not from FContexts read by other FProtocolFactories.
+	tenant, _ = NewFContextFrom(WithContext(inbound, context.Background())).RequestHeader("tenant")
+	assert.Equal("t1", tenant)
+	proto = NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).GetProtocol(buff)
+	assert.Nil(proto.WriteRequestHeader(sent))
+	other, err := proto.ReadRequestHeader()
+	assert.Nil(err)
+	_, ok = NewFContextFrom(other).RequestHeader("tenant")
+	assert.False(ok)
+
+	// The outbound request is aborted once the inbound request is done.
+	cancelContext(inbound)
+	assert.Equal(context.Canceled, goContext(ctx).Err())
+}
+
+// Ensures NewFContextFrom uses the inbound timeout if the inbound
+// context.Context has no deadline.
+func TestNewFContextFromNoDeadline(t *testing.T) {
+	inbound := NewFContext("")
+	inbound.SetTimeout(time.Minute)
+
+	ctx := NewFContextFrom(inbound)
+
+	assert.Equal(t, time.Minute, ctx.Timeout())
+	assert.Equal(t, inbound.CorrelationID(), ctx.CorrelationID())
+	_, ok := ctx.RequestHeader(traceparentHeader)
+	assert.False(t, ok)
+}
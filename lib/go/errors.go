@@ -21,6 +21,11 @@ const (
 	// TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE is a TTransportException
 	// error type indicating the response exceeded the size limit.
 	TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE = 101
+
+	// TRANSPORT_EXCEPTION_CIRCUIT_OPEN is a TTransportException error type
+	// indicating the request was not sent because the circuit breaker for
+	// the method is open.
+	TRANSPORT_EXCEPTION_CIRCUIT_OPEN = 102
 )
 
 // TApplicationException types used in frugal instantiated
@@ -42,6 +47,22 @@ const (
 	// APPLICATION_EXCEPTION_RESPONSE_TOO_LARGE is a TApplicationException
 	// error type indicating the response exceeded the size limit.
 	APPLICATION_EXCEPTION_RESPONSE_TOO_LARGE = 100
+
+	// APPLICATION_EXCEPTION_DEADLINE_EXCEEDED is a TApplicationException
+	// error type indicating the request timed out before the server
+	// processed it.
+	APPLICATION_EXCEPTION_DEADLINE_EXCEEDED = 101
+
+	// APPLICATION_EXCEPTION_UNAUTHORIZED is a TApplicationException error
+	// type indicating the request was rejected because it was not
+	// authenticated or not authorized to call the method.
+	APPLICATION_EXCEPTION_UNAUTHORIZED = 102
+
+	// APPLICATION_EXCEPTION_OVERLOADED is a TApplicationException error type
+	// indicating the server rejected the request without processing it
+	// because the method's concurrency or rate limit was reached or the
+	// server's work queue was full.
+	APPLICATION_EXCEPTION_OVERLOADED = 103
 )
 
 // IsErrTooLarge indicates if the given error is a TTransportException
@@ -53,3 +74,43 @@ func IsErrTooLarge(err error) bool {
 	}
 	return false
 }
+
+// IsErrCircuitOpen indicates if the given error is a TTransportException
+// indicating the request was not sent because the circuit breaker for the
+// method is open.
+func IsErrCircuitOpen(err error) bool {
+	if e, ok := err.(thrift.TTransportException); ok {
+		return e.TypeId() == TRANSPORT_EXCEPTION_CIRCUIT_OPEN
+	}
+	return false
+}
+
+// IsErrDeadlineExceeded indicates if the given error is a
+// TApplicationException indicating the request timed out before the server
+// processed it.
+func IsErrDeadlineExceeded(err error) bool {
+	if e, ok := err.(thrift.TApplicationException); ok {
+		return e.TypeId() == APPLICATION_EXCEPTION_DEADLINE_EXCEEDED
+	}
+	return false
+}
+
+// IsErrUnauthorized indicates if the given error is a TApplicationException
+// indicating the request was not authenticated or not authorized to call the
+// method.
+func IsErrUnauthorized(err error) bool {
+	if e, ok := err.(thrift.TApplicationException); ok {
+		return e.TypeId() == APPLICATION_EXCEPTION_UNAUTHORIZED
+	}
+	return false
+}
+
+// IsErrOverloaded indicates if the given error is a TApplicationException
+// indicating the server rejected the request without processing it because
+// the method is overloaded. Clients should back off before retrying.
+func IsErrOverloaded(err error) bool {
+	if e, ok := err.(thrift.TApplicationException); ok {
+		return e.TypeId() == APPLICATION_EXCEPTION_OVERLOADED
+	}
+	return false
+}
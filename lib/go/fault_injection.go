@@ -0,0 +1,327 @@
+package frugal
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FaultInjectionHeader is the request header which enables fault injection
+// for a request or message when set to "true", so only test traffic is
+// affected.
+const FaultInjectionHeader = "_fault_injection"
+
+var (
+	faultRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	faultRandMu sync.Mutex
+)
+
+// Fault describes the faults to inject into a method's requests or a topic's
+// messages. Each fault is injected independently with its probability,
+// between 0 and 1.
+type Fault struct {
+	// Latency is the delay added before the request or message is sent.
+	Latency            time.Duration
+	LatencyProbability float64
+
+	// Err is the error returned without invoking the method or sending the
+	// request or message, e.g. a TTransportException or
+	// TApplicationException.
+	Err            error
+	ErrProbability float64
+
+	// DropProbability is the probability the response is dropped after the
+	// request is processed, resulting in a TRANSPORT_EXCEPTION_TIMED_OUT
+	// error. Oneway requests and published messages are dropped without
+	// being sent.
+	DropProbability float64
+
+	// CorruptProbability is the probability a byte of the request or message
+	// is corrupted before it's sent. Only applies to FTransports and
+	// FPublisherTransports.
+	CorruptProbability float64
+}
+
+// FaultPolicy configures fault injection.
+type FaultPolicy struct {
+	// Faults are the faults by method name, as seen by ServiceMiddleware or
+	// in the request message for FTransports, or by topic for
+	// FPublisherTransports.
+	Faults map[string]Fault
+
+	// Default is the fault for methods and topics not in Faults, and for
+	// requests whose method an FTransport can't read, e.g. because the
+	// payload is compressed.
+	Default Fault
+
+	// IgnoreHeader injects faults into all requests and messages rather than
+	// only those with the FaultInjectionHeader set to "true".
+	IgnoreHeader bool
+}
+
+// fault returns the Fault for the method or topic.
+func (f FaultPolicy) fault(name string) Fault {
+	if fault, ok := f.Faults[name]; ok {
+		return fault
+	}
+	return f.Default
+}
+
+// enabled returns true if faults are injected into the request or message
+// with the given FaultInjectionHeader value.
+func (f FaultPolicy) enabled(header string) bool {
+	return f.IgnoreHeader || header == "true"
+}
+
+func (f FaultPolicy) enabledForContext(ctx FContext) bool {
+	header, _ := ctx.RequestHeader(FaultInjectionHeader)
+	return f.enabled(header)
+}
+
+// NewFaultInjectionMiddleware returns ServiceMiddleware which injects latency,
+// errors and dropped responses into method calls for chaos testing. Faults
+// are only injected into calls whose FContext has the FaultInjectionHeader
+// set to "true", unless the FaultPolicy ignores the header.
+func NewFaultInjectionMiddleware(policy FaultPolicy) ServiceMiddleware {
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			ctx := args.Context()
+			if !policy.enabledForContext(ctx) {
+				return next(service, method, args)
+			}
+			fault := policy.fault(method.Name)
+			if err := fault.delay(ctx); err != nil {
+				return ErrorResults(method, err)
+			}
+			if fault.Err != nil && chance(fault.ErrProbability) {
+				return ErrorResults(method, fault.Err)
+			}
+			results := next(service, method, args)
+			if chance(fault.DropProbability) {
+				return ErrorResults(method, droppedError())
+			}
+			return results
+		}
+	}
+}
+
+// delay sleeps for the fault's latency, if it's injected, returning an error
+// if the FContext's context.Context is done first.
+func (f Fault) delay(ctx FContext) error {
+	if f.Latency <= 0 || !chance(f.LatencyProbability) {
+		return nil
+	}
+	select {
+	case <-time.After(f.Latency):
+		return nil
+	case <-goContext(ctx).Done():
+		return contextError(ctx)
+	}
+}
+
+// corrupt returns a copy of the frame with a random byte after the frame
+// size changed, if it's injected, or the frame.
+func (f Fault) corrupt(frame []byte) []byte {
+	if len(frame) <= 4 || !chance(f.CorruptProbability) {
+		return frame
+	}
+	corrupted := make([]byte, len(frame))
+	copy(corrupted, frame)
+	faultRandMu.Lock()
+	i := 4 + faultRand.Intn(len(frame)-4)
+	corrupted[i] ^= byte(1 + faultRand.Intn(255))
+	faultRandMu.Unlock()
+	return corrupted
+}
+
+func droppedError() error {
+	return thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: fault injection dropped response")
+}
+
+// chance returns true with the given probability.
+func chance(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+	if probability >= 1 {
+		return true
+	}
+	faultRandMu.Lock()
+	defer faultRandMu.Unlock()
+	return faultRand.Float64() < probability
+}
+
+// faultInjectionTransport is an FTransport which injects faults into the
+// requests of the FTransport it wraps.
+type faultInjectionTransport struct {
+	FTransport
+	protoFactory *FProtocolFactory
+	policy       FaultPolicy
+}
+
+// NewFaultInjectionTransport returns an FTransport which wraps the given
+// FTransport and injects faults into requests by method for chaos testing,
+// e.g. to test timeout handling or servers' handling of corrupt frames. The
+// method of a request is read from its message with the given
+// FProtocolFactory, without the service name of multiplexed requests. Faults
+// are only injected into requests whose FContext has the
+// FaultInjectionHeader set to "true", unless the FaultPolicy ignores the
+// header.
+func NewFaultInjectionTransport(transport FTransport, protoFactory *FProtocolFactory, policy FaultPolicy) FTransport {
+	return &faultInjectionTransport{FTransport: transport, protoFactory: protoFactory, policy: policy}
+}
+
+// fault returns the Fault for the method of the request in the frame, or the
+// Default fault if the method can't be read.
+func (f *faultInjectionTransport) fault(frame []byte) Fault {
+	if len(f.policy.Faults) == 0 || len(frame) < 5 {
+		return f.policy.Default
+	}
+	// The headers are read from the buffer, leaving the serialized message.
+	buff := bytes.NewBuffer(frame[4:])
+	if _, err := readHeader(buff); err != nil {
+		return f.policy.Default
+	}
+	iprot := f.protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: buff})
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return f.policy.Default
+	}
+	if idx := strings.Index(name, multiplexedSeparator); idx >= 0 {
+		name = name[idx+len(multiplexedSeparator):]
+	}
+	return f.policy.fault(name)
+}
+
+// Oneway transmits the given data and doesn't wait for a response, injecting
+// faults.
+func (f *faultInjectionTransport) Oneway(ctx FContext, payload []byte) error {
+	if !f.policy.enabledForContext(ctx) {
+		return f.FTransport.Oneway(ctx, payload)
+	}
+	fault := f.fault(payload)
+	if err := fault.inject(ctx); err != nil {
+		return err
+	}
+	if chance(fault.DropProbability) {
+		return nil
+	}
+	return f.FTransport.Oneway(ctx, fault.corrupt(payload))
+}
+
+// Request transmits the given data and waits for a response, injecting
+// faults.
+func (f *faultInjectionTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	if !f.policy.enabledForContext(ctx) {
+		return f.FTransport.Request(ctx, payload)
+	}
+	fault := f.fault(payload)
+	if err := fault.inject(ctx); err != nil {
+		return nil, err
+	}
+	result, err := f.FTransport.Request(ctx, fault.corrupt(payload))
+	if err == nil && chance(fault.DropProbability) {
+		return nil, droppedError()
+	}
+	return result, err
+}
+
+// inject adds the fault's latency and returns its error, if they're
+// injected.
+func (f Fault) inject(ctx FContext) error {
+	if err := f.delay(ctx); err != nil {
+		return err
+	}
+	if f.Err != nil && chance(f.ErrProbability) {
+		return f.Err
+	}
+	return nil
+}
+
+// faultInjectionPublisherTransport is an FPublisherTransport which injects
+// faults into the messages published with the FPublisherTransport it wraps.
+type faultInjectionPublisherTransport struct {
+	FPublisherTransport
+	policy FaultPolicy
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+// NewFaultInjectionPublisherTransport returns an FPublisherTransport which
+// wraps the given FPublisherTransport and injects faults into messages by
+// topic for chaos testing. Faults are only injected into messages whose
+// FContext had the FaultInjectionHeader set to "true" when published, unless
+// the FaultPolicy ignores the header.
+func NewFaultInjectionPublisherTransport(transport FPublisherTransport, policy FaultPolicy) FPublisherTransport {
+	return &faultInjectionPublisherTransport{
+		FPublisherTransport: transport,
+		policy:              policy,
+		closed:              make(chan struct{}),
+	}
+}
+
+// Open opens the transport.
+func (f *faultInjectionPublisherTransport) Open() error {
+	if err := f.FPublisherTransport.Open(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+		f.closed = make(chan struct{})
+	default:
+	}
+	f.mu.Unlock()
+	return nil
+}
+
+// Close closes the transport, aborting messages whose injected latency
+// hasn't elapsed.
+func (f *faultInjectionPublisherTransport) Close() error {
+	f.mu.Lock()
+	select {
+	case <-f.closed:
+	default:
+		close(f.closed)
+	}
+	f.mu.Unlock()
+	return f.FPublisherTransport.Close()
+}
+
+// Publish sends the given payload with the transport, injecting faults.
+func (f *faultInjectionPublisherTransport) Publish(topic string, data []byte) error {
+	if !f.policy.IgnoreHeader {
+		if len(data) <= 4 {
+			return f.FPublisherTransport.Publish(topic, data)
+		}
+		header, err := getHeaderFromFrame(data[4:], FaultInjectionHeader)
+		if err != nil || !f.policy.enabled(header) {
+			return f.FPublisherTransport.Publish(topic, data)
+		}
+	}
+	fault := f.policy.fault(topic)
+	if fault.Latency > 0 && chance(fault.LatencyProbability) {
+		f.mu.Lock()
+		closed := f.closed
+		f.mu.Unlock()
+		select {
+		case <-time.After(fault.Latency):
+		case <-closed:
+			return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+				"frugal: publisher transport closed while delaying message")
+		}
+	}
+	if fault.Err != nil && chance(fault.ErrProbability) {
+		return fault.Err
+	}
+	if chance(fault.DropProbability) {
+		logger().Debugf("frugal: fault injection dropped message on topic %s", topic)
+		return nil
+	}
+	return f.FPublisherTransport.Publish(topic, fault.corrupt(data))
+}
@@ -0,0 +1,211 @@
+package frugal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// faultHandler counts the calls to its method.
+type faultHandler struct {
+	calls int
+}
+
+func (f *faultHandler) Get(ctx FContext) (string, error) {
+	f.calls++
+	return "ok", nil
+}
+
+// faultTransport is an FTransport which records the payloads it sends.
+type faultTransport struct {
+	FTransport
+	payloads [][]byte
+}
+
+func (f *faultTransport) Oneway(ctx FContext, payload []byte) error {
+	f.payloads = append(f.payloads, payload)
+	return nil
+}
+
+func (f *faultTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	f.payloads = append(f.payloads, payload)
+	return thrift.NewTMemoryBuffer(), nil
+}
+
+// faultPublisherTransport is an FPublisherTransport which records the
+// messages it publishes.
+type faultPublisherTransport struct {
+	FPublisherTransport
+	messages [][]byte
+}
+
+func (f *faultPublisherTransport) Open() error {
+	return nil
+}
+
+func (f *faultPublisherTransport) Close() error {
+	return nil
+}
+
+func (f *faultPublisherTransport) Publish(topic string, data []byte) error {
+	f.messages = append(f.messages, data)
+	return nil
+}
+
+func faultContext() FContext {
+	ctx := NewFContext("")
+	ctx.AddRequestHeader(FaultInjectionHeader, "true")
+	return ctx
+}
+
+// Ensures faults are only injected into calls with the fault injection
+// header unless the policy ignores it.
+func TestFaultInjectionMiddlewareHeader(t *testing.T) {
+	handler := &faultHandler{}
+	injected := errors.New("injected")
+	policy := FaultPolicy{Default: Fault{Err: injected, ErrProbability: 1}}
+	method := NewMethod(handler, handler.Get, "Get", []ServiceMiddleware{NewFaultInjectionMiddleware(policy)})
+
+	ret := method.Invoke([]interface{}{NewFContext("")})
+	assert.Nil(t, ret.Error())
+	assert.Equal(t, "ok", ret[0])
+
+	ret = method.Invoke([]interface{}{faultContext()})
+	assert.Equal(t, injected, ret.Error())
+	assert.Equal(t, "", ret[0])
+	assert.Equal(t, 1, handler.calls)
+
+	policy.IgnoreHeader = true
+	method = NewMethod(handler, handler.Get, "Get", []ServiceMiddleware{NewFaultInjectionMiddleware(policy)})
+	assert.Equal(t, injected, method.Invoke([]interface{}{NewFContext("")}).Error())
+	assert.Equal(t, 1, handler.calls)
+}
+
+// Ensures faults for a method take precedence over the default and dropped
+// responses time out after the method is invoked.
+func TestFaultInjectionMiddlewareMethodFaults(t *testing.T) {
+	handler := &faultHandler{}
+	policy := FaultPolicy{
+		Default: Fault{Err: errors.New("injected"), ErrProbability: 1},
+		Faults:  map[string]Fault{"Get": {DropProbability: 1}},
+	}
+	method := NewMethod(handler, handler.Get, "Get", []ServiceMiddleware{NewFaultInjectionMiddleware(policy)})
+
+	err := method.Invoke([]interface{}{faultContext()}).Error()
+	assert.Equal(t, TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+	assert.Equal(t, 1, handler.calls)
+}
+
+// Ensures injected latency delays the call.
+func TestFaultInjectionMiddlewareLatency(t *testing.T) {
+	handler := &faultHandler{}
+	policy := FaultPolicy{Default: Fault{Latency: 20 * time.Millisecond, LatencyProbability: 1}}
+	method := NewMethod(handler, handler.Get, "Get", []ServiceMiddleware{NewFaultInjectionMiddleware(policy)})
+
+	start := time.Now()
+	assert.Nil(t, method.Invoke([]interface{}{faultContext()}).Error())
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
+
+// Ensures the FTransport wrapper injects errors, drops and corrupt frames.
+func TestFaultInjectionTransport(t *testing.T) {
+	frame := []byte{0, 0, 0, 4, 1, 2, 3, 4}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	inner := &faultTransport{}
+	transport := NewFaultInjectionTransport(inner, protoFactory, FaultPolicy{Default: Fault{CorruptProbability: 1}})
+
+	_, err := transport.Request(NewFContext(""), frame)
+	assert.Nil(t, err)
+	assert.Equal(t, frame, inner.payloads[0])
+
+	_, err = transport.Request(faultContext(), frame)
+	assert.Nil(t, err)
+	corrupted := inner.payloads[1]
+	assert.Equal(t, frame[:4], corrupted[:4])
+	assert.False(t, bytes.Equal(frame, corrupted))
+	assert.Equal(t, []byte{0, 0, 0, 4, 1, 2, 3, 4}, frame)
+
+	inner = &faultTransport{}
+	transport = NewFaultInjectionTransport(inner, protoFactory, FaultPolicy{Default: Fault{DropProbability: 1}})
+	_, err = transport.Request(faultContext(), frame)
+	assert.Equal(t, TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+	assert.Len(t, inner.payloads, 1)
+	assert.Nil(t, transport.Oneway(faultContext(), frame))
+	assert.Len(t, inner.payloads, 1)
+
+	injected := thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "injected")
+	transport = NewFaultInjectionTransport(inner, protoFactory, FaultPolicy{Default: Fault{Err: injected, ErrProbability: 1}})
+	_, err = transport.Request(faultContext(), frame)
+	assert.Equal(t, injected, err)
+	assert.Len(t, inner.payloads, 1)
+}
+
+// Ensures the FTransport wrapper injects faults by the method of the request,
+// without the service name of multiplexed requests.
+func TestFaultInjectionTransportMethodFaults(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	injected := errors.New("injected")
+	inner := &faultTransport{}
+	frame := requestFrame(t, protoFactory, faultContext())
+
+	transport := NewFaultInjectionTransport(inner, protoFactory, FaultPolicy{
+		Faults: map[string]Fault{"ping": {Err: injected, ErrProbability: 1}},
+	})
+	_, err := transport.Request(faultContext(), frame)
+	assert.Equal(t, injected, err)
+	assert.Len(t, inner.payloads, 0)
+
+	transport = NewFaultInjectionTransport(inner, protoFactory, FaultPolicy{
+		Faults: map[string]Fault{"pong": {Err: injected, ErrProbability: 1}},
+	})
+	_, err = transport.Request(faultContext(), frame)
+	assert.Nil(t, err)
+	assert.Len(t, inner.payloads, 1)
+}
+
+// Ensures the FPublisherTransport wrapper injects faults by topic into
+// messages with the fault injection header.
+func TestFaultInjectionPublisherTransport(t *testing.T) {
+	injected := errors.New("injected")
+	inner := &faultPublisherTransport{}
+	transport := NewFaultInjectionPublisherTransport(inner, FaultPolicy{
+		Faults: map[string]Fault{"chaos": {Err: injected, ErrProbability: 1}},
+	})
+	faultFrame, err := addHeadersToFrame(completeFrugalFrame, map[string]string{FaultInjectionHeader: "true"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, transport.Publish("chaos", completeFrugalFrame))
+	assert.Nil(t, transport.Publish("calm", faultFrame))
+	assert.Equal(t, injected, transport.Publish("chaos", faultFrame))
+	assert.Len(t, inner.messages, 2)
+}
+
+// Ensures closing the FPublisherTransport wrapper aborts messages which are
+// being delayed.
+func TestFaultInjectionPublisherTransportCloseDuringLatency(t *testing.T) {
+	inner := &faultPublisherTransport{}
+	transport := NewFaultInjectionPublisherTransport(inner, FaultPolicy{
+		Default: Fault{Latency: time.Minute, LatencyProbability: 1},
+	})
+	faultFrame, err := addHeadersToFrame(completeFrugalFrame, map[string]string{FaultInjectionHeader: "true"})
+	assert.Nil(t, err)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- transport.Publish("chaos", faultFrame)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, transport.Close())
+
+	select {
+	case err := <-errC:
+		assert.Equal(t, TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	case <-time.After(time.Second):
+		t.Fatal("Publish wasn't aborted by Close")
+	}
+	assert.Len(t, inner.messages, 0)
+}
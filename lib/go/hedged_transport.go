@@ -0,0 +1,271 @@
+package frugal
+
+import (
+	"context"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// attemptContext is an FContext for one of several attempts of a request. It
+// shares the headers of the request's FContext but has its own
+// context.Context and timeout, so an attempt can be cancelled without
+// cancelling the request.
+type attemptContext struct {
+	FContext
+	goCtx   context.Context
+	timeout time.Duration
+}
+
+// Context returns the attempt's context.Context.
+func (a *attemptContext) Context() context.Context {
+	return a.goCtx
+}
+
+// Timeout returns the attempt's timeout.
+func (a *attemptContext) Timeout() time.Duration {
+	return a.timeout
+}
+
+// fPairedTransport implements the FTransport lifecycle for a primary
+// FTransport and a secondary FTransport which is only used for additional
+// requests. Failures of the secondary FTransport don't affect the primary.
+// The secondary FTransport may be the primary.
+type fPairedTransport struct {
+	primary   FTransport
+	secondary FTransport
+}
+
+// SetMonitor starts a monitor that can watch the health of, and reopen, the
+// primary transport.
+func (f *fPairedTransport) SetMonitor(monitor FTransportMonitor) {
+	f.primary.SetMonitor(monitor)
+}
+
+// Closed channel receives the cause of a close of the primary transport (nil
+// if clean close).
+func (f *fPairedTransport) Closed() <-chan error {
+	return f.primary.Closed()
+}
+
+// Open opens the primary and secondary transports. Only an error opening the
+// primary transport is returned.
+func (f *fPairedTransport) Open() error {
+	if err := f.primary.Open(); err != nil {
+		return err
+	}
+	if f.secondary == f.primary {
+		return nil
+	}
+	if err := f.secondary.Open(); err != nil && !isAlreadyOpen(err) {
+		logger().Warnf("frugal: error opening secondary transport: %s", err)
+	}
+	return nil
+}
+
+// IsOpen returns true if the primary transport is open, false otherwise.
+func (f *fPairedTransport) IsOpen() bool {
+	return f.primary.IsOpen()
+}
+
+// Close closes the primary and secondary transports. Only an error closing
+// the primary transport is returned.
+func (f *fPairedTransport) Close() error {
+	if f.secondary != f.primary && f.secondary.IsOpen() {
+		if err := f.secondary.Close(); err != nil {
+			logger().Warnf("frugal: error closing secondary transport: %s", err)
+		}
+	}
+	return f.primary.Close()
+}
+
+// GetRequestSizeLimit returns the smaller request size limit of the
+// transports. Returns a non-positive number to indicate an unbounded
+// allowable size.
+func (f *fPairedTransport) GetRequestSizeLimit() uint {
+	limit := f.primary.GetRequestSizeLimit()
+	if l := f.secondary.GetRequestSizeLimit(); l > 0 && (limit == 0 || l < limit) {
+		limit = l
+	}
+	return limit
+}
+
+// fHedgedTransport is an FTransport which hedges requests with a second
+// FTransport.
+type fHedgedTransport struct {
+	fPairedTransport
+	delay time.Duration
+}
+
+// NewHedgedTransport returns an FTransport which sends requests to the
+// primary FTransport and, if no response arrives within the given delay,
+// sends a duplicate to the hedge FTransport, e.g. another instance of the
+// service. The first successful response is returned and the other attempt
+// is cancelled, removing its registration. Both attempts share the FContext
+// timeout. The hedge is sent with its own operation id, so the hedge
+// FTransport may be the primary FTransport, e.g. a load-balanced FTransport.
+//
+// Since a request may be processed twice, only use this for idempotent
+// requests, such as reads. Oneway requests are not hedged.
+func NewHedgedTransport(primary, hedge FTransport, delay time.Duration) FTransport {
+	return &fHedgedTransport{
+		fPairedTransport: fPairedTransport{primary: primary, secondary: hedge},
+		delay:            delay,
+	}
+}
+
+// Oneway transmits the given data with the primary transport and doesn't
+// wait for a response.
+func (f *fHedgedTransport) Oneway(ctx FContext, payload []byte) error {
+	return f.primary.Oneway(ctx, payload)
+}
+
+// hedgeReply is the result of an attempt of a hedged request.
+type hedgeReply struct {
+	result thrift.TTransport
+	err    error
+	hedge  bool
+}
+
+// Request transmits the given data with the primary transport, hedging it
+// with the hedge transport after the delay, and returns the first successful
+// response.
+func (f *fHedgedTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	goCtx, cancel := context.WithCancel(goContext(ctx))
+	// Cancelling the attempt which lost causes its transport to return and
+	// unregister it.
+	defer cancel()
+
+	// The attempts may outlive the request, and the caller may reuse the
+	// payload once it returns.
+	payload = append([]byte(nil), payload...)
+	replies := make(chan hedgeReply, 2)
+	send := func(transport FTransport, attemptCtx FContext, payload []byte, hedge bool) {
+		result, err := transport.Request(attemptCtx, payload)
+		replies <- hedgeReply{result: result, err: err, hedge: hedge}
+	}
+
+	start := time.Now()
+	go send(f.primary, &attemptContext{FContext: ctx, goCtx: goCtx, timeout: ctx.Timeout()}, payload, false)
+	timer := time.NewTimer(f.delay)
+	defer timer.Stop()
+
+	pending := 1
+	var hedgeCtx FContext
+	for {
+		select {
+		case <-timer.C:
+			remaining := ctx.Timeout() - time.Since(start)
+			if remaining <= 0 {
+				continue
+			}
+			var hedgePayload []byte
+			var err error
+			hedgeCtx, hedgePayload, err = hedgeRequest(WithContext(ctx, goCtx), payload, remaining)
+			if err != nil {
+				logger().Warnf("frugal: can't hedge request with correlation id %s: %s", ctx.CorrelationID(), err)
+				continue
+			}
+			logger().Debugf("frugal: hedging request with correlation id %s", ctx.CorrelationID())
+			go send(f.secondary, hedgeCtx, hedgePayload, true)
+			pending++
+		case reply := <-replies:
+			pending--
+			if reply.err == nil {
+				if reply.hedge {
+					logger().Debugf("frugal: hedged request with correlation id %s won", ctx.CorrelationID())
+					copyResponseHeaders(ctx, hedgeCtx)
+				}
+				return reply.result, nil
+			}
+			// An attempt which fails before the hedge is sent isn't
+			// hedged, failed requests are retried by the retry
+			// middleware.
+			if pending == 0 {
+				return nil, reply.err
+			}
+		}
+	}
+}
+
+// hedgeRequest returns a copy of the FContext with a new operation id and the
+// given timeout, and a copy of the payload with its headers, for the hedge of
+// a request. The hedge is registered separately from the primary attempt if
+// both are sent with the same FTransport.
+func hedgeRequest(ctx FContext, payload []byte, timeout time.Duration) (FContext, []byte, error) {
+	hedgeCtx := copyFContext(ctx)
+	hedgeCtx.SetTimeout(timeout)
+	opID, _ := hedgeCtx.RequestHeader(opIDHeader)
+	timeoutMillis, _ := hedgeCtx.RequestHeader(timeoutHeader)
+	hedgePayload, err := addHeadersToFrame(payload, map[string]string{
+		opIDHeader:    opID,
+		timeoutHeader: timeoutMillis,
+	})
+	return hedgeCtx, hedgePayload, err
+}
+
+// fMirroredTransport is an FTransport which mirrors requests to a shadow
+// FTransport.
+type fMirroredTransport struct {
+	fPairedTransport
+	fraction float64
+}
+
+// NewMirroredTransport returns an FTransport which sends requests to the
+// primary FTransport and mirrors the given fraction of them, between 0 and
+// 1, to the shadow FTransport, e.g. a new version of the service. Responses
+// and errors from the shadow FTransport are discarded and don't delay the
+// primary request, allowing the shadow service to be validated under real
+// load. Mirrored requests have the FContext timeout but aren't cancelled
+// with it.
+func NewMirroredTransport(primary, shadow FTransport, fraction float64) FTransport {
+	return &fMirroredTransport{
+		fPairedTransport: fPairedTransport{primary: primary, secondary: shadow},
+		fraction:         fraction,
+	}
+}
+
+// Oneway transmits the given data with the primary transport, mirroring it
+// to the shadow transport, and doesn't wait for a response.
+func (f *fMirroredTransport) Oneway(ctx FContext, payload []byte) error {
+	if f.mirror() {
+		shadowCtx, shadowPayload, cancel := f.shadowRequest(ctx, payload)
+		go func() {
+			defer cancel()
+			if err := f.secondary.Oneway(shadowCtx, shadowPayload); err != nil {
+				logger().Debugf("frugal: mirrored oneway request failed: %s", err)
+			}
+		}()
+	}
+	return f.primary.Oneway(ctx, payload)
+}
+
+// Request transmits the given data with the primary transport, mirroring it
+// to the shadow transport, and waits for the primary response.
+func (f *fMirroredTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	if f.mirror() {
+		shadowCtx, shadowPayload, cancel := f.shadowRequest(ctx, payload)
+		go func() {
+			defer cancel()
+			if _, err := f.secondary.Request(shadowCtx, shadowPayload); err != nil {
+				logger().Debugf("frugal: mirrored request failed: %s", err)
+			}
+		}()
+	}
+	return f.primary.Request(ctx, payload)
+}
+
+// mirror returns true if a request should be mirrored.
+func (f *fMirroredTransport) mirror() bool {
+	return f.secondary.IsOpen() && chance(f.fraction)
+}
+
+// shadowRequest returns the FContext, a copy of the payload and the
+// cancel function of the FContext for a mirrored request. The FContext's
+// context.Context is detached from the request's so the mirrored request
+// isn't cancelled when the primary request returns.
+func (f *fMirroredTransport) shadowRequest(ctx FContext, payload []byte) (FContext, []byte, context.CancelFunc) {
+	goCtx, cancel := context.WithTimeout(context.Background(), ctx.Timeout())
+	shadowCtx := &attemptContext{FContext: ctx, goCtx: goCtx, timeout: ctx.Timeout()}
+	return shadowCtx, append([]byte(nil), payload...), cancel
+}
@@ -0,0 +1,144 @@
+package frugal
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures a slow request is hedged and the losing attempt is cancelled.
+func TestHedgedTransportHedges(t *testing.T) {
+	primary, hedge := newLBEndpoint("a"), newLBEndpoint("b")
+	primary.block = make(chan struct{})
+	tr := NewHedgedTransport(primary, hedge, 10*time.Millisecond)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	assert.Equal(t, "b", lbRequest(t, tr, ctx))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primary.canceled))
+	assert.Nil(t, goContext(ctx).Err())
+}
+
+// hedgeRegistryTransport registers requests like FTransports do, records
+// their operation ids, and blocks the first request until it's cancelled.
+type hedgeRegistryTransport struct {
+	*lbEndpoint
+	registry fRegistry
+	mu       sync.Mutex
+	opIDs    []string
+}
+
+func (h *hedgeRegistryTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	if err := h.registry.Register(ctx, make(chan []byte, 1)); err != nil {
+		return nil, err
+	}
+	defer h.registry.Unregister(ctx)
+	opID, err := getHeaderFromFrame(payload[4:], opIDHeader)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	h.opIDs = append(h.opIDs, opID)
+	first := len(h.opIDs) == 1
+	h.mu.Unlock()
+	if first {
+		<-goContext(ctx).Done()
+		return nil, contextError(ctx)
+	}
+	ctx.AddResponseHeader("foo", "bar")
+	return h.lbEndpoint.Request(ctx, payload)
+}
+
+// Ensures requests can be hedged with the primary transport, since the hedge
+// has its own operation id, and the hedge's response headers are copied to
+// the FContext.
+func TestHedgedTransportSameTransport(t *testing.T) {
+	endpoint := &hedgeRegistryTransport{lbEndpoint: newLBEndpoint("a"), registry: newFRegistry()}
+	tr := NewHedgedTransport(endpoint, endpoint, 10*time.Millisecond)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	assert.Equal(t, "a", lbRequest(t, tr, ctx))
+	endpoint.mu.Lock()
+	assert.Equal(t, 2, len(endpoint.opIDs))
+	assert.Equal(t, opID, endpoint.opIDs[0])
+	assert.NotEqual(t, opID, endpoint.opIDs[1])
+	endpoint.mu.Unlock()
+	requestOpID, _ := ctx.RequestHeader(opIDHeader)
+	assert.Equal(t, opID, requestOpID)
+	foo, _ := ctx.ResponseHeader("foo")
+	assert.Equal(t, "bar", foo)
+}
+
+// Ensures fast requests are not hedged.
+func TestHedgedTransportFast(t *testing.T) {
+	primary, hedge := newLBEndpoint("a"), newLBEndpoint("b")
+	tr := NewHedgedTransport(primary, hedge, 50*time.Millisecond)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	assert.Equal(t, "a", lbRequest(t, tr, NewFContext("")))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hedge.requests))
+}
+
+// Ensures the request fails only if every attempt fails, and an attempt
+// which fails before the delay is not hedged.
+func TestHedgedTransportErrors(t *testing.T) {
+	primary, hedge := newLBEndpoint("a"), newLBEndpoint("b")
+	tr := NewHedgedTransport(primary, hedge, 10*time.Millisecond)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	primaryErr := thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, "primary")
+	primary.setErr(primaryErr)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ctx := NewFContext("")
+	_, err := tr.Request(ctx, requestFrame(t, protoFactory, ctx))
+	assert.Equal(t, primaryErr, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&hedge.requests))
+
+	// The hedge fails while the primary is slow.
+	primary.setErr(nil)
+	primary.block = make(chan struct{})
+	hedge.setErr(errors.New("hedge"))
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		close(primary.block)
+	}()
+	assert.Equal(t, "a", lbRequest(t, tr, NewFContext("")))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hedge.requests))
+}
+
+// Ensures requests are mirrored to the shadow transport without affecting
+// the primary request.
+func TestMirroredTransport(t *testing.T) {
+	primary, shadow := newLBEndpoint("a"), newLBEndpoint("b")
+	shadow.setErr(errors.New("shadow"))
+	shadow.block = make(chan struct{})
+	tr := NewMirroredTransport(primary, shadow, 1)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	assert.Equal(t, "a", lbRequest(t, tr, NewFContext("")))
+	assert.Nil(t, tr.Oneway(NewFContext(""), []byte{0, 0, 0, 1, 0}))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&shadow.requests))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&shadow.canceled))
+	close(shadow.block)
+
+	none := newLBEndpoint("c")
+	tr = NewMirroredTransport(primary, none, 0)
+	assert.Nil(t, none.Open())
+	assert.Equal(t, "a", lbRequest(t, tr, NewFContext("")))
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&none.requests))
+}
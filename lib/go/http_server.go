@@ -0,0 +1,72 @@
+package frugal
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// FHTTPServer is an FServer which serves an FProcessor over HTTP using the
+// handler created by NewFrugalHandlerFunc. It tracks the requests being
+// processed so they can be drained on Shutdown.
+type FHTTPServer struct {
+	server          *http.Server
+	processor       FProcessor
+	protocolFactory *FProtocolFactory
+	handler         http.HandlerFunc
+	inFlight        int32
+}
+
+// NewFHTTPServer creates a new FHTTPServer which serves the FProcessor on the
+// given http.Server. The http.Server's Handler is replaced with the Frugal
+// handler, all other settings, such as the address, are left as configured.
+func NewFHTTPServer(server *http.Server, processor FProcessor,
+	protocolFactory *FProtocolFactory) *FHTTPServer {
+	f := &FHTTPServer{
+		server:          server,
+		processor:       processor,
+		protocolFactory: protocolFactory,
+		handler:         NewFrugalHandlerFunc(processor, protocolFactory),
+	}
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.inFlight, 1)
+		defer atomic.AddInt32(&f.inFlight, -1)
+		f.handler(w, r)
+	})
+	return f
+}
+
+// WithMaxRequestSize sets the maximum size of request frames, larger requests
+// are rejected with a 413 response. If set to 0, there is no size limit on
+// requests. The default is 16MB. This must be called before Serve.
+func (f *FHTTPServer) WithMaxRequestSize(maxRequestSize uint) *FHTTPServer {
+	f.handler = NewFrugalHandlerFuncWithMaxRequestSize(f.processor, f.protocolFactory, maxRequestSize)
+	return f
+}
+
+// Serve starts the server.
+func (f *FHTTPServer) Serve() error {
+	if err := f.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop the server. Requests which are being processed are abandoned.
+func (f *FHTTPServer) Stop() error {
+	return f.server.Close()
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections, closes
+// idle connections, and waits for the requests being processed to finish
+// until the context is done. If the context is done first, the server is
+// stopped and the number of requests which were abandoned is returned along
+// with the context's error.
+func (f *FHTTPServer) Shutdown(ctx context.Context) (int, error) {
+	if err := f.server.Shutdown(ctx); err != nil {
+		abandoned := int(atomic.LoadInt32(&f.inFlight))
+		f.server.Close()
+		return abandoned, err
+	}
+	return 0, nil
+}
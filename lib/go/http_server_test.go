@@ -0,0 +1,96 @@
+package frugal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// startHTTPServer starts an FHTTPServer with the given FProcessor on a random
+// port and returns it along with its URL.
+func startHTTPServer(t *testing.T, processor FProcessor) (*FHTTPServer, string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFHTTPServer(&http.Server{}, processor, protoFactory)
+	go server.server.Serve(listener)
+	return server, "http://" + listener.Addr().String()
+}
+
+// Ensures FHTTPServer serves requests and Shutdown waits for the request
+// being processed to finish.
+func TestFHTTPServerShutdown(t *testing.T) {
+	processor := &slowProcessor{delay: 50 * time.Millisecond}
+	server, url := startHTTPServer(t, processor)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFHTTPTransportBuilder(&http.Client{}, url).Build()
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+
+	resultC := make(chan thrift.TTransport, 1)
+	ctx := NewFContext("")
+	go func() {
+		result, err := transport.Request(ctx, requestFrame(t, protoFactory, ctx))
+		assert.Nil(t, err)
+		resultC <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := server.Shutdown(shutdownCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+
+	resultProto := protoFactory.GetProtocol(<-resultC)
+	assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+	result, err := resultProto.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", result)
+}
+
+// Ensures Shutdown stops the FHTTPServer and reports the abandoned requests
+// when the context is done before the requests are processed.
+func TestFHTTPServerShutdownAbandoned(t *testing.T) {
+	processor := &slowProcessor{delay: 100 * time.Millisecond}
+	server, url := startHTTPServer(t, processor)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFHTTPTransportBuilder(&http.Client{}, url).Build()
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+
+	ctx := NewFContext("")
+	go transport.Request(ctx, requestFrame(t, protoFactory, ctx))
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	abandoned, err := server.Shutdown(shutdownCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, abandoned)
+}
+
+// Ensures Serve returns nil once the FHTTPServer is stopped.
+func TestFHTTPServerServeStop(t *testing.T) {
+	server := NewFHTTPServer(&http.Server{Addr: "localhost:0"}, &slowProcessor{}, nil)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Nil(t, server.Stop())
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to return")
+	}
+}
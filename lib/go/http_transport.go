@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,12 +18,24 @@ import (
 
 const (
 	payloadLimitHeader            = "x-frugal-payload-limit"
+	tooLargeHeader                = "x-frugal-too-large"
 	acceptHeader                  = "accept"
 	contentTypeHeader             = "content-type"
 	contentTransferEncodingHeader = "content-transfer-encoding"
 
 	frugalContentType = "application/x-frugal"
 	base64Encoding    = "base64"
+	binaryEncoding    = "binary"
+
+	// binaryContentType is accepted by clients which can read raw binary
+	// responses.
+	binaryContentType = frugalContentType + "; encoding=" + binaryEncoding
+
+	// tooLargeRequest and tooLargeResponse are the values of the too large
+	// header of a 413 response, which tell clients whether the request or
+	// the response exceeded its limit.
+	tooLargeRequest  = "request"
+	tooLargeResponse = "response"
 )
 
 var newEncoder = func(buf *bytes.Buffer) io.WriteCloser {
@@ -30,8 +43,22 @@ var newEncoder = func(buf *bytes.Buffer) io.WriteCloser {
 }
 
 // NewFrugalHandlerFunc is a function that creates a ready to use Frugal handler
-// function.
+// function. Requests larger than 16MB are rejected.
 func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactory) http.HandlerFunc {
+	return NewFrugalHandlerFuncWithMaxRequestSize(processor, protocolFactory, defaultMaxLength)
+}
+
+// NewFrugalHandlerFuncWithMaxRequestSize creates a ready to use Frugal handler
+// function which rejects requests whose frame is larger than the given number
+// of bytes with a 413 response. If set to 0, there is no size limit on
+// requests.
+//
+// Request bodies are base64 encoded unless the request's
+// content-transfer-encoding is binary. Responses are base64 encoded unless the
+// request accepts application/x-frugal; encoding=binary, in which case they're
+// sent as raw binary with a content-transfer-encoding of binary.
+func NewFrugalHandlerFuncWithMaxRequestSize(processor FProcessor,
+	protocolFactory *FProtocolFactory, maxRequestSize uint) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add(contentTypeHeader, frugalContentType)
@@ -58,23 +85,47 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 		}
 
 		// Create a decoder based on the payload
-		decoder := base64.NewDecoder(base64.StdEncoding, r.Body)
+		binaryRequest := isBinaryEncoded(r.Header)
+		var decoder io.Reader
+		if binaryRequest {
+			decoder = r.Body
+		} else {
+			decoder = base64.NewDecoder(base64.StdEncoding, r.Body)
+		}
+
+		// Reject requests which are too large before reading them
+		if maxRequestSize > 0 && r.ContentLength > maxEncodedRequestSize(maxRequestSize, binaryRequest) {
+			w.Header().Set(tooLargeHeader, tooLargeRequest)
+			http.Error(w,
+				fmt.Sprintf("Request size (%d) larger than maximum size (%d)", r.ContentLength, maxRequestSize),
+				http.StatusRequestEntityTooLarge,
+			)
+			return
+		}
 
 		// Read out the frame size
-		// TODO: should we do something with the frame size?
-		frameSize := make([]byte, 4)
-		if _, err := io.ReadFull(decoder, frameSize); err != nil {
+		frameSizeBytes := make([]byte, 4)
+		if _, err := io.ReadFull(decoder, frameSizeBytes); err != nil {
 			http.Error(w,
 				fmt.Sprintf("Could not read the frugal frame bytes %s", err),
 				http.StatusBadRequest,
 			)
 			return
 		}
+		frameSize := binary.BigEndian.Uint32(frameSizeBytes)
+		if maxRequestSize > 0 && uint64(frameSize) > uint64(maxRequestSize) {
+			w.Header().Set(tooLargeHeader, tooLargeRequest)
+			http.Error(w,
+				fmt.Sprintf("Request size (%d) larger than maximum size (%d)", frameSize, maxRequestSize),
+				http.StatusRequestEntityTooLarge,
+			)
+			return
+		}
 
-		// Read and process frame
-		input := thrift.NewStreamTransportR(decoder)
-		outBuf := new(bytes.Buffer)
-		output := &thrift.TMemoryBuffer{Buffer: outBuf}
+		// Read and process frame, which can't be read past its frame size
+		input := thrift.NewStreamTransportR(io.LimitReader(decoder, int64(frameSize)))
+		output := NewTMemoryOutputBuffer(0)
+		defer output.Release()
 		iprot := protocolFactory.GetProtocol(input)
 		oprot := protocolFactory.GetProtocol(output)
 		if err := processor.Process(iprot, oprot); err != nil {
@@ -86,25 +137,30 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 		}
 
 		// If client requested a limit, check the buffer size
-		if limit > 0 && outBuf.Len() > int(limit) {
+		if responseSize := output.Len() - 4; limit > 0 && responseSize > int(limit) {
+			w.Header().Set(tooLargeHeader, tooLargeResponse)
 			http.Error(w,
-				fmt.Sprintf("Response size (%d) larger than requested size (%d)", outBuf.Len(), limit),
+				fmt.Sprintf("Response size (%d) larger than requested size (%d)", responseSize, limit),
 				http.StatusRequestEntityTooLarge,
 			)
 			return
 		}
 
-		// Encode response
+		// Respond with the raw frame if the client accepts it
+		if acceptsBinary(r.Header) {
+			w.Header().Add(contentTransferEncodingHeader, binaryEncoding)
+			w.Write(output.Bytes())
+			return
+		}
+
+		// Encode response, which is already framed
 		var (
-			encoded = new(bytes.Buffer)
+			encoded = acquireBuffer()
 			encoder = newEncoder(encoded)
 			err     error
 		)
-		binary.BigEndian.PutUint32(frameSize, uint32(outBuf.Len()))
-		if _, e := encoder.Write(frameSize); e != nil {
-			err = e
-		}
-		if _, e := encoder.Write(outBuf.Bytes()); e != nil {
+		defer releaseBuffer(encoded)
+		if _, e := encoder.Write(output.Bytes()); e != nil {
 			err = e
 		}
 		if e := encoder.Close(); e != nil {
@@ -125,12 +181,48 @@ func NewFrugalHandlerFunc(processor FProcessor, protocolFactory *FProtocolFactor
 	}
 }
 
+// maxEncodedRequestSize returns the maximum length of a request body whose
+// frame is at most the given number of bytes, including the frame size.
+func maxEncodedRequestSize(maxRequestSize uint, binary bool) int64 {
+	size := int64(maxRequestSize) + 4
+	if binary {
+		return size
+	}
+	return int64(base64.StdEncoding.EncodedLen(int(size)))
+}
+
+// isBinaryEncoded returns true if the body with the given headers is raw
+// binary rather than base64 encoded. Bodies without a
+// content-transfer-encoding are base64 encoded for compatibility with older
+// clients and servers.
+func isBinaryEncoded(header http.Header) bool {
+	return strings.EqualFold(header.Get(contentTransferEncodingHeader), binaryEncoding)
+}
+
+// acceptsBinary returns true if the request with the given headers accepts a
+// raw binary response.
+func acceptsBinary(header http.Header) bool {
+	for _, accept := range header[http.CanonicalHeaderKey(acceptHeader)] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			if mediaType == frugalContentType && strings.EqualFold(params["encoding"], binaryEncoding) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // FHTTPTransportBuilder configures and builds HTTP FTransport instances.
 type FHTTPTransportBuilder struct {
 	client            *http.Client
 	url               string
 	requestSizeLimit  uint
 	responseSizeLimit uint
+	binaryRequests    bool
 }
 
 // NewFHTTPTransportBuilder creates a builder which configures and builds HTTP
@@ -156,6 +248,16 @@ func (h *FHTTPTransportBuilder) WithResponseSizeLimit(responseSizeLimit uint) *F
 	return h
 }
 
+// WithBinaryEncoding sends requests as raw binary rather than base64 encoded,
+// avoiding the cost of encoding them. The server must support binary
+// requests, such as the handler created by NewFrugalHandlerFunc. Responses
+// are read as raw binary whenever the server sends them, regardless of this
+// setting.
+func (h *FHTTPTransportBuilder) WithBinaryEncoding() *FHTTPTransportBuilder {
+	h.binaryRequests = true
+	return h
+}
+
 // Build a new configured HTTP FTransport.
 func (h *FHTTPTransportBuilder) Build() FTransport {
 	return &fHTTPTransport{
@@ -163,6 +265,7 @@ func (h *FHTTPTransportBuilder) Build() FTransport {
 		client:            h.client,
 		url:               h.url,
 		responseSizeLimit: h.responseSizeLimit,
+		binaryRequests:    h.binaryRequests,
 	}
 }
 
@@ -176,6 +279,7 @@ type fHTTPTransport struct {
 	client            *http.Client
 	url               string
 	responseSizeLimit uint
+	binaryRequests    bool
 	isOpen            bool
 }
 
@@ -226,6 +330,9 @@ func (h *fHTTPTransport) Request(ctx FContext, data []byte) (thrift.TTransport,
 	// Make the HTTP request
 	response, err := h.makeRequest(ctx, data)
 	if err != nil {
+		if goContext(ctx).Err() != nil {
+			return nil, contextError(ctx)
+		}
 		if strings.HasSuffix(err.Error(), "net/http: request canceled") ||
 			strings.HasSuffix(err.Error(), "net/http: timeout awaiting response headers") ||
 			strings.HasSuffix(err.Error(), "net/http: request canceled while waiting for connection") {
@@ -267,17 +374,27 @@ func (h *fHTTPTransport) SetMonitor(monitor FTransportMonitor) {
 
 func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]byte, error) {
 	// Encode request payload
-	encoded := new(bytes.Buffer)
-	encoder := newEncoder(encoded)
-	if _, err := encoder.Write(requestPayload); err != nil {
-		return nil, err
-	}
-	if err := encoder.Close(); err != nil {
-		return nil, err
+	var (
+		encoded  io.Reader
+		encoding = base64Encoding
+	)
+	if h.binaryRequests {
+		encoded = bytes.NewReader(requestPayload)
+		encoding = binaryEncoding
+	} else {
+		buf := new(bytes.Buffer)
+		encoder := newEncoder(buf)
+		if _, err := encoder.Write(requestPayload); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+		encoded = buf
 	}
 
 	// Initialize request
-	ctx, cancel := context.WithTimeout(context.Background(), fCtx.Timeout())
+	ctx, cancel := context.WithTimeout(goContext(fCtx), fCtx.Timeout())
 	defer cancel()
 	request, err := http.NewRequest("POST", h.url, encoded)
 	if err != nil {
@@ -288,7 +405,8 @@ func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]by
 	// Add request headers
 	request.Header.Add(contentTypeHeader, frugalContentType)
 	request.Header.Add(acceptHeader, frugalContentType)
-	request.Header.Add(contentTransferEncodingHeader, base64Encoding)
+	request.Header.Add(acceptHeader, binaryContentType)
+	request.Header.Add(contentTransferEncodingHeader, encoding)
 	if h.responseSizeLimit > 0 {
 		request.Header.Add(payloadLimitHeader, strconv.FormatUint(uint64(h.responseSizeLimit), 10))
 	}
@@ -299,8 +417,14 @@ func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]by
 		return nil, err
 	}
 
-	// Response too large
+	// Request or response too large. Servers which don't say which was too
+	// large only reject responses.
 	if response.StatusCode == http.StatusRequestEntityTooLarge {
+		response.Body.Close()
+		if response.Header.Get(tooLargeHeader) == tooLargeRequest {
+			return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+				"request was too large for the server")
+		}
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_RESPONSE_TOO_LARGE,
 			"response was too large for the transport")
 	}
@@ -313,17 +437,19 @@ func (h *fHTTPTransport) makeRequest(fCtx FContext, requestPayload []byte) ([]by
 	if err := response.Body.Close(); err != nil {
 		return nil, err
 	}
-	body := string(buf.Bytes())
 
 	// Check bad status code
 	if response.StatusCode >= 300 {
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
 			fmt.Sprintf("response errored with code %d and message %s",
-				response.StatusCode, body))
+				response.StatusCode, buf.String()))
 	}
 
 	// Decode and return response body
-	bts, err := base64.StdEncoding.DecodeString(body)
+	if isBinaryEncoded(response.Header) {
+		return buf.Bytes(), nil
+	}
+	bts, err := base64.StdEncoding.DecodeString(buf.String())
 	if err != nil {
 		return nil, err
 	}
@@ -2,6 +2,7 @@ package frugal
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -183,6 +184,7 @@ func TestFrugalHandlerFuncTooLargeError(t *testing.T) {
 		"Response size (10) larger than requested size (5)\n",
 		string(w.Body.Bytes()),
 	)
+	assert.Equal(tooLargeResponse, w.Header().Get(tooLargeHeader))
 }
 
 // Ensures that base64 encoding errors are handled and routed back in the http
@@ -281,6 +283,70 @@ func TestFrugalHandlerFunc(t *testing.T) {
 
 }
 
+// Ensures that a raw binary request is processed and a raw binary response is
+// returned when the client accepts it.
+func TestFrugalHandlerFuncBinary(t *testing.T) {
+	assert := assert.New(t)
+	w := httptest.NewRecorder()
+
+	expectedBody := []byte{4, 5, 6, 7, 8}
+	framedBody := append([]byte{0, 0, 0, 5}, expectedBody...)
+	r, err := http.NewRequest("POST", "fooUrl", bytes.NewReader(framedBody))
+	assert.Nil(err)
+	r.Header.Add(contentTransferEncodingHeader, binaryEncoding)
+	r.Header.Add(acceptHeader, frugalContentType+", "+binaryContentType)
+
+	response := []byte{9, 10, 11, 12}
+	mockProcessor := &mockFProcessorForHTTP{expectedPayload: expectedBody, response: response}
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(mockProcessor, protocolFactory)
+
+	handler(w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(frugalContentType, w.Header().Get(contentTypeHeader))
+	assert.Equal(binaryEncoding, w.Header().Get(contentTransferEncodingHeader))
+	assert.Equal(append([]byte{0, 0, 0, 4}, response...), w.Body.Bytes())
+}
+
+// Ensures that requests larger than the maximum request size are rejected
+// with a RequestEntityTooLarge error.
+func TestFrugalHandlerFuncMaxRequestSize(t *testing.T) {
+	assert := assert.New(t)
+	mockProcessor := &mockFProcessorForHTTP{}
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFuncWithMaxRequestSize(mockProcessor, protocolFactory, 10)
+
+	// The frame size is larger than the maximum.
+	w := httptest.NewRecorder()
+	encodedBody := base64.StdEncoding.EncodeToString([]byte{0, 0, 0, 11, 1})
+	r, err := http.NewRequest("POST", "fooUrl", strings.NewReader(encodedBody))
+	assert.Nil(err)
+	handler(w, r)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal("Request size (11) larger than maximum size (10)\n", string(w.Body.Bytes()))
+
+	// The body is larger than the maximum.
+	w = httptest.NewRecorder()
+	r, err = http.NewRequest("POST", "fooUrl", bytes.NewReader(make([]byte, 15)))
+	assert.Nil(err)
+	r.Header.Add(contentTransferEncodingHeader, binaryEncoding)
+	handler(w, r)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal("Request size (15) larger than maximum size (10)\n", string(w.Body.Bytes()))
+	assert.Equal(tooLargeRequest, w.Header().Get(tooLargeHeader))
+
+	// The frame is read no further than its frame size.
+	w = httptest.NewRecorder()
+	mockProcessor.expectedPayload = []byte{1, 2, 3}
+	r, err = http.NewRequest("POST", "fooUrl", bytes.NewReader([]byte{0, 0, 0, 2, 1, 2, 3}))
+	assert.Nil(err)
+	r.Header.Add(contentTransferEncodingHeader, binaryEncoding)
+	handler(w, r)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Equal(fmt.Sprintf("Error processing request: %s\n", io.EOF), string(w.Body.Bytes()))
+}
+
 // Ensures the transport opens, writes, flushes, excecutes, and closes as
 // expected
 func TestHTTPTransportLifecycle(t *testing.T) {
@@ -453,6 +519,24 @@ func TestHTTPTransportRequestTooLarge(t *testing.T) {
 	assert.Nil(transport.Close())
 }
 
+// Ensures the transport returns a Request Too Large error when the server
+// rejects the request as too large.
+func TestHTTPTransportServerRequestTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	mockProcessor := &mockFProcessorForHTTP{}
+	protocolFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ts := httptest.NewServer(NewFrugalHandlerFuncWithMaxRequestSize(mockProcessor, protocolFactory, 10))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).WithResponseSizeLimit(10).Build()
+	assert.Nil(transport.Open())
+
+	_, err := transport.Request(NewFContext(""), prependFrameSize([]byte("Hello from the other side")))
+	assert.Equal(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+
+	assert.Nil(transport.Close())
+}
+
 // Ensures the transport flush returns an Response Too Large error when
 // requesting too much data from the server
 func TestHTTPTransportResponseTooLarge(t *testing.T) {
@@ -566,6 +650,31 @@ func TestHTTPTransportResponseTimeout(t *testing.T) {
 	assert.Nil(transport.Close())
 }
 
+// Ensures Request returns as soon as the FContext's context.Context is
+// cancelled.
+func TestHTTPTransportRequestContextCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).Build()
+	assert.Nil(transport.Open())
+
+	goCtx, cancel := context.WithCancel(context.Background())
+	ctx := NewFContextWithContext(goCtx, "")
+	ctx.SetTimeout(time.Second)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, actualErr := transport.Request(ctx, []byte{})
+	assert.True(time.Since(start) < 100*time.Millisecond)
+	assert.Equal(context.Canceled.Error(), actualErr.Error())
+
+	assert.Nil(transport.Close())
+}
+
 // Ensures the transport flush returns an error when given a bad url
 func TestHTTPTransportBadURL(t *testing.T) {
 	assert := assert.New(t)
@@ -590,3 +699,49 @@ func TestHTTPTransportBadURL(t *testing.T) {
 	// Close
 	assert.Nil(transport.Close())
 }
+
+// Ensures the transport sends raw binary requests and reads raw binary
+// responses from the Frugal handler when binary encoding is enabled.
+func TestHTTPTransportBinaryEncoding(t *testing.T) {
+	assert := assert.New(t)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(&echoProcessor{}, protoFactory)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(frugalContentType, r.Header.Get(contentTypeHeader))
+		assert.Equal(binaryEncoding, r.Header.Get(contentTransferEncodingHeader))
+		assert.True(acceptsBinary(r.Header))
+		handler(w, r)
+		assert.Equal(binaryEncoding, w.Header().Get(contentTransferEncodingHeader))
+	}))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).WithBinaryEncoding().Build()
+	assert.Nil(transport.Open())
+	defer transport.Close()
+
+	body := compressibleString(1000)
+	_, response := echo(t, transport, protoFactory, body)
+	assert.Equal(body, response)
+}
+
+// Ensures the transport sends base64 requests by default and reads the raw
+// binary responses the Frugal handler sends it.
+func TestHTTPTransportBinaryResponse(t *testing.T) {
+	assert := assert.New(t)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	handler := NewFrugalHandlerFunc(&echoProcessor{}, protoFactory)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(base64Encoding, r.Header.Get(contentTransferEncodingHeader))
+		handler(w, r)
+		assert.Equal(binaryEncoding, w.Header().Get(contentTransferEncodingHeader))
+	}))
+	defer ts.Close()
+
+	transport := NewFHTTPTransportBuilder(&http.Client{}, ts.URL).Build()
+	assert.Nil(transport.Open())
+	defer transport.Close()
+
+	body := compressibleString(1000)
+	_, response := echo(t, transport, protoFactory, body)
+	assert.Equal(body, response)
+}
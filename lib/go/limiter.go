@@ -0,0 +1,205 @@
+package frugal
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// MaxConcurrencyAnnotation is the method annotation which limits the
+	// number of concurrent executions of the method, e.g.
+	// (max_concurrency="4").
+	MaxConcurrencyAnnotation = "max_concurrency"
+
+	// RateLimitAnnotation is the method annotation which limits the number of
+	// requests per second processed for the method, e.g. (rate_limit="100").
+	RateLimitAnnotation = "rate_limit"
+
+	// RateBurstAnnotation is the method annotation which sets the number of
+	// requests for the method which may exceed the rate limit in a burst,
+	// e.g. (rate_burst="20").
+	RateBurstAnnotation = "rate_burst"
+)
+
+// MethodLimits are the limits applied to a method. Zero values mean no limit.
+type MethodLimits struct {
+	// MaxConcurrency is the maximum number of concurrent executions of the
+	// method.
+	MaxConcurrency int
+
+	// Rate is the maximum number of requests processed per second, enforced
+	// with a token bucket.
+	Rate float64
+
+	// Burst is the size of the token bucket, i.e. the number of requests
+	// which may be processed at once after the method has been idle.
+	// Defaults to Rate, rounded up.
+	Burst int
+}
+
+// LimitPolicy configures the ServiceMiddleware returned by
+// NewLimitMiddleware.
+type LimitPolicy struct {
+	// Default are the limits of methods which have no limits in Methods or
+	// annotations.
+	Default MethodLimits
+
+	// Methods are the limits of methods by the name of the handler method,
+	// e.g. "GetThing", which take precedence over annotations.
+	Methods map[string]MethodLimits
+}
+
+// NewLimitMiddleware returns ServiceMiddleware for processors which limits
+// the concurrent executions and request rate of each method, so a single
+// expensive method can't use up all of the server's workers. A method's
+// limits are taken from the LimitPolicy Methods, the max_concurrency,
+// rate_limit and rate_burst annotations on the method in the IDL, or the
+// LimitPolicy Default, in that order. Requests over the limits fail
+// immediately with a TApplicationException of type
+// APPLICATION_EXCEPTION_OVERLOADED, which clients can detect with
+// IsErrOverloaded.
+func NewLimitMiddleware(policy LimitPolicy) ServiceMiddleware {
+	return func(next InvocationHandler) InvocationHandler {
+		// Middleware is applied to each method separately, so each gets its
+		// own limiter. The limits are resolved on the first call since the
+		// annotations are only available when the method is invoked.
+		var (
+			limiter *methodLimiter
+			once    sync.Once
+		)
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			once.Do(func() {
+				limiter = newMethodLimiter(policy.limits(service, method, args))
+			})
+			if reason := limiter.acquire(); reason != "" {
+				return ErrorResults(method, thrift.NewTApplicationException(APPLICATION_EXCEPTION_OVERLOADED,
+					fmt.Sprintf("frugal: %s overloaded: %s", method.Name, reason)))
+			}
+			defer limiter.release()
+			return next(service, method, args)
+		}
+	}
+}
+
+// limits returns the limits of the method.
+func (l LimitPolicy) limits(service reflect.Value, method reflect.Method, args Arguments) MethodLimits {
+	if limits, ok := l.Methods[method.Name]; ok {
+		return limits
+	}
+	annotations := MethodAnnotations(service, method, args)
+	limits := l.Default
+	if value, ok := annotations[MaxConcurrencyAnnotation]; ok {
+		limits.MaxConcurrency = parseLimitAnnotation(method.Name, MaxConcurrencyAnnotation, value, limits.MaxConcurrency)
+	}
+	if value, ok := annotations[RateLimitAnnotation]; ok {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 {
+			logger().Warnf("frugal: invalid %s annotation %q on method %s, using default of %g",
+				RateLimitAnnotation, value, method.Name, limits.Rate)
+		} else {
+			limits.Rate = rate
+			limits.Burst = 0
+		}
+	}
+	if value, ok := annotations[RateBurstAnnotation]; ok {
+		limits.Burst = parseLimitAnnotation(method.Name, RateBurstAnnotation, value, limits.Burst)
+	}
+	return limits
+}
+
+func parseLimitAnnotation(method, annotation, value string, defaultLimit int) int {
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		logger().Warnf("frugal: invalid %s annotation %q on method %s, using default of %d",
+			annotation, value, method, defaultLimit)
+		return defaultLimit
+	}
+	return limit
+}
+
+// methodLimiter enforces the limits of a single method.
+type methodLimiter struct {
+	slots  chan struct{}
+	bucket *tokenBucket
+}
+
+func newMethodLimiter(limits MethodLimits) *methodLimiter {
+	limiter := &methodLimiter{}
+	if limits.MaxConcurrency > 0 {
+		limiter.slots = make(chan struct{}, limits.MaxConcurrency)
+	}
+	if limits.Rate > 0 {
+		burst := limits.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(limits.Rate))
+		}
+		limiter.bucket = newTokenBucket(limits.Rate, burst)
+	}
+	return limiter
+}
+
+// acquire reserves a concurrency slot and a rate token for a call, returning
+// the reason the call is rejected, if it is.
+func (m *methodLimiter) acquire() string {
+	if m.slots != nil {
+		select {
+		case m.slots <- struct{}{}:
+		default:
+			return "too many concurrent requests"
+		}
+	}
+	if m.bucket != nil && !m.bucket.take() {
+		if m.slots != nil {
+			<-m.slots
+		}
+		return "rate limit exceeded"
+	}
+	return ""
+}
+
+// release frees the call's concurrency slot.
+func (m *methodLimiter) release() {
+	if m.slots != nil {
+		<-m.slots
+	}
+}
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// take removes a token from the bucket, returning false if it's empty.
+func (t *tokenBucket) take() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.tokens = math.Min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
@@ -0,0 +1,151 @@
+package frugal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// limitHandler is a handler whose methods block until released.
+type limitHandler struct {
+	release chan struct{}
+}
+
+var limitAnnotations = map[string]map[string]string{
+	"Slow":    {MaxConcurrencyAnnotation: "1"},
+	"Limited": {RateLimitAnnotation: "2", RateBurstAnnotation: "1"},
+	"Invalid": {MaxConcurrencyAnnotation: "x", RateLimitAnnotation: "-1"},
+}
+
+// newLimitMethod returns a Method for the limitHandler method with its
+// annotations.
+func newLimitMethod(handler *limitHandler, method interface{}, name string, middleware []ServiceMiddleware) *Method {
+	m := NewMethod(handler, method, name, middleware)
+	m.SetAnnotations(limitAnnotations[name])
+	return m
+}
+
+// invocationArgs returns the Arguments of an invocation of the Method, as
+// passed to its ServiceMiddleware.
+func invocationArgs(method *Method) Arguments {
+	ctx := NewFContext("").(*FContextImpl)
+	if method.annotations != nil {
+		ctx.SetContextValue(methodAnnotationsKey{}, method.annotations)
+	}
+	return Arguments{ctx}
+}
+
+func (l *limitHandler) Slow(ctx FContext) (string, error) {
+	<-l.release
+	return "done", nil
+}
+
+func (l *limitHandler) Limited(ctx FContext) error {
+	return nil
+}
+
+func (l *limitHandler) Invalid(ctx FContext) error {
+	return nil
+}
+
+// Ensures calls over the max_concurrency annotation are rejected with an
+// overloaded error until a call finishes.
+func TestLimitMiddlewareConcurrency(t *testing.T) {
+	handler := &limitHandler{release: make(chan struct{})}
+	method := newLimitMethod(handler, handler.Slow, "Slow", []ServiceMiddleware{NewLimitMiddleware(LimitPolicy{})})
+
+	done := make(chan Results)
+	go func() {
+		done <- method.Invoke([]interface{}{NewFContext("")})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ret := method.Invoke([]interface{}{NewFContext("")})
+	assert.True(t, IsErrOverloaded(ret.Error()))
+	assert.Equal(t, "frugal: Slow overloaded: too many concurrent requests", ret.Error().Error())
+	assert.Equal(t, "", ret[0])
+
+	handler.release <- struct{}{}
+	assert.Nil(t, (<-done).Error())
+	go func() { handler.release <- struct{}{} }()
+	assert.Nil(t, method.Invoke([]interface{}{NewFContext("")}).Error())
+}
+
+// Ensures calls over the rate_limit annotation are rejected.
+func TestLimitMiddlewareRate(t *testing.T) {
+	handler := &limitHandler{}
+	method := newLimitMethod(handler, handler.Limited, "Limited", []ServiceMiddleware{NewLimitMiddleware(LimitPolicy{})})
+
+	assert.Nil(t, method.Invoke([]interface{}{NewFContext("")}).Error())
+	err := method.Invoke([]interface{}{NewFContext("")}).Error()
+	assert.True(t, IsErrOverloaded(err))
+	assert.Equal(t, "frugal: Limited overloaded: rate limit exceeded", err.Error())
+}
+
+// Ensures limits in the LimitPolicy take precedence over annotations and the
+// default applies to methods without limits.
+func TestLimitPolicyLimits(t *testing.T) {
+	handler := &limitHandler{}
+	policy := LimitPolicy{
+		Default: MethodLimits{MaxConcurrency: 8, Rate: 10, Burst: 5},
+		Methods: map[string]MethodLimits{"Slow": {MaxConcurrency: 2}},
+	}
+	slow := newLimitMethod(handler, handler.Slow, "Slow", nil)
+	limited := newLimitMethod(handler, handler.Limited, "Limited", nil)
+	invalid := newLimitMethod(handler, handler.Invalid, "Invalid", nil)
+	other := NewMethod(&breakerClient{}, (&breakerClient{}).ping, "ping", nil)
+
+	assert.Equal(t, MethodLimits{MaxConcurrency: 2},
+		policy.limits(slow.proxiedStruct, slow.proxiedMethod, invocationArgs(slow)))
+	assert.Equal(t, MethodLimits{MaxConcurrency: 8, Rate: 2, Burst: 1},
+		policy.limits(limited.proxiedStruct, limited.proxiedMethod, invocationArgs(limited)))
+	assert.Equal(t, policy.Default, policy.limits(invalid.proxiedStruct, invalid.proxiedMethod, invocationArgs(invalid)))
+	assert.Equal(t, policy.Default, policy.limits(other.proxiedStruct, other.proxiedMethod, invocationArgs(other)))
+}
+
+// Ensures the token bucket allows bursts and refills at the rate.
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, 3)
+	bucket.last = now
+	bucket.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, bucket.take())
+	}
+	assert.False(t, bucket.take())
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, bucket.take())
+	assert.False(t, bucket.take())
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, bucket.take())
+	}
+	assert.False(t, bucket.take())
+}
+
+// Ensures the default burst is the rate rounded up and rejected rate limited
+// calls don't hold a concurrency slot.
+func TestMethodLimiter(t *testing.T) {
+	limiter := newMethodLimiter(MethodLimits{MaxConcurrency: 1, Rate: 0.5})
+	assert.Equal(t, float64(1), limiter.bucket.burst)
+	assert.Equal(t, "", limiter.acquire())
+	limiter.release()
+	assert.Equal(t, "rate limit exceeded", limiter.acquire())
+	assert.Equal(t, 0, len(limiter.slots))
+
+	unlimited := newMethodLimiter(MethodLimits{})
+	assert.Equal(t, "", unlimited.acquire())
+	unlimited.release()
+}
+
+func TestIsErrOverloaded(t *testing.T) {
+	assert.True(t, IsErrOverloaded(thrift.NewTApplicationException(APPLICATION_EXCEPTION_OVERLOADED, "")))
+	assert.False(t, IsErrOverloaded(thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNAUTHORIZED, "")))
+	assert.False(t, IsErrOverloaded(errors.New("error")))
+}
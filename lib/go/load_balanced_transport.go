@@ -0,0 +1,451 @@
+package frugal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	defaultProbeInterval    = 5 * time.Second
+	defaultMaxProbeInterval = 2 * time.Minute
+)
+
+// BalanceStrategy determines which endpoint of a load-balanced FTransport
+// receives a request.
+type BalanceStrategy int
+
+const (
+	// RoundRobin sends requests to each healthy endpoint in turn.
+	RoundRobin BalanceStrategy = iota
+
+	// LeastInFlight sends requests to the healthy endpoint with the fewest
+	// requests in flight.
+	LeastInFlight
+
+	// ConsistentHash sends requests with the same value of the
+	// LoadBalancerPolicy HashHeader to the same healthy endpoint, and only
+	// moves the requests of an endpoint when it's ejected. Requests without
+	// the header are sent round-robin.
+	ConsistentHash
+)
+
+// String returns the name of the strategy.
+func (b BalanceStrategy) String() string {
+	switch b {
+	case RoundRobin:
+		return "round-robin"
+	case LeastInFlight:
+		return "least-in-flight"
+	case ConsistentHash:
+		return "consistent-hash"
+	default:
+		return fmt.Sprintf("BalanceStrategy(%d)", int(b))
+	}
+}
+
+// LoadBalancerPolicy configures the FTransport returned by
+// NewLoadBalancedTransport. Zero values are replaced with their defaults.
+type LoadBalancerPolicy struct {
+	// Strategy determines which endpoint receives a request. Defaults to
+	// RoundRobin.
+	Strategy BalanceStrategy
+
+	// HashHeader is the request header hashed by the ConsistentHash
+	// strategy.
+	HashHeader string
+
+	// FailureThreshold is the number of consecutive failed requests which
+	// ejects an endpoint. Defaults to 5.
+	FailureThreshold int
+
+	// ProbeInterval is how long after it's ejected an endpoint is first
+	// probed. The delay doubles each time the probe fails or the endpoint is
+	// ejected again before a request succeeds, so endpoints which pass the
+	// probe but keep failing requests are re-added less and less often.
+	// Defaults to 5s.
+	ProbeInterval time.Duration
+
+	// MaxProbeInterval is the longest delay between probes of an ejected
+	// endpoint. Defaults to 2m.
+	MaxProbeInterval time.Duration
+
+	// Probe returns nil if the ejected endpoint is healthy and can be
+	// re-added. Defaults to opening the endpoint if it's not open, which
+	// doesn't check that the endpoint can serve requests, so a Probe which
+	// sends a request, e.g. a health check, is recommended.
+	Probe func(FTransport) error
+}
+
+// endpoint is an FTransport of a load-balanced FTransport.
+type endpoint struct {
+	id        string
+	transport FTransport
+	inFlight  int64
+	failures  int
+	healthy   bool
+
+	// backoff is the number of times the endpoint was ejected or failed
+	// the probe since a request last succeeded.
+	backoff int
+	probeAt time.Time
+}
+
+// fLoadBalancedTransport is an FTransport which spreads requests over
+// several FTransports.
+type fLoadBalancedTransport struct {
+	policy    LoadBalancerPolicy
+	endpoints []*endpoint
+	mu        sync.RWMutex
+	isOpen    bool
+	closed    chan error
+	stop      chan struct{}
+	next      uint64
+}
+
+// NewLoadBalancedTransport returns an FTransport which spreads requests over
+// the given FTransports, e.g. FHTTPTransports for each instance of a
+// service, according to the LoadBalancerPolicy. Endpoints are ejected when
+// their Closed channel fires or after FailureThreshold consecutive failed
+// requests, and are re-added once the health probe succeeds. A request fails
+// with a TTransportException of type TRANSPORT_EXCEPTION_NOT_OPEN if every
+// endpoint is ejected.
+//
+// Endpoints should not be opened or closed directly. Open opens each
+// endpoint and Close closes them.
+func NewLoadBalancedTransport(transports []FTransport, policy LoadBalancerPolicy) FTransport {
+	if policy.FailureThreshold == 0 {
+		policy.FailureThreshold = defaultFailureThreshold
+	}
+	if policy.ProbeInterval == 0 {
+		policy.ProbeInterval = defaultProbeInterval
+	}
+	if policy.MaxProbeInterval == 0 {
+		policy.MaxProbeInterval = defaultMaxProbeInterval
+	}
+	if policy.MaxProbeInterval < policy.ProbeInterval {
+		policy.MaxProbeInterval = policy.ProbeInterval
+	}
+	if policy.Probe == nil {
+		policy.Probe = probeOpen
+	}
+	endpoints := make([]*endpoint, len(transports))
+	for i, transport := range transports {
+		endpoints[i] = &endpoint{id: strconv.Itoa(i), transport: transport}
+	}
+	return &fLoadBalancedTransport{policy: policy, endpoints: endpoints}
+}
+
+// probeOpen opens the FTransport if it's not open.
+func probeOpen(transport FTransport) error {
+	if transport.IsOpen() {
+		return nil
+	}
+	return transport.Open()
+}
+
+// Open opens the endpoints. Endpoints which fail to open are ejected until
+// the health probe succeeds. Returns an error if no endpoint opens.
+func (f *fLoadBalancedTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: load-balanced transport already open")
+	}
+
+	var lastErr error
+	healthy := 0
+	for _, e := range f.endpoints {
+		if err := e.transport.Open(); err != nil && !isAlreadyOpen(err) {
+			logger().Warnf("frugal: error opening load-balanced endpoint, ejecting it: %s", err)
+			e.healthy = false
+			f.backOff(e)
+			lastErr = err
+			continue
+		}
+		e.healthy = true
+		e.failures = 0
+		healthy++
+	}
+	if healthy == 0 && len(f.endpoints) > 0 {
+		return lastErr
+	}
+
+	f.isOpen = true
+	f.closed = make(chan error, 1)
+	f.stop = make(chan struct{})
+	for _, e := range f.endpoints {
+		if e.healthy {
+			go f.watch(e, e.transport.Closed(), f.stop)
+		}
+	}
+	go f.probe(f.stop)
+	return nil
+}
+
+// isAlreadyOpen returns true if the error is a TTransportException of type
+// TRANSPORT_EXCEPTION_ALREADY_OPEN.
+func isAlreadyOpen(err error) bool {
+	e, ok := err.(thrift.TTransportException)
+	return ok && e.TypeId() == TRANSPORT_EXCEPTION_ALREADY_OPEN
+}
+
+// watch ejects the endpoint when its Closed channel fires.
+func (f *fLoadBalancedTransport) watch(e *endpoint, closed <-chan error, stop chan struct{}) {
+	if closed == nil {
+		return
+	}
+	select {
+	case cause := <-closed:
+		f.eject(e, fmt.Sprintf("closed: %v", cause))
+	case <-stop:
+	}
+}
+
+// backOff delays the next probe of the ejected endpoint, doubling the delay
+// each time it's called until a request to the endpoint succeeds. The
+// transport must be locked.
+func (f *fLoadBalancedTransport) backOff(e *endpoint) {
+	delay := f.policy.ProbeInterval
+	for i := 0; i < e.backoff && delay < f.policy.MaxProbeInterval; i++ {
+		delay *= 2
+	}
+	if delay > f.policy.MaxProbeInterval {
+		delay = f.policy.MaxProbeInterval
+	}
+	e.backoff++
+	e.probeAt = time.Now().Add(delay)
+}
+
+// probe periodically re-adds ejected endpoints whose health probe succeeds
+// once their probe is due.
+func (f *fLoadBalancedTransport) probe(stop chan struct{}) {
+	ticker := time.NewTicker(f.policy.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		f.mu.RLock()
+		var ejected []*endpoint
+		now := time.Now()
+		for _, e := range f.endpoints {
+			if !e.healthy && !now.Before(e.probeAt) {
+				ejected = append(ejected, e)
+			}
+		}
+		f.mu.RUnlock()
+
+		for _, e := range ejected {
+			if err := f.policy.Probe(e.transport); err != nil {
+				logger().Debugf("frugal: load-balanced endpoint health probe failed: %s", err)
+				f.mu.Lock()
+				f.backOff(e)
+				f.mu.Unlock()
+				continue
+			}
+			f.mu.Lock()
+			if f.stop != stop {
+				f.mu.Unlock()
+				return
+			}
+			e.healthy = true
+			e.failures = 0
+			f.mu.Unlock()
+			go f.watch(e, e.transport.Closed(), stop)
+			logger().Info("frugal: load-balanced endpoint passed health probe, re-adding it")
+		}
+	}
+}
+
+// eject removes the endpoint from rotation until the health probe succeeds.
+func (f *fLoadBalancedTransport) eject(e *endpoint, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !e.healthy {
+		return
+	}
+	e.healthy = false
+	f.backOff(e)
+	logger().Warnf("frugal: ejecting load-balanced endpoint: %s", reason)
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fLoadBalancedTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.isOpen
+}
+
+// Close closes the transport and its endpoints.
+func (f *fLoadBalancedTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: load-balanced transport not open")
+	}
+	close(f.stop)
+	f.stop = nil
+	for _, e := range f.endpoints {
+		if e.transport.IsOpen() {
+			if err := e.transport.Close(); err != nil {
+				logger().Warnf("frugal: error closing load-balanced endpoint: %s", err)
+			}
+		}
+		e.healthy = false
+	}
+	f.isOpen = false
+	f.closed <- nil
+	close(f.closed)
+	logger().Debug("frugal: load-balanced transport closed")
+	return nil
+}
+
+// Closed channel receives the cause of an FTransport close (nil if clean
+// close).
+func (f *fLoadBalancedTransport) Closed() <-chan error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.closed
+}
+
+// SetMonitor is a no-op for fLoadBalancedTransport. Ejected endpoints are
+// re-added by the health probe.
+func (f *fLoadBalancedTransport) SetMonitor(monitor FTransportMonitor) {
+}
+
+// Oneway transmits the given data to an endpoint and doesn't wait for a
+// response.
+func (f *fLoadBalancedTransport) Oneway(ctx FContext, payload []byte) error {
+	e, err := f.pick(ctx)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&e.inFlight, 1)
+	err = e.transport.Oneway(ctx, payload)
+	atomic.AddInt64(&e.inFlight, -1)
+	f.record(ctx, e, err)
+	return err
+}
+
+// Request transmits the given data to an endpoint and waits for a response.
+func (f *fLoadBalancedTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	e, err := f.pick(ctx)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&e.inFlight, 1)
+	result, err := e.transport.Request(ctx, payload)
+	atomic.AddInt64(&e.inFlight, -1)
+	f.record(ctx, e, err)
+	return result, err
+}
+
+// pick returns the healthy endpoint which receives the request.
+func (f *fLoadBalancedTransport) pick(ctx FContext) (*endpoint, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !f.isOpen {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: load-balanced transport not open")
+	}
+	healthy := make([]*endpoint, 0, len(f.endpoints))
+	for _, e := range f.endpoints {
+		if e.healthy {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: no healthy load-balanced endpoints")
+	}
+
+	switch f.policy.Strategy {
+	case LeastInFlight:
+		least := healthy[0]
+		for _, e := range healthy[1:] {
+			if atomic.LoadInt64(&e.inFlight) < atomic.LoadInt64(&least.inFlight) {
+				least = e
+			}
+		}
+		return least, nil
+	case ConsistentHash:
+		if key, ok := ctx.RequestHeader(f.policy.HashHeader); ok && f.policy.HashHeader != "" {
+			return f.hash(key, healthy), nil
+		}
+	}
+	next := atomic.AddUint64(&f.next, 1) - 1
+	return healthy[next%uint64(len(healthy))], nil
+}
+
+// hash returns the healthy endpoint for the key using rendezvous hashing, so
+// keys only move when their endpoint is ejected.
+func (f *fLoadBalancedTransport) hash(key string, healthy []*endpoint) *endpoint {
+	var (
+		chosen *endpoint
+		max    uint64
+	)
+	for _, e := range healthy {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e.id))
+		if sum := h.Sum64(); chosen == nil || sum > max {
+			chosen, max = e, sum
+		}
+	}
+	return chosen
+}
+
+// record tracks consecutive failures of the endpoint, ejecting it once they
+// reach the FailureThreshold.
+func (f *fLoadBalancedTransport) record(ctx FContext, e *endpoint, err error) {
+	failed := isEndpointFailure(err) && goContext(ctx).Err() == nil
+	f.mu.Lock()
+	if !failed {
+		e.failures = 0
+		if err == nil {
+			e.backoff = 0
+		}
+		f.mu.Unlock()
+		return
+	}
+	e.failures++
+	eject := e.failures >= f.policy.FailureThreshold
+	f.mu.Unlock()
+	if eject {
+		f.eject(e, fmt.Sprintf("%d consecutive failures, last: %s", f.policy.FailureThreshold, err))
+	}
+}
+
+// isEndpointFailure returns true if the error indicates the endpoint is
+// unhealthy rather than the request is invalid.
+func isEndpointFailure(err error) bool {
+	if err == nil || IsErrTooLarge(err) {
+		return false
+	}
+	_, ok := err.(thrift.TTransportException)
+	return ok
+}
+
+// GetRequestSizeLimit returns the smallest request size limit of the
+// endpoints. Returns a non-positive number to indicate an unbounded
+// allowable size.
+func (f *fLoadBalancedTransport) GetRequestSizeLimit() uint {
+	var limit uint
+	for _, e := range f.endpoints {
+		if l := e.transport.GetRequestSizeLimit(); l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	return limit
+}
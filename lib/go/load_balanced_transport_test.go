@@ -0,0 +1,272 @@
+package frugal
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// lbEndpoint is an FTransport which responds to requests with its name.
+type lbEndpoint struct {
+	name     string
+	mu       sync.Mutex
+	open     bool
+	openErr  error
+	err      error
+	closed   chan error
+	block    chan struct{}
+	requests int32
+	canceled int32
+}
+
+func newLBEndpoint(name string) *lbEndpoint {
+	return &lbEndpoint{name: name}
+}
+
+func (l *lbEndpoint) SetMonitor(FTransportMonitor) {}
+
+func (l *lbEndpoint) Closed() <-chan error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+func (l *lbEndpoint) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.openErr != nil {
+		return l.openErr
+	}
+	l.open = true
+	l.closed = make(chan error, 1)
+	return nil
+}
+
+func (l *lbEndpoint) IsOpen() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.open
+}
+
+func (l *lbEndpoint) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.open = false
+	l.closed <- nil
+	close(l.closed)
+	return nil
+}
+
+func (l *lbEndpoint) Oneway(ctx FContext, payload []byte) error {
+	_, err := l.Request(ctx, payload)
+	return err
+}
+
+func (l *lbEndpoint) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	l.mu.Lock()
+	err, block := l.err, l.block
+	l.mu.Unlock()
+	atomic.AddInt32(&l.requests, 1)
+	if block != nil {
+		select {
+		case <-block:
+		case <-goContext(ctx).Done():
+			atomic.AddInt32(&l.canceled, 1)
+			return nil, contextError(ctx)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &thrift.TMemoryBuffer{Buffer: bytes.NewBufferString(l.name)}, nil
+}
+
+func (l *lbEndpoint) GetRequestSizeLimit() uint {
+	return 0
+}
+
+func (l *lbEndpoint) setErr(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.err = err
+}
+
+func lbRequest(t *testing.T, tr FTransport, ctx FContext) string {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	result, err := tr.Request(ctx, requestFrame(t, protoFactory, ctx))
+	assert.Nil(t, err)
+	if err != nil {
+		return ""
+	}
+	name, _ := ioutil.ReadAll(result)
+	return string(name)
+}
+
+// Ensures requests are sent to each endpoint in turn.
+func TestLoadBalancedTransportRoundRobin(t *testing.T) {
+	tr := NewLoadBalancedTransport([]FTransport{newLBEndpoint("a"), newLBEndpoint("b"), newLBEndpoint("c")},
+		LoadBalancerPolicy{})
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	var names []string
+	for i := 0; i < 6; i++ {
+		names = append(names, lbRequest(t, tr, NewFContext("")))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "b", "c"}, names)
+}
+
+// Ensures requests are sent to the endpoint with the fewest requests in
+// flight.
+func TestLoadBalancedTransportLeastInFlight(t *testing.T) {
+	a, b := newLBEndpoint("a"), newLBEndpoint("b")
+	a.block = make(chan struct{})
+	tr := NewLoadBalancedTransport([]FTransport{a, b}, LoadBalancerPolicy{Strategy: LeastInFlight})
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	done := make(chan string)
+	go func() { done <- lbRequest(t, tr, NewFContext("")) }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, "b", lbRequest(t, tr, NewFContext("")))
+	assert.Equal(t, "b", lbRequest(t, tr, NewFContext("")))
+	close(a.block)
+	assert.Equal(t, "a", <-done)
+}
+
+// Ensures requests with the same hash header value are sent to the same
+// endpoint, and only move when it's ejected.
+func TestLoadBalancedTransportConsistentHash(t *testing.T) {
+	endpoints := []*lbEndpoint{newLBEndpoint("a"), newLBEndpoint("b"), newLBEndpoint("c")}
+	tr := NewLoadBalancedTransport([]FTransport{endpoints[0], endpoints[1], endpoints[2]},
+		LoadBalancerPolicy{Strategy: ConsistentHash, HashHeader: "user", FailureThreshold: 1, ProbeInterval: time.Hour})
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	chosen := make(map[string]string)
+	for _, user := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		ctx := NewFContext("")
+		ctx.AddRequestHeader("user", user)
+		chosen[user] = lbRequest(t, tr, ctx)
+		assert.Equal(t, chosen[user], lbRequest(t, tr, ctx))
+	}
+
+	// Eject the endpoint of the first user.
+	var ejected *lbEndpoint
+	for _, e := range endpoints {
+		if e.name == chosen["1"] {
+			ejected = e
+		}
+	}
+	ejected.setErr(thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, "down"))
+	ctx := NewFContext("")
+	ctx.AddRequestHeader("user", "1")
+	_, err := tr.Request(ctx, []byte{0, 0, 0, 1, 0})
+	assert.NotNil(t, err)
+
+	for user, name := range chosen {
+		ctx := NewFContext("")
+		ctx.AddRequestHeader("user", user)
+		moved := lbRequest(t, tr, ctx)
+		if name == ejected.name {
+			assert.NotEqual(t, name, moved)
+		} else {
+			assert.Equal(t, name, moved)
+		}
+	}
+}
+
+// Ensures endpoints are ejected after repeated failures or when closed, and
+// re-added once the health probe succeeds.
+func TestLoadBalancedTransportEjection(t *testing.T) {
+	a, b := newLBEndpoint("a"), newLBEndpoint("b")
+	var mu sync.Mutex
+	healthy := map[FTransport]bool{}
+	tr := NewLoadBalancedTransport([]FTransport{a, b}, LoadBalancerPolicy{
+		FailureThreshold: 2,
+		ProbeInterval:    10 * time.Millisecond,
+		MaxProbeInterval: 10 * time.Millisecond,
+		Probe: func(transport FTransport) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if !healthy[transport] {
+				return errors.New("unhealthy")
+			}
+			return probeOpen(transport)
+		},
+	})
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	a.setErr(thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN, "down"))
+	for i := 0; i < 4; i++ {
+		tr.Request(NewFContext(""), []byte{0, 0, 0, 1, 0})
+	}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "b", lbRequest(t, tr, NewFContext("")))
+	}
+
+	b.Close()
+	time.Sleep(10 * time.Millisecond)
+	_, err := tr.Request(NewFContext(""), []byte{0, 0, 0, 1, 0})
+	assert.Equal(t, "frugal: no healthy load-balanced endpoints", err.Error())
+
+	a.setErr(nil)
+	mu.Lock()
+	healthy[a], healthy[b] = true, true
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, b.IsOpen())
+	names := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		names[lbRequest(t, tr, NewFContext(""))] = true
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, names)
+}
+
+// Ensures the delay before probing an ejected endpoint doubles up to the
+// maximum until a request to the endpoint succeeds.
+func TestLoadBalancedTransportProbeBackoff(t *testing.T) {
+	tr := NewLoadBalancedTransport([]FTransport{newLBEndpoint("a")}, LoadBalancerPolicy{
+		ProbeInterval:    time.Minute,
+		MaxProbeInterval: 4 * time.Minute,
+	}).(*fLoadBalancedTransport)
+	e := tr.endpoints[0]
+
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		start := time.Now()
+		tr.backOff(e)
+		delay := e.probeAt.Sub(start)
+		assert.True(t, delay >= expected && delay < expected+time.Second)
+	}
+
+	tr.record(NewFContext(""), e, nil)
+	assert.Equal(t, 0, e.backoff)
+	start := time.Now()
+	tr.backOff(e)
+	assert.True(t, e.probeAt.Sub(start) < time.Minute+time.Second)
+}
+
+// Ensures Open fails only if no endpoint opens.
+func TestLoadBalancedTransportOpen(t *testing.T) {
+	a, b := newLBEndpoint("a"), newLBEndpoint("b")
+	a.openErr = errors.New("refused")
+	tr := NewLoadBalancedTransport([]FTransport{a, b}, LoadBalancerPolicy{ProbeInterval: time.Hour})
+	assert.Nil(t, tr.Open())
+	assert.Equal(t, "b", lbRequest(t, tr, NewFContext("")))
+	assert.Equal(t, "b", lbRequest(t, tr, NewFContext("")))
+	assert.Nil(t, tr.Close())
+	assert.False(t, b.IsOpen())
+	assert.Nil(t, <-tr.Closed())
+
+	b.openErr = errors.New("refused")
+	assert.Equal(t, b.openErr, tr.Open())
+	assert.False(t, tr.IsOpen())
+}
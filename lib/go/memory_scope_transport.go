@@ -0,0 +1,235 @@
+package frugal
+
+import (
+	"strings"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FInMemoryBroker routes messages published with in-memory
+// FPublisherTransports to the in-memory FSubscriberTransports subscribed to
+// matching topics. It's the in-memory equivalent of a NATS connection and is
+// useful for testing scopes and for wiring publishers and subscribers
+// together within a single process.
+//
+// Topics are matched like NATS subjects. Topics consist of tokens separated
+// by ".". In a subscription topic, "*" matches any single token and ">"
+// matches one or more trailing tokens.
+type FInMemoryBroker struct {
+	mu          sync.RWMutex
+	subscribers map[*fInMemorySubscriberTransport]struct{}
+}
+
+// NewFInMemoryBroker creates a new FInMemoryBroker with no subscribers.
+func NewFInMemoryBroker() *FInMemoryBroker {
+	return &FInMemoryBroker{subscribers: make(map[*fInMemorySubscriberTransport]struct{})}
+}
+
+// publish delivers the message to every subscriber whose topic matches. The
+// message is delivered synchronously, so subscribers have received it by the
+// time publish returns.
+func (b *FInMemoryBroker) publish(topic string, data []byte) {
+	b.mu.RLock()
+	subscribers := make([]*fInMemorySubscriberTransport, 0, len(b.subscribers))
+	for sub := range b.subscribers {
+		if matchTopic(sub.topic, topic) {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subscribers {
+		sub.deliver(data)
+	}
+}
+
+func (b *FInMemoryBroker) subscribe(sub *fInMemorySubscriberTransport) {
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+}
+
+func (b *FInMemoryBroker) unsubscribe(sub *fInMemorySubscriberTransport) {
+	b.mu.Lock()
+	delete(b.subscribers, sub)
+	b.mu.Unlock()
+}
+
+// matchTopic returns true if the topic matches the subscription topic, which
+// may contain "*" and ">" wildcards.
+func matchTopic(subscription, topic string) bool {
+	subTokens := strings.Split(subscription, ".")
+	topicTokens := strings.Split(topic, ".")
+	for i, token := range subTokens {
+		if token == ">" && i == len(subTokens)-1 {
+			return len(topicTokens) > i
+		}
+		if i >= len(topicTokens) {
+			return false
+		}
+		if token != "*" && token != topicTokens[i] {
+			return false
+		}
+	}
+	return len(subTokens) == len(topicTokens)
+}
+
+// FInMemoryPublisherTransportFactory creates in-memory FPublisherTransports.
+type FInMemoryPublisherTransportFactory struct {
+	broker *FInMemoryBroker
+}
+
+// NewFInMemoryPublisherTransportFactory creates an
+// FInMemoryPublisherTransportFactory which publishes to the given
+// FInMemoryBroker.
+func NewFInMemoryPublisherTransportFactory(broker *FInMemoryBroker) *FInMemoryPublisherTransportFactory {
+	return &FInMemoryPublisherTransportFactory{broker: broker}
+}
+
+// GetTransport creates a new in-memory FPublisherTransport.
+func (f *FInMemoryPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return NewFInMemoryPublisherTransport(f.broker)
+}
+
+// fInMemoryPublisherTransport implements FPublisherTransport.
+type fInMemoryPublisherTransport struct {
+	broker *FInMemoryBroker
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// NewFInMemoryPublisherTransport creates a new FPublisherTransport which
+// publishes to the given FInMemoryBroker.
+func NewFInMemoryPublisherTransport(broker *FInMemoryBroker) FPublisherTransport {
+	return &fInMemoryPublisherTransport{broker: broker}
+}
+
+// Open initializes the transport.
+func (f *fInMemoryPublisherTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fInMemoryPublisherTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.isOpen
+}
+
+// Close closes the transport.
+func (f *fInMemoryPublisherTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (f *fInMemoryPublisherTransport) GetPublishSizeLimit() uint {
+	return 0
+}
+
+// Publish sends the given payload with the transport.
+func (f *fInMemoryPublisherTransport) Publish(topic string, data []byte) error {
+	if !f.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: in-memory FPublisherTransport not open")
+	}
+
+	f.broker.publish(topic, data)
+	return nil
+}
+
+// FInMemorySubscriberTransportFactory creates in-memory
+// FSubscriberTransports.
+type FInMemorySubscriberTransportFactory struct {
+	broker *FInMemoryBroker
+}
+
+// NewFInMemorySubscriberTransportFactory creates an
+// FInMemorySubscriberTransportFactory which subscribes to the given
+// FInMemoryBroker.
+func NewFInMemorySubscriberTransportFactory(broker *FInMemoryBroker) *FInMemorySubscriberTransportFactory {
+	return &FInMemorySubscriberTransportFactory{broker: broker}
+}
+
+// GetTransport creates a new in-memory FSubscriberTransport.
+func (f *FInMemorySubscriberTransportFactory) GetTransport() FSubscriberTransport {
+	return NewFInMemorySubscriberTransport(f.broker)
+}
+
+// fInMemorySubscriberTransport implements FSubscriberTransport.
+type fInMemorySubscriberTransport struct {
+	broker       *FInMemoryBroker
+	topic        string
+	callback     FAsyncCallback
+	openMu       sync.RWMutex
+	isSubscribed bool
+}
+
+// NewFInMemorySubscriberTransport creates a new FSubscriberTransport which
+// subscribes to the given FInMemoryBroker.
+func NewFInMemorySubscriberTransport(broker *FInMemoryBroker) FSubscriberTransport {
+	return &fInMemorySubscriberTransport{broker: broker}
+}
+
+// Subscribe sets the subscribe topic and opens the transport.
+func (f *fInMemorySubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	f.openMu.Lock()
+	defer f.openMu.Unlock()
+	if f.isSubscribed {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: in-memory transport already open")
+	}
+
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty subject")
+	}
+
+	f.topic = topic
+	f.callback = callback
+	f.broker.subscribe(f)
+	f.isSubscribed = true
+	return nil
+}
+
+// deliver invokes the subscriber's callback with the given message frame.
+func (f *fInMemorySubscriberTransport) deliver(data []byte) {
+	if len(data) < 4 {
+		logger().Warn("frugal: Discarding invalid scope message frame")
+		return
+	}
+	transport := acquireFrameTransport(data[4:])
+	defer releaseFrameTransport(transport)
+	if err := f.callback(transport); err != nil {
+		logger().Warn("frugal: error executing callback: ", err)
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (f *fInMemorySubscriberTransport) IsSubscribed() bool {
+	f.openMu.RLock()
+	defer f.openMu.RUnlock()
+	return f.isSubscribed
+}
+
+// Unsubscribe unsubscribes from the topic and closes the transport.
+func (f *fInMemorySubscriberTransport) Unsubscribe() error {
+	f.openMu.Lock()
+	defer f.openMu.Unlock()
+	if !f.isSubscribed {
+		return nil
+	}
+
+	f.broker.unsubscribe(f)
+	f.isSubscribed = false
+	return nil
+}
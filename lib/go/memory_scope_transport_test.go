@@ -0,0 +1,104 @@
+package frugal
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures published messages are delivered to the subscribers of matching
+// topics.
+func TestInMemoryScopeTransportPublishSubscribe(t *testing.T) {
+	broker := NewFInMemoryBroker()
+	publisher := NewFInMemoryPublisherTransportFactory(broker).GetTransport()
+	assert.Nil(t, publisher.Open())
+	defer publisher.Close()
+
+	var received [][]byte
+	subscriber := NewFInMemorySubscriberTransportFactory(broker).GetTransport()
+	assert.Nil(t, subscriber.Subscribe("foo.*", func(tr thrift.TTransport) error {
+		data, err := ioutil.ReadAll(tr)
+		received = append(received, data)
+		return err
+	}))
+	assert.True(t, subscriber.IsSubscribed())
+
+	assert.Nil(t, publisher.Publish("foo.bar", prependFrameSize([]byte("hello"))))
+	assert.Nil(t, publisher.Publish("baz.bar", prependFrameSize([]byte("ignored"))))
+	assert.Equal(t, [][]byte{[]byte("hello")}, received)
+
+	assert.Nil(t, subscriber.Unsubscribe())
+	assert.False(t, subscriber.IsSubscribed())
+	assert.Nil(t, publisher.Publish("foo.bar", prependFrameSize([]byte("hello"))))
+	assert.Equal(t, 1, len(received))
+}
+
+// Ensures Publish returns a NOT_OPEN TTransportException if the publisher is
+// not open.
+func TestInMemoryPublisherTransportNotOpen(t *testing.T) {
+	publisher := NewFInMemoryPublisherTransport(NewFInMemoryBroker())
+
+	err := publisher.Publish("foo", prependFrameSize([]byte("hello")))
+	assert.Equal(t, TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures Subscribe returns an ALREADY_OPEN TTransportException if the
+// subscriber is already subscribed and an error for empty topics.
+func TestInMemorySubscriberTransportSubscribeErrors(t *testing.T) {
+	subscriber := NewFInMemorySubscriberTransport(NewFInMemoryBroker())
+	callback := func(thrift.TTransport) error { return nil }
+
+	assert.Error(t, subscriber.Subscribe("", callback))
+	assert.Nil(t, subscriber.Subscribe("foo", callback))
+	err := subscriber.Subscribe("foo", callback)
+	assert.Equal(t, TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures matchTopic supports NATS-style wildcards.
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		subscription string
+		topic        string
+		match        bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.bar", "foo.bar.baz", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.>", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo.bar", true},
+		{"foo.*.baz", "foo.bar.baz", true},
+		{"foo.*.baz", "foo.bar.qux", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchTopic(c.subscription, c.topic), "%s %s", c.subscription, c.topic)
+	}
+}
+
+// BenchmarkInMemoryScopeTransportPublish measures publishing a message and
+// delivering it to a subscriber.
+func BenchmarkInMemoryScopeTransportPublish(b *testing.B) {
+	broker := NewFInMemoryBroker()
+	publisher := NewFInMemoryPublisherTransport(broker)
+	publisher.Open()
+	defer publisher.Close()
+	subscriber := NewFInMemorySubscriberTransport(broker)
+	buff := make([]byte, 64)
+	subscriber.Subscribe("foo.bar", func(tr thrift.TTransport) error {
+		_, err := tr.Read(buff)
+		return err
+	})
+	defer subscriber.Unsubscribe()
+	frame := prependFrameSize(make([]byte, 64))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		publisher.Publish("foo.bar", frame)
+	}
+}
@@ -0,0 +1,163 @@
+package frugal
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// NewFInMemoryTransport returns a new FTransport which is wired directly to
+// the given FProcessor. Requests are framed and serialized exactly as they are
+// on the wire and each is processed by the FProcessor on its own goroutine, so
+// concurrent requests, timeouts, and cancellation behave as they do with a
+// network FTransport. The FProtocolFactory must match the one used by the
+// client. This is useful for testing services and for wiring services
+// together within a single process without a network hop.
+func NewFInMemoryTransport(processor FProcessor, protoFactory *FProtocolFactory) FTransport {
+	return &fInMemoryTransport{
+		fBaseTransport: newFBaseTransport(0),
+		processor:      processor,
+		protoFactory:   protoFactory,
+	}
+}
+
+// fInMemoryTransport implements FTransport by invoking an FProcessor
+// directly.
+type fInMemoryTransport struct {
+	*fBaseTransport
+	processor    FProcessor
+	protoFactory *FProtocolFactory
+	mu           sync.RWMutex
+	isOpen       bool
+}
+
+// Open prepares the transport to send data.
+func (f *fInMemoryTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: in-memory transport already open")
+	}
+	f.fBaseTransport.Open()
+	f.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fInMemoryTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.isOpen
+}
+
+// Close closes the transport.
+func (f *fInMemoryTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return nil
+	}
+	f.isOpen = false
+	f.fBaseTransport.Close(nil)
+	return nil
+}
+
+// Oneway transmits the given data and doesn't wait for a response.
+// Implementations of oneway should be threadsafe and respect the timeout
+// present on the context.
+func (f *fInMemoryTransport) Oneway(ctx FContext, data []byte) error {
+	if !f.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: in-memory transport not open")
+	}
+
+	if len(data) == 4 {
+		return nil
+	}
+
+	if goContext(ctx).Err() != nil {
+		return contextError(ctx)
+	}
+
+	go f.process(copyFrame(data))
+	return nil
+}
+
+// Request transmits the given data and waits for a response.
+// Implementations of request should be threadsafe and respect the timeout
+// present on the context. The data is expected to already be framed.
+func (f *fInMemoryTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	resultC := make(chan []byte, 1)
+
+	if !f.IsOpen() {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: in-memory transport not open")
+	}
+
+	if len(data) == 4 {
+		return nil, nil
+	}
+
+	if err := f.registry.Register(ctx, resultC); err != nil {
+		return nil, err
+	}
+	defer f.registry.Unregister(ctx)
+
+	if goContext(ctx).Err() != nil {
+		return nil, contextError(ctx)
+	}
+
+	go f.process(copyFrame(data))
+
+	select {
+	case result := <-resultC:
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
+	case <-goContext(ctx).Done():
+		return nil, contextError(ctx)
+	case <-time.After(ctx.Timeout()):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: in-memory request timed out")
+	}
+}
+
+// copyFrame returns a TMemoryBuffer holding a copy of the frame without its
+// frame size. The caller may reuse the frame as soon as Oneway or Request
+// returns, so it's copied before it's processed asynchronously.
+func copyFrame(frame []byte) *thrift.TMemoryBuffer {
+	input := &thrift.TMemoryBuffer{Buffer: acquireBuffer()}
+	input.Write(frame[4:]) // Discard frame size
+	return input
+}
+
+// process invokes the FProcessor with the given request, which is released
+// once it's processed, and executes the response, if any.
+func (f *fInMemoryTransport) process(input *thrift.TMemoryBuffer) {
+	defer releaseBuffer(input.Buffer)
+	// The response is handed to the caller, so it's not released.
+	output := NewTMemoryOutputBuffer(0)
+	if err := f.processor.Process(f.protoFactory.GetProtocol(input), f.protoFactory.GetProtocol(output)); err != nil {
+		logger().Errorf("frugal: error processing request: %s", err.Error())
+		return
+	}
+
+	if !output.HasWriteData() {
+		return
+	}
+
+	if err := f.fBaseTransport.ExecuteFrame(output.Bytes()); err != nil {
+		logger().Warn("frugal: could not execute frame: ", err)
+	}
+}
+
+// GetRequestSizeLimit returns the maximum number of bytes that can be
+// transmitted. Returns a non-positive number to indicate an unbounded
+// allowable size.
+func (f *fInMemoryTransport) GetRequestSizeLimit() uint {
+	return 0
+}
+
+// This is a no-op for fInMemoryTransport
+func (f *fInMemoryTransport) SetMonitor(monitor FTransportMonitor) {
+}
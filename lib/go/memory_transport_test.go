@@ -0,0 +1,165 @@
+package frugal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// pingRequest returns a framed ping request for the given FContext.
+func pingRequest(t testing.TB, protoFactory *FProtocolFactory, ctx FContext) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteMessageBegin("ping", thrift.CALL, 0))
+	assert.Nil(t, proto.WriteStructBegin("args"))
+	assert.Nil(t, proto.WriteFieldStop())
+	assert.Nil(t, proto.WriteStructEnd())
+	assert.Nil(t, proto.WriteMessageEnd())
+	assert.Nil(t, proto.Flush())
+	return buffer.Bytes()
+}
+
+// Ensures Request invokes the FProcessor and returns its response.
+func TestInMemoryTransportRequest(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	tr := NewFInMemoryTransport(newNamedProcessor("foo"), protoFactory)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	result, err := tr.Request(ctx, pingRequest(t, protoFactory, ctx))
+	assert.Nil(t, err)
+
+	iprot := protoFactory.GetProtocol(result)
+	assert.Nil(t, iprot.ReadResponseHeader(ctx))
+	name, mType, _, err := iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", name)
+	assert.Equal(t, thrift.REPLY, mType)
+	body, err := iprot.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", body)
+}
+
+// Ensures concurrent requests are processed concurrently.
+func TestInMemoryTransportConcurrentRequests(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	processor := &slowProcessor{delay: 50 * time.Millisecond}
+	tr := NewFInMemoryTransport(processor, protoFactory)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := NewFContext("")
+			_, err := tr.Request(ctx, pingRequest(t, protoFactory, ctx))
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(10), atomic.LoadInt32(&processor.processed))
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+}
+
+// Ensures Request returns a TIMED_OUT TTransportException if the FProcessor
+// doesn't respond within the timeout.
+func TestInMemoryTransportRequestTimeout(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	tr := NewFInMemoryTransport(&slowProcessor{delay: 100 * time.Millisecond}, protoFactory)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	ctx.SetTimeout(10 * time.Millisecond)
+	_, err := tr.Request(ctx, pingRequest(t, protoFactory, ctx))
+	assert.Equal(t, TRANSPORT_EXCEPTION_TIMED_OUT, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures Request returns when the FContext's context.Context is cancelled.
+func TestInMemoryTransportRequestCancelled(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	tr := NewFInMemoryTransport(&slowProcessor{delay: 100 * time.Millisecond}, protoFactory)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	goCtx, cancel := context.WithCancel(context.Background())
+	ctx := NewFContextWithContext(goCtx, "")
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := tr.Request(ctx, pingRequest(t, protoFactory, ctx))
+	assert.Equal(t, context.Canceled.Error(), err.Error())
+}
+
+// Ensures Oneway invokes the FProcessor without waiting for it, and the frame
+// can be reused once it returns.
+func TestInMemoryTransportOneway(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	processor := &slowProcessor{delay: 10 * time.Millisecond}
+	tr := NewFInMemoryTransport(processor, protoFactory)
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+
+	ctx := NewFContext("")
+	frame := pingRequest(t, protoFactory, ctx)
+	assert.Nil(t, tr.Oneway(ctx, frame))
+	for i := range frame {
+		frame[i] = 0
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&processor.processed))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&processor.processed))
+}
+
+// Ensures the transport returns NOT_OPEN TTransportExceptions when it's not
+// open and ALREADY_OPEN when opened twice.
+func TestInMemoryTransportOpenClose(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	tr := NewFInMemoryTransport(newNamedProcessor("foo"), protoFactory)
+	ctx := NewFContext("")
+
+	_, err := tr.Request(ctx, pingRequest(t, protoFactory, ctx))
+	assert.Equal(t, TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	err = tr.Oneway(ctx, pingRequest(t, protoFactory, ctx))
+	assert.Equal(t, TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+
+	assert.Nil(t, tr.Open())
+	assert.True(t, tr.IsOpen())
+	err = tr.Open()
+	assert.Equal(t, TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+
+	assert.Nil(t, tr.Close())
+	assert.False(t, tr.IsOpen())
+	select {
+	case err := <-tr.Closed():
+		assert.Nil(t, err)
+	default:
+		t.Fatal("Expected transport to close")
+	}
+}
+
+// BenchmarkInMemoryTransportRequest measures a request/response round trip,
+// including serialization and processing.
+func BenchmarkInMemoryTransportRequest(b *testing.B) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	tr := NewFInMemoryTransport(newNamedProcessor("foo"), protoFactory)
+	tr.Open()
+	defer tr.Close()
+	ctx := NewFContext("")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tr.Request(ctx, pingRequest(b, protoFactory, ctx)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/Workiva/frugal/lib/go"
+)
+
+// NewClientMiddleware returns ServiceMiddleware for clients which records
+// per-method request counts, error counts by exception type, latency and
+// in-flight requests in the Registry. The metrics are named
+// frugal_client_requests_total, frugal_client_errors_total,
+// frugal_client_request_duration_seconds and
+// frugal_client_requests_in_flight, labeled by service and method.
+func NewClientMiddleware(registry *Registry) frugal.ServiceMiddleware {
+	return newMiddleware(registry, "client")
+}
+
+// NewServerMiddleware returns ServiceMiddleware for processors which records
+// per-method request counts, error counts by exception type, latency and
+// in-flight requests in the Registry. The metrics are named
+// frugal_server_requests_total, frugal_server_errors_total,
+// frugal_server_request_duration_seconds and
+// frugal_server_requests_in_flight, labeled by service and method.
+func NewServerMiddleware(registry *Registry) frugal.ServiceMiddleware {
+	return newMiddleware(registry, "server")
+}
+
+func newMiddleware(registry *Registry, side string) frugal.ServiceMiddleware {
+	prefix := "frugal_" + side + "_"
+	requests := registry.Counter(prefix+"requests_total",
+		"Number of "+side+" requests by method.", "service", "method")
+	errors := registry.Counter(prefix+"errors_total",
+		"Number of "+side+" requests which returned an error by method and exception type.",
+		"service", "method", "exception")
+	latency := registry.Histogram(prefix+"request_duration_seconds",
+		"Latency of "+side+" requests by method.", DefaultBuckets, "service", "method")
+	inFlight := registry.Gauge(prefix+"requests_in_flight",
+		"Number of "+side+" requests in progress by method.", "service", "method")
+
+	return func(next frugal.InvocationHandler) frugal.InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args frugal.Arguments) frugal.Results {
+			serviceName := serviceName(service)
+			methodName := methodName(method)
+			methodInFlight := inFlight.With(serviceName, methodName)
+			methodInFlight.Inc()
+			start := time.Now()
+			// The request is recorded even if the method panics, since the
+			// panic may be recovered further up.
+			defer func() {
+				latency.With(serviceName, methodName).Observe(time.Since(start).Seconds())
+				methodInFlight.Dec()
+				requests.With(serviceName, methodName).Inc()
+			}()
+
+			results := next(service, method, args)
+			// Methods without return values, such as subscriber handlers,
+			// can't return an error.
+			if len(results) == 0 {
+				return results
+			}
+			if err := results.Error(); err != nil {
+				errors.With(serviceName, methodName, exceptionType(err)).Inc()
+			}
+			return results
+		}
+	}
+}
+
+// methodName returns the label value of the method. Client methods are
+// unexported, e.g. "buyAlbum", while server methods are exported, e.g.
+// "BuyAlbum", so both use the exported form.
+func methodName(method reflect.Method) string {
+	if method.Name == "" {
+		return ""
+	}
+	r, size := utf8.DecodeRuneInString(method.Name)
+	return string(unicode.ToUpper(r)) + method.Name[size:]
+}
+
+// serviceName returns the name of the service's type, e.g. "FFooClient".
+func serviceName(service reflect.Value) string {
+	if !service.IsValid() {
+		return ""
+	}
+	serviceType := service.Type()
+	if serviceType.Kind() == reflect.Ptr {
+		serviceType = serviceType.Elem()
+	}
+	return serviceType.Name()
+}
+
+// exceptionType returns the label value identifying the type of the error.
+// TTransportExceptions and TApplicationExceptions include their type id,
+// e.g. "TTransportException(3)", and other errors, such as exceptions
+// declared in the IDL, use their Go type, e.g. "*base.APIException".
+func exceptionType(err error) string {
+	switch e := err.(type) {
+	case thrift.TTransportException:
+		return fmt.Sprintf("TTransportException(%d)", e.TypeId())
+	case thrift.TApplicationException:
+		return fmt.Sprintf("TApplicationException(%d)", e.TypeId())
+	default:
+		return fmt.Sprintf("%T", err)
+	}
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/Workiva/frugal/lib/go"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient struct {
+	errs []error
+}
+
+func (c *testClient) ping(ctx frugal.FContext) error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+func (c *testClient) onPing(ctx frugal.FContext) {}
+
+func (c *testClient) panics(ctx frugal.FContext) error {
+	panic("boom")
+}
+
+// Ensures the client middleware records requests, errors by exception type,
+// latency and in-flight requests.
+func TestClientMiddleware(t *testing.T) {
+	registry := NewRegistry()
+	client := &testClient{errs: []error{
+		thrift.NewTTransportException(frugal.TRANSPORT_EXCEPTION_TIMED_OUT, "timed out"),
+		errors.New("error"),
+	}}
+	method := frugal.NewMethod(client, client.ping, "ping",
+		[]frugal.ServiceMiddleware{NewClientMiddleware(registry)})
+
+	for i := 0; i < 3; i++ {
+		method.Invoke([]interface{}{frugal.NewFContext("")})
+	}
+
+	assert.Equal(t, float64(3), registry.Counter("frugal_client_requests_total", "",
+		"service", "method").With("testClient", "Ping").Value())
+	errorsTotal := registry.Counter("frugal_client_errors_total", "", "service", "method", "exception")
+	assert.Equal(t, float64(1), errorsTotal.With("testClient", "Ping", "TTransportException(3)").Value())
+	assert.Equal(t, float64(1), errorsTotal.With("testClient", "Ping", "*errors.errorString").Value())
+	assert.Equal(t, uint64(3), registry.Histogram("frugal_client_request_duration_seconds", "",
+		DefaultBuckets, "service", "method").With("testClient", "Ping").Count())
+	assert.Equal(t, float64(0), registry.Gauge("frugal_client_requests_in_flight", "",
+		"service", "method").With("testClient", "Ping").Value())
+}
+
+// Ensures client and server middleware can share a Registry.
+func TestServerMiddleware(t *testing.T) {
+	registry := NewRegistry()
+	client := &testClient{}
+	NewClientMiddleware(registry)
+	method := frugal.NewMethod(client, client.ping, "ping",
+		[]frugal.ServiceMiddleware{NewServerMiddleware(registry)})
+
+	method.Invoke([]interface{}{frugal.NewFContext("")})
+
+	assert.Equal(t, float64(1), registry.Counter("frugal_server_requests_total", "",
+		"service", "method").With("testClient", "Ping").Value())
+	assert.Equal(t, float64(0), registry.Counter("frugal_client_requests_total", "",
+		"service", "method").With("testClient", "Ping").Value())
+}
+
+// Ensures methods without results, such as subscriber handlers, and methods
+// which panic are recorded without leaking in-flight requests.
+func TestMiddlewareNoResultsAndPanic(t *testing.T) {
+	registry := NewRegistry()
+	client := &testClient{}
+	middleware := []frugal.ServiceMiddleware{NewServerMiddleware(registry)}
+
+	frugal.NewMethod(client, client.onPing, "onPing", middleware).Invoke(
+		[]interface{}{frugal.NewFContext("")})
+	assert.Equal(t, float64(1), registry.Counter("frugal_server_requests_total", "",
+		"service", "method").With("testClient", "OnPing").Value())
+
+	assert.Panics(t, func() {
+		frugal.NewMethod(client, client.panics, "panics", middleware).Invoke(
+			[]interface{}{frugal.NewFContext("")})
+	})
+	assert.Equal(t, float64(1), registry.Counter("frugal_server_requests_total", "",
+		"service", "method").With("testClient", "Panics").Value())
+	assert.Equal(t, float64(0), registry.Gauge("frugal_server_requests_in_flight", "",
+		"service", "method").With("testClient", "Panics").Value())
+}
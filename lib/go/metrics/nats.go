@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/Workiva/frugal/lib/go"
+)
+
+// NewNatsServerObserver returns an FNatsServerObserver which records the NATS
+// FServer's work queue depth and the time requests wait in the queue in the
+// Registry, labeled with the given server name. The metrics are named
+// frugal_nats_server_queue_depth and frugal_nats_server_queue_wait_seconds.
+// Use it with FNatsServerBuilder.WithObserver.
+func NewNatsServerObserver(registry *Registry, server string) frugal.FNatsServerObserver {
+	return &natsServerObserver{
+		depth: registry.Gauge("frugal_nats_server_queue_depth",
+			"Number of requests waiting in the NATS server work queue.", "server").With(server),
+		wait: registry.Histogram("frugal_nats_server_queue_wait_seconds",
+			"Time requests waited in the NATS server work queue.", DefaultBuckets, "server").With(server),
+	}
+}
+
+type natsServerObserver struct {
+	depth *Gauge
+	wait  *Histogram
+}
+
+// QueueDepth sets the queue depth gauge.
+func (n *natsServerObserver) QueueDepth(depth int) {
+	n.depth.Set(float64(depth))
+}
+
+// QueueWait records the time the request waited in the queue.
+func (n *natsServerObserver) QueueWait(wait time.Duration) {
+	n.wait.Observe(wait.Seconds())
+}
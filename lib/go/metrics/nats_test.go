@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures the observer records the queue depth and queue wait time.
+func TestNatsServerObserver(t *testing.T) {
+	registry := NewRegistry()
+	observer := NewNatsServerObserver(registry, "foo")
+
+	observer.QueueDepth(4)
+	observer.QueueWait(time.Millisecond)
+
+	assert.Equal(t, float64(4), registry.Gauge("frugal_nats_server_queue_depth", "", "server").With("foo").Value())
+	assert.Equal(t, uint64(1), registry.Histogram("frugal_nats_server_queue_wait_seconds", "",
+		DefaultBuckets, "server").With("foo").Count())
+}
@@ -0,0 +1,382 @@
+// Package metrics provides ServiceMiddleware and an FNatsServerObserver which
+// record Frugal client and server metrics, and exposes them in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram bucket upper bounds, in seconds, used for
+// latency histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// Registry holds metrics and writes them in the Prometheus text format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the CounterVec with the given name, creating it if it
+// doesn't exist. It panics if a metric with the name exists with a different
+// type or labels.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.family(name, help, counterType, nil, labels)}
+}
+
+// Gauge returns the GaugeVec with the given name, creating it if it doesn't
+// exist. It panics if a metric with the name exists with a different type or
+// labels.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.family(name, help, gaugeType, nil, labels)}
+}
+
+// Histogram returns the HistogramVec with the given name, creating it with
+// the given bucket upper bounds if it doesn't exist. It panics if a metric
+// with the name exists with a different type or labels.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{r.family(name, help, histogramType, buckets, labels)}
+}
+
+func (r *Registry) family(name, help string, typ metricType, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.typ != typ || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metrics: %s already registered as %s with labels %v", name, f.typ, f.labels))
+		}
+		return f
+	}
+	f := &family{
+		name:     name,
+		help:     help,
+		typ:      typ,
+		buckets:  buckets,
+		labels:   labels,
+		children: make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*family, len(names))
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// Handler returns an http.Handler which serves the metrics in the Prometheus
+// text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		r.WriteTo(w)
+	})
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the Counter for the given label values, in the order the
+// labels were registered.
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{c.f.series(labelValues)}
+}
+
+// Counter is a value which only increases.
+type Counter struct {
+	s *series
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.s.add(v)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() float64 {
+	return c.s.get()
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the Gauge for the given label values, in the order the labels
+// were registered.
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{g.f.series(labelValues)}
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	s *series
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64) {
+	g.s.set(v)
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	g.s.add(1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	g.s.add(-1)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	return g.s.get()
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the Histogram for the given label values, in the order the
+// labels were registered.
+func (h *HistogramVec) With(labelValues ...string) *Histogram {
+	return &Histogram{h.f.series(labelValues), h.f.buckets}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.s.observe(h.buckets, v)
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	return h.s.count
+}
+
+// family is a named metric and its series for each set of label values.
+type family struct {
+	name     string
+	help     string
+	typ      metricType
+	buckets  []float64
+	labels   []string
+	mu       sync.Mutex
+	children map[string]*series
+}
+
+// series returns the series for the label values, creating it if needed.
+func (f *family) series(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.children[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.typ == histogramType {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.children[key] = s
+	}
+	return s
+}
+
+func (f *family) write(w *countingWriter) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.children))
+	for key := range f.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]*series, len(keys))
+	for i, key := range keys {
+		children[i] = f.children[key]
+	}
+	f.mu.Unlock()
+	if len(children) == 0 {
+		return
+	}
+
+	w.printf("# HELP %s %s\n", f.name, escapeHelp(f.help))
+	w.printf("# TYPE %s %s\n", f.name, f.typ)
+	for _, s := range children {
+		labels := f.formatLabels(s.labelValues)
+		s.mu.Lock()
+		if f.typ != histogramType {
+			w.printf("%s%s %s\n", f.name, labels, formatFloat(s.value))
+			s.mu.Unlock()
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			w.printf("%s_bucket%s %d\n", f.name, f.formatLabels(s.labelValues, "le", formatFloat(bound)), cumulative)
+		}
+		w.printf("%s_bucket%s %d\n", f.name, f.formatLabels(s.labelValues, "le", "+Inf"), s.count)
+		w.printf("%s_sum%s %s\n", f.name, labels, formatFloat(s.value))
+		w.printf("%s_count%s %d\n", f.name, labels, s.count)
+		s.mu.Unlock()
+	}
+}
+
+// formatLabels returns the label set for the series, with an optional extra
+// label name and value, e.g. {method="Ping",le="0.5"}.
+func (f *family) formatLabels(labelValues []string, extra ...string) string {
+	if len(f.labels) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, label := range f.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(labelValues[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[0], extra[1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// series holds the value of a metric for one set of label values. For
+// histograms, value is the sum of observations.
+type series struct {
+	labelValues []string
+	mu          sync.Mutex
+	value       float64
+	count       uint64
+	counts      []uint64
+}
+
+func (s *series) add(v float64) {
+	s.mu.Lock()
+	s.value += v
+	s.mu.Unlock()
+}
+
+func (s *series) set(v float64) {
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+}
+
+func (s *series) get() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+func (s *series) observe(bounds []float64, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.value += v
+	s.count++
+	for i, bound := range bounds {
+		if v <= bound {
+			s.counts[i]++
+			return
+		}
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// countingWriter counts the bytes written and keeps the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures metrics are written in the Prometheus text format, sorted by name
+// and label values.
+func TestRegistryWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("requests_total", "Number of requests.", "method")
+	requests.With("ping").Inc()
+	requests.With("blah").Add(2)
+	registry.Gauge("in_flight", "In-flight\nrequests.").With().Set(3)
+	latency := registry.Histogram("latency_seconds", "Latency.", []float64{1, 0.1}, "method")
+	latency.With("ping").Observe(0.05)
+	latency.With("ping").Observe(0.5)
+	latency.With("ping").Observe(2)
+	registry.Counter("unused_total", "Never incremented.")
+
+	var buf bytes.Buffer
+	n, err := registry.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP in_flight In-flight\nrequests.
+# TYPE in_flight gauge
+in_flight 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="ping",le="0.1"} 1
+latency_seconds_bucket{method="ping",le="1"} 2
+latency_seconds_bucket{method="ping",le="+Inf"} 3
+latency_seconds_sum{method="ping"} 2.55
+latency_seconds_count{method="ping"} 3
+# HELP requests_total Number of requests.
+# TYPE requests_total counter
+requests_total{method="blah"} 2
+requests_total{method="ping"} 1
+`, buf.String())
+}
+
+// Ensures label values are escaped.
+func TestRegistryEscapesLabelValues(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("errors_total", "Errors.", "exception").With("a\"b\\c\nd").Inc()
+
+	var buf bytes.Buffer
+	_, err := registry.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), `errors_total{exception="a\"b\\c\nd"} 1`)
+}
+
+// Ensures getting a metric by name returns the existing metric and
+// conflicting registrations panic.
+func TestRegistryExistingMetric(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "Requests.", "method").With("ping").Inc()
+	registry.Counter("requests_total", "Requests.", "method").With("ping").Inc()
+	assert.Equal(t, float64(2), registry.Counter("requests_total", "Requests.", "method").With("ping").Value())
+
+	assert.Panics(t, func() { registry.Gauge("requests_total", "Requests.", "method") })
+	assert.Panics(t, func() { registry.Counter("requests_total", "Requests.", "service") })
+	assert.Panics(t, func() { registry.Counter("requests_total", "Requests.", "method").With() })
+	assert.Panics(t, func() { registry.Counter("requests_total", "Requests.", "method").With("ping").Add(-1) })
+}
+
+// Ensures the Handler serves the metrics with the text format content type.
+func TestRegistryHandler(t *testing.T) {
+	registry := NewRegistry()
+	registry.Gauge("up", "Up.").With().Inc()
+
+	w := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP up Up.\n# TYPE up gauge\nup 1\n", w.Body.String())
+}
@@ -1,6 +1,7 @@
 package frugal
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"unicode"
@@ -38,9 +39,56 @@ type (
 		handler       InvocationHandler
 		proxiedStruct reflect.Value
 		proxiedMethod reflect.Method
+		hasMiddleware bool
+		annotations   *methodAnnotations
 	}
 )
 
+// methodAnnotations are the annotations of a Method, which are linked to the
+// FContext of each invocation. They're only returned for the method they
+// belong to, since the FContext's context.Context may be passed on to other
+// calls, e.g. with NewFContextFrom.
+type methodAnnotations struct {
+	service     reflect.Type
+	method      string
+	annotations map[string]string
+}
+
+// methodAnnotationsKey is the context.Context key of methodAnnotations.
+type methodAnnotationsKey struct{}
+
+// MethodAnnotations returns the annotations defined in the IDL for the method
+// invoked on the service with the arguments, as passed to an
+// InvocationHandler, or nil if the method has none. Annotations are
+// available to ServiceMiddleware applied to clients and processors. The
+// annotations of processor methods are those of the service the processor
+// serves, even if its handler serves other services too.
+func MethodAnnotations(service reflect.Value, method reflect.Method, args Arguments) map[string]string {
+	if !service.IsValid() || len(args) == 0 {
+		return nil
+	}
+	ctx, ok := args[0].(FContext)
+	if !ok {
+		return nil
+	}
+	annotated, ok := goContext(ctx).Value(methodAnnotationsKey{}).(*methodAnnotations)
+	if ok && annotated.service == service.Type() && annotated.method == method.Name {
+		return annotated.annotations
+	}
+	return nil
+}
+
+// SetAnnotations makes the annotations defined in the IDL for the Method
+// available to ServiceMiddleware applied to it via MethodAnnotations. This
+// should only be called by generated code.
+func (m *Method) SetAnnotations(annotations map[string]string) {
+	m.annotations = &methodAnnotations{
+		service:     m.proxiedStruct.Type(),
+		method:      m.proxiedMethod.Name,
+		annotations: annotations,
+	}
+}
+
 // Context returns the first argument value as an FContext.
 func (a Arguments) Context() FContext {
 	return a[0].(FContext)
@@ -66,9 +114,38 @@ func (r Results) SetError(err error) {
 	r[len(r)-1] = err
 }
 
+// ErrorResults returns Results for the method containing the zero value of
+// each return type and the given error. ServiceMiddleware which returns
+// without invoking the method must use this, since generated code expects
+// Results of the method's return types. Methods without return values, such
+// as subscriber handlers, get empty Results.
+func ErrorResults(method reflect.Method, err error) Results {
+	numOut := method.Type.NumOut()
+	results := make(Results, numOut)
+	if numOut == 0 {
+		return results
+	}
+	for i := 0; i < numOut-1; i++ {
+		results[i] = reflect.Zero(method.Type.Out(i)).Interface()
+	}
+	results[numOut-1] = err
+	return results
+}
+
 // Invoke the Method and return its results. This should only be called by
 // generated code.
 func (m *Method) Invoke(args Arguments) Results {
+	if m.annotations != nil && len(args) > 0 {
+		// The FContext may be used by other calls, so the annotations are
+		// linked to a copy of it for this invocation rather than to the
+		// FContext itself.
+		switch ctx := args[0].(type) {
+		case *FContextImpl:
+			args[0] = WithContext(ctx, context.WithValue(ctx.Context(), methodAnnotationsKey{}, m.annotations))
+		case *fContextWithGoContext:
+			args[0] = WithContext(ctx.FContext, context.WithValue(ctx.goCtx, methodAnnotationsKey{}, m.annotations))
+		}
+	}
 	return m.handler(m.proxiedStruct, m.proxiedMethod, args)
 }
 
@@ -76,6 +153,15 @@ func (m *Method) Invoke(args Arguments) Results {
 // only be called by generated code.
 func (m *Method) AddMiddleware(middleware ServiceMiddleware) {
 	m.handler = middleware(m.handler)
+	m.hasMiddleware = true
+}
+
+// HasMiddleware returns true if any ServiceMiddleware is applied to the
+// Method. Generated code calls the proxied method directly when there is no
+// middleware, avoiding the cost of Invoke, which boxes arguments and calls
+// the method with reflection. This should only be called by generated code.
+func (m *Method) HasMiddleware() bool {
+	return m.hasMiddleware
 }
 
 // NewMethod creates a new Method which proxies the given handler.
@@ -107,6 +193,7 @@ func NewMethod(proxiedHandler, method interface{}, methodName string, middleware
 		handler:       composeMiddleware(reflectMethodValue, middleware),
 		proxiedStruct: reflectHandler,
 		proxiedMethod: reflectMethod,
+		hasMiddleware: len(middleware) > 0,
 	}
 }
 
@@ -26,6 +26,7 @@ func TestServiceMiddleware(t *testing.T) {
 	middleware2 := newTestMiddleware(&calledContext2, ctx1, &calledArg2, &serviceName2, &methodName2)
 	handler := &testHandler{}
 	method := NewMethod(handler, handler.handlerMethod, "handlerMethod", []ServiceMiddleware{middleware1, middleware2})
+	assert.True(method.HasMiddleware())
 	called := make(chan bool, 1)
 	method.AddMiddleware(newTestSimpleMiddleware(called))
 
@@ -56,6 +57,7 @@ func TestServiceMiddlewareNoMiddleware(t *testing.T) {
 	assert := assert.New(t)
 	handler := &testHandler{}
 	method := NewMethod(handler, handler.handlerMethod, "handlerMethod", nil)
+	assert.False(method.HasMiddleware())
 
 	ctx := NewFContext("fooid")
 	arg := 42
@@ -65,6 +67,59 @@ func TestServiceMiddlewareNoMiddleware(t *testing.T) {
 	assert.Equal(arg, handler.calledArg)
 }
 
+// Ensure HasMiddleware returns true once middleware is added to a Method
+// created without any.
+func TestServiceMiddlewareAddMiddleware(t *testing.T) {
+	handler := &testHandler{}
+	method := NewMethod(handler, handler.handlerMethod, "handlerMethod", nil)
+	assert.False(t, method.HasMiddleware())
+
+	method.AddMiddleware(newTestSimpleMiddleware(make(chan bool, 1)))
+	assert.True(t, method.HasMiddleware())
+}
+
+// BenchmarkMethodDirectCall calls the proxied method the way generated code
+// does when no middleware is installed.
+func BenchmarkMethodDirectCall(b *testing.B) {
+	handler := &testHandler{}
+	method := NewMethod(handler, handler.handlerMethod, "handlerMethod", nil)
+	ctx := NewFContext("fooid")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !method.HasMiddleware() {
+			handler.handlerMethod(ctx, i)
+		}
+	}
+}
+
+// BenchmarkMethodInvoke calls the proxied method through Invoke with no
+// middleware installed.
+func BenchmarkMethodInvoke(b *testing.B) {
+	handler := &testHandler{}
+	method := NewMethod(handler, handler.handlerMethod, "handlerMethod", nil)
+	ctx := NewFContext("fooid")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		method.Invoke([]interface{}{ctx, i})
+	}
+}
+
+// BenchmarkMethodInvokeMiddleware calls the proxied method through Invoke
+// with a single middleware installed.
+func BenchmarkMethodInvokeMiddleware(b *testing.B) {
+	handler := &testHandler{}
+	middleware := newTestSimpleMiddleware(make(chan bool))
+	method := NewMethod(handler, handler.handlerMethod, "handlerMethod", []ServiceMiddleware{middleware})
+	ctx := NewFContext("fooid")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		method.Invoke([]interface{}{ctx, i})
+	}
+}
+
 type testHandler struct {
 	calledContext FContext
 	calledArg     int
@@ -103,3 +158,103 @@ func newTestSimpleMiddleware(called chan<- bool) ServiceMiddleware {
 		}
 	}
 }
+
+type annotatedHandler struct{}
+
+func (a *annotatedHandler) Ping(ctx FContext) error {
+	return nil
+}
+
+type annotatedPingProcessorFunction struct {
+	*FBaseProcessorFunction
+}
+
+func (a *annotatedPingProcessorFunction) Process(ctx FContext, in, out *FProtocol) error {
+	return nil
+}
+
+// Ensures ServiceMiddleware applied to processors can get the annotations of
+// the invoked handler method.
+func TestMethodAnnotationsProcessor(t *testing.T) {
+	var annotations map[string]string
+	middleware := func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			annotations = MethodAnnotations(service, method, args)
+			return next(service, method, args)
+		}
+	}
+	handler := &annotatedHandler{}
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &annotatedPingProcessorFunction{
+		NewFBaseProcessorFunction(processor.GetWriteMutex(),
+			NewMethod(handler, handler.Ping, "Ping", []ServiceMiddleware{middleware}))})
+	processor.AddToAnnotationsMap("ping", map[string]string{"foo": "bar"})
+
+	processor.processMap["ping"].(*annotatedPingProcessorFunction).InvokeMethod([]interface{}{NewFContext("")})
+	assert.Equal(t, map[string]string{"foo": "bar"}, annotations)
+}
+
+type otherPingProcessorFunction struct {
+	*FBaseProcessorFunction
+}
+
+func (o *otherPingProcessorFunction) Process(ctx FContext, in, out *FProtocol) error {
+	return nil
+}
+
+// Ensures a handler serving several services gets the annotations of the
+// service whose processor invoked it, and annotations aren't returned for
+// other methods invoked with the FContext.
+func TestMethodAnnotationsProcessorSharedHandler(t *testing.T) {
+	var annotations []map[string]string
+	middleware := func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			annotations = append(annotations, MethodAnnotations(service, method, args))
+			return next(service, method, args)
+		}
+	}
+	handler := &annotatedHandler{}
+	foo := NewFBaseProcessor()
+	foo.AddToProcessorMap("ping", &annotatedPingProcessorFunction{
+		NewFBaseProcessorFunction(foo.GetWriteMutex(),
+			NewMethod(handler, handler.Ping, "Ping", []ServiceMiddleware{middleware}))})
+	foo.AddToAnnotationsMap("ping", map[string]string{"service": "foo"})
+	bar := NewFBaseProcessor()
+	bar.AddToProcessorMap("ping", &otherPingProcessorFunction{
+		NewFBaseProcessorFunction(bar.GetWriteMutex(),
+			NewMethod(handler, handler.Ping, "Ping", []ServiceMiddleware{middleware}))})
+	bar.AddToAnnotationsMap("ping", map[string]string{"service": "bar"})
+
+	ctx := NewFContext("")
+	foo.processMap["ping"].(*annotatedPingProcessorFunction).InvokeMethod([]interface{}{ctx})
+	bar.processMap["ping"].(*otherPingProcessorFunction).InvokeMethod([]interface{}{NewFContext("")})
+	other := &testHandler{}
+	NewMethod(other, other.handlerMethod, "handlerMethod", []ServiceMiddleware{middleware}).
+		Invoke([]interface{}{ctx, 1})
+
+	assert.Equal(t, []map[string]string{{"service": "foo"}, {"service": "bar"}, nil}, annotations)
+}
+
+// Ensures invoking an annotated method doesn't change the caller's FContext,
+// so an FContext reused for many calls doesn't accumulate annotations.
+func TestMethodInvokeDoesNotChangeFContext(t *testing.T) {
+	var annotations map[string]string
+	middleware := func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			annotations = MethodAnnotations(service, method, args)
+			return next(service, method, args)
+		}
+	}
+	handler := &annotatedHandler{}
+	method := NewMethod(handler, handler.Ping, "Ping", []ServiceMiddleware{middleware})
+	method.SetAnnotations(map[string]string{"foo": "bar"})
+
+	ctx := NewFContext("").(*FContextImpl)
+	goCtx := ctx.Context()
+	for i := 0; i < 3; i++ {
+		method.Invoke([]interface{}{ctx})
+		assert.Equal(t, map[string]string{"foo": "bar"}, annotations)
+	}
+	assert.Equal(t, goCtx, ctx.Context())
+	assert.Nil(t, ctx.Context().Value(methodAnnotationsKey{}))
+}
@@ -0,0 +1,155 @@
+package frugal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// Header containing the name of the service a request is intended for.
+	// This is used by FMultiplexedProcessor for requests whose message name
+	// is not prefixed with the service name.
+	serviceHeader = "_service"
+
+	// multiplexedSeparator separates the service name from the method name in
+	// prefixed message names, e.g. "Foo:ping".
+	multiplexedSeparator = thrift.MULTIPLEXED_SEPARATOR
+)
+
+// messageProcessor is implemented by FProcessors which can process a request
+// whose request header and message begin have already been read. FBaseProcessor
+// implements this, so all generated FProcessors do as well.
+type messageProcessor interface {
+	FProcessor
+	processMessage(ctx FContext, name string, iprot, oprot *FProtocol) error
+}
+
+// FMultiplexedProcessor is an FProcessor which hosts several services on a
+// single FServer. It's Frugal's equivalent of Thrift's TMultiplexedProcessor.
+// Requests are routed to the FProcessor registered for the service name,
+// which is taken from the message name if it's prefixed with the service name
+// (e.g. "Foo:ping") or otherwise from the "_service" request header. Requests
+// which do not specify a service are routed to the default FProcessor, if one
+// is registered.
+//
+// Clients opt into the prefixed message names by using an FProtocolFactory
+// created with NewFMultiplexedProtocolFactory.
+type FMultiplexedProcessor struct {
+	writeMu          sync.Mutex
+	processors       map[string]messageProcessor
+	defaultProcessor messageProcessor
+}
+
+// NewFMultiplexedProcessor returns a new FMultiplexedProcessor with no
+// registered services.
+func NewFMultiplexedProcessor() *FMultiplexedProcessor {
+	return &FMultiplexedProcessor{processors: make(map[string]messageProcessor)}
+}
+
+// RegisterProcessor registers the FProcessor for the given service name. The
+// FProcessor must embed FBaseProcessor, which all generated FProcessors do.
+// This should only be called before the server is started.
+func (f *FMultiplexedProcessor) RegisterProcessor(serviceName string, processor FProcessor) {
+	f.processors[serviceName] = toMessageProcessor(processor)
+}
+
+// RegisterDefault registers the FProcessor used to handle requests which do
+// not specify a service name. This allows existing clients to continue to
+// work when their service is moved onto a multiplexed server. This should
+// only be called before the server is started.
+func (f *FMultiplexedProcessor) RegisterDefault(processor FProcessor) {
+	f.defaultProcessor = toMessageProcessor(processor)
+}
+
+// Process the request from the input protocol and write the response to the
+// output protocol.
+func (f *FMultiplexedProcessor) Process(iprot, oprot *FProtocol) error {
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	setRequestDeadline(ctx, iprot)
+	defer cancelContext(ctx)
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	return f.processMessage(ctx, name, iprot, oprot)
+}
+
+// processMessage routes the request to the FProcessor registered for its
+// service.
+func (f *FMultiplexedProcessor) processMessage(ctx FContext, name string, iprot, oprot *FProtocol) error {
+	serviceName, ok := ctx.RequestHeader(serviceHeader)
+	if parts := strings.SplitN(name, multiplexedSeparator, 2); len(parts) == 2 {
+		serviceName, name, ok = parts[0], parts[1], true
+	}
+
+	processor := f.defaultProcessor
+	if ok {
+		processor = f.processors[serviceName]
+	}
+	if processor != nil {
+		return processor.processMessage(ctx, name, iprot, oprot)
+	}
+
+	logger().Warnf("frugal: client invoked function %s on unknown service %s on request with correlation id %s",
+		name, serviceName, ctx.CorrelationID())
+	return skipAndWriteUnknownMethod(ctx, name, iprot, oprot, &f.writeMu)
+}
+
+// AddMiddleware adds the given ServiceMiddleware to every registered
+// FProcessor. This should only be called before the server is started.
+func (f *FMultiplexedProcessor) AddMiddleware(middleware ServiceMiddleware) {
+	for _, processor := range f.registered() {
+		processor.AddMiddleware(middleware)
+	}
+}
+
+// Annotations returns a map of method name to annotations as defined in the
+// service IDLs that are serviced by this processor. Method names are prefixed
+// with the service name they were registered with, e.g. "Foo:ping". Methods of
+// the default FProcessor are included without a prefix.
+func (f *FMultiplexedProcessor) Annotations() map[string]map[string]string {
+	annotations := make(map[string]map[string]string)
+	if f.defaultProcessor != nil {
+		for method, methodAnnotations := range f.defaultProcessor.Annotations() {
+			annotations[method] = methodAnnotations
+		}
+	}
+	for serviceName, processor := range f.processors {
+		for method, methodAnnotations := range processor.Annotations() {
+			annotations[serviceName+multiplexedSeparator+method] = methodAnnotations
+		}
+	}
+	return annotations
+}
+
+// registered returns the distinct registered FProcessors. The same FProcessor
+// may be registered for several services and as the default.
+func (f *FMultiplexedProcessor) registered() []messageProcessor {
+	seen := make(map[messageProcessor]bool)
+	processors := []messageProcessor{}
+	if f.defaultProcessor != nil {
+		seen[f.defaultProcessor] = true
+		processors = append(processors, f.defaultProcessor)
+	}
+	for _, processor := range f.processors {
+		if !seen[processor] {
+			seen[processor] = true
+			processors = append(processors, processor)
+		}
+	}
+	return processors
+}
+
+func toMessageProcessor(processor FProcessor) messageProcessor {
+	p, ok := processor.(messageProcessor)
+	if !ok {
+		panic(fmt.Sprintf("frugal: processor of type %T does not embed FBaseProcessor", processor))
+	}
+	return p
+}
@@ -0,0 +1,147 @@
+package frugal
+
+import (
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// namedProcessorFunction replies to a request with its name.
+type namedProcessorFunction struct {
+	name string
+}
+
+func (n *namedProcessorFunction) Process(ctx FContext, iprot, oprot *FProtocol) error {
+	if err := iprot.Skip(thrift.STRUCT); err != nil {
+		return err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	oprot.WriteResponseHeader(ctx)
+	oprot.WriteMessageBegin("ping", thrift.REPLY, 0)
+	oprot.WriteString(n.name)
+	oprot.WriteMessageEnd()
+	return oprot.Flush()
+}
+
+func (n *namedProcessorFunction) AddMiddleware(ServiceMiddleware) {}
+
+func newNamedProcessor(name string) *FBaseProcessor {
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &namedProcessorFunction{name})
+	processor.AddToAnnotationsMap("ping", map[string]string{"service": name})
+	return processor
+}
+
+// multiplexedCall sends a ping request with the given protocol factory to the
+// processor and returns the reply message name, type, and body.
+func multiplexedCall(t *testing.T, processor FProcessor, protoFactory *FProtocolFactory,
+	ctx FContext) (string, thrift.TMessageType, string) {
+	input := thrift.NewTMemoryBuffer()
+	oprot := protoFactory.GetProtocol(input)
+	assert.Nil(t, oprot.WriteRequestHeader(ctx))
+	assert.Nil(t, oprot.WriteMessageBegin("ping", thrift.CALL, 0))
+	assert.Nil(t, oprot.WriteStructBegin("args"))
+	assert.Nil(t, oprot.WriteFieldStop())
+	assert.Nil(t, oprot.WriteStructEnd())
+	assert.Nil(t, oprot.WriteMessageEnd())
+	assert.Nil(t, oprot.Flush())
+
+	output := thrift.NewTMemoryBuffer()
+	jsonFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	assert.Nil(t, processor.Process(jsonFactory.GetProtocol(input), jsonFactory.GetProtocol(output)))
+
+	iprot := jsonFactory.GetProtocol(output)
+	assert.Nil(t, iprot.ReadResponseHeader(ctx))
+	name, mType, _, err := iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	if mType == thrift.EXCEPTION {
+		ex, err := thrift.NewTApplicationException(0, "").Read(iprot)
+		assert.Nil(t, err)
+		return name, mType, ex.Error()
+	}
+	body, err := iprot.ReadString()
+	assert.Nil(t, err)
+	return name, mType, body
+}
+
+// Ensures FMultiplexedProcessor routes requests with prefixed message names
+// to the FProcessor registered for the service.
+func TestFMultiplexedProcessorPrefixedName(t *testing.T) {
+	processor := NewFMultiplexedProcessor()
+	processor.RegisterProcessor("Foo", newNamedProcessor("foo"))
+	processor.RegisterProcessor("Bar", newNamedProcessor("bar"))
+
+	for service, expected := range map[string]string{"Foo": "foo", "Bar": "bar"} {
+		protoFactory := NewFMultiplexedProtocolFactory(thrift.NewTJSONProtocolFactory(), service)
+		name, mType, body := multiplexedCall(t, processor, protoFactory, NewFContext(""))
+		assert.Equal(t, "ping", name)
+		assert.Equal(t, thrift.REPLY, mType)
+		assert.Equal(t, expected, body)
+	}
+}
+
+// Ensures FMultiplexedProcessor routes requests using the service request
+// header when the message name is not prefixed.
+func TestFMultiplexedProcessorServiceHeader(t *testing.T) {
+	processor := NewFMultiplexedProcessor()
+	processor.RegisterProcessor("Foo", newNamedProcessor("foo"))
+	processor.RegisterProcessor("Bar", newNamedProcessor("bar"))
+
+	ctx := NewFContext("")
+	ctx.AddRequestHeader(serviceHeader, "Bar")
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	name, mType, body := multiplexedCall(t, processor, protoFactory, ctx)
+	assert.Equal(t, "ping", name)
+	assert.Equal(t, thrift.REPLY, mType)
+	assert.Equal(t, "bar", body)
+}
+
+// Ensures FMultiplexedProcessor routes requests which do not specify a service
+// to the default FProcessor.
+func TestFMultiplexedProcessorDefault(t *testing.T) {
+	processor := NewFMultiplexedProcessor()
+	processor.RegisterProcessor("Foo", newNamedProcessor("foo"))
+	processor.RegisterDefault(newNamedProcessor("default"))
+
+	protoFactory := NewFProtocolFactory(thrift.NewTJSONProtocolFactory())
+	name, mType, body := multiplexedCall(t, processor, protoFactory, NewFContext(""))
+	assert.Equal(t, "ping", name)
+	assert.Equal(t, thrift.REPLY, mType)
+	assert.Equal(t, "default", body)
+}
+
+// Ensures FMultiplexedProcessor writes an UNKNOWN_METHOD
+// TApplicationException for requests to an unregistered service.
+func TestFMultiplexedProcessorUnknownService(t *testing.T) {
+	processor := NewFMultiplexedProcessor()
+	processor.RegisterProcessor("Foo", newNamedProcessor("foo"))
+
+	protoFactory := NewFMultiplexedProtocolFactory(thrift.NewTJSONProtocolFactory(), "Baz")
+	name, mType, body := multiplexedCall(t, processor, protoFactory, NewFContext(""))
+	assert.Equal(t, "ping", name)
+	assert.Equal(t, thrift.EXCEPTION, mType)
+	assert.Equal(t, "Unknown function ping", body)
+}
+
+// Ensures FMultiplexedProcessor prefixes annotations with the service name.
+func TestFMultiplexedProcessorAnnotations(t *testing.T) {
+	processor := NewFMultiplexedProcessor()
+	processor.RegisterProcessor("Foo", newNamedProcessor("foo"))
+	processor.RegisterDefault(newNamedProcessor("default"))
+
+	annotations := processor.Annotations()
+	assert.Equal(t, "foo", annotations["Foo:ping"]["service"])
+	assert.Equal(t, "default", annotations["ping"]["service"])
+}
+
+// Ensures RegisterProcessor panics for FProcessors which do not embed
+// FBaseProcessor.
+func TestFMultiplexedProcessorRegisterInvalid(t *testing.T) {
+	multiplexed := NewFMultiplexedProcessor()
+	assert.Panics(t, func() {
+		multiplexed.RegisterProcessor("Foo", &processor{t})
+	})
+}
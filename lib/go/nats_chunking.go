@@ -0,0 +1,482 @@
+package frugal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+)
+
+// Messages larger than the NATS message limit are sent in chunks. The first
+// chunk is sent like any other message, e.g. to a server's queue group, and
+// names the sender's fetch subject. The receiver of the first chunk requests
+// the remaining chunks on the fetch subject, and the sender publishes them in
+// order to the reply subject of the request. This ensures the remaining
+// chunks reach the same receiver as the first, even within queue groups.
+//
+// Each chunk has the following layout, in network byte order:
+//
+//	magic (4 bytes, 0xFFFFFFFF, which is never a valid frame size)
+//	message id (8 bytes)
+//	chunk index (4 bytes)
+//	chunk count (4 bytes)
+//	message size (4 bytes)
+//	fetch subject size (2 bytes) and fetch subject, first chunk only
+//	data
+const (
+	chunkMagic      = 0xFFFFFFFF
+	chunkHeaderSize = 24
+
+	// Bytes of each chunk reserved for its header and fetch subject
+	chunkOverhead = 1024
+
+	// Largest fetch subject which fits in the chunk overhead
+	maxFetchSubjectSize = chunkOverhead - chunkHeaderSize - 2
+
+	defaultChunkTimeout                 = 30 * time.Second
+	defaultChunkFetchTimeout            = 5 * time.Second
+	defaultMaxChunkSendBufferedBytes    = 32 * 1024 * 1024
+	defaultMaxChunkReceiveBufferedBytes = 32 * 1024 * 1024
+)
+
+// NatsChunkingPolicy configures the transfer of messages larger than the NATS
+// message limit in chunks by the NATS FTransport, FServer, FPublisherTransport
+// and FSubscriberTransport it's set on. Each of them buffers chunked messages
+// separately. Zero values are replaced with their defaults.
+type NatsChunkingPolicy struct {
+	// Enabled sends messages larger than the NATS message limit in chunks
+	// rather than rejecting them with a TTransportException of type
+	// TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE. Only enable it once every peer
+	// supports chunking. Chunked messages are received whether or not it's
+	// enabled.
+	Enabled bool
+
+	// MaxMessageSize is the largest message in bytes which is sent or
+	// reassembled. Defaults to 16MB.
+	MaxMessageSize int
+
+	// Timeout is how long a chunked message which is being reassembled is
+	// buffered. Defaults to 30s.
+	Timeout time.Duration
+
+	// FetchTimeout is how long a sent chunked message is buffered for its
+	// receivers to fetch the remaining chunks. Requests and responses are
+	// released as soon as they're fetched. Defaults to 5s.
+	FetchTimeout time.Duration
+
+	// MaxSendBufferedBytes is the most memory held for sent chunked messages
+	// which can be fetched. Messages which would exceed it are rejected with
+	// a TTransportException of type TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE.
+	// Defaults to 32MB.
+	MaxSendBufferedBytes int
+
+	// MaxReceiveBufferedBytes is the most memory held for chunked messages
+	// being reassembled. Messages which would exceed it are discarded.
+	// Defaults to 32MB.
+	MaxReceiveBufferedBytes int
+}
+
+// withDefaults returns the NatsChunkingPolicy with zero values replaced by
+// their defaults.
+func (p NatsChunkingPolicy) withDefaults() NatsChunkingPolicy {
+	if p.MaxMessageSize <= 0 {
+		p.MaxMessageSize = defaultMaxLength
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultChunkTimeout
+	}
+	if p.FetchTimeout <= 0 {
+		p.FetchTimeout = defaultChunkFetchTimeout
+	}
+	if p.MaxSendBufferedBytes <= 0 {
+		p.MaxSendBufferedBytes = defaultMaxChunkSendBufferedBytes
+	}
+	if p.MaxReceiveBufferedBytes <= 0 {
+		p.MaxReceiveBufferedBytes = defaultMaxChunkReceiveBufferedBytes
+	}
+	return p
+}
+
+// chunkHeader is the header of a chunk.
+type chunkHeader struct {
+	id           string
+	index        int
+	count        int
+	size         int
+	fetchSubject string
+}
+
+// isChunk returns true if the NATS message data is a chunk.
+func isChunk(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == chunkMagic
+}
+
+// parseChunk returns the header and data of a chunk.
+func parseChunk(data []byte) (*chunkHeader, []byte, error) {
+	if len(data) < chunkHeaderSize || !isChunk(data) {
+		return nil, nil, errors.New("frugal: invalid chunk")
+	}
+	header := &chunkHeader{
+		id:    string(data[4:12]),
+		index: int(binary.BigEndian.Uint32(data[12:16])),
+		count: int(binary.BigEndian.Uint32(data[16:20])),
+		size:  int(binary.BigEndian.Uint32(data[20:24])),
+	}
+	data = data[chunkHeaderSize:]
+	if header.index == 0 {
+		if len(data) < 2 {
+			return nil, nil, errors.New("frugal: invalid chunk")
+		}
+		subjectSize := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+subjectSize {
+			return nil, nil, errors.New("frugal: invalid chunk")
+		}
+		header.fetchSubject = string(data[2 : 2+subjectSize])
+		data = data[2+subjectSize:]
+	}
+	if header.index >= header.count {
+		return nil, nil, errors.New("frugal: invalid chunk")
+	}
+	return header, data, nil
+}
+
+// chunkedMessage is a message which was sent in chunks and can be fetched
+// until it expires.
+type chunkedMessage struct {
+	size   int
+	chunks [][]byte
+	// once removes the message after it's fetched, for messages with a
+	// single receiver.
+	once  bool
+	timer *time.Timer
+}
+
+// chunkAssembly is a chunked message being reassembled.
+type chunkAssembly struct {
+	header  *chunkHeader
+	msg     *nats.Msg
+	frame   []byte
+	next    int
+	deliver func(*nats.Msg)
+	timer   *time.Timer
+}
+
+// natsChunker sends and receives chunked messages over a NATS connection.
+// Sent messages and messages being reassembled are buffered within separate
+// budgets, so receiving messages doesn't prevent sending them and vice versa.
+type natsChunker struct {
+	conn          *nats.Conn
+	policy        NatsChunkingPolicy
+	mu            sync.Mutex
+	fetchSubject  string
+	fetchSub      *nats.Subscription
+	chunkInbox    string
+	chunkSub      *nats.Subscription
+	sent          map[string]*chunkedMessage
+	sentBytes     int
+	assemblies    map[string]*chunkAssembly
+	assemblyBytes int
+}
+
+// newNatsChunker returns a natsChunker which sends and receives chunked
+// messages over the NATS connection with the given NatsChunkingPolicy.
+func newNatsChunker(conn *nats.Conn, policy NatsChunkingPolicy) *natsChunker {
+	return &natsChunker{
+		conn:       conn,
+		policy:     policy.withDefaults(),
+		sent:       make(map[string]*chunkedMessage),
+		assemblies: make(map[string]*chunkAssembly),
+	}
+}
+
+// messageLimit returns the largest message in bytes which can be sent.
+func (c *natsChunker) messageLimit() int {
+	if c.policy.Enabled && c.policy.MaxMessageSize > natsMaxMessageSize {
+		return c.policy.MaxMessageSize
+	}
+	return natsMaxMessageSize
+}
+
+// reserve reserves memory for a chunked message in the given budget,
+// returning false if it would exceed max.
+func (c *natsChunker) reserve(buffered *int, max, size int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *buffered+size > max {
+		return false
+	}
+	*buffered += size
+	return true
+}
+
+// release releases memory reserved for a chunked message in the given budget.
+func (c *natsChunker) release(buffered *int, size int) {
+	c.mu.Lock()
+	*buffered -= size
+	c.mu.Unlock()
+}
+
+// publish publishes the data to the subject with the given reply subject,
+// sending it in chunks if it's larger than the NATS message limit. once
+// indicates the message has a single receiver. The caller must check the
+// data doesn't exceed messageLimit.
+func (c *natsChunker) publish(subject, reply string, data []byte, once bool) error {
+	if len(data) <= natsMaxMessageSize {
+		return c.conn.PublishRequest(subject, reply, data)
+	}
+
+	fetchSubject, err := c.subscribeFetch()
+	if err != nil {
+		return err
+	}
+	if !c.reserve(&c.sentBytes, c.policy.MaxSendBufferedBytes, len(data)) {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("frugal: chunk buffer full, can't send %d byte message", len(data)))
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		c.release(&c.sentBytes, len(data))
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	message := &chunkedMessage{size: len(data), chunks: splitChunks(string(id), data, fetchSubject), once: once}
+
+	c.mu.Lock()
+	c.sent[string(id)] = message
+	message.timer = time.AfterFunc(c.policy.FetchTimeout, func() {
+		c.removeSent(string(id), message)
+	})
+	c.mu.Unlock()
+
+	return c.conn.PublishRequest(subject, reply, message.chunks[0])
+}
+
+// splitChunks splits the data into chunks.
+func splitChunks(id string, data []byte, fetchSubject string) [][]byte {
+	size := natsMaxMessageSize - chunkOverhead
+	count := (len(data) + size - 1) / size
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, chunkHeaderSize, chunkHeaderSize+2+len(fetchSubject)+end-i*size)
+		binary.BigEndian.PutUint32(chunk, chunkMagic)
+		copy(chunk[4:12], id)
+		binary.BigEndian.PutUint32(chunk[12:16], uint32(i))
+		binary.BigEndian.PutUint32(chunk[16:20], uint32(count))
+		binary.BigEndian.PutUint32(chunk[20:24], uint32(len(data)))
+		if i == 0 {
+			chunk = append(chunk, byte(len(fetchSubject)>>8), byte(len(fetchSubject)))
+			chunk = append(chunk, fetchSubject...)
+		}
+		chunks[i] = append(chunk, data[i*size:end]...)
+	}
+	return chunks
+}
+
+// removeSent removes the sent chunked message if it's still retained.
+func (c *natsChunker) removeSent(id string, message *chunkedMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sent[id] != message {
+		return
+	}
+	delete(c.sent, id)
+	message.timer.Stop()
+	c.sentBytes -= message.size
+}
+
+// subscribeFetch subscribes to the fetch subject if it's not subscribed and
+// returns it.
+func (c *natsChunker) subscribeFetch() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fetchSub != nil {
+		return c.fetchSubject, nil
+	}
+	subject := nats.NewInbox()
+	if len(subject) > maxFetchSubjectSize {
+		return "", thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: chunk fetch subject %s too long", subject))
+	}
+	sub, err := c.conn.Subscribe(subject, c.handleFetch)
+	if err != nil {
+		return "", thrift.NewTTransportExceptionFromError(err)
+	}
+	c.fetchSubject = subject
+	c.fetchSub = sub
+	return subject, nil
+}
+
+// handleFetch publishes the remaining chunks of a sent chunked message to the
+// reply subject of the fetch request.
+func (c *natsChunker) handleFetch(msg *nats.Msg) {
+	id := string(msg.Data)
+	c.mu.Lock()
+	message, ok := c.sent[id]
+	c.mu.Unlock()
+	if !ok {
+		logger().Warn("frugal: chunked message fetched after it expired")
+		return
+	}
+	if message.once {
+		c.removeSent(id, message)
+	}
+	for _, chunk := range message.chunks[1:] {
+		if err := c.conn.Publish(msg.Reply, chunk); err != nil {
+			logger().Warnf("frugal: error publishing chunk: %s", err)
+			return
+		}
+	}
+}
+
+// receive passes the NATS message to deliver, reassembling it first if it's
+// the first chunk of a chunked message.
+func (c *natsChunker) receive(msg *nats.Msg, deliver func(*nats.Msg)) {
+	if !isChunk(msg.Data) {
+		deliver(msg)
+		return
+	}
+	header, data, err := parseChunk(msg.Data)
+	if err != nil || header.index != 0 {
+		logger().Warn("frugal: discarding invalid chunk")
+		return
+	}
+	if header.size > c.policy.MaxMessageSize {
+		logger().Warnf("frugal: discarding %d byte chunked message, exceeds %d bytes", header.size, c.policy.MaxMessageSize)
+		return
+	}
+	if !c.reserve(&c.assemblyBytes, c.policy.MaxReceiveBufferedBytes, header.size) {
+		logger().Warnf("frugal: chunk buffer full, discarding %d byte chunked message", header.size)
+		return
+	}
+	inbox, err := c.subscribeChunks()
+	if err != nil {
+		c.release(&c.assemblyBytes, header.size)
+		logger().Warnf("frugal: error subscribing to chunks: %s", err)
+		return
+	}
+
+	assembly := &chunkAssembly{
+		header:  header,
+		msg:     msg,
+		frame:   append(make([]byte, 0, header.size), data...),
+		next:    1,
+		deliver: deliver,
+	}
+	c.mu.Lock()
+	if _, ok := c.assemblies[header.id]; ok {
+		c.assemblyBytes -= header.size
+		c.mu.Unlock()
+		logger().Warn("frugal: discarding duplicate chunked message")
+		return
+	}
+	c.assemblies[header.id] = assembly
+	assembly.timer = time.AfterFunc(c.policy.Timeout, func() {
+		if c.removeAssembly(header.id, assembly) {
+			logger().Warnf("frugal: discarding incomplete chunked message after %s", c.policy.Timeout)
+		}
+	})
+	c.mu.Unlock()
+
+	if err := c.conn.PublishRequest(header.fetchSubject, inbox, []byte(header.id)); err != nil {
+		c.removeAssembly(header.id, assembly)
+		logger().Warnf("frugal: error fetching chunks: %s", err)
+	}
+}
+
+// subscribeChunks subscribes to the chunk inbox if it's not subscribed and
+// returns it.
+func (c *natsChunker) subscribeChunks() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chunkSub != nil {
+		return c.chunkInbox, nil
+	}
+	inbox := nats.NewInbox()
+	sub, err := c.conn.Subscribe(inbox, c.handleChunk)
+	if err != nil {
+		return "", err
+	}
+	c.chunkInbox = inbox
+	c.chunkSub = sub
+	return inbox, nil
+}
+
+// handleChunk adds a fetched chunk to its chunked message, delivering the
+// message once it's complete.
+func (c *natsChunker) handleChunk(msg *nats.Msg) {
+	header, data, err := parseChunk(msg.Data)
+	if err != nil {
+		logger().Warn("frugal: discarding invalid chunk")
+		return
+	}
+	c.mu.Lock()
+	assembly, ok := c.assemblies[header.id]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if header.index != assembly.next || len(assembly.frame)+len(data) > assembly.header.size {
+		c.removeAssembly(header.id, assembly)
+		logger().Warn("frugal: discarding chunked message with chunks out of sequence")
+		return
+	}
+	assembly.frame = append(assembly.frame, data...)
+	assembly.next++
+	if assembly.next < assembly.header.count {
+		return
+	}
+	if !c.removeAssembly(header.id, assembly) {
+		return
+	}
+	if len(assembly.frame) != assembly.header.size {
+		logger().Warn("frugal: discarding chunked message with incorrect size")
+		return
+	}
+	assembly.deliver(&nats.Msg{Subject: assembly.msg.Subject, Reply: assembly.msg.Reply, Data: assembly.frame})
+}
+
+// removeAssembly removes the chunked message being reassembled, returning
+// false if it was already removed.
+func (c *natsChunker) removeAssembly(id string, assembly *chunkAssembly) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.assemblies[id] != assembly {
+		return false
+	}
+	delete(c.assemblies, id)
+	assembly.timer.Stop()
+	c.assemblyBytes -= assembly.header.size
+	return true
+}
+
+// close unsubscribes and discards the chunked messages being sent or
+// reassembled.
+func (c *natsChunker) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sub := range []*nats.Subscription{c.fetchSub, c.chunkSub} {
+		if sub != nil {
+			sub.Unsubscribe()
+		}
+	}
+	c.fetchSub = nil
+	c.chunkSub = nil
+	for id, message := range c.sent {
+		message.timer.Stop()
+		c.sentBytes -= message.size
+		delete(c.sent, id)
+	}
+	for id, assembly := range c.assemblies {
+		assembly.timer.Stop()
+		c.assemblyBytes -= assembly.header.size
+		delete(c.assemblies, id)
+	}
+}
@@ -0,0 +1,231 @@
+package frugal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/nats-io/go-nats"
+	"github.com/stretchr/testify/assert"
+)
+
+// Ensures chunks are split and parsed.
+func TestSplitParseChunks(t *testing.T) {
+	data := make([]byte, 3*natsMaxMessageSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	chunks := splitChunks("abcdefgh", data, "fetch")
+	assert.Equal(t, 4, len(chunks))
+
+	var reassembled []byte
+	for i, chunk := range chunks {
+		assert.True(t, len(chunk) <= natsMaxMessageSize)
+		assert.True(t, isChunk(chunk))
+		header, chunkData, err := parseChunk(chunk)
+		assert.Nil(t, err)
+		assert.Equal(t, "abcdefgh", header.id)
+		assert.Equal(t, i, header.index)
+		assert.Equal(t, 4, header.count)
+		assert.Equal(t, len(data), header.size)
+		if i == 0 {
+			assert.Equal(t, "fetch", header.fetchSubject)
+		}
+		reassembled = append(reassembled, chunkData...)
+	}
+	assert.Equal(t, data, reassembled)
+
+	assert.False(t, isChunk(prependFrameSize(data)))
+	_, _, err := parseChunk(chunks[0][:chunkHeaderSize+1])
+	assert.NotNil(t, err)
+}
+
+// Ensures requests and responses larger than a NATS message are chunked
+// when chunking is enabled, including to servers in a queue group.
+func TestNatsChunkedRequestResponse(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	policy := NatsChunkingPolicy{Enabled: true}
+
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	for i := 0; i < 2; i++ {
+		server := NewFNatsServerBuilder(conn, &echoProcessor{}, protoFactory, []string{"foo"}).
+			WithQueueGroup("queue").
+			WithChunkingPolicy(policy).
+			Build()
+		go func() {
+			assert.Nil(t, server.Serve())
+		}()
+		defer server.Stop()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	tr := NewFNatsTransportBuilder(conn, "foo", "").WithChunkingPolicy(policy).Build()
+	assert.Nil(t, tr.Open())
+	defer tr.Close()
+	assert.Equal(t, uint(defaultMaxLength), tr.GetRequestSizeLimit())
+
+	for _, size := range []int{100, 3 * natsMaxMessageSize} {
+		for i := 0; i < 4; i++ {
+			body := compressibleString(size)
+			_, response := echo(t, tr, protoFactory, body)
+			assert.Equal(t, body, response)
+		}
+	}
+	chunker := tr.(*fNatsTransport).chunker
+	chunker.mu.Lock()
+	assert.Equal(t, 0, chunker.sentBytes)
+	assert.Equal(t, 0, chunker.assemblyBytes)
+	chunker.mu.Unlock()
+
+	ctx := NewFContext("")
+	_, err = tr.Request(ctx, stringMessage(t, protoFactory, ctx, compressibleString(defaultMaxLength)))
+	assert.Equal(t, TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+}
+
+// Ensures published messages larger than a NATS message are chunked and
+// received by each subscriber.
+func TestNatsChunkedPublish(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	policy := NatsChunkingPolicy{Enabled: true}
+
+	received := make(chan []byte, 2)
+	for i := 0; i < 2; i++ {
+		sub := NewFNatsSubscriberTransportFactory(conn).WithChunkingPolicy(policy).GetTransport()
+		assert.Nil(t, sub.Subscribe("foo", func(transport thrift.TTransport) error {
+			buff := new(bytes.Buffer)
+			_, err := buff.ReadFrom(transport)
+			received <- buff.Bytes()
+			return err
+		}))
+		defer sub.Unsubscribe()
+	}
+
+	pub := NewFNatsPublisherTransportFactory(conn).WithChunkingPolicy(policy).GetTransport()
+	assert.Nil(t, pub.Open())
+	defer pub.Close()
+	frame := make([]byte, 2*natsMaxMessageSize)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	assert.Nil(t, pub.Publish("foo", prependFrameSize(frame)))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			assert.Equal(t, frame, data)
+		case <-time.After(5 * time.Second):
+			t.Fatal("chunked message not received")
+		}
+	}
+}
+
+// Ensures chunked messages are rejected when they exceed the send or receive
+// buffer, and that a full receive buffer doesn't prevent sending.
+func TestNatsChunkingMemoryCap(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	policy := NatsChunkingPolicy{
+		Enabled:                 true,
+		MaxSendBufferedBytes:    2 * natsMaxMessageSize,
+		MaxReceiveBufferedBytes: 2 * natsMaxMessageSize,
+	}
+
+	pub := NewFNatsPublisherTransportFactory(conn).WithChunkingPolicy(policy).GetTransport()
+	assert.Nil(t, pub.Open())
+	defer pub.Close()
+	err = pub.Publish("foo", prependFrameSize(make([]byte, 3*natsMaxMessageSize)))
+	assert.Equal(t, TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+
+	// A received message exceeding the cap isn't reassembled.
+	chunker := newNatsChunker(conn, policy)
+	defer chunker.close()
+	chunks := splitChunks("abcdefgh", make([]byte, 3*natsMaxMessageSize), "fetch")
+	chunker.receive(&nats.Msg{Data: chunks[0]}, func(*nats.Msg) {
+		t.Fatal("message delivered")
+	})
+	chunker.mu.Lock()
+	assert.Equal(t, 0, len(chunker.assemblies))
+	assert.Equal(t, 0, chunker.assemblyBytes)
+	chunker.mu.Unlock()
+
+	// Messages being reassembled don't use the send buffer.
+	chunks = splitChunks("abcdefgh", make([]byte, 2*natsMaxMessageSize), "fetch")
+	chunker.receive(&nats.Msg{Data: chunks[0]}, func(*nats.Msg) {
+		t.Fatal("message delivered")
+	})
+	assert.Nil(t, chunker.publish("foo", "", make([]byte, 2*natsMaxMessageSize), false))
+	chunker.mu.Lock()
+	assert.Equal(t, 2*natsMaxMessageSize, chunker.assemblyBytes)
+	assert.Equal(t, 2*natsMaxMessageSize, chunker.sentBytes)
+	chunker.mu.Unlock()
+}
+
+// Ensures incomplete chunked messages are discarded after the timeout and
+// sent chunked messages which aren't fetched are released after the fetch
+// timeout.
+func TestNatsChunkingTimeout(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Nothing answers fetches on the fetch subject.
+	chunker := newNatsChunker(conn, NatsChunkingPolicy{
+		Enabled:      true,
+		Timeout:      20 * time.Millisecond,
+		FetchTimeout: 20 * time.Millisecond,
+	})
+	defer chunker.close()
+	chunks := splitChunks("abcdefgh", make([]byte, 2*natsMaxMessageSize), "fetch")
+	chunker.receive(&nats.Msg{Data: chunks[0]}, func(*nats.Msg) {
+		t.Fatal("message delivered")
+	})
+	// Nothing fetches the published message.
+	assert.Nil(t, chunker.publish("foo", "", make([]byte, 2*natsMaxMessageSize), false))
+	chunker.mu.Lock()
+	assert.Equal(t, 1, len(chunker.assemblies))
+	assert.Equal(t, 2*natsMaxMessageSize, chunker.assemblyBytes)
+	assert.Equal(t, 1, len(chunker.sent))
+	assert.Equal(t, 2*natsMaxMessageSize, chunker.sentBytes)
+	chunker.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	chunker.mu.Lock()
+	assert.Equal(t, 0, len(chunker.assemblies))
+	assert.Equal(t, 0, chunker.assemblyBytes)
+	assert.Equal(t, 0, len(chunker.sent))
+	assert.Equal(t, 0, chunker.sentBytes)
+	chunker.mu.Unlock()
+
+	// Chunks out of sequence discard the message.
+	chunker.receive(&nats.Msg{Data: chunks[0]}, func(*nats.Msg) {
+		t.Fatal("message delivered")
+	})
+	chunker.handleChunk(&nats.Msg{Data: chunks[2]})
+	chunker.mu.Lock()
+	assert.Equal(t, 0, len(chunker.assemblies))
+	assert.Equal(t, 0, chunker.assemblyBytes)
+	chunker.mu.Unlock()
+}
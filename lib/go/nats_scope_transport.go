@@ -1,7 +1,6 @@
 package frugal
 
 import (
-	"bytes"
 	"fmt"
 	"sync"
 	"time"
@@ -18,7 +17,8 @@ const flushTimeout = 5 * time.Second
 
 // FNatsPublisherTransportFactory creates FNatsPublisherTransports.
 type FNatsPublisherTransportFactory struct {
-	conn *nats.Conn
+	conn     *nats.Conn
+	chunking NatsChunkingPolicy
 }
 
 // NewFNatsPublisherTransportFactory creates an FNatsPublisherTransportFactory using
@@ -27,20 +27,28 @@ func NewFNatsPublisherTransportFactory(conn *nats.Conn) *FNatsPublisherTransport
 	return &FNatsPublisherTransportFactory{conn: conn}
 }
 
+// WithChunkingPolicy controls the transfer of published messages larger than
+// a NATS message in chunks. By default they're rejected.
+func (n *FNatsPublisherTransportFactory) WithChunkingPolicy(policy NatsChunkingPolicy) *FNatsPublisherTransportFactory {
+	n.chunking = policy
+	return n
+}
+
 // GetTransport creates a new NATS FPublisherTransport.
 func (n *FNatsPublisherTransportFactory) GetTransport() FPublisherTransport {
-	return NewNatsFPublisherTransport(n.conn)
+	return &fNatsPublisherTransport{conn: n.conn, chunker: newNatsChunker(n.conn, n.chunking)}
 }
 
 // fNatsPublisherTransport implements FPublisherTransport.
 type fNatsPublisherTransport struct {
-	conn *nats.Conn
+	conn    *nats.Conn
+	chunker *natsChunker
 }
 
 // NewNatsFPublisherTransport creates a new FPublisherTransport which is used for
 // publishing with scopes.
 func NewNatsFPublisherTransport(conn *nats.Conn) FPublisherTransport {
-	return &fNatsPublisherTransport{conn: conn}
+	return NewFNatsPublisherTransportFactory(conn).GetTransport()
 }
 
 // Open initializes the transport.
@@ -67,8 +75,10 @@ func (n *fNatsPublisherTransport) getClosedConditionError(prefix string) error {
 		fmt.Sprintf("%s NATS FPublisherTransport not open", prefix))
 }
 
-// Close closes the transport.
+// Close closes the transport. Chunked messages which haven't been fetched by
+// subscribers are discarded.
 func (n *fNatsPublisherTransport) Close() error {
+	n.chunker.close()
 	return nil
 }
 
@@ -76,7 +86,7 @@ func (n *fNatsPublisherTransport) Close() error {
 // to be published. A non-positive number is returned to indicate an
 // unbounded allowable size.
 func (n *fNatsPublisherTransport) GetPublishSizeLimit() uint {
-	return uint(natsMaxMessageSize)
+	return uint(n.chunker.messageLimit())
 }
 
 // Publish sends the given payload with the transport.
@@ -85,13 +95,13 @@ func (n *fNatsPublisherTransport) Publish(topic string, data []byte) error {
 		return n.getClosedConditionError("flush:")
 	}
 
-	if len(data) > natsMaxMessageSize {
+	if limit := n.chunker.messageLimit(); len(data) > limit {
 		return thrift.NewTTransportException(
 			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
-			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", natsMaxMessageSize, len(data)))
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
 	}
 
-	err := n.conn.Publish(n.formattedSubject(topic), data)
+	err := n.chunker.publish(n.formattedSubject(topic), "", data, false)
 	return thrift.NewTTransportExceptionFromError(err)
 }
 
@@ -101,8 +111,9 @@ func (n *fNatsPublisherTransport) formattedSubject(subject string) string {
 
 // FNatsSubscriberTransportFactory creates FNatsSubscriberTransports.
 type FNatsSubscriberTransportFactory struct {
-	conn  *nats.Conn
-	queue string
+	conn     *nats.Conn
+	queue    string
+	chunking NatsChunkingPolicy
 }
 
 // NewFNatsSubscriberTransportFactory creates an FNatsSubscriberTransportFactory using
@@ -120,9 +131,16 @@ func NewFNatsSubscriberTransportFactoryWithQueue(conn *nats.Conn, queue string)
 	return &FNatsSubscriberTransportFactory{conn: conn, queue: queue}
 }
 
+// WithChunkingPolicy controls the reassembly of published messages which
+// were sent in chunks.
+func (n *FNatsSubscriberTransportFactory) WithChunkingPolicy(policy NatsChunkingPolicy) *FNatsSubscriberTransportFactory {
+	n.chunking = policy
+	return n
+}
+
 // GetTransport creates a new NATS FSubscriberTransport.
 func (n *FNatsSubscriberTransportFactory) GetTransport() FSubscriberTransport {
-	return NewNatsFSubscriberTransportWithQueue(n.conn, n.queue)
+	return &fNatsSubscriberTransport{conn: n.conn, queue: n.queue, chunker: newNatsChunker(n.conn, n.chunking)}
 }
 
 // fNatsSubscriberTransport implements FSubscriberTransport.
@@ -132,12 +150,13 @@ type fNatsSubscriberTransport struct {
 	sub          *nats.Subscription
 	openMu       sync.RWMutex
 	isSubscribed bool
+	chunker      *natsChunker
 }
 
 // NewNatsFSubscriberTransport creates a new FSubscriberTransport which is used for
 // pub/sub. Subscribers using this transport will not use a queue.
 func NewNatsFSubscriberTransport(conn *nats.Conn) FSubscriberTransport {
-	return &fNatsSubscriberTransport{conn: conn}
+	return NewFNatsSubscriberTransportFactory(conn).GetTransport()
 }
 
 // NewNatsFSubscriberTransportWithQueue creates a new FSubscriberTransport which is used
@@ -145,7 +164,7 @@ func NewNatsFSubscriberTransport(conn *nats.Conn) FSubscriberTransport {
 // queue, forming a queue group. When a queue group is formed, only one member
 // receives the message.
 func NewNatsFSubscriberTransportWithQueue(conn *nats.Conn, queue string) FSubscriberTransport {
-	return &fNatsSubscriberTransport{conn: conn, queue: queue}
+	return NewFNatsSubscriberTransportFactoryWithQueue(conn, queue).GetTransport()
 }
 
 // Subscribe sets the subscribe topic and opens the transport.
@@ -167,7 +186,10 @@ func (n *fNatsSubscriberTransport) Subscribe(topic string, callback FAsyncCallba
 			"cannot subscribe to empty subject")
 	}
 
-	sub, err := n.conn.QueueSubscribe(n.formattedSubject(topic), n.queue, handleMessage(callback))
+	handler := handleMessage(callback)
+	sub, err := n.conn.QueueSubscribe(n.formattedSubject(topic), n.queue, func(msg *nats.Msg) {
+		n.chunker.receive(msg, handler)
+	})
 	if err != nil {
 		return thrift.NewTTransportExceptionFromError(err)
 	}
@@ -185,7 +207,8 @@ func handleMessage(callback FAsyncCallback) func(*nats.Msg) {
 			logger().Warn("frugal: Discarding invalid scope message frame")
 			return
 		}
-		transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(msg.Data[4:])}
+		transport := acquireFrameTransport(msg.Data[4:])
+		defer releaseFrameTransport(transport)
 		if err := callback(transport); err != nil {
 			logger().Warn("frugal: error executing callback: ", err)
 		}
@@ -223,6 +246,7 @@ func (n *fNatsSubscriberTransport) Unsubscribe() error {
 	}
 	n.sub = nil
 	n.isSubscribed = false
+	n.chunker.close()
 	return nil
 }
 
@@ -2,6 +2,12 @@ package frugal
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
@@ -13,6 +19,58 @@ const (
 	defaultWatermark    = 5 * time.Second
 )
 
+// LoadSheddingPolicy determines what the NATS FServer does with a request it
+// receives while its work queue is full.
+type LoadSheddingPolicy int
+
+const (
+	// LoadSheddingBlock blocks the NATS subscription until there is room in
+	// the work queue. This is the default.
+	LoadSheddingBlock LoadSheddingPolicy = iota
+
+	// LoadSheddingDropNewest discards the request which was just received.
+	// The client is sent an APPLICATION_EXCEPTION_OVERLOADED
+	// TApplicationException.
+	LoadSheddingDropNewest
+
+	// LoadSheddingDropOldest discards the request which has been waiting in
+	// the work queue the longest to make room for the request which was just
+	// received. The client is sent an APPLICATION_EXCEPTION_OVERLOADED
+	// TApplicationException.
+	LoadSheddingDropOldest
+)
+
+// ExpiredRequestPolicy determines what the NATS FServer does with a request
+// whose timeout elapsed while it was waiting in the work queue.
+type ExpiredRequestPolicy int
+
+const (
+	// ExpiredRequestFail responds to expired requests with a
+	// DEADLINE_EXCEEDED TApplicationException without processing them. This
+	// is the default.
+	ExpiredRequestFail ExpiredRequestPolicy = iota
+
+	// ExpiredRequestDrop discards expired requests without responding.
+	ExpiredRequestDrop
+
+	// ExpiredRequestProcess processes expired requests like any other
+	// request.
+	ExpiredRequestProcess
+)
+
+// FNatsServerObserver is notified of activity in the NATS FServer's work
+// queue, e.g. to export metrics. Its methods are called synchronously by the
+// server, so they must be safe for concurrent use and should not block.
+type FNatsServerObserver interface {
+	// QueueDepth is called with the number of requests waiting in the work
+	// queue after a request is received or taken off the queue.
+	QueueDepth(depth int)
+
+	// QueueWait is called with the time a request spent waiting in the work
+	// queue before a worker took it.
+	QueueWait(wait time.Duration)
+}
+
 type frameWrapper struct {
 	frameBytes []byte
 	timestamp  time.Time
@@ -29,6 +87,10 @@ type FNatsServerBuilder struct {
 	workerCount   uint
 	queueLen      uint
 	highWatermark time.Duration
+	loadShedding  LoadSheddingPolicy
+	expired       ExpiredRequestPolicy
+	observer      FNatsServerObserver
+	chunking      NatsChunkingPolicy
 }
 
 // NewFNatsServerBuilder creates a builder which configures and builds NATS
@@ -43,6 +105,8 @@ func NewFNatsServerBuilder(conn *nats.Conn, processor FProcessor,
 		workerCount:   1,
 		queueLen:      defaultWorkQueueLen,
 		highWatermark: defaultWatermark,
+		loadShedding:  LoadSheddingBlock,
+		expired:       ExpiredRequestFail,
 	}
 }
 
@@ -72,6 +136,34 @@ func (f *FNatsServerBuilder) WithHighWatermark(highWatermark time.Duration) *FNa
 	return f
 }
 
+// WithLoadSheddingPolicy controls what happens to requests received while the
+// work queue is full. The default is LoadSheddingBlock.
+func (f *FNatsServerBuilder) WithLoadSheddingPolicy(policy LoadSheddingPolicy) *FNatsServerBuilder {
+	f.loadShedding = policy
+	return f
+}
+
+// WithExpiredRequestPolicy controls what happens to requests whose timeout
+// elapsed while they were waiting in the work queue. The default is
+// ExpiredRequestFail.
+func (f *FNatsServerBuilder) WithExpiredRequestPolicy(policy ExpiredRequestPolicy) *FNatsServerBuilder {
+	f.expired = policy
+	return f
+}
+
+// WithObserver sets the FNatsServerObserver notified of work queue activity.
+func (f *FNatsServerBuilder) WithObserver(observer FNatsServerObserver) *FNatsServerBuilder {
+	f.observer = observer
+	return f
+}
+
+// WithChunkingPolicy controls the transfer of requests and responses larger
+// than a NATS message in chunks. By default they're rejected.
+func (f *FNatsServerBuilder) WithChunkingPolicy(policy NatsChunkingPolicy) *FNatsServerBuilder {
+	f.chunking = policy
+	return f
+}
+
 // Build a new configured NATS FServer.
 func (f *FNatsServerBuilder) Build() FServer {
 	return &fNatsServer{
@@ -83,7 +175,12 @@ func (f *FNatsServerBuilder) Build() FServer {
 		workerCount:   f.workerCount,
 		workC:         make(chan *frameWrapper, f.queueLen),
 		quit:          make(chan struct{}),
+		drain:         make(chan struct{}),
 		highWatermark: f.highWatermark,
+		loadShedding:  f.loadShedding,
+		expired:       f.expired,
+		observer:      f.observer,
+		chunker:       newNatsChunker(f.conn, f.chunking),
 	}
 }
 
@@ -98,41 +195,115 @@ type fNatsServer struct {
 	workerCount   uint
 	workC         chan *frameWrapper
 	quit          chan struct{}
+	quitOnce      sync.Once
+	drain         chan struct{}
+	drainOnce     sync.Once
 	highWatermark time.Duration
+	loadShedding  LoadSheddingPolicy
+	expired       ExpiredRequestPolicy
+	observer      FNatsServerObserver
+	subMu         sync.Mutex
+	subscriptions []*nats.Subscription
+	shutdown      bool
+	workers       sync.WaitGroup
+	inFlight      int32
+	chunker       *natsChunker
 }
 
 // Serve starts the server.
 func (f *fNatsServer) Serve() error {
-	subscriptions := []*nats.Subscription{}
+	f.subMu.Lock()
+	// The workers are added while holding subMu so Shutdown can't be waiting
+	// on them concurrently. A server which was shut down before it started
+	// doesn't serve.
+	if f.shutdown {
+		f.subMu.Unlock()
+		return nil
+	}
 	for _, subject := range f.subjects {
-		sub, err := f.conn.QueueSubscribe(subject, f.queue, f.handler)
+		sub, err := f.conn.QueueSubscribe(subject, f.queue, f.receive)
 		if err != nil {
+			f.subMu.Unlock()
+			f.unsubscribe()
 			return err
 		}
-		subscriptions = append(subscriptions, sub)
+		f.subscriptions = append(f.subscriptions, sub)
 	}
+	f.workers.Add(int(f.workerCount))
+	f.subMu.Unlock()
 
 	for i := uint(0); i < f.workerCount; i++ {
-		go f.worker()
+		go func() {
+			defer f.workers.Done()
+			f.worker()
+		}()
 	}
 
 	logger().Info("frugal: server running...")
 	<-f.quit
 	logger().Info("frugal: server stopping...")
 
-	for _, sub := range subscriptions {
-		sub.Unsubscribe()
-	}
+	f.unsubscribe()
+	f.chunker.close()
 
 	return nil
 }
 
-// Stop the server.
+// Stop the server. Requests which are queued or being processed are
+// abandoned.
 func (f *fNatsServer) Stop() error {
-	close(f.quit)
+	f.quitOnce.Do(func() { close(f.quit) })
 	return nil
 }
 
+// Shutdown gracefully stops the server. It unsubscribes from the server's
+// subjects and waits for the queued and in-flight requests to be processed
+// until the context is done. If the context is done first, the server is
+// stopped and the number of requests which were abandoned is returned along
+// with the context's error.
+func (f *fNatsServer) Shutdown(ctx context.Context) (int, error) {
+	f.subMu.Lock()
+	f.shutdown = true
+	f.subMu.Unlock()
+	f.unsubscribe()
+	f.drainOnce.Do(func() { close(f.drain) })
+
+	done := make(chan struct{})
+	go func() {
+		f.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		f.Stop()
+		// Requests may have been queued by a subscription callback which
+		// was running when the server unsubscribed.
+		return len(f.workC), nil
+	case <-ctx.Done():
+		abandoned := len(f.workC) + int(atomic.LoadInt32(&f.inFlight))
+		f.Stop()
+		return abandoned, ctx.Err()
+	}
+}
+
+// unsubscribe removes the server's subscriptions so no new requests are
+// received.
+func (f *fNatsServer) unsubscribe() {
+	f.subMu.Lock()
+	defer f.subMu.Unlock()
+	for _, sub := range f.subscriptions {
+		sub.Unsubscribe()
+	}
+	f.subscriptions = nil
+}
+
+// receive is invoked when a NATS message is received. Chunked requests are
+// reassembled before they're handled.
+func (f *fNatsServer) receive(msg *nats.Msg) {
+	f.chunker.receive(msg, f.handler)
+}
+
 // handler is invoked when a request is received. The request is placed on the
 // work channel which is processed by a worker goroutine.
 func (f *fNatsServer) handler(msg *nats.Msg) {
@@ -140,10 +311,38 @@ func (f *fNatsServer) handler(msg *nats.Msg) {
 		logger().Warn("frugal: discarding invalid NATS request (no reply)")
 		return
 	}
-	select {
-	case f.workC <- &frameWrapper{frameBytes: msg.Data, timestamp: time.Now(), reply: msg.Reply}:
-	case <-f.quit:
-		return
+	frame := &frameWrapper{frameBytes: msg.Data, timestamp: time.Now(), reply: msg.Reply}
+	defer f.observeQueueDepth()
+
+	switch f.loadShedding {
+	case LoadSheddingDropNewest:
+		select {
+		case f.workC <- frame:
+		default:
+			logger().Warn("frugal: work queue full, dropping newest request")
+			f.shed(frame)
+		}
+	case LoadSheddingDropOldest:
+		for {
+			select {
+			case f.workC <- frame:
+				return
+			case <-f.quit:
+				return
+			default:
+			}
+			select {
+			case oldest := <-f.workC:
+				logger().Warn("frugal: work queue full, dropping oldest request")
+				f.shed(oldest)
+			default:
+			}
+		}
+	default:
+		select {
+		case f.workC <- frame:
+		case <-f.quit:
+		}
 	}
 }
 
@@ -155,26 +354,139 @@ func (f *fNatsServer) worker() {
 		case <-f.quit:
 			return
 		case frame := <-f.workC:
-			dur := time.Since(frame.timestamp)
-			if dur > f.highWatermark {
-				logger().Warnf("frugal: request spent %+v in the transport buffer, your consumer might be backed up", dur)
-			}
-			if err := f.processFrame(frame.frameBytes, frame.reply); err != nil {
-				logger().Errorf("frugal: error processing request: %s", err.Error())
+			f.processWork(frame)
+		case <-f.drain:
+			// Process the remaining queued requests and exit.
+			for {
+				select {
+				case <-f.quit:
+					return
+				case frame := <-f.workC:
+					f.processWork(frame)
+				default:
+					return
+				}
 			}
 		}
 	}
 }
 
-// processFrame invokes the FProcessor and sends the response on the given
-// subject.
-func (f *fNatsServer) processFrame(frame []byte, reply string) error {
-	// Read and process frame.
+// processWork processes a request taken off the work channel.
+func (f *fNatsServer) processWork(frame *frameWrapper) {
+	atomic.AddInt32(&f.inFlight, 1)
+	defer atomic.AddInt32(&f.inFlight, -1)
+
+	dur := time.Since(frame.timestamp)
+	if f.observer != nil {
+		f.observer.QueueDepth(len(f.workC))
+		f.observer.QueueWait(dur)
+	}
+	if dur > f.highWatermark {
+		logger().Warnf("frugal: request spent %+v in the transport buffer, your consumer might be backed up", dur)
+	}
+	if f.expired != ExpiredRequestProcess && dur > requestTimeout(frame.frameBytes) {
+		f.handleExpired(frame, dur)
+		return
+	}
+	if err := f.processFrame(frame.frameBytes, frame.reply, frame.timestamp); err != nil {
+		logger().Errorf("frugal: error processing request: %s", err.Error())
+	}
+}
+
+// observeQueueDepth notifies the FNatsServerObserver, if any, of the current
+// work queue depth.
+func (f *fNatsServer) observeQueueDepth() {
+	if f.observer != nil {
+		f.observer.QueueDepth(len(f.workC))
+	}
+}
+
+// handleExpired drops or fails a request whose timeout elapsed while it was
+// waiting in the work queue, depending on the ExpiredRequestPolicy.
+func (f *fNatsServer) handleExpired(frame *frameWrapper, dur time.Duration) {
+	if f.expired == ExpiredRequestDrop {
+		logger().Warnf("frugal: dropping request which expired after %+v in the transport buffer", dur)
+		return
+	}
+	logger().Warnf("frugal: failing request which expired after %+v in the transport buffer", dur)
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_DEADLINE_EXCEEDED,
+		"frugal: request timed out before it was processed")
+	if err := f.failFrame(frame.frameBytes, frame.reply, ex); err != nil {
+		logger().Errorf("frugal: error failing expired request: %s", err.Error())
+	}
+}
+
+// shed responds to a request dropped by the LoadSheddingPolicy with an
+// OVERLOADED TApplicationException, so the client can back off or retry
+// elsewhere rather than waiting for its request to time out.
+func (f *fNatsServer) shed(frame *frameWrapper) {
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_OVERLOADED,
+		"frugal: request dropped by overloaded server")
+	if err := f.failFrame(frame.frameBytes, frame.reply, ex); err != nil {
+		logger().Errorf("frugal: error failing dropped request: %s", err.Error())
+	}
+}
+
+// failFrame responds to the request with the given TApplicationException
+// without invoking the FProcessor.
+func (f *fNatsServer) failFrame(frame []byte, reply string, ex thrift.TApplicationException) error {
+	if len(frame) < 4 {
+		return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid frame size %d", len(frame)))
+	}
 	input := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(frame[4:])} // Discard frame size
-	// Only allow 1MB to be buffered.
-	output := NewTMemoryOutputBuffer(natsMaxMessageSize)
+	output := NewTMemoryOutputBuffer(uint(f.chunker.messageLimit()))
 	iprot := f.protoFactory.GetProtocol(input)
 	oprot := f.protoFactory.GetProtocol(output)
+	ctx, err := iprot.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	name, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return err
+	}
+	// Strip the service name from multiplexed requests.
+	if idx := strings.Index(name, multiplexedSeparator); idx >= 0 {
+		name = name[idx+len(multiplexedSeparator):]
+	}
+
+	if err := writeApplicationException(ctx, oprot, name, ex); err != nil {
+		return err
+	}
+	return f.chunker.publish(reply, "", output.Bytes(), true)
+}
+
+// requestTimeout returns the timeout of the request contained in the given
+// frame. The default timeout is returned if the frame has no valid timeout.
+func requestTimeout(frame []byte) time.Duration {
+	if len(frame) < 4 {
+		return defaultTimeout
+	}
+	header, err := getHeaderFromFrame(frame[4:], timeoutHeader)
+	if err != nil {
+		return defaultTimeout
+	}
+	timeoutMillis, err := strconv.ParseInt(header, 10, 64)
+	if err != nil {
+		return defaultTimeout
+	}
+	return time.Millisecond * time.Duration(timeoutMillis)
+}
+
+// processFrame invokes the FProcessor and sends the response on the given
+// subject. The request's deadline is derived from the time it was received.
+func (f *fNatsServer) processFrame(frame []byte, reply string, received time.Time) error {
+	// Read and process frame.
+	input := acquireFrameTransport(frame[4:]) // Discard frame size
+	defer releaseFrameTransport(input)
+	// Only allow 1MB to be buffered, unless responses can be chunked.
+	output := NewTMemoryOutputBuffer(uint(f.chunker.messageLimit()))
+	// The NATS connection copies the response when it's published, and
+	// chunked responses are copied into chunks.
+	defer output.Release()
+	iprot := f.protoFactory.GetProtocol(&receivedFrame{TMemoryBuffer: input, received: received})
+	oprot := f.protoFactory.GetProtocol(output)
 	if err := f.processor.Process(iprot, oprot); err != nil {
 		return err
 	}
@@ -184,5 +496,5 @@ func (f *fNatsServer) processFrame(frame []byte, reply string) error {
 	}
 
 	// Send response.
-	return f.conn.Publish(reply, output.Bytes())
+	return f.chunker.publish(reply, "", output.Bytes(), true)
 }
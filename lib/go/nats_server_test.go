@@ -1,7 +1,10 @@
 package frugal
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -73,3 +76,317 @@ func (p *processor) AddMiddleware(middleware ServiceMiddleware) {}
 func (p *processor) Annotations() map[string]map[string]string {
 	return nil
 }
+
+// requestFrame returns a request frame for the Foo:ping method with the given
+// FContext.
+func requestFrame(t *testing.T, protoFactory *FProtocolFactory, ctx FContext) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteMessageBegin("Foo:ping", thrift.CALL, 0))
+	assert.Nil(t, proto.WriteMessageEnd())
+	return buffer.Bytes()
+}
+
+// expiredRequest returns a request with the given timeout which has been
+// waiting in the work queue for longer than the timeout.
+func expiredRequest(t *testing.T, protoFactory *FProtocolFactory, timeout time.Duration, reply string) *frameWrapper {
+	ctx := NewFContext("")
+	ctx.SetTimeout(timeout)
+	return &frameWrapper{
+		frameBytes: requestFrame(t, protoFactory, ctx),
+		timestamp:  time.Now().Add(-2 * timeout),
+		reply:      reply,
+	}
+}
+
+// Ensures the NATS FServer responds to requests which expired in the work
+// queue with a DEADLINE_EXCEEDED TApplicationException without processing
+// them.
+func TestFNatsServerExpiredRequestFail(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &processor{t}, protoFactory, []string{"foo"}).
+		Build().(*fNatsServer)
+	sub, err := conn.SubscribeSync("reply")
+	assert.Nil(t, err)
+
+	go server.worker()
+	defer server.Stop()
+	server.workC <- expiredRequest(t, protoFactory, 10*time.Millisecond, "reply")
+
+	msg, err := sub.NextMsg(time.Second)
+	assert.Nil(t, err)
+	resultProto := protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(msg.Data[4:])})
+	ctx := NewFContext("")
+	assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+	name, mType, _, err := resultProto.ReadMessageBegin()
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", name)
+	assert.Equal(t, thrift.EXCEPTION, mType)
+	ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "").Read(resultProto)
+	assert.Nil(t, err)
+	assert.True(t, IsErrDeadlineExceeded(ex))
+}
+
+// Ensures the NATS FServer discards requests which expired in the work queue
+// when configured with ExpiredRequestDrop.
+func TestFNatsServerExpiredRequestDrop(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, &processor{t}, protoFactory, []string{"foo"}).
+		WithExpiredRequestPolicy(ExpiredRequestDrop).
+		Build().(*fNatsServer)
+	sub, err := conn.SubscribeSync("reply")
+	assert.Nil(t, err)
+
+	go server.worker()
+	defer server.Stop()
+	server.workC <- expiredRequest(t, protoFactory, 10*time.Millisecond, "reply")
+
+	_, err = sub.NextMsg(50 * time.Millisecond)
+	assert.Equal(t, nats.ErrTimeout, err)
+}
+
+// Ensures the NATS FServer discards the received request when the work queue
+// is full and it's configured with LoadSheddingDropNewest.
+func TestFNatsServerLoadSheddingDropNewest(t *testing.T) {
+	server := NewFNatsServerBuilder(nil, &processor{t}, nil, []string{"foo"}).
+		WithQueueLength(1).
+		WithLoadSheddingPolicy(LoadSheddingDropNewest).
+		Build().(*fNatsServer)
+
+	server.handler(&nats.Msg{Data: []byte{1}, Reply: "reply"})
+	server.handler(&nats.Msg{Data: []byte{2}, Reply: "reply"})
+
+	assert.Equal(t, 1, len(server.workC))
+	assert.Equal(t, []byte{1}, (<-server.workC).frameBytes)
+}
+
+// Ensures the NATS FServer discards the oldest queued request when the work
+// queue is full and it's configured with LoadSheddingDropOldest.
+func TestFNatsServerLoadSheddingDropOldest(t *testing.T) {
+	server := NewFNatsServerBuilder(nil, &processor{t}, nil, []string{"foo"}).
+		WithQueueLength(1).
+		WithLoadSheddingPolicy(LoadSheddingDropOldest).
+		Build().(*fNatsServer)
+
+	server.handler(&nats.Msg{Data: []byte{1}, Reply: "reply"})
+	server.handler(&nats.Msg{Data: []byte{2}, Reply: "reply"})
+
+	assert.Equal(t, 1, len(server.workC))
+	assert.Equal(t, []byte{2}, (<-server.workC).frameBytes)
+}
+
+// Ensures the NATS FServer responds to requests dropped by the
+// LoadSheddingPolicy with an OVERLOADED TApplicationException.
+func TestFNatsServerLoadSheddingReply(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	for _, policy := range []LoadSheddingPolicy{LoadSheddingDropNewest, LoadSheddingDropOldest} {
+		server := NewFNatsServerBuilder(conn, &processor{t}, protoFactory, []string{"foo"}).
+			WithQueueLength(1).
+			WithLoadSheddingPolicy(policy).
+			Build().(*fNatsServer)
+		sub, err := conn.SubscribeSync("dropped")
+		assert.Nil(t, err)
+
+		first, second := "dropped", "queued"
+		if policy == LoadSheddingDropNewest {
+			first, second = second, first
+		}
+		ctx := NewFContext("")
+		server.handler(&nats.Msg{Data: requestFrame(t, protoFactory, ctx), Reply: first})
+		server.handler(&nats.Msg{Data: requestFrame(t, protoFactory, ctx), Reply: second})
+
+		msg, err := sub.NextMsg(time.Second)
+		assert.Nil(t, err)
+		resultProto := protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(msg.Data[4:])})
+		assert.Nil(t, resultProto.ReadResponseHeader(NewFContext("")))
+		_, mType, _, err := resultProto.ReadMessageBegin()
+		assert.Nil(t, err)
+		assert.Equal(t, thrift.EXCEPTION, mType)
+		ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "").Read(resultProto)
+		assert.Nil(t, err)
+		assert.True(t, IsErrOverloaded(ex))
+		assert.Equal(t, "queued", (<-server.workC).reply)
+		sub.Unsubscribe()
+	}
+}
+
+type queueObserver struct {
+	depths []int
+	waits  []time.Duration
+}
+
+func (q *queueObserver) QueueDepth(depth int) {
+	q.depths = append(q.depths, depth)
+}
+
+func (q *queueObserver) QueueWait(wait time.Duration) {
+	q.waits = append(q.waits, wait)
+}
+
+// Ensures the NATS FServer notifies its FNatsServerObserver of the work queue
+// depth and the time requests wait in the queue.
+func TestFNatsServerObserver(t *testing.T) {
+	observer := &queueObserver{}
+	server := NewFNatsServerBuilder(nil, &processor{t}, nil, []string{"foo"}).
+		WithQueueLength(2).
+		WithExpiredRequestPolicy(ExpiredRequestDrop).
+		WithObserver(observer).
+		Build().(*fNatsServer)
+
+	server.handler(&nats.Msg{Data: []byte{1}, Reply: "reply"})
+	server.handler(&nats.Msg{Data: []byte{2}, Reply: "reply"})
+	assert.Equal(t, []int{1, 2}, observer.depths)
+
+	frame := <-server.workC
+	frame.timestamp = frame.timestamp.Add(-time.Minute)
+	server.processWork(frame)
+	assert.Equal(t, []int{1, 2, 1}, observer.depths)
+	assert.Equal(t, 1, len(observer.waits))
+	assert.True(t, observer.waits[0] >= time.Minute)
+}
+
+// Ensures requestTimeout returns the timeout header of the request frame and
+// falls back to the default timeout for invalid frames.
+func TestRequestTimeout(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	frame := expiredRequest(t, protoFactory, 42*time.Millisecond, "reply")
+
+	assert.Equal(t, 42*time.Millisecond, requestTimeout(frame.frameBytes))
+	assert.Equal(t, defaultTimeout, requestTimeout([]byte{0, 0}))
+	assert.Equal(t, defaultTimeout, requestTimeout([]byte{0, 0, 0, 1, 9}))
+}
+
+// slowProcessor responds to requests after a delay.
+type slowProcessor struct {
+	delay     time.Duration
+	processed int32
+}
+
+func (p *slowProcessor) Process(in, out *FProtocol) error {
+	ctx, err := in.ReadRequestHeader()
+	if err != nil {
+		return err
+	}
+	time.Sleep(p.delay)
+	atomic.AddInt32(&p.processed, 1)
+	if err := out.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	if err := out.WriteString("foo"); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+func (p *slowProcessor) AddMiddleware(middleware ServiceMiddleware) {}
+
+func (p *slowProcessor) Annotations() map[string]map[string]string {
+	return nil
+}
+
+// Ensures Shutdown processes the queued requests before stopping the NATS
+// FServer.
+func TestFNatsServerShutdown(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	processor := &slowProcessor{delay: 10 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, processor, protoFactory, []string{"foo"}).
+		Build().(*fNatsServer)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	sub, err := conn.SubscribeSync("reply")
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		server.handler(&nats.Msg{Data: requestFrame(t, protoFactory, NewFContext("")), Reply: "reply"})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := server.Shutdown(ctx)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&processor.processed))
+	for i := 0; i < 3; i++ {
+		_, err := sub.NextMsg(time.Second)
+		assert.Nil(t, err)
+	}
+	select {
+	case err := <-served:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected Serve to return")
+	}
+}
+
+// Ensures Shutdown stops the NATS FServer and reports the abandoned requests
+// when the context is done before the queued requests are processed.
+func TestFNatsServerShutdownAbandoned(t *testing.T) {
+	s := runServer(nil)
+	defer s.Shutdown()
+	conn, err := nats.Connect(fmt.Sprintf("nats://localhost:%d", defaultOptions.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	processor := &slowProcessor{delay: 100 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFNatsServerBuilder(conn, processor, protoFactory, []string{"foo"}).
+		Build().(*fNatsServer)
+	go server.Serve()
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		server.handler(&nats.Msg{Data: requestFrame(t, protoFactory, NewFContext("")), Reply: "reply"})
+	}
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	abandoned, err := server.Shutdown(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 3, abandoned)
+}
+
+// Ensures Stop can be called after Shutdown and Serve returns without
+// serving.
+func TestFNatsServerStopAfterShutdown(t *testing.T) {
+	server := NewFNatsServerBuilder(nil, &processor{t}, nil, []string{"foo"}).Build().(FGracefulServer)
+
+	abandoned, err := server.Shutdown(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+	assert.Nil(t, server.Stop())
+	assert.Nil(t, server.Serve())
+}
@@ -14,13 +14,31 @@ const (
 	frugalPrefix       = "frugal."
 )
 
-// NewFNatsTransport returns a new FTransport which uses the NATS messaging
-// system as the underlying transport. This FTransport is stateless in that
-// there is no connection maintained between the client and server. A request
-// is simply published to a subject and responses are received on another
-// subject. This requires requests and responses to fit within a single NATS
-// message.
-func NewFNatsTransport(conn *nats.Conn, subject, inbox string) FTransport {
+// FNatsTransportBuilder configures and builds NATS FTransport instances.
+type FNatsTransportBuilder struct {
+	conn     *nats.Conn
+	subject  string
+	inbox    string
+	chunking NatsChunkingPolicy
+}
+
+// NewFNatsTransportBuilder creates a builder which configures and builds NATS
+// FTransport instances which publish requests to the given subject and
+// receive responses on the given inbox. A random inbox is used if it's empty.
+func NewFNatsTransportBuilder(conn *nats.Conn, subject, inbox string) *FNatsTransportBuilder {
+	return &FNatsTransportBuilder{conn: conn, subject: subject, inbox: inbox}
+}
+
+// WithChunkingPolicy controls the transfer of requests and responses larger
+// than a NATS message in chunks. By default they're rejected.
+func (f *FNatsTransportBuilder) WithChunkingPolicy(policy NatsChunkingPolicy) *FNatsTransportBuilder {
+	f.chunking = policy
+	return f
+}
+
+// Build a new configured NATS FTransport.
+func (f *FNatsTransportBuilder) Build() FTransport {
+	inbox := f.inbox
 	if inbox == "" {
 		inbox = nats.NewInbox()
 	}
@@ -28,22 +46,35 @@ func NewFNatsTransport(conn *nats.Conn, subject, inbox string) FTransport {
 		// FTransports manually frame messages.
 		// Leave enough room for frame size.
 		fBaseTransport: newFBaseTransport(natsMaxMessageSize - 4),
-		conn:           conn,
-		subject:        subject,
+		conn:           f.conn,
+		subject:        f.subject,
 		inbox:          inbox,
+		chunker:        newNatsChunker(f.conn, f.chunking),
 	}
 }
 
+// NewFNatsTransport returns a new FTransport which uses the NATS messaging
+// system as the underlying transport. This FTransport is stateless in that
+// there is no connection maintained between the client and server. A request
+// is simply published to a subject and responses are received on another
+// subject. Requests and responses larger than a NATS message are rejected
+// unless chunking is enabled with FNatsTransportBuilder.WithChunkingPolicy.
+func NewFNatsTransport(conn *nats.Conn, subject, inbox string) FTransport {
+	return NewFNatsTransportBuilder(conn, subject, inbox).Build()
+}
+
 // fNatsTransport implements FTransport. This is a "stateless" transport in the
 // sense that there is no connection with a server. A request is simply
 // published to a subject and responses are received on another subject.
-// This assumes requests/responses fit within a single NATS message.
+// Requests and responses larger than a NATS message are sent in chunks if
+// chunking is enabled.
 type fNatsTransport struct {
 	*fBaseTransport
 	conn    *nats.Conn
 	subject string
 	inbox   string
 	sub     *nats.Subscription
+	chunker *natsChunker
 }
 
 // Open subscribes to the configured inbox subject.
@@ -69,8 +100,14 @@ func (f *fNatsTransport) Open() error {
 	return nil
 }
 
-// handler receives a NATS message and executes the frame
+// handler receives a NATS message and executes the frame, reassembling it
+// first if it's chunked.
 func (f *fNatsTransport) handler(msg *nats.Msg) {
+	f.chunker.receive(msg, f.executeFrame)
+}
+
+// executeFrame executes the frame of a NATS message.
+func (f *fNatsTransport) executeFrame(msg *nats.Msg) {
 	if err := f.fBaseTransport.ExecuteFrame(msg.Data); err != nil {
 		logger().Warn("Could not execute frame", err)
 	}
@@ -90,16 +127,17 @@ func (f *fNatsTransport) Close() error {
 		return thrift.NewTTransportExceptionFromError(err)
 	}
 	f.sub = nil
+	f.chunker.close()
 
 	f.fBaseTransport.Close(nil)
 	return nil
 }
 
 func (f *fNatsTransport) checkMessageSize(data []byte) error {
-	if len(data) > natsMaxMessageSize {
+	if limit := f.chunker.messageLimit(); len(data) > limit {
 		return thrift.NewTTransportException(
 			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
-			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", natsMaxMessageSize, len(data)))
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", limit, len(data)))
 	}
 	return nil
 }
@@ -120,7 +158,11 @@ func (f *fNatsTransport) Oneway(ctx FContext, data []byte) error {
 		return err
 	}
 
-	return f.conn.PublishRequest(f.subject, f.inbox, data)
+	if goContext(ctx).Err() != nil {
+		return contextError(ctx)
+	}
+
+	return f.chunker.publish(f.subject, f.inbox, data, true)
 }
 
 // Request transmits the given data and waits for a response.
@@ -144,13 +186,19 @@ func (f *fNatsTransport) Request(ctx FContext, data []byte) (thrift.TTransport,
 		return nil, err
 	}
 
-	if err := f.conn.PublishRequest(f.subject, f.inbox, data); err != nil {
+	if goContext(ctx).Err() != nil {
+		return nil, contextError(ctx)
+	}
+
+	if err := f.chunker.publish(f.subject, f.inbox, data, true); err != nil {
 		return nil, err
 	}
 
 	select {
 	case result := <-resultC:
 		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
+	case <-goContext(ctx).Done():
+		return nil, contextError(ctx)
 	case <-time.After(ctx.Timeout()):
 		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: nats request timed out")
 	}
@@ -160,7 +208,7 @@ func (f *fNatsTransport) Request(ctx FContext, data []byte) (thrift.TTransport,
 // transmitted. Returns a non-positive number to indicate an unbounded
 // allowable size.
 func (f *fNatsTransport) GetRequestSizeLimit() uint {
-	return uint(natsMaxMessageSize)
+	return uint(f.chunker.messageLimit())
 }
 
 // This is a no-op for fNatsTransport
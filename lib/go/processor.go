@@ -1,6 +1,8 @@
 package frugal
 
 import (
+	"fmt"
+	"runtime/debug"
 	"sync"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
@@ -31,6 +33,7 @@ type FBaseProcessor struct {
 	writeMu        sync.Mutex
 	processMap     map[string]FProcessorFunction
 	annotationsMap map[string]map[string]string
+	recoverPanics  bool
 }
 
 // NewFBaseProcessor returns a new FBaseProcessor which FProcessors can extend.
@@ -38,6 +41,7 @@ func NewFBaseProcessor() *FBaseProcessor {
 	return &FBaseProcessor{
 		processMap:     make(map[string]FProcessorFunction),
 		annotationsMap: make(map[string]map[string]string),
+		recoverPanics:  true,
 	}
 }
 
@@ -48,20 +52,48 @@ func (f *FBaseProcessor) Process(iprot, oprot *FProtocol) error {
 	if err != nil {
 		return err
 	}
+	setRequestDeadline(ctx, iprot)
+	defer cancelContext(ctx)
 	name, _, _, err := iprot.ReadMessageBegin()
 	if err != nil {
 		return err
 	}
+	return f.processMessage(ctx, name, iprot, oprot)
+}
+
+// processMessage invokes the FProcessorFunction registered for the given
+// method name. The request header and message begin have already been read
+// from the input protocol.
+func (f *FBaseProcessor) processMessage(ctx FContext, name string, iprot, oprot *FProtocol) (err error) {
 	if processor, ok := f.processMap[name]; ok {
-		if err := processor.Process(ctx, iprot, oprot); err != nil {
-			if _, ok := err.(thrift.TException); ok {
+		span := StartSpan(ctx, name, SpanKindServer)
+		var processErr error
+		defer func() {
+			// Errors which were written to the client as a response, such
+			// as exceptions returned by the handler, aren't returned by
+			// Process.
+			if processErr == nil {
+				processErr = responseError(ctx)
+			}
+			span.Finish(processErr)
+		}()
+		if f.recoverPanics {
+			defer func() {
+				if r := recover(); r != nil {
+					processErr = fmt.Errorf("panic: %v", r)
+					err = f.writePanic(ctx, name, oprot, r)
+				}
+			}()
+		}
+		if processErr = processor.Process(ctx, iprot, oprot); processErr != nil {
+			if _, ok := processErr.(thrift.TException); ok {
 				logger().Errorf(
 					"frugal: error occurred while processing request with correlation id %s: %s",
-					ctx.CorrelationID(), err.Error())
+					ctx.CorrelationID(), processErr.Error())
 			} else {
 				logger().Errorf(
 					"frugal: user handler code returned unhandled error on request with correlation id %s: %s",
-					ctx.CorrelationID(), err.Error())
+					ctx.CorrelationID(), processErr.Error())
 			}
 		}
 		// Return nil because the server should still send a response to the client.
@@ -70,31 +102,34 @@ func (f *FBaseProcessor) Process(iprot, oprot *FProtocol) error {
 
 	logger().Warnf("frugal: client invoked unknown function %s on request with correlation id %s",
 		name, ctx.CorrelationID())
-	if err := iprot.Skip(thrift.STRUCT); err != nil {
-		return err
-	}
-	if err := iprot.ReadMessageEnd(); err != nil {
-		return err
-	}
-	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN_METHOD, "Unknown function "+name)
-	f.writeMu.Lock()
-	defer f.writeMu.Unlock()
-	if err := oprot.WriteResponseHeader(ctx); err != nil {
-		return err
-	}
-	if err := oprot.WriteMessageBegin(name, thrift.EXCEPTION, 0); err != nil {
-		return err
-	}
-	if err := ex.Write(oprot); err != nil {
-		return err
-	}
-	if err := oprot.WriteMessageEnd(); err != nil {
-		return err
-	}
-	if err := oprot.Flush(); err != nil {
-		return err
-	}
-	return nil
+	return skipAndWriteUnknownMethod(ctx, name, iprot, oprot, &f.writeMu)
+}
+
+// writePanic logs a panic recovered while processing the named method along
+// with its stack and writes an INTERNAL_ERROR TApplicationException response
+// for it in place of any partial response. The panic isn't described to the
+// client, since it may contain sensitive data.
+//
+// The write mutex isn't locked, since the panic may have happened while it
+// was held, e.g. by generated code writing the response. The output protocol
+// belongs to the request being processed, so no other writes can interleave.
+func (f *FBaseProcessor) writePanic(ctx FContext, name string, oprot *FProtocol, r interface{}) error {
+	logger().Errorf(
+		"frugal: recovered from panic while processing %s on request with correlation id %s: %v\n%s",
+		name, ctx.CorrelationID(), r, debug.Stack())
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR,
+		fmt.Sprintf("Internal error processing %s", name))
+	oprot.discardWrites()
+	return writeApplicationException(ctx, oprot, name, ex)
+}
+
+// SetRecoverPanics controls whether panics in handlers, middleware, and
+// FProcessorFunctions are recovered. Recovered panics are logged and an
+// INTERNAL_ERROR TApplicationException is sent to the client. This is enabled
+// by default. Disabling it, e.g. in tests, lets panics propagate. This should
+// only be called before the server is started.
+func (f *FBaseProcessor) SetRecoverPanics(recoverPanics bool) {
+	f.recoverPanics = recoverPanics
 }
 
 // AddMiddleware adds the given ServiceMiddleware to the FProcessor. This
@@ -111,8 +146,13 @@ func (f *FBaseProcessor) AddToProcessorMap(key string, proc FProcessorFunction)
 }
 
 // AddToAnnotationsMap registers the given annotations to the given method.
+// The method's FProcessorFunction must already be registered for its
+// annotations to be available to ServiceMiddleware via MethodAnnotations.
 func (f *FBaseProcessor) AddToAnnotationsMap(method string, annotations map[string]string) {
 	f.annotationsMap[method] = annotations
+	if proc, ok := f.processMap[method].(methodProcessorFunction); ok {
+		proc.method().SetAnnotations(annotations)
+	}
 }
 
 // Annotations returns a map of method name to annotations as defined in
@@ -150,6 +190,12 @@ type FProcessorFunction interface {
 	AddMiddleware(middleware ServiceMiddleware)
 }
 
+// methodProcessorFunction is implemented by FProcessorFunctions which embed
+// FBaseProcessorFunction.
+type methodProcessorFunction interface {
+	method() *Method
+}
+
 // FBaseProcessorFunction is a base implementation of FProcessorFunction.
 // FProcessorFunctions should embed this. This should only be used by generated
 // code.
@@ -170,13 +216,59 @@ func (f *FBaseProcessorFunction) GetWriteMutex() *sync.Mutex {
 	return f.writeMu
 }
 
+// method returns the Method which proxies the handler method.
+func (f *FBaseProcessorFunction) method() *Method {
+	return f.handler
+}
+
 // AddMiddleware adds the given ServiceMiddleware to the FProcessorFunction.
 // This should only be called before the server is started.
 func (f *FBaseProcessorFunction) AddMiddleware(middleware ServiceMiddleware) {
 	f.handler.AddMiddleware(middleware)
 }
 
+// HasMiddleware returns true if any ServiceMiddleware is applied to the
+// handler method. Generated code calls the handler directly when there is no
+// middleware rather than using InvokeMethod.
+func (f *FBaseProcessorFunction) HasMiddleware() bool {
+	return f.handler.HasMiddleware()
+}
+
 // InvokeMethod invokes the handler method.
 func (f *FBaseProcessorFunction) InvokeMethod(args []interface{}) Results {
 	return f.handler.Invoke(args)
 }
+
+// skipAndWriteUnknownMethod skips the remainder of the request message and
+// writes an UNKNOWN_METHOD TApplicationException response for it.
+func skipAndWriteUnknownMethod(ctx FContext, name string, iprot, oprot *FProtocol, writeMu *sync.Mutex) error {
+	if err := iprot.Skip(thrift.STRUCT); err != nil {
+		return err
+	}
+	if err := iprot.ReadMessageEnd(); err != nil {
+		return err
+	}
+	ex := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN_METHOD, "Unknown function "+name)
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	return writeApplicationException(ctx, oprot, name, ex)
+}
+
+// writeApplicationException writes the given TApplicationException as the
+// response to the named method. The caller is responsible for synchronizing
+// access to the output protocol.
+func writeApplicationException(ctx FContext, oprot *FProtocol, name string, ex thrift.TApplicationException) error {
+	if err := oprot.WriteResponseHeader(ctx); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageBegin(name, thrift.EXCEPTION, 0); err != nil {
+		return err
+	}
+	if err := ex.Write(oprot); err != nil {
+		return err
+	}
+	if err := oprot.WriteMessageEnd(); err != nil {
+		return err
+	}
+	return oprot.Flush()
+}
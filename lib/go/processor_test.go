@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 	"github.com/Sirupsen/logrus"
@@ -242,3 +244,176 @@ func TestFBaseProcessorAnnotations(t *testing.T) {
 	assert.Equal("baz", annoMap["foo"]["bar"])
 	assert.Equal("boom", annoMap["foo"]["boosh"])
 }
+
+// panicProcessor panics when processing a request after writing part of the
+// response.
+type panicProcessor struct{}
+
+func (p *panicProcessor) Process(ctx FContext, iprot, oprot *FProtocol) error {
+	oprot.WriteResponseHeader(ctx)
+	oprot.WriteMessageBegin("ping", thrift.REPLY, 0)
+	panic("boom")
+}
+
+func (p *panicProcessor) AddMiddleware(ServiceMiddleware) {}
+
+// Ensures FBaseProcessor recovers panics in FProcessorFunctions, logs them
+// with the correlation id and stack, and writes an INTERNAL_ERROR
+// TApplicationException response without the panic in place of the partial
+// response.
+func TestFBaseProcessorRecoverPanic(t *testing.T) {
+	tmpLogger := logrus.New()
+	var logBuf bytes.Buffer
+	tmpLogger.Out = &logBuf
+	oldLogger := logger()
+	SetLogger(tmpLogger)
+	defer func() {
+		SetLogger(oldLogger)
+	}()
+
+	input := thrift.NewTMemoryBuffer()
+	input.Write(pingFrame)
+	output := thrift.NewTMemoryBuffer()
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &panicProcessor{})
+
+	assert.Nil(t, processor.Process(&FProtocol{thrift.NewTJSONProtocol(input)},
+		&FProtocol{thrift.NewTJSONProtocol(output)}))
+	assert.True(t,
+		strings.Contains(
+			string(logBuf.Bytes()),
+			"frugal: recovered from panic while processing ping on request with correlation id 123: boom"))
+	assert.True(t, strings.Contains(string(logBuf.Bytes()), "panicProcessor"))
+
+	oprot := &FProtocol{thrift.NewTJSONProtocol(output)}
+	ctx := NewFContext("")
+	setRequestOpID(ctx, 0)
+	assert.Nil(t, oprot.ReadResponseHeader(ctx))
+	name, mType, _, err := oprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", name)
+	assert.Equal(t, thrift.EXCEPTION, mType)
+	ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "").Read(oprot)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(APPLICATION_EXCEPTION_INTERNAL_ERROR), ex.TypeId())
+	assert.Equal(t, "Internal error processing ping", ex.Error())
+	assert.Equal(t, 0, output.Len())
+}
+
+// lockedPanicProcessor panics while holding the write mutex, as generated
+// code which locks it without defer does if writing the response panics.
+type lockedPanicProcessor struct {
+	writeMu *sync.Mutex
+}
+
+func (p *lockedPanicProcessor) Process(ctx FContext, iprot, oprot *FProtocol) error {
+	p.writeMu.Lock()
+	oprot.WriteResponseHeader(ctx)
+	panic("boom")
+}
+
+func (p *lockedPanicProcessor) AddMiddleware(ServiceMiddleware) {}
+
+// Ensures FBaseProcessor writes the INTERNAL_ERROR response for a panic which
+// happened while the write mutex was held without deadlocking.
+func TestFBaseProcessorRecoverPanicWriteLocked(t *testing.T) {
+	input := thrift.NewTMemoryBuffer()
+	input.Write(pingFrame)
+	output := thrift.NewTMemoryBuffer()
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &lockedPanicProcessor{writeMu: processor.GetWriteMutex()})
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- processor.Process(&FProtocol{thrift.NewTJSONProtocol(input)},
+			&FProtocol{thrift.NewTJSONProtocol(output)})
+	}()
+	select {
+	case err := <-errC:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Process deadlocked writing the panic response")
+	}
+
+	oprot := &FProtocol{thrift.NewTJSONProtocol(output)}
+	ctx := NewFContext("")
+	setRequestOpID(ctx, 0)
+	assert.Nil(t, oprot.ReadResponseHeader(ctx))
+	_, mType, _, err := oprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	assert.Equal(t, thrift.EXCEPTION, mType)
+	ex, err := thrift.NewTApplicationException(APPLICATION_EXCEPTION_UNKNOWN, "").Read(oprot)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(APPLICATION_EXCEPTION_INTERNAL_ERROR), ex.TypeId())
+}
+
+// Ensures FBaseProcessor lets panics propagate when panic recovery is
+// disabled.
+func TestFBaseProcessorRecoverPanicDisabled(t *testing.T) {
+	input := thrift.NewTMemoryBuffer()
+	input.Write(pingFrame)
+	output := thrift.NewTMemoryBuffer()
+	processor := NewFBaseProcessor()
+	processor.SetRecoverPanics(false)
+	processor.AddToProcessorMap("ping", &panicProcessor{})
+
+	assert.Panics(t, func() {
+		processor.Process(&FProtocol{thrift.NewTJSONProtocol(input)},
+			&FProtocol{thrift.NewTJSONProtocol(output)})
+	})
+}
+
+type traceProcessor struct {
+	traceparent string
+	responseErr error
+}
+
+func (p *traceProcessor) Process(ctx FContext, iprot, oprot *FProtocol) error {
+	p.traceparent, _ = ctx.RequestHeader(traceparentHeader)
+	if p.responseErr != nil {
+		SetResponseError(ctx, p.responseErr)
+	}
+	return nil
+}
+
+func (p *traceProcessor) AddMiddleware(ServiceMiddleware) {}
+
+// Ensures FBaseProcessor processes requests in a server span which is a
+// child of the client's span.
+func TestFBaseProcessorSpan(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	processor := NewFBaseProcessor()
+	processorFunction := &traceProcessor{}
+	processor.AddToProcessorMap("ping", processorFunction)
+	ctx := NewFContext("")
+	ctx.AddRequestHeader(traceparentHeader, testTraceparent)
+
+	assert.Nil(t, processor.processMessage(ctx, "ping", nil, nil))
+	spans := exporter.Spans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "ping", spans[0].Name)
+	assert.Equal(t, SpanKindServer, spans[0].Kind)
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].ParentID.String())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+spans[0].SpanID.String()+"-01",
+		processorFunction.traceparent)
+}
+
+// Ensures FBaseProcessor's server span records the errors written to the
+// client as a response, which Process doesn't return.
+func TestFBaseProcessorSpanResponseError(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	responseErr := thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR, "error")
+	processor := NewFBaseProcessor()
+	processor.AddToProcessorMap("ping", &traceProcessor{responseErr: responseErr})
+
+	assert.Nil(t, processor.processMessage(NewFContext(""), "ping", nil, nil))
+	spans := exporter.Spans()
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, responseErr, spans[0].Err)
+}
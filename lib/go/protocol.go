@@ -1,19 +1,28 @@
 package frugal
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"unicode/utf8"
 
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
 
-const protocolV0 = 0x00
+const (
+	protocolV0 = 0x00
+	protocolV1 = 0x01
+
+	// v1 header value types.
+	v1StringValue = 0x00
+	v1BinaryValue = 0x01
+)
 
 var (
-	writeMarshaler = v0Marshaler
-	v0Marshaler    = &v0ProtocolMarshaler{}
+	v0Marshaler = &v0ProtocolMarshaler{}
+	v1Marshaler = &v1ProtocolMarshaler{}
 )
 
 type frameComponents struct {
@@ -36,6 +45,11 @@ type protocolMarshaler interface {
 	// into a map.
 	unmarshalHeadersFromFrame(frame []byte) (map[string]string, error)
 
+	// unmarshalHeaderFromFrame reads the value of the named header from the
+	// serialized headers in the byte slice without unmarshaling the others.
+	// An empty string is returned if the header is not present.
+	unmarshalHeaderFromFrame(frame []byte, name string) (string, error)
+
 	// addHeadersToFrame returns a new frame containing the given headers. This
 	// assumes the frame still has the frame size header at the beginning.
 	addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error)
@@ -50,6 +64,8 @@ func getMarshaler(version byte) (protocolMarshaler, error) {
 	switch version {
 	case protocolV0:
 		return v0Marshaler, nil
+	case protocolV1:
+		return v1Marshaler, nil
 	default:
 		return nil, thrift.NewTProtocolExceptionWithType(
 			thrift.BAD_VERSION, fmt.Errorf("frugal: unsupported protocol version %d", version))
@@ -62,18 +78,74 @@ func getMarshaler(version byte) (protocolMarshaler, error) {
 // provided TTransport. This makes it easy to produce an FProtocol which uses
 // any existing Thrift transports and protocols in a composable manner.
 type FProtocolFactory struct {
-	protoFactory thrift.TProtocolFactory
+	protoFactory      thrift.TProtocolFactory
+	compression       *compressionState
+	propagatedHeaders []string
+	writeMarshaler    protocolMarshaler
 }
 
 // NewFProtocolFactory creates a new FProtocolFactory with the given
 // TProtocolFactory.
 func NewFProtocolFactory(protoFactory thrift.TProtocolFactory) *FProtocolFactory {
-	return &FProtocolFactory{protoFactory}
+	return &FProtocolFactory{protoFactory: protoFactory}
+}
+
+// NewFMultiplexedProtocolFactory creates a new FProtocolFactory with the
+// given TProtocolFactory which prefixes request message names with the given
+// service name, e.g. "Foo:ping". Clients must use this to call a service
+// hosted by an FMultiplexedProcessor under a service name.
+func NewFMultiplexedProtocolFactory(protoFactory thrift.TProtocolFactory, serviceName string) *FProtocolFactory {
+	return &FProtocolFactory{protoFactory: &tMultiplexedProtocolFactory{protoFactory, serviceName}}
+}
+
+// WithProtocolVersion sets the version of the Frugal protocol the FProtocols
+// returned by the FProtocolFactory use to write request headers, and
+// response headers to requests which don't determine the version. Version 0
+// is the default. Version 1 encodes headers more compactly and marks binary
+// header values, i.e. values which aren't valid UTF-8, so implementations in
+// other languages can decode them as bytes. Only enable version 1 once every
+// client and server supports it. Regardless of the version set, servers
+// always respond to a request in the version of its headers, and headers of
+// either version are read. It must be set before the FProtocolFactory is
+// used.
+func (f *FProtocolFactory) WithProtocolVersion(version byte) *FProtocolFactory {
+	marshaler, err := getMarshaler(version)
+	if err != nil {
+		logger().Warnf("frugal: %s, writing protocol version %d", err, protocolV0)
+		f.writeMarshaler = nil
+		return f
+	}
+	f.writeMarshaler = marshaler
+	return f
 }
 
 // GetProtocol returns a new FProtocol instance using the given TTransport.
 func (f *FProtocolFactory) GetProtocol(tr thrift.TTransport) *FProtocol {
-	return &FProtocol{f.protoFactory.GetProtocol(tr)}
+	if f.compression == nil && f.propagatedHeaders == nil && f.writeMarshaler == nil {
+		return &FProtocol{f.protoFactory.GetProtocol(tr)}
+	}
+	return &FProtocol{&fCompressionProtocol{TProtocol: f.protoFactory.GetProtocol(tr), factory: f}}
+}
+
+// getWriteMarshaler returns the protocolMarshaler for the version set with
+// WithProtocolVersion.
+func (f *FProtocolFactory) getWriteMarshaler() protocolMarshaler {
+	if f.writeMarshaler == nil {
+		return v0Marshaler
+	}
+	return f.writeMarshaler
+}
+
+// tMultiplexedProtocolFactory produces TMultiplexedProtocols wrapping the
+// TProtocols produced by another TProtocolFactory.
+type tMultiplexedProtocolFactory struct {
+	protoFactory thrift.TProtocolFactory
+	serviceName  string
+}
+
+// GetProtocol returns a new TMultiplexedProtocol using the given TTransport.
+func (t *tMultiplexedProtocolFactory) GetProtocol(tr thrift.TTransport) thrift.TProtocol {
+	return thrift.NewTMultiplexedProtocol(t.protoFactory.GetProtocol(tr), t.serviceName)
 }
 
 // FProtocol is Frugal's equivalent of Thrift's TProtocol. It defines the
@@ -90,25 +162,33 @@ type FProtocol struct {
 // WriteRequestHeader writes the request headers set on the given Context
 // into the protocol
 func (f *FProtocol) WriteRequestHeader(ctx FContext) error {
-	return f.writeHeader(ctx.RequestHeaders())
+	headers := removeCompressionHeaders(ctx.RequestHeaders())
+	if p, ok := f.TProtocol.(*fCompressionProtocol); ok {
+		return p.writeHeader(p.factory.getWriteMarshaler(), headers, p.requestCodec())
+	}
+	return f.writeHeader(headers)
 }
 
 // ReadRequestHeader reads the request headers on the protocol into a
 // returned Context
 func (f *FProtocol) ReadRequestHeader() (FContext, error) {
-	headers, err := readHeader(f.Transport())
+	marshaler, headers, err := readVersionedHeader(f.Transport())
 	if err != nil {
 		return nil, err
 	}
 
 	ctx := &FContextImpl{
-		requestHeaders:  make(map[string]string),
-		responseHeaders: make(map[string]string),
+		requestHeaders:   make(map[string]string),
+		responseHeaders:  make(map[string]string),
+		requestMarshaler: marshaler,
 	}
 
 	for name, value := range headers {
 		ctx.AddRequestHeader(name, value)
 	}
+	if p, ok := f.TProtocol.(*fCompressionProtocol); ok {
+		ctx.propagatedHeaders = p.factory.propagatedHeaders
+	}
 
 	// Put op id in response headers
 	opid, ok := headers[opIDHeader]
@@ -117,13 +197,30 @@ func (f *FProtocol) ReadRequestHeader() (FContext, error) {
 	}
 	setResponseOpID(ctx, opid)
 
+	if err := f.decompress(headers); err != nil {
+		return nil, err
+	}
+
 	return ctx, nil
 }
 
 // WriteResponseHeader writes the response headers set on the given Context
-// into the protocol
+// into the protocol. If the Context was read by ReadRequestHeader, the
+// headers are written in the protocol version of the request.
 func (f *FProtocol) WriteResponseHeader(ctx FContext) error {
-	return f.writeHeader(ctx.ResponseHeaders())
+	var marshaler protocolMarshaler = v0Marshaler
+	p, wrapped := f.TProtocol.(*fCompressionProtocol)
+	if wrapped {
+		marshaler = p.factory.getWriteMarshaler()
+	}
+	if impl, ok := ctx.(*FContextImpl); ok && impl.requestMarshaler != nil {
+		marshaler = impl.requestMarshaler
+	}
+	headers := removeCompressionHeaders(ctx.ResponseHeaders())
+	if wrapped {
+		return p.writeHeader(marshaler, headers, p.responseCodec(ctx))
+	}
+	return f.writeHeaderWith(marshaler, headers)
 }
 
 // ReadResponseHeader reads the response headers on the protocol into a
@@ -138,14 +235,99 @@ func (f *FProtocol) ReadResponseHeader(ctx FContext) error {
 		ctx.AddResponseHeader(name, value)
 	}
 
+	// The server's accepted codecs are remembered so requests are only
+	// compressed once it accepts the codec.
+	if p, ok := f.TProtocol.(*fCompressionProtocol); ok && p.factory.compression != nil {
+		p.factory.compression.peerCodecs.Store(headers[acceptCompressionHeader])
+	}
+
+	return f.decompress(headers)
+}
+
+// discardWrites discards the data written to the protocol which wasn't
+// flushed, e.g. a partial response written before a panic. Data which was
+// already flushed, or written to a transport which doesn't buffer writes,
+// can't be discarded.
+func (f *FProtocol) discardWrites() {
+	if p, ok := f.TProtocol.(*fCompressionProtocol); ok {
+		if p.pending != nil {
+			releaseBuffer(p.pending.body.Buffer)
+			p.TProtocol = p.pending.protocol
+			p.pending = nil
+		}
+		p.TProtocol = resetWriteState(p.TProtocol)
+	} else {
+		f.TProtocol = resetWriteState(f.TProtocol)
+	}
+	switch transport := f.Transport().(type) {
+	case *TMemoryOutputBuffer:
+		transport.Reset()
+	case *thrift.TMemoryBuffer:
+		transport.Reset()
+	case *TFramedTransport:
+		transport.buf.Reset()
+	}
+}
+
+// resetWriteState returns the TProtocol, or a new one on the same transport
+// if it tracks the structure being written, like the JSON protocols do.
+func resetWriteState(proto thrift.TProtocol) thrift.TProtocol {
+	switch proto.(type) {
+	case *thrift.TJSONProtocol:
+		return thrift.NewTJSONProtocol(proto.Transport())
+	case *thrift.TSimpleJSONProtocol:
+		return thrift.NewTSimpleJSONProtocol(proto.Transport())
+	}
+	return proto
+}
+
+// decompress replaces the TProtocol with one reading the decompressed payload
+// if the headers indicate the payload is compressed.
+func (f *FProtocol) decompress(headers map[string]string) error {
+	name, ok := headers[compressionHeader]
+	if !ok {
+		return nil
+	}
+	if p, ok := f.TProtocol.(*fCompressionProtocol); ok {
+		return p.decompress(name)
+	}
+	// Without a CompressionPolicy, the TProtocol isn't wrapped, so the
+	// decompressed payload replaces the remainder of the frame it reads.
+	var buffer *thrift.TMemoryBuffer
+	switch transport := f.Transport().(type) {
+	case *thrift.TMemoryBuffer:
+		buffer = transport
+	case *receivedFrame:
+		buffer = transport.TMemoryBuffer
+	default:
+		return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			errors.New("frugal: compressed payloads can only be read from frames or by FProtocols with a CompressionPolicy"))
+	}
+	payload, err := decompressPayload(name, buffer)
+	if err != nil {
+		return err
+	}
+	*buffer.Buffer = *bytes.NewBuffer(payload)
 	return nil
 }
 
-// writeHeader serializes the headers and writes them to the underlying
-// transport.
+// writeHeader serializes the headers in the default protocol version and
+// writes them to the underlying transport.
 func (f *FProtocol) writeHeader(headers map[string]string) error {
-	buff := writeMarshaler.marshalHeaders(headers)
-	if n, err := f.Transport().Write(buff); err != nil {
+	return f.writeHeaderWith(v0Marshaler, headers)
+}
+
+// writeHeaderWith serializes the headers with the protocolMarshaler and
+// writes them to the underlying transport.
+func (f *FProtocol) writeHeaderWith(marshaler protocolMarshaler, headers map[string]string) error {
+	return writeHeaders(f.Transport(), marshaler, headers)
+}
+
+// writeHeaders serializes the headers with the protocolMarshaler and writes
+// them to the transport.
+func writeHeaders(transport thrift.TTransport, marshaler protocolMarshaler, headers map[string]string) error {
+	buff := marshaler.marshalHeaders(headers)
+	if n, err := transport.Write(buff); err != nil {
 		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
 			fmt.Sprintf("frugal: error writing protocol headers in writeHeader: %s", err))
 	} else if n != len(buff) {
@@ -158,21 +340,32 @@ func (f *FProtocol) writeHeader(headers map[string]string) error {
 
 // readHeader deserializes headers from the given Reader.
 func readHeader(reader io.Reader) (map[string]string, error) {
+	_, headers, err := readVersionedHeader(reader)
+	return headers, err
+}
+
+// readVersionedHeader deserializes headers from the given Reader, returning
+// the protocolMarshaler of their version.
+func readVersionedHeader(reader io.Reader) (protocolMarshaler, map[string]string, error) {
 	buff := make([]byte, 1)
 	if _, err := io.ReadFull(reader, buff); err != nil {
 		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
-			return nil, err
+			return nil, nil, err
 		}
-		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+		return nil, nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
 			fmt.Sprintf("frugal: error reading protocol headers in readHeader: %s", err))
 	}
 
 	marshaler, err := getMarshaler(buff[0])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return marshaler.unmarshalHeaders(reader)
+	headers, err := marshaler.unmarshalHeaders(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return marshaler, headers, nil
 }
 
 // getHeadersFromFrame deserializes headers from the frame into a map.
@@ -190,6 +383,24 @@ func getHeadersFromFrame(frame []byte) (map[string]string, error) {
 	return marshaler.unmarshalHeadersFromFrame(frame[1:])
 }
 
+// getHeaderFromFrame returns the value of the named header in the frame, or
+// an empty string if it's not present. Unlike getHeadersFromFrame, this
+// doesn't allocate the other headers, so it's used on hot paths which only
+// need a single header.
+func getHeaderFromFrame(frame []byte, name string) (string, error) {
+	// Need at least 1 byte for the version.
+	if len(frame) == 0 {
+		return "", thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA, errors.New("frugal: invalid frame size 0"))
+	}
+
+	marshaler, err := getMarshaler(frame[0])
+	if err != nil {
+		return "", err
+	}
+
+	return marshaler.unmarshalHeaderFromFrame(frame[1:], name)
+}
+
 // addHeadersToFrame returns a new frame containing the given headers. This
 // assumes the frame still has the frame size header at the beginning.
 func addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
@@ -307,6 +518,30 @@ func (v *v0ProtocolMarshaler) unmarshalHeadersFromFrame(frame []byte) (map[strin
 	return v.readPairs(frame, 4, size+4)
 }
 
+// unmarshalHeaderFromFrame reads the value of the named header from the
+// serialized headers in the byte slice without unmarshaling the others.
+func (v *v0ProtocolMarshaler) unmarshalHeaderFromFrame(frame []byte, name string) (string, error) {
+	// Need at least 4 bytes for headers size.
+	if len(frame) < 4 {
+		return "", thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v0 frame size %d", len(frame)))
+	}
+	size := int32(binary.BigEndian.Uint32(frame))
+	if size > int32(len(frame[4:])) {
+		return "", thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: v0 frame size %d does not match actual size %d", size, len(frame[4:])))
+	}
+	value := ""
+	err := v.forEachPair(frame, 4, size+4, func(pairName, pairValue []byte) bool {
+		if string(pairName) == name {
+			value = string(pairValue)
+			return false
+		}
+		return true
+	})
+	return value, err
+}
+
 // addHeadersToFrame returns a new frame containing the given headers. This
 // assumes the frame still has the frame size header at the beginning.
 func (v *v0ProtocolMarshaler) addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
@@ -351,31 +586,46 @@ func (v *v0ProtocolMarshaler) unmarshalFrame(frame []byte, components *frameComp
 
 func (v *v0ProtocolMarshaler) readPairs(buff []byte, start, end int32) (map[string]string, error) {
 	headers := make(map[string]string)
+	err := v.forEachPair(buff, start, end, func(name, value []byte) bool {
+		headers[string(name)] = string(value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// forEachPair calls fn with each serialized header name and value between
+// start and end, which share the memory of buff, until fn returns false.
+func (v *v0ProtocolMarshaler) forEachPair(buff []byte, start, end int32, fn func(name, value []byte) bool) error {
 	i := start
 	for i < end {
 		// Read header name.
 		nameSize := int32(binary.BigEndian.Uint32(buff[i : i+4]))
 		i += 4
 		if i > end || i+nameSize > end {
-			return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
 				errors.New("frugal: invalid v0 protocol header name"))
 		}
-		name := string(buff[i : i+nameSize])
+		name := buff[i : i+nameSize]
 		i += nameSize
 
 		// Read header value.
 		valueSize := int32(binary.BigEndian.Uint32(buff[i : i+4]))
 		i += 4
 		if i > end || i+valueSize > end {
-			return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
 				errors.New("frugal: invalid v0 protocol header value"))
 		}
-		value := string(buff[i : i+valueSize])
+		value := buff[i : i+valueSize]
 		i += valueSize
 
-		headers[name] = value
+		if !fn(name, value) {
+			return nil
+		}
 	}
-	return headers, nil
+	return nil
 }
 
 func (v *v0ProtocolMarshaler) calculateHeaderSize(headers map[string]string) int32 {
@@ -385,3 +635,246 @@ func (v *v0ProtocolMarshaler) calculateHeaderSize(headers map[string]string) int
 	}
 	return size
 }
+
+// v1ProtocolMarshaler implements the protocolMarshaler interface for v1 of the
+// Frugal protocol. Unlike v0, sizes are encoded as unsigned varints and each
+// header value has a type, which is binary for values that aren't valid
+// UTF-8.
+type v1ProtocolMarshaler struct{}
+
+// marshalHeaders serializes the given headers map to a byte slice.
+func (v *v1ProtocolMarshaler) marshalHeaders(headers map[string]string) []byte {
+	size := v.calculateHeaderSize(headers)
+
+	// Header buff = [version (1 byte), size (uvarint), headers (size bytes)]
+	// Headers = [size (uvarint) name (size bytes) type (1 byte) size (uvarint) value (size bytes)*]
+	buff := make([]byte, 1+uvarintSize(uint64(size))+size)
+
+	// Write version
+	buff[0] = protocolV1
+
+	// Write size
+	i := 1 + binary.PutUvarint(buff[1:], uint64(size))
+
+	// Write headers
+	for name, value := range headers {
+		i += binary.PutUvarint(buff[i:], uint64(len(name)))
+		i += copy(buff[i:], name)
+		buff[i] = v1StringValue
+		if !utf8.ValidString(value) {
+			buff[i] = v1BinaryValue
+		}
+		i++
+		i += binary.PutUvarint(buff[i:], uint64(len(value)))
+		i += copy(buff[i:], value)
+	}
+
+	return buff
+}
+
+// unmarshalHeaders reads headers from the reader into a map.
+func (v *v1ProtocolMarshaler) unmarshalHeaders(reader io.Reader) (map[string]string, error) {
+	size, err := readUvarint(reader)
+	if err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, err
+		}
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading header size: %s", err))
+	}
+	if size > defaultMaxLength {
+		return nil, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v1 header size %d", size))
+	}
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if e, ok := err.(thrift.TTransportException); ok && e.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil, err
+		}
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading protocol headers in unmarshalHeaders reading headers: %s", err))
+	}
+
+	return v.readPairs(buff, 0, len(buff))
+}
+
+// unmarshalHeadersFromFrame reads serialized headers from the byte slice into
+// a map.
+func (v *v1ProtocolMarshaler) unmarshalHeadersFromFrame(frame []byte) (map[string]string, error) {
+	start, end, err := v.headerBounds(frame)
+	if err != nil {
+		return nil, err
+	}
+	return v.readPairs(frame, start, end)
+}
+
+// unmarshalHeaderFromFrame reads the value of the named header from the
+// serialized headers in the byte slice without unmarshaling the others.
+func (v *v1ProtocolMarshaler) unmarshalHeaderFromFrame(frame []byte, name string) (string, error) {
+	start, end, err := v.headerBounds(frame)
+	if err != nil {
+		return "", err
+	}
+	value := ""
+	err = v.forEachPair(frame, start, end, func(pairName, pairValue []byte) bool {
+		if string(pairName) == name {
+			value = string(pairValue)
+			return false
+		}
+		return true
+	})
+	return value, err
+}
+
+// addHeadersToFrame returns a new frame containing the given headers. This
+// assumes the frame still has the frame size header at the beginning.
+func (v *v1ProtocolMarshaler) addHeadersToFrame(frame []byte, headers map[string]string) ([]byte, error) {
+	_, end, err := v.headerBounds(frame[5:])
+	if err != nil {
+		return nil, err
+	}
+	existing, err := v.unmarshalHeadersFromFrame(frame[5:])
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		existing[name] = value
+	}
+	serializedHeaders := v.marshalHeaders(existing)
+	payload := frame[5+end:]
+	buff := make([]byte, 4+len(serializedHeaders)+len(payload))
+
+	// Add frame size.
+	binary.BigEndian.PutUint32(buff, uint32(len(buff)-4))
+
+	// Add headers (version is included).
+	offset := copy(buff[4:], serializedHeaders)
+
+	// Add payload.
+	copy(buff[4+offset:], payload)
+
+	return buff, nil
+}
+
+// unmarshalFrame deserializes the byte slice into frame components.
+func (v *v1ProtocolMarshaler) unmarshalFrame(frame []byte, components *frameComponents) error {
+	start, end, err := v.headerBounds(frame)
+	if err != nil {
+		return err
+	}
+	headers, err := v.readPairs(frame, start, end)
+	if err != nil {
+		return err
+	}
+
+	components.headers = headers
+	components.payload = frame[end:]
+
+	return nil
+}
+
+// headerBounds returns the start and end of the serialized headers in the
+// byte slice, which begins with the headers size.
+func (v *v1ProtocolMarshaler) headerBounds(frame []byte) (int, int, error) {
+	size, n := binary.Uvarint(frame)
+	if n <= 0 {
+		return 0, 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid v1 frame size %d", len(frame)))
+	}
+	if size > uint64(len(frame[n:])) {
+		return 0, 0, thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: v1 frame size %d does not match actual size %d", size, len(frame[n:])))
+	}
+	return n, n + int(size), nil
+}
+
+func (v *v1ProtocolMarshaler) readPairs(buff []byte, start, end int) (map[string]string, error) {
+	headers := make(map[string]string)
+	err := v.forEachPair(buff, start, end, func(name, value []byte) bool {
+		headers[string(name)] = string(value)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// forEachPair calls fn with each serialized header name and value between
+// start and end, which share the memory of buff, until fn returns false.
+func (v *v1ProtocolMarshaler) forEachPair(buff []byte, start, end int, fn func(name, value []byte) bool) error {
+	i := start
+	for i < end {
+		// Read header name.
+		nameSize, n := binary.Uvarint(buff[i:end])
+		if n <= 0 || nameSize > uint64(end-i-n) {
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				errors.New("frugal: invalid v1 protocol header name"))
+		}
+		i += n
+		name := buff[i : i+int(nameSize)]
+		i += int(nameSize)
+
+		// Read header value type.
+		if i >= end || buff[i] > v1BinaryValue {
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				errors.New("frugal: invalid v1 protocol header value type"))
+		}
+		i++
+
+		// Read header value.
+		valueSize, n := binary.Uvarint(buff[i:end])
+		if n <= 0 || valueSize > uint64(end-i-n) {
+			return thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+				errors.New("frugal: invalid v1 protocol header value"))
+		}
+		i += n
+		value := buff[i : i+int(valueSize)]
+		i += int(valueSize)
+
+		if !fn(name, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (v *v1ProtocolMarshaler) calculateHeaderSize(headers map[string]string) int {
+	size := 0
+	for name, value := range headers {
+		size += uvarintSize(uint64(len(name))) + len(name) + 1 + uvarintSize(uint64(len(value))) + len(value)
+	}
+	return size
+}
+
+// uvarintSize returns the number of bytes used to encode x as an unsigned
+// varint.
+func uvarintSize(x uint64) int {
+	size := 1
+	for x >= 0x80 {
+		x >>= 7
+		size++
+	}
+	return size
+}
+
+// readUvarint reads an unsigned varint from the reader one byte at a time,
+// so no more than the varint is read.
+func readUvarint(reader io.Reader) (uint64, error) {
+	var (
+		buff  = make([]byte, 1)
+		x     uint64
+		shift uint
+	)
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		if _, err := io.ReadFull(reader, buff); err != nil {
+			return 0, err
+		}
+		if buff[0] < 0x80 {
+			return x | uint64(buff[0])<<shift, nil
+		}
+		x |= uint64(buff[0]&0x7f) << shift
+		shift += 7
+	}
+	return 0, errors.New("frugal: varint overflows a 64-bit integer")
+}
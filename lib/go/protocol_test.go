@@ -180,8 +180,8 @@ func TestReadHeaderTransportError(t *testing.T) {
 // encoding version.
 func TestReadHeaderUnsupportedVersion(t *testing.T) {
 	assert := assert.New(t)
-	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer([]byte{0x01, 0, 0, 0, 0})}
-	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 1"))
+	transport := &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer([]byte{0x02, 0, 0, 0, 0})}
+	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 2"))
 	_, err := readHeader(transport)
 	assert.Equal(expectedErr, err)
 }
@@ -217,8 +217,8 @@ func TestGetHeadersFromFrameInvalidSize(t *testing.T) {
 // frame encoding version.
 func TestGetHeadersFromFrameUnsupportedVersion(t *testing.T) {
 	assert := assert.New(t)
-	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 1"))
-	_, err := getHeadersFromFrame([]byte{0x01, 0, 0, 0, 0})
+	expectedErr := thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION, errors.New("frugal: unsupported protocol version 2"))
+	_, err := getHeadersFromFrame([]byte{0x02, 0, 0, 0, 0})
 	assert.Equal(expectedErr, err)
 }
 
@@ -230,6 +230,28 @@ func TestGetHeadersFromFrame(t *testing.T) {
 	assert.Equal(basicHeaders, headers)
 }
 
+// Ensures getHeaderFromFrame returns the value of a single header, or an empty
+// string if it's not present.
+func TestGetHeaderFromFrame(t *testing.T) {
+	assert := assert.New(t)
+	value, err := getHeaderFromFrame(completeFrugalFrame[4:], cidHeader)
+	assert.Nil(err)
+	assert.Equal("12345", value)
+	value, err = getHeaderFromFrame(completeFrugalFrame[4:], "baz")
+	assert.Nil(err)
+	assert.Equal("qux", value)
+	value, err = getHeaderFromFrame(completeFrugalFrame[4:], "missing")
+	assert.Nil(err)
+	assert.Equal("", value)
+
+	_, err = getHeaderFromFrame([]byte{0x02, 0, 0, 0, 0}, cidHeader)
+	assert.Equal(thrift.NewTProtocolExceptionWithType(thrift.BAD_VERSION,
+		errors.New("frugal: unsupported protocol version 2")), err)
+	_, err = getHeaderFromFrame([]byte{0}, cidHeader)
+	assert.Equal(thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+		errors.New("frugal: invalid v0 frame size 0")), err)
+}
+
 // Ensures addHeadersToFrame returns a new frame with the headers added.
 func TestAddHeadersToFrame(t *testing.T) {
 	assert := assert.New(t)
@@ -304,6 +326,175 @@ func TestMarshalUnmarshalHeadersUTF8(t *testing.T) {
 	assert.Equal(headers, decodedHeaders)
 }
 
+// splitFrame returns the headers and payload of the frame, including the
+// frame size.
+func splitFrame(t *testing.T, frame []byte) (map[string]string, []byte) {
+	buff := bytes.NewBuffer(frame[4:])
+	headers, err := readHeader(buff)
+	assert.Nil(t, err)
+	return headers, buff.Bytes()
+}
+
+// toV1Frame returns the v0 frame, including the frame size, in v1.
+func toV1Frame(t *testing.T, frame []byte) []byte {
+	headers, payload := splitFrame(t, frame)
+	return prependFrameSize(append(v1Marshaler.marshalHeaders(headers), payload...))
+}
+
+// Ensures v1 headers, including binary values, round trip and are smaller
+// than v0 headers.
+func TestMarshalUnmarshalHeadersV1(t *testing.T) {
+	assert := assert.New(t)
+	headers := map[string]string{
+		"Đ¥ÑØ":     "δάüΓ",
+		"binary":   string([]byte{0xff, 0x00, 0xfe}),
+		"empty":    "",
+		"long":     string(bytes.Repeat([]byte("x"), 300)),
+		opIDHeader: "12",
+	}
+	encoded := v1Marshaler.marshalHeaders(headers)
+	assert.Equal(byte(protocolV1), encoded[0])
+	assert.True(len(encoded) < len(v0Marshaler.marshalHeaders(headers)))
+
+	decoded, err := v1Marshaler.unmarshalHeadersFromFrame(encoded[1:])
+	assert.Nil(err)
+	assert.Equal(headers, decoded)
+	decoded, err = readHeader(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(encoded)})
+	assert.Nil(err)
+	assert.Equal(headers, decoded)
+
+	// The binary value is marked as binary.
+	encoded = v1Marshaler.marshalHeaders(map[string]string{"b": string([]byte{0xff})})
+	assert.Equal([]byte{protocolV1, 5, 1, 'b', v1BinaryValue, 1, 0xff}, encoded)
+	encoded = v1Marshaler.marshalHeaders(map[string]string{"s": "v"})
+	assert.Equal([]byte{protocolV1, 5, 1, 's', v1StringValue, 1, 'v'}, encoded)
+}
+
+// Ensures existing v0 frames convert to v1 and back without losing headers
+// or payload.
+func TestCrossVersionFrames(t *testing.T) {
+	assert := assert.New(t)
+	v0Headers, v0Payload := splitFrame(t, completeFrugalFrame)
+
+	v1Frame := toV1Frame(t, completeFrugalFrame)
+	assert.True(len(v1Frame) < len(completeFrugalFrame))
+	v1Components, err := unmarshalFrame(v1Frame)
+	assert.Nil(err)
+	assert.Equal(byte(protocolV1), v1Components.protocolVersion)
+	assert.Equal(v0Headers, v1Components.headers)
+	assert.Equal(v0Payload, v1Components.payload)
+	headers, payload := splitFrame(t, v1Frame)
+	assert.Equal(v0Headers, headers)
+	assert.Equal(v0Payload, payload)
+
+	value, err := getHeaderFromFrame(v1Frame[4:], "baz")
+	assert.Nil(err)
+	assert.Equal("qux", value)
+	headers, err = getHeadersFromFrame(v1Frame[4:])
+	assert.Nil(err)
+	assert.Equal(v0Headers, headers)
+
+	v0Frame := prependFrameSize(append(v0Marshaler.marshalHeaders(v1Components.headers), v1Components.payload...))
+	headers, payload = splitFrame(t, v0Frame)
+	assert.Equal(byte(protocolV0), v0Frame[4])
+	assert.Equal(v0Headers, headers)
+	assert.Equal(v0Payload, payload)
+
+	v1Headers, err := v1Marshaler.unmarshalHeadersFromFrame(v1Marshaler.marshalHeaders(frugalHeaders)[1:])
+	assert.Nil(err)
+	v0Headers, err = getHeadersFromFrame(frugalFrame)
+	assert.Nil(err)
+	assert.Equal(v0Headers, v1Headers)
+}
+
+// Ensures addHeadersToFrame keeps the protocol version of v1 frames.
+func TestAddHeadersToFrameV1(t *testing.T) {
+	assert := assert.New(t)
+	newFrame, err := addHeadersToFrame(toV1Frame(t, completeFrugalFrame), map[string]string{"bat": "man"})
+	assert.Nil(err)
+
+	components, err := unmarshalFrame(newFrame)
+	assert.Nil(err)
+	assert.Equal(byte(protocolV1), components.protocolVersion)
+	assert.Equal("man", components.headers["bat"])
+	assert.Equal("qux", components.headers["baz"])
+	_, payload := splitFrame(t, completeFrugalFrame)
+	assert.Equal(payload, components.payload)
+}
+
+// Ensures malformed v1 headers are rejected.
+func TestUnmarshalHeadersV1Invalid(t *testing.T) {
+	assert := assert.New(t)
+	for _, frame := range [][]byte{
+		{},
+		{5, 1, 'b'},
+		{3, 1, 'b', 0x02},
+		{4, 1, 'b', v1StringValue, 2},
+		{2, 5, 'b'},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		_, err := v1Marshaler.unmarshalHeadersFromFrame(frame)
+		assert.Equal(thrift.INVALID_DATA, err.(thrift.TProtocolException).TypeId(), "frame %v", frame)
+	}
+	_, err := readHeader(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer([]byte{protocolV1, 3, 1})})
+	assert.Error(err)
+}
+
+// Ensures v0 is written by default, v1 once enabled, and servers respond in
+// the version of the request.
+func TestProtocolVersionNegotiation(t *testing.T) {
+	assert := assert.New(t)
+	v0Factory := NewFProtocolFactory(tProtocolFactory)
+	v1Factory := NewFProtocolFactory(tProtocolFactory).WithProtocolVersion(protocolV1)
+
+	writeRequest := func(protoFactory *FProtocolFactory) []byte {
+		transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+		proto := protoFactory.GetProtocol(transport)
+		assert.Nil(proto.WriteRequestHeader(NewFContext("")))
+		return transport.Bytes()
+	}
+	respond := func(protoFactory *FProtocolFactory, request []byte) []byte {
+		proto := protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(request)})
+		ctx, err := proto.ReadRequestHeader()
+		assert.Nil(err)
+		ctx.AddResponseHeader("foo", "bar")
+		transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+		proto = protoFactory.GetProtocol(transport)
+		assert.Nil(proto.WriteResponseHeader(ctx))
+		return transport.Bytes()
+	}
+
+	v0Request := writeRequest(v0Factory)
+	assert.Equal(byte(protocolV0), v0Request[0])
+	v1Request := writeRequest(v1Factory)
+	assert.Equal(byte(protocolV1), v1Request[0])
+
+	// A v1 server responds to a v0 client in v0.
+	assert.Equal(byte(protocolV0), respond(v1Factory, v0Request)[0])
+
+	// A server writing v0 responds to a v1 client in v1.
+	response := respond(v0Factory, v1Request)
+	assert.Equal(byte(protocolV1), response[0])
+	ctx := NewFContext("")
+	proto := v0Factory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(response)})
+	assert.Nil(proto.ReadResponseHeader(ctx))
+	value, _ := ctx.ResponseHeader("foo")
+	assert.Equal("bar", value)
+
+	// Responses to FContexts which weren't read from a request use the
+	// version set.
+	for protoFactory, version := range map[*FProtocolFactory]byte{v0Factory: protocolV0, v1Factory: protocolV1} {
+		transport := &thrift.TMemoryBuffer{Buffer: &bytes.Buffer{}}
+		proto = protoFactory.GetProtocol(transport)
+		assert.Nil(proto.WriteResponseHeader(NewFContext("")))
+		assert.Equal(version, transport.Bytes()[0])
+	}
+
+	// Unsupported versions are ignored.
+	badFactory := NewFProtocolFactory(tProtocolFactory).WithProtocolVersion(0x02)
+	assert.Equal(byte(protocolV0), writeRequest(badFactory)[0])
+}
+
 func BenchmarkAddHeadersToFrame(b *testing.B) {
 	headers := map[string]string{"bat": "man", "spider": "man", "super": "man"}
 	b.ResetTimer()
@@ -311,3 +502,20 @@ func BenchmarkAddHeadersToFrame(b *testing.B) {
 		addHeadersToFrame(completeFrugalFrame, headers)
 	}
 }
+
+func BenchmarkGetHeaderFromFrame(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		getHeaderFromFrame(completeFrugalFrame[4:], opIDHeader)
+	}
+}
+
+func BenchmarkGetHeaderFromFrameV1(b *testing.B) {
+	headers, _ := getHeadersFromFrame(completeFrugalFrame[4:])
+	frame := v1Marshaler.marshalHeaders(headers)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		getHeaderFromFrame(frame, opIDHeader)
+	}
+}
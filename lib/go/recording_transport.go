@@ -0,0 +1,273 @@
+package frugal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// Recordings written by the recording FTransport are a sequence of
+// request/response pairs. Each request and response is a Frugal frame,
+// including its frame size, exactly as it's sent on the wire. Oneway
+// requests are followed by an empty frame, i.e. a frame size of 0, since
+// they don't have a response.
+
+// fRecordingTransport is an FTransport which records the requests and
+// responses of the FTransport it wraps.
+type fRecordingTransport struct {
+	FTransport
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewRecordingTransport returns an FTransport which wraps the given
+// FTransport and records each request frame and its response frame,
+// including their headers, to the given io.Writer. Requests which fail are
+// not recorded. The recording can be replayed with NewReplayTransport, e.g.
+// to write deterministic tests against recorded traffic without the
+// downstream service.
+func NewRecordingTransport(transport FTransport, w io.Writer) FTransport {
+	return &fRecordingTransport{FTransport: transport, w: w}
+}
+
+// Oneway transmits the given data and doesn't wait for a response, recording
+// the request.
+func (f *fRecordingTransport) Oneway(ctx FContext, payload []byte) error {
+	if err := f.FTransport.Oneway(ctx, payload); err != nil {
+		return err
+	}
+	f.record(payload, nil)
+	return nil
+}
+
+// Request transmits the given data and waits for a response, recording the
+// request and response.
+func (f *fRecordingTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	result, err := f.FTransport.Request(ctx, payload)
+	if err != nil || result == nil {
+		return result, err
+	}
+	response, err := ioutil.ReadAll(result)
+	if err != nil {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: error reading response to record: %s", err))
+	}
+	f.record(payload, prependFrameSize(response))
+	return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(response)}, nil
+}
+
+// record writes the request and response frames to the recording. A nil
+// response is written as an empty frame.
+func (f *fRecordingTransport) record(request, response []byte) {
+	if response == nil {
+		response = make([]byte, 4)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(request); err != nil {
+		logger().Warnf("frugal: error recording request: %s", err)
+		return
+	}
+	if _, err := f.w.Write(response); err != nil {
+		logger().Warnf("frugal: error recording response: %s", err)
+	}
+}
+
+// fReplayTransport is an FTransport which responds to requests with recorded
+// responses.
+type fReplayTransport struct {
+	*fBaseTransport
+	protoFactory *FProtocolFactory
+	mu           sync.Mutex
+	isOpen       bool
+	responses    map[string][][]byte
+}
+
+// NewReplayTransport returns an FTransport which replays the recording read
+// from the given io.Reader, as written by an FTransport returned by
+// NewRecordingTransport. Requests are matched to recorded requests by method
+// name and serialized arguments, ignoring headers, and receive the recorded
+// response with the op id of the request. Requests matching more than one
+// recorded request receive the recorded responses in order, with the last
+// repeated once the others are used. Requests which don't match a recorded
+// request fail with a TTransportException. The FProtocolFactory must match
+// the one used by the client when recording.
+//
+// Arguments must serialize deterministically to match, so arguments
+// containing maps or sets with more than one element may not match their
+// recorded requests.
+func NewReplayTransport(r io.Reader, protoFactory *FProtocolFactory) (FTransport, error) {
+	f := &fReplayTransport{
+		fBaseTransport: newFBaseTransport(0),
+		protoFactory:   protoFactory,
+		responses:      make(map[string][][]byte),
+	}
+	reader := bufio.NewReader(r)
+	for {
+		request, err := readRecordedFrame(reader)
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		response, err := readRecordedFrame(reader)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		_, key, err := f.requestKey(request)
+		if err != nil {
+			return nil, err
+		}
+		f.responses[key] = append(f.responses[key], response)
+	}
+}
+
+// readRecordedFrame reads the next frame, including its frame size, from the
+// recording. It returns io.EOF if the recording has no more frames.
+func readRecordedFrame(reader io.Reader) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(reader, size); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("frugal: error reading recording: %s", err)
+		}
+		return nil, err
+	}
+	frame := make([]byte, 4+binary.BigEndian.Uint32(size))
+	copy(frame, size)
+	if _, err := io.ReadFull(reader, frame[4:]); err != nil {
+		return nil, fmt.Errorf("frugal: error reading recording: %s", err)
+	}
+	return frame, nil
+}
+
+// requestKey returns the method name of the request frame and the key which
+// matches it to recorded requests.
+func (f *fReplayTransport) requestKey(frame []byte) (string, string, error) {
+	if len(frame) < 5 {
+		return "", "", thrift.NewTProtocolExceptionWithType(thrift.INVALID_DATA,
+			fmt.Errorf("frugal: invalid frame size %d", len(frame)))
+	}
+	// The headers are read from the buffer, leaving the serialized message.
+	buff := bytes.NewBuffer(frame[4:])
+	if _, err := readHeader(buff); err != nil {
+		return "", "", err
+	}
+	body := buff.Bytes()
+	iprot := f.protoFactory.GetProtocol(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(body)})
+	method, _, _, err := iprot.ReadMessageBegin()
+	if err != nil {
+		return "", "", err
+	}
+	return method, string(body), nil
+}
+
+// Open prepares the transport to send data.
+func (f *fReplayTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isOpen {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: replay transport already open")
+	}
+	f.fBaseTransport.Open()
+	f.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fReplayTransport) IsOpen() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.isOpen
+}
+
+// Close closes the transport.
+func (f *fReplayTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.isOpen {
+		return nil
+	}
+	f.isOpen = false
+	f.fBaseTransport.Close(nil)
+	return nil
+}
+
+// Oneway transmits the given data and doesn't wait for a response. The
+// request must match a recorded request.
+func (f *fReplayTransport) Oneway(ctx FContext, data []byte) error {
+	if !f.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: replay transport not open")
+	}
+	_, err := f.replay(data)
+	return err
+}
+
+// Request transmits the given data and returns the recorded response.
+func (f *fReplayTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if !f.IsOpen() {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: replay transport not open")
+	}
+	if len(data) == 4 {
+		return nil, nil
+	}
+	response, err := f.replay(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 4 {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"frugal: recorded request has no response")
+	}
+
+	// The client may check the response's op id, so it's replaced with the
+	// request's.
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	response, err = addHeadersToFrame(response, map[string]string{opIDHeader: opID})
+	if err != nil {
+		return nil, err
+	}
+	return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(response[4:])}, nil
+}
+
+// replay returns the next recorded response to the request frame.
+func (f *fReplayTransport) replay(frame []byte) ([]byte, error) {
+	method, key, err := f.requestKey(frame)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	responses := f.responses[key]
+	if len(responses) == 0 {
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			fmt.Sprintf("frugal: no recorded request to %s matches arguments", method))
+	}
+	if len(responses) > 1 {
+		f.responses[key] = responses[1:]
+	}
+	return responses[0], nil
+}
+
+// GetRequestSizeLimit returns the maximum number of bytes that can be
+// transmitted. Returns a non-positive number to indicate an unbounded
+// allowable size.
+func (f *fReplayTransport) GetRequestSizeLimit() uint {
+	return 0
+}
+
+// This is a no-op for fReplayTransport
+func (f *fReplayTransport) SetMonitor(monitor FTransportMonitor) {
+}
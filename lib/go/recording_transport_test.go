@@ -0,0 +1,158 @@
+package frugal
+
+import (
+	"bytes"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// echoTransport is an FTransport which responds to requests with the request
+// frame.
+type echoTransport struct {
+	FTransport
+}
+
+func (e *echoTransport) Request(ctx FContext, payload []byte) (thrift.TTransport, error) {
+	return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(payload[4:])}, nil
+}
+
+func (e *echoTransport) Oneway(ctx FContext, payload []byte) error {
+	return nil
+}
+
+// echoRequest returns a framed request to the method with the given string
+// argument.
+func echoRequest(t *testing.T, protoFactory *FProtocolFactory, ctx FContext, method, arg string) []byte {
+	buffer := NewTMemoryOutputBuffer(0)
+	proto := protoFactory.GetProtocol(buffer)
+	assert.Nil(t, proto.WriteRequestHeader(ctx))
+	assert.Nil(t, proto.WriteMessageBegin(method, thrift.CALL, 0))
+	assert.Nil(t, proto.WriteString(arg))
+	assert.Nil(t, proto.WriteMessageEnd())
+	assert.Nil(t, proto.Flush())
+	return buffer.Bytes()
+}
+
+// Ensures requests recorded from an FTransport are replayed by method name
+// and arguments with the request's op id.
+func TestRecordingTransportReplay(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	recording := new(bytes.Buffer)
+	tr := NewRecordingTransport(&echoTransport{}, recording)
+	for _, arg := range []string{"a", "b"} {
+		ctx := NewFContext("")
+		result, err := tr.Request(ctx, echoRequest(t, protoFactory, ctx, "echo", arg))
+		assert.Nil(t, err)
+		iprot := protoFactory.GetProtocol(result)
+		assert.Nil(t, iprot.ReadResponseHeader(ctx))
+		name, _, _, err := iprot.ReadMessageBegin()
+		assert.Nil(t, err)
+		assert.Equal(t, "echo", name)
+	}
+	ctx := NewFContext("")
+	assert.Nil(t, tr.Oneway(ctx, echoRequest(t, protoFactory, ctx, "notify", "")))
+
+	replay, err := NewReplayTransport(recording, protoFactory)
+	assert.Nil(t, err)
+	assert.Nil(t, replay.Open())
+	defer replay.Close()
+
+	ctx = NewFContext("replay")
+	result, err := replay.Request(ctx, echoRequest(t, protoFactory, ctx, "echo", "b"))
+	assert.Nil(t, err)
+	iprot := protoFactory.GetProtocol(result)
+	assert.Nil(t, iprot.ReadResponseHeader(ctx))
+	opID, _ := ctx.RequestHeader(opIDHeader)
+	responseOpID, _ := ctx.ResponseHeader(opIDHeader)
+	assert.Equal(t, opID, responseOpID)
+	_, _, _, err = iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	arg, err := iprot.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, "b", arg)
+
+	assert.Nil(t, replay.Oneway(ctx, echoRequest(t, protoFactory, ctx, "notify", "")))
+	_, err = replay.Request(ctx, echoRequest(t, protoFactory, ctx, "notify", ""))
+	assert.Equal(t, "frugal: recorded request has no response", err.Error())
+
+	_, err = replay.Request(ctx, echoRequest(t, protoFactory, ctx, "echo", "c"))
+	assert.Equal(t, "frugal: no recorded request to echo matches arguments", err.Error())
+}
+
+// Ensures requests matching several recorded requests receive the recorded
+// responses in order, repeating the last.
+func TestReplayTransportOrder(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	recording := new(bytes.Buffer)
+	for _, name := range []string{"foo", "bar"} {
+		processor := NewFInMemoryTransport(newNamedProcessor(name), protoFactory)
+		assert.Nil(t, processor.Open())
+		ctx := NewFContext("")
+		_, err := NewRecordingTransport(processor, recording).Request(ctx, pingRequest(t, protoFactory, ctx))
+		assert.Nil(t, err)
+		processor.Close()
+	}
+
+	replay, err := NewReplayTransport(recording, protoFactory)
+	assert.Nil(t, err)
+	assert.Nil(t, replay.Open())
+	defer replay.Close()
+	for _, expected := range []string{"foo", "bar", "bar"} {
+		ctx := NewFContext("")
+		result, err := replay.Request(ctx, pingRequest(t, protoFactory, ctx))
+		assert.Nil(t, err)
+		iprot := protoFactory.GetProtocol(result)
+		assert.Nil(t, iprot.ReadResponseHeader(ctx))
+		_, _, _, err = iprot.ReadMessageBegin()
+		assert.Nil(t, err)
+		body, err := iprot.ReadString()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, body)
+	}
+}
+
+// Ensures truncated recordings are rejected.
+func TestReplayTransportTruncated(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	ctx := NewFContext("")
+	request := echoRequest(t, protoFactory, ctx, "echo", "a")
+
+	_, err := NewReplayTransport(bytes.NewReader(request), protoFactory)
+	assert.NotNil(t, err)
+	_, err = NewReplayTransport(bytes.NewReader(request[:len(request)-1]), protoFactory)
+	assert.NotNil(t, err)
+	replay, err := NewReplayTransport(bytes.NewReader(nil), protoFactory)
+	assert.Nil(t, err)
+	assert.NotNil(t, replay)
+}
+
+// Ensures requests match recorded requests written in another protocol
+// version.
+func TestReplayTransportProtocolVersion(t *testing.T) {
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	recording := new(bytes.Buffer)
+	ctx := NewFContext("")
+	_, err := NewRecordingTransport(&echoTransport{}, recording).Request(ctx, echoRequest(t, protoFactory, ctx, "echo", "a"))
+	assert.Nil(t, err)
+
+	replay, err := NewReplayTransport(recording, protoFactory)
+	assert.Nil(t, err)
+	assert.Nil(t, replay.Open())
+	defer replay.Close()
+
+	ctx = NewFContext("")
+	v1Factory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault()).WithProtocolVersion(protocolV1)
+	request := echoRequest(t, v1Factory, ctx, "echo", "a")
+	assert.Equal(t, byte(protocolV1), request[4])
+	result, err := replay.Request(ctx, request)
+	assert.Nil(t, err)
+	iprot := protoFactory.GetProtocol(result)
+	assert.Nil(t, iprot.ReadResponseHeader(ctx))
+	_, _, _, err = iprot.ReadMessageBegin()
+	assert.Nil(t, err)
+	arg, err := iprot.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", arg)
+}
@@ -12,9 +12,10 @@ import (
 // code and invoked by an FRegistry when a RPC response is received. In other
 // words, it's used to complete RPCs. The operation ID on FContext is used to
 // look up the appropriate callback. FAsyncCallback is passed an in-memory
-// TTransport which wraps the complete message. The callback returns an error
-// or throws an exception if an unrecoverable error occurs and the transport
-// needs to be shutdown.
+// TTransport which wraps the complete message. The TTransport and the message
+// are only valid until the callback returns, after which the FTransport may
+// reuse them. The callback returns an error or throws an exception if an
+// unrecoverable error occurs and the transport needs to be shutdown.
 type FAsyncCallback func(thrift.TTransport) error
 
 // FRegistry is responsible for multiplexing and handling received messages.
@@ -83,13 +84,13 @@ func (c *fRegistryImpl) Unregister(ctx FContext) {
 
 // Execute dispatches a single Thrift message frame.
 func (c *fRegistryImpl) Execute(frame []byte) error {
-	headers, err := getHeadersFromFrame(frame)
+	opidHeader, err := getHeaderFromFrame(frame, opIDHeader)
 	if err != nil {
 		logger().Warn("frugal: invalid protocol frame headers:", err)
 		return err
 	}
 
-	opid, err := strconv.ParseUint(headers[opIDHeader], 10, 64)
+	opid, err := strconv.ParseUint(opidHeader, 10, 64)
 	if err != nil {
 		logger().Warn("frugal: invalid protocol frame, op id not a uint64:", err)
 		return err
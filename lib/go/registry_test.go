@@ -77,3 +77,22 @@ func (p *mockProcessor) Process(in, out *FProtocol) error {
 }
 
 func (p *mockProcessor) AddMiddleware(middleware ServiceMiddleware) {}
+
+// BenchmarkClientRegistryExecute measures dispatching a response frame to the
+// registered request.
+func BenchmarkClientRegistryExecute(b *testing.B) {
+	resultC := make(chan []byte, 1)
+	registry := newFRegistry()
+	ctx := NewFContext("")
+	registry.Register(ctx, resultC)
+	transport := &thrift.TMemoryBuffer{Buffer: new(bytes.Buffer)}
+	proto := &FProtocol{tProtocolFactory.GetProtocol(transport)}
+	proto.writeHeader(ctx.RequestHeaders())
+	frame := transport.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		registry.Execute(frame)
+		<-resultC
+	}
+}
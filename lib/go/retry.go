@@ -0,0 +1,167 @@
+package frugal
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// IdempotentAnnotation is the method annotation which marks a method as
+	// safe to retry, e.g. (idempotent="true"). The retry middleware only
+	// retries methods with this annotation.
+	IdempotentAnnotation = "idempotent"
+
+	// RetriesAnnotation is the method annotation which sets the maximum
+	// number of times a call to an idempotent method is retried, e.g.
+	// (retries="3").
+	RetriesAnnotation = "retries"
+
+	defaultMaxRetries     = 2
+	defaultInitialBackoff = 10 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+)
+
+// RetryPolicy configures the ServiceMiddleware returned by
+// NewRetryMiddleware. Zero values are replaced with their defaults.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times a call to an idempotent
+	// method is retried if the method does not have the retries annotation.
+	// Defaults to 2.
+	MaxRetries int
+
+	// InitialBackoff bounds the delay before the first retry. The bound
+	// doubles for each subsequent retry, up to MaxBackoff, and the actual
+	// delay is chosen at random up to the bound. Defaults to 10ms.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the largest delay between retries. Defaults to 1s.
+	MaxBackoff time.Duration
+
+	// AttemptTimeout limits the timeout of each attempt, so an attempt which
+	// hangs leaves time for retries. Defaults to the time remaining of the
+	// FContext timeout.
+	AttemptTimeout time.Duration
+}
+
+// NewRetryMiddleware returns ServiceMiddleware for clients which retries
+// calls to methods annotated with idempotent="true" in the IDL. Only
+// TTransportExceptions of type TRANSPORT_EXCEPTION_TIMED_OUT and
+// TRANSPORT_EXCEPTION_NOT_OPEN and TApplicationExceptions of type
+// APPLICATION_EXCEPTION_OVERLOADED are retried. Other errors are either
+// returned by the server or are not resolved by sending the request again.
+//
+// All attempts share the FContext timeout. Each attempt's timeout is the time
+// remaining, limited by the policy's AttemptTimeout, and retries stop once
+// the remaining time is used up or the FContext's context.Context is done.
+// Each attempt is sent with a copy of the FContext which has a new operation
+// id, so a late response to an earlier attempt is not mistaken for the
+// retry's and the caller's FContext is left unchanged. The response headers
+// of the last attempt are copied to the caller's FContext.
+func NewRetryMiddleware(policy RetryPolicy) ServiceMiddleware {
+	if policy.MaxRetries == 0 {
+		policy.MaxRetries = defaultMaxRetries
+	}
+	if policy.InitialBackoff == 0 {
+		policy.InitialBackoff = defaultInitialBackoff
+	}
+	if policy.MaxBackoff == 0 {
+		policy.MaxBackoff = defaultMaxBackoff
+	}
+	return func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			retries := policy.retries(method.Name, MethodAnnotations(service, method, args))
+			if retries <= 0 {
+				return next(service, method, args)
+			}
+			return policy.invoke(next, service, method, args, retries)
+		}
+	}
+}
+
+// retries returns the number of times a call to the method with the given
+// annotations may be retried.
+func (r RetryPolicy) retries(method string, annotations map[string]string) int {
+	if annotations[IdempotentAnnotation] != "true" {
+		return 0
+	}
+	retriesStr, ok := annotations[RetriesAnnotation]
+	if !ok {
+		return r.MaxRetries
+	}
+	retries, err := strconv.Atoi(retriesStr)
+	if err != nil {
+		logger().Warnf("frugal: invalid %s annotation %q on method %s, using default of %d",
+			RetriesAnnotation, retriesStr, method, r.MaxRetries)
+		return r.MaxRetries
+	}
+	return retries
+}
+
+// invoke calls next, retrying retryable errors up to the given number of
+// times within the FContext timeout.
+func (r RetryPolicy) invoke(next InvocationHandler, service reflect.Value, method reflect.Method,
+	args Arguments, retries int) Results {
+	ctx := args.Context()
+	deadline := time.Now().Add(ctx.Timeout())
+	var attemptCtx FContext
+	defer func() { copyResponseHeaders(ctx, attemptCtx) }()
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx = copyFContext(ctx)
+		timeout := deadline.Sub(time.Now())
+		if r.AttemptTimeout > 0 && r.AttemptTimeout < timeout {
+			timeout = r.AttemptTimeout
+		}
+		attemptCtx.SetTimeout(timeout)
+		attemptArgs := append(Arguments(nil), args...)
+		attemptArgs.SetContext(attemptCtx)
+		results := next(service, method, attemptArgs)
+		if attempt == retries || !isRetryable(results.Error()) {
+			return results
+		}
+
+		backoff := r.backoff(attempt)
+		if deadline.Sub(time.Now())-backoff < time.Millisecond {
+			// Not enough time left for another attempt.
+			return results
+		}
+		select {
+		case <-time.After(backoff):
+		case <-goContext(ctx).Done():
+			return results
+		}
+
+		logger().Debugf("frugal: retrying %s on request with correlation id %s after error: %s",
+			method.Name, ctx.CorrelationID(), results.Error())
+	}
+}
+
+// backoff returns a random delay before the given retry attempt, bounded by
+// the exponentially increasing backoff.
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	bound := r.InitialBackoff
+	for i := 0; i < attempt && bound < r.MaxBackoff; i++ {
+		bound *= 2
+	}
+	if bound > r.MaxBackoff {
+		bound = r.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1))
+}
+
+// isRetryable returns true if the error is a TTransportException of a type
+// which is retried or indicates the server was overloaded.
+func isRetryable(err error) bool {
+	if IsErrOverloaded(err) {
+		return true
+	}
+	e, ok := err.(thrift.TTransportException)
+	if !ok {
+		return false
+	}
+	return e.TypeId() == TRANSPORT_EXCEPTION_TIMED_OUT || e.TypeId() == TRANSPORT_EXCEPTION_NOT_OPEN
+}
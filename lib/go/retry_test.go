@@ -0,0 +1,185 @@
+package frugal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// retryClient is a client whose ping method returns the queued errors in
+// order.
+type retryClient struct {
+	annotations map[string]map[string]string
+	errs        []error
+	opids       []string
+	timeouts    []time.Duration
+}
+
+func (r *retryClient) ping(ctx FContext) error {
+	opid, _ := ctx.RequestHeader(opIDHeader)
+	r.opids = append(r.opids, opid)
+	r.timeouts = append(r.timeouts, ctx.Timeout())
+	if len(r.errs) == 0 {
+		return nil
+	}
+	err := r.errs[0]
+	r.errs = r.errs[1:]
+	return err
+}
+
+func newRetryMethod(client *retryClient, policy RetryPolicy) *Method {
+	method := NewMethod(client, client.ping, "ping", []ServiceMiddleware{NewRetryMiddleware(policy)})
+	method.SetAnnotations(client.annotations["ping"])
+	return method
+}
+
+var (
+	timedOutErr = thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "timed out")
+	notOpenErr  = thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "not open")
+)
+
+// Ensures idempotent methods are retried on TIMED_OUT and NOT_OPEN errors with
+// a copy of the FContext with a new operation id and the remaining timeout,
+// leaving the caller's FContext unchanged.
+func TestRetryMiddleware(t *testing.T) {
+	client := &retryClient{
+		annotations: map[string]map[string]string{"ping": {IdempotentAnnotation: "true"}},
+		errs:        []error{timedOutErr, notOpenErr},
+	}
+	method := newRetryMethod(client, RetryPolicy{InitialBackoff: time.Millisecond})
+
+	ctx := NewFContext("")
+	ctx.SetTimeout(3 * time.Second)
+	opid, _ := ctx.RequestHeader(opIDHeader)
+	ret := method.Invoke([]interface{}{ctx})
+	assert.Nil(t, ret.Error())
+	assert.Equal(t, 3, len(client.opids))
+	assert.NotEqual(t, opid, client.opids[0])
+	assert.NotEqual(t, client.opids[0], client.opids[1])
+	assert.NotEqual(t, client.opids[1], client.opids[2])
+	assert.True(t, client.timeouts[0] > 2*time.Second)
+	assert.True(t, client.timeouts[2] < client.timeouts[0])
+	assert.Equal(t, 3*time.Second, ctx.Timeout())
+	callerOpid, _ := ctx.RequestHeader(opIDHeader)
+	assert.Equal(t, opid, callerOpid)
+}
+
+// Ensures each attempt's timeout is limited by the AttemptTimeout.
+func TestRetryMiddlewareAttemptTimeout(t *testing.T) {
+	client := &retryClient{
+		annotations: map[string]map[string]string{"ping": {IdempotentAnnotation: "true"}},
+		errs:        []error{timedOutErr},
+	}
+	method := newRetryMethod(client, RetryPolicy{InitialBackoff: time.Millisecond, AttemptTimeout: time.Second})
+
+	ctx := NewFContext("")
+	ctx.SetTimeout(time.Minute)
+	assert.Nil(t, method.Invoke([]interface{}{ctx}).Error())
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, client.timeouts)
+}
+
+// Ensures the error is returned once the retries are exhausted, using the
+// retries annotation.
+func TestRetryMiddlewareRetriesAnnotation(t *testing.T) {
+	client := &retryClient{
+		annotations: map[string]map[string]string{
+			"ping": {IdempotentAnnotation: "true", RetriesAnnotation: "1"},
+		},
+		errs: []error{notOpenErr, notOpenErr, notOpenErr},
+	}
+	method := newRetryMethod(client, RetryPolicy{InitialBackoff: time.Millisecond})
+
+	ret := method.Invoke([]interface{}{NewFContext("")})
+	assert.Equal(t, notOpenErr, ret.Error())
+	assert.Equal(t, 2, len(client.opids))
+}
+
+// Ensures methods which are not annotated as idempotent are not retried.
+func TestRetryMiddlewareNotIdempotent(t *testing.T) {
+	client := &retryClient{errs: []error{notOpenErr}}
+	method := newRetryMethod(client, RetryPolicy{})
+
+	ret := method.Invoke([]interface{}{NewFContext("")})
+	assert.Equal(t, notOpenErr, ret.Error())
+	assert.Equal(t, 1, len(client.opids))
+}
+
+// Ensures errors other than TIMED_OUT and NOT_OPEN are not retried.
+func TestRetryMiddlewareNotRetryable(t *testing.T) {
+	for _, err := range []error{
+		errors.New("error"),
+		thrift.NewTApplicationException(APPLICATION_EXCEPTION_INTERNAL_ERROR, "error"),
+		thrift.NewTTransportException(TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, "error"),
+	} {
+		client := &retryClient{
+			annotations: map[string]map[string]string{"ping": {IdempotentAnnotation: "true"}},
+			errs:        []error{err},
+		}
+		method := newRetryMethod(client, RetryPolicy{InitialBackoff: time.Millisecond})
+
+		ret := method.Invoke([]interface{}{NewFContext("")})
+		assert.Equal(t, err, ret.Error())
+		assert.Equal(t, 1, len(client.opids))
+	}
+}
+
+// Ensures calls rejected by an overloaded server are retried.
+func TestRetryMiddlewareOverloaded(t *testing.T) {
+	client := &retryClient{
+		annotations: map[string]map[string]string{"ping": {IdempotentAnnotation: "true"}},
+		errs:        []error{thrift.NewTApplicationException(APPLICATION_EXCEPTION_OVERLOADED, "overloaded")},
+	}
+	method := newRetryMethod(client, RetryPolicy{InitialBackoff: time.Millisecond})
+
+	ret := method.Invoke([]interface{}{NewFContext("")})
+	assert.Nil(t, ret.Error())
+	assert.Equal(t, 2, len(client.opids))
+}
+
+// Ensures retries stop once the FContext timeout is used up.
+func TestRetryMiddlewareTimeoutBudget(t *testing.T) {
+	client := &retryClient{
+		annotations: map[string]map[string]string{"ping": {IdempotentAnnotation: "true"}},
+		errs:        []error{notOpenErr, notOpenErr, notOpenErr},
+	}
+	method := newRetryMethod(client, RetryPolicy{
+		MaxRetries:     5,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+
+	ctx := NewFContext("")
+	ctx.SetTimeout(time.Millisecond)
+	ret := method.Invoke([]interface{}{ctx})
+	assert.Equal(t, notOpenErr, ret.Error())
+	assert.Equal(t, 1, len(client.opids))
+}
+
+// Ensures MethodAnnotations returns the annotations of the invoked method,
+// including when it's invoked with an FContext returned by WithContext, and
+// nil for other methods.
+func TestMethodAnnotations(t *testing.T) {
+	var annotations []map[string]string
+	middleware := func(next InvocationHandler) InvocationHandler {
+		return func(service reflect.Value, method reflect.Method, args Arguments) Results {
+			annotations = append(annotations, MethodAnnotations(service, method, args))
+			return next(service, method, args)
+		}
+	}
+	client := &retryClient{}
+	method := NewMethod(client, client.ping, "ping", []ServiceMiddleware{middleware})
+	method.SetAnnotations(map[string]string{IdempotentAnnotation: "true"})
+
+	ctx := NewFContext("")
+	method.Invoke([]interface{}{ctx})
+	method.Invoke([]interface{}{WithContext(NewFContext(""), context.Background())})
+	expected := map[string]string{IdempotentAnnotation: "true"}
+	assert.Equal(t, []map[string]string{expected, expected}, annotations)
+	assert.Nil(t, MethodAnnotations(reflect.ValueOf(&testHandler{}), method.proxiedMethod, Arguments{ctx}))
+	assert.Nil(t, MethodAnnotations(reflect.Value{}, method.proxiedMethod, Arguments{ctx}))
+}
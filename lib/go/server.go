@@ -1,5 +1,7 @@
 package frugal
 
+import "context"
+
 // FServer is Frugal's equivalent of Thrift's TServer. It's used to run a Frugal
 // RPC service by executing an FProcessor on client connections.
 type FServer interface {
@@ -10,3 +12,17 @@ type FServer interface {
 	// servers are required to be cleanly stoppable.
 	Stop() error
 }
+
+// FGracefulServer is an FServer which can be stopped gracefully. It's
+// implemented by the FServers included with Frugal and can be type asserted
+// from an FServer.
+type FGracefulServer interface {
+	FServer
+
+	// Shutdown gracefully stops the server. The server stops accepting new
+	// requests and waits for in-flight and queued requests to finish until
+	// the context is done. If the context is done first, the server is
+	// stopped and the number of requests which were abandoned is returned
+	// along with the context's error.
+	Shutdown(ctx context.Context) (int, error)
+}
@@ -1,16 +1,70 @@
 package frugal
 
 import (
+	"context"
+	"sync"
+
 	"git.apache.org/thrift.git/lib/go/thrift"
 )
 
+// simpleConn tracks a client connection of an FSimpleServer. Only the
+// goroutine reading from the connection closes its transport, since closing
+// it while it's being read isn't safe. Other goroutines interrupt the reader
+// instead.
+type simpleConn struct {
+	transport thrift.TTransport
+	writeMu   sync.Mutex
+	closeMu   sync.Mutex
+	closed    bool
+}
+
+// interruptible is implemented by transports, such as TSocket, which can be
+// closed while they're being read.
+type interruptible interface {
+	Interrupt() error
+}
+
+// interrupt unblocks the goroutine reading from the connection so it stops
+// processing requests and closes the connection. Transports which can't be
+// interrupted are closed.
+func (c *simpleConn) interrupt() {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return
+	}
+	if transport, ok := c.transport.(interruptible); ok {
+		transport.Interrupt()
+		return
+	}
+	c.closed = true
+	c.transport.Close()
+}
+
+// close closes the connection. It's called by the goroutine reading from the
+// connection.
+func (c *simpleConn) close() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.transport.Close()
+}
+
 // FSimpleServer is a simple FServer which starts a goroutine for each
 // connection.
 type FSimpleServer struct {
 	quit            chan struct{}
+	quitOnce        sync.Once
 	processor       FProcessor
 	serverTransport thrift.TServerTransport
 	protocolFactory *FProtocolFactory
+	conns           *connTracker
+	workers         chan struct{}
+	maxInFlight     uint
+	maxFrameSize    uint32
 }
 
 // NewFSimpleServer creates a new FSimpleServer which is a simple FServer that
@@ -25,9 +79,43 @@ func NewFSimpleServer(
 		serverTransport: serverTransport,
 		protocolFactory: protocolFactory,
 		quit:            make(chan struct{}, 1),
+		conns:           newConnTracker(),
+		maxFrameSize:    defaultMaxLength,
 	}
 }
 
+// WithWorkerCount makes the server process requests concurrently, allowing
+// responses to requests on the same connection to be written out of order
+// as they complete. Frames are read continuously from each connection and
+// at most workerCount requests are processed at once across connections. By
+// default, requests on a connection are processed one at a time. Must be
+// called before Serve.
+func (p *FSimpleServer) WithWorkerCount(workerCount uint) *FSimpleServer {
+	if workerCount == 0 {
+		p.workers = nil
+	} else {
+		p.workers = make(chan struct{}, workerCount)
+	}
+	return p
+}
+
+// WithMaxInFlight limits the number of requests read from a connection which
+// are waiting for a worker or being processed when processing requests
+// concurrently. The server stops reading from the connection until a request
+// completes. Defaults to the worker count. Must be called before Serve.
+func (p *FSimpleServer) WithMaxInFlight(maxInFlight uint) *FSimpleServer {
+	p.maxInFlight = maxInFlight
+	return p
+}
+
+// WithMaxFrameSize limits the size of request frames, excluding the frame
+// size. Connections which send larger frames are closed. Defaults to
+// 16384000 bytes. Must be called before Serve.
+func (p *FSimpleServer) WithMaxFrameSize(maxFrameSize uint32) *FSimpleServer {
+	p.maxFrameSize = maxFrameSize
+	return p
+}
+
 // Listen should not be called directly.
 func (p *FSimpleServer) listen() error {
 	return p.serverTransport.Listen()
@@ -64,31 +152,158 @@ func (p *FSimpleServer) Serve() error {
 	return nil
 }
 
-// Stop the server.
+// Stop the server. Connections are left open.
 func (p *FSimpleServer) Stop() error {
-	close(p.quit)
-	p.serverTransport.Interrupt()
+	p.quitOnce.Do(func() {
+		close(p.quit)
+		p.serverTransport.Interrupt()
+	})
 	return nil
 }
 
+// Shutdown gracefully stops the server. It stops accepting connections, closes
+// idle connections, and waits for connections processing a request to finish
+// it until the context is done. If the context is done first, all remaining
+// connections are closed and the number of requests which were abandoned is
+// returned along with the context's error.
+func (p *FSimpleServer) Shutdown(ctx context.Context) (int, error) {
+	p.Stop()
+	return p.conns.drain(ctx)
+}
+
 func (p *FSimpleServer) accept(client thrift.TTransport) error {
-	framed := NewTFramedTransport(client)
-	iprot := p.protocolFactory.GetProtocol(framed)
-	oprot := p.protocolFactory.GetProtocol(framed)
-	processor := p.processor
+	conn := &simpleConn{transport: client}
+	if !p.conns.track(conn) {
+		return client.Close()
+	}
+	defer p.conns.untrack(conn)
+	defer conn.close()
 
+	framed := NewTFramedTransportMaxLength(client, p.maxFrameSize)
 	logger().Debug("frugal: client connection accepted")
+	var err error
+	if p.workers != nil {
+		err = p.processConcurrently(conn, framed)
+	} else {
+		err = p.processSerially(conn, framed)
+	}
+	return err
+}
+
+// processSerially processes the requests of the client connection one at a
+// time.
+func (p *FSimpleServer) processSerially(conn *simpleConn, framed *TFramedTransport) error {
+	oprot := p.protocolFactory.GetProtocol(framed)
+	processor := p.processor
 
+	// Frames are processed one at a time, so each is read into the memory
+	// of the last.
+	var (
+		frame []byte
+		err   error
+	)
 	for {
-		err := processor.Process(iprot, oprot)
+		frame, err = readFrame(framed, frame)
+		if err, ok := err.(thrift.TTransportException); ok && err.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil
+		} else if err != nil {
+			if p.conns.isDraining() {
+				// The connection was interrupted by Shutdown.
+				return nil
+			}
+			return err
+		}
+
+		if !p.conns.begin(conn) {
+			return nil
+		}
+		input := acquireFrameTransport(frame)
+		err = processor.Process(p.protocolFactory.GetProtocol(input), oprot)
+		releaseFrameTransport(input)
+		if !p.conns.finish(conn) {
+			return nil
+		}
 		if err, ok := err.(thrift.TTransportException); ok && err.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
 			return nil
 		} else if err != nil {
 			logger().Printf("error processing request: %s", err)
 			return err
 		}
-		if err, ok := err.(thrift.TApplicationException); ok && err.TypeId() == APPLICATION_EXCEPTION_UNKNOWN_METHOD {
-			continue
+	}
+}
+
+// processConcurrently reads frames from the client connection continuously
+// and processes them with the worker pool, writing each response as it
+// completes.
+func (p *FSimpleServer) processConcurrently(conn *simpleConn, framed *TFramedTransport) error {
+	maxInFlight := p.maxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = uint(cap(p.workers))
+	}
+	slots := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+	// The connection is untracked once its requests are processed.
+	defer wg.Wait()
+
+	for {
+		// Each frame is processed while the next is read, so frames can't
+		// share memory.
+		frame, err := readFrame(framed, nil)
+		if err, ok := err.(thrift.TTransportException); ok && err.TypeId() == TRANSPORT_EXCEPTION_END_OF_FILE {
+			return nil
+		} else if err != nil {
+			if p.conns.isDraining() {
+				// The connection was interrupted by Shutdown.
+				return nil
+			}
+			return err
 		}
+
+		slots <- struct{}{}
+		if !p.conns.begin(conn) {
+			return nil
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.workers <- struct{}{}
+			p.processFrame(conn, frame)
+			<-p.workers
+			<-slots
+			if !p.conns.finish(conn) {
+				conn.interrupt()
+			}
+		}()
+	}
+}
+
+// processFrame processes the request frame and writes the response, if any,
+// to the client connection. The connection is interrupted if the request
+// can't be processed or the response can't be written.
+func (p *FSimpleServer) processFrame(conn *simpleConn, frame []byte) {
+	input := acquireFrameTransport(frame)
+	defer releaseFrameTransport(input)
+	output := NewTMemoryOutputBuffer(0)
+	defer output.Release()
+
+	if err := p.processor.Process(p.protocolFactory.GetProtocol(input), p.protocolFactory.GetProtocol(output)); err != nil {
+		logger().Printf("error processing request: %s", err)
+		conn.interrupt()
+		return
+	}
+	if !output.HasWriteData() {
+		return
+	}
+
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	if _, err := conn.transport.Write(output.Bytes()); err != nil {
+		logger().Printf("error writing response: %s", err)
+		conn.interrupt()
+		return
+	}
+	if err := conn.transport.Flush(); err != nil {
+		logger().Printf("error writing response: %s", err)
+		conn.interrupt()
 	}
 }
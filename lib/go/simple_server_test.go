@@ -1,6 +1,8 @@
 package frugal
 
 import (
+	"context"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -54,3 +56,229 @@ func TestSimpleServer(t *testing.T) {
 	mockFProcessor.AssertExpectations(t)
 	mockFProcessor.AssertExpectations(t)
 }
+
+// Ensures Shutdown waits for the request being processed to finish and
+// closes the client connections.
+func TestSimpleServerShutdown(t *testing.T) {
+	processor := &slowProcessor{delay: 50 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverTr, err := thrift.NewTServerSocket(simpleServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewFSimpleServer(processor, serverTr, protoFactory)
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	transport, err := thrift.NewTSocket(simpleServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fTransport := NewAdapterTransport(transport)
+	if err := fTransport.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewFContext("")
+	resultC := make(chan error, 1)
+	go func() {
+		_, err := fTransport.Request(ctx, requestFrame(t, protoFactory, ctx))
+		resultC <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := server.Shutdown(shutdownCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+	assert.Nil(t, <-resultC)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&processor.processed))
+
+	select {
+	case <-fTransport.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("Expected transport to close")
+	}
+}
+
+// Ensures Shutdown closes the client connections and reports the abandoned
+// requests when the context is done before the requests are processed.
+func TestSimpleServerShutdownAbandoned(t *testing.T) {
+	processor := &slowProcessor{delay: 100 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	serverTr, err := thrift.NewTServerSocket(simpleServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewFSimpleServer(processor, serverTr, protoFactory)
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	transport, err := thrift.NewTSocket(simpleServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fTransport := NewAdapterTransport(transport)
+	if err := fTransport.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer fTransport.Close()
+
+	ctx := NewFContext("")
+	go fTransport.Request(ctx, requestFrame(t, protoFactory, ctx))
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	abandoned, err := server.Shutdown(shutdownCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, abandoned)
+}
+
+// startSimpleServer serves the processor with an FSimpleServer configured by
+// the given function and returns an open client FTransport connected to it.
+func startSimpleServer(t *testing.T, processor FProcessor, protoFactory *FProtocolFactory,
+	configure func(*FSimpleServer)) (*FSimpleServer, FTransport) {
+	serverTr, err := thrift.NewTServerSocket(simpleServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewFSimpleServer(processor, serverTr, protoFactory)
+	configure(server)
+	go func() {
+		assert.Nil(t, server.Serve())
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	transport, err := thrift.NewTSocket(simpleServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fTransport := NewAdapterTransport(transport)
+	if err := fTransport.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return server, fTransport
+}
+
+// sendConcurrently sends the given number of requests at once and returns how
+// long they took.
+func sendConcurrently(t *testing.T, fTransport FTransport, protoFactory *FProtocolFactory, requests int) time.Duration {
+	start := time.Now()
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			ctx := NewFContext("")
+			_, err := fTransport.Request(ctx, requestFrame(t, protoFactory, ctx))
+			errs <- err
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		assert.Nil(t, <-errs)
+	}
+	return time.Since(start)
+}
+
+// Ensures requests on the same connection are processed concurrently with a
+// worker pool.
+func TestSimpleServerConcurrent(t *testing.T) {
+	processor := &slowProcessor{delay: 50 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server, fTransport := startSimpleServer(t, processor, protoFactory, func(server *FSimpleServer) {
+		server.WithWorkerCount(4)
+	})
+	defer server.Stop()
+	defer fTransport.Close()
+
+	elapsed := sendConcurrently(t, fTransport, protoFactory, 4)
+	assert.True(t, elapsed < 150*time.Millisecond, "requests took %s", elapsed)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&processor.processed))
+}
+
+// Ensures the in-flight requests of a connection are limited.
+func TestSimpleServerMaxInFlight(t *testing.T) {
+	processor := &slowProcessor{delay: 30 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server, fTransport := startSimpleServer(t, processor, protoFactory, func(server *FSimpleServer) {
+		server.WithWorkerCount(4).WithMaxInFlight(1)
+	})
+	defer server.Stop()
+	defer fTransport.Close()
+
+	elapsed := sendConcurrently(t, fTransport, protoFactory, 3)
+	assert.True(t, elapsed >= 90*time.Millisecond, "requests took %s", elapsed)
+}
+
+// Ensures Shutdown waits for concurrently processed requests to finish.
+func TestSimpleServerConcurrentShutdown(t *testing.T) {
+	processor := &slowProcessor{delay: 50 * time.Millisecond}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server, fTransport := startSimpleServer(t, processor, protoFactory, func(server *FSimpleServer) {
+		server.WithWorkerCount(2)
+	})
+
+	resultC := make(chan time.Duration, 1)
+	go func() { resultC <- sendConcurrently(t, fTransport, protoFactory, 2) }()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := server.Shutdown(shutdownCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+	<-resultC
+	assert.Equal(t, int32(2), atomic.LoadInt32(&processor.processed))
+
+	select {
+	case <-fTransport.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("Expected transport to close")
+	}
+}
+
+// Ensures connections which send frames over the max frame size are closed.
+func TestSimpleServerMaxFrameSize(t *testing.T) {
+	processor := &slowProcessor{}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server, fTransport := startSimpleServer(t, processor, protoFactory, func(server *FSimpleServer) {
+		server.WithMaxFrameSize(16)
+	})
+	defer server.Stop()
+
+	ctx := NewFContext("")
+	ctx.SetTimeout(time.Second)
+	go fTransport.Request(ctx, requestFrame(t, protoFactory, ctx))
+
+	select {
+	case <-fTransport.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("Expected transport to close")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&processor.processed))
+}
+
+// Ensures connections are closed when a worker can't process a request.
+func TestSimpleServerConcurrentProcessError(t *testing.T) {
+	processor := &slowProcessor{}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server, fTransport := startSimpleServer(t, processor, protoFactory, func(server *FSimpleServer) {
+		server.WithWorkerCount(2)
+	})
+	defer server.Stop()
+
+	ctx := NewFContext("")
+	ctx.SetTimeout(time.Second)
+	// The frame's header can't be read.
+	go fTransport.Request(ctx, prependFrameSize([]byte{0xff, 0xff}))
+
+	select {
+	case <-fTransport.Closed():
+	case <-time.After(time.Second):
+		t.Fatal("Expected transport to close")
+	}
+}
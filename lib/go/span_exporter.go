@@ -0,0 +1,112 @@
+package frugal
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// InMemorySpanExporter is a SpanExporter which keeps finished spans in
+// memory, e.g. for tests.
+type InMemorySpanExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewInMemorySpanExporter creates an empty InMemorySpanExporter.
+func NewInMemorySpanExporter() *InMemorySpanExporter {
+	return &InMemorySpanExporter{}
+}
+
+// ExportSpan keeps the finished span.
+func (i *InMemorySpanExporter) ExportSpan(span *Span) {
+	i.mu.Lock()
+	i.spans = append(i.spans, span)
+	i.mu.Unlock()
+}
+
+// Spans returns the finished spans in the order they finished.
+func (i *InMemorySpanExporter) Spans() []*Span {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]*Span(nil), i.spans...)
+}
+
+// Reset discards the finished spans.
+func (i *InMemorySpanExporter) Reset() {
+	i.mu.Lock()
+	i.spans = nil
+	i.mu.Unlock()
+}
+
+// JSONSpanExporter is a SpanExporter which writes each finished span as a
+// line of JSON.
+type JSONSpanExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+// jsonSpan is the JSON representation of a Span.
+type jsonSpan struct {
+	TraceID       string `json:"trace_id"`
+	SpanID        string `json:"span_id"`
+	ParentID      string `json:"parent_id,omitempty"`
+	Name          string `json:"name"`
+	Kind          string `json:"kind"`
+	CorrelationID string `json:"correlation_id"`
+	Start         string `json:"start"`
+	DurationUs    int64  `json:"duration_us"`
+	Error         string `json:"error,omitempty"`
+}
+
+// NewJSONSpanExporter creates a JSONSpanExporter which writes to w.
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{w: w, encoder: json.NewEncoder(w)}
+}
+
+// NewJSONFileSpanExporter creates a JSONSpanExporter which appends to the
+// file at path, creating it if needed. Call Close to close the file.
+func NewJSONFileSpanExporter(path string) (*JSONSpanExporter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSpanExporter(file), nil
+}
+
+// ExportSpan writes the finished span as a line of JSON. Write errors are
+// logged.
+func (j *JSONSpanExporter) ExportSpan(span *Span) {
+	js := jsonSpan{
+		TraceID:       span.TraceID.String(),
+		SpanID:        span.SpanID.String(),
+		Name:          span.Name,
+		Kind:          span.Kind.String(),
+		CorrelationID: span.CorrelationID,
+		Start:         span.Start.UTC().Format(time.RFC3339Nano),
+		DurationUs:    int64(span.Duration() / time.Microsecond),
+	}
+	if !span.ParentID.IsZero() {
+		js.ParentID = span.ParentID.String()
+	}
+	if span.Err != nil {
+		js.Error = span.Err.Error()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.encoder.Encode(js); err != nil {
+		logger().Errorf("frugal: error exporting span: %s", err)
+	}
+}
+
+// Close closes the underlying writer if it's an io.Closer.
+func (j *JSONSpanExporter) Close() error {
+	if closer, ok := j.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
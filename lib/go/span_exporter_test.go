@@ -0,0 +1,83 @@
+package frugal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSpan() *Span {
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	span := &Span{
+		Name:          "ping",
+		Kind:          SpanKindServer,
+		CorrelationID: "cid",
+		Start:         start,
+		End:           start.Add(1500 * time.Microsecond),
+		Err:           errors.New("error"),
+	}
+	span.TraceID, span.ParentID, _, _ = parseTraceparent(testTraceparent)
+	span.SpanID = SpanID{1, 2, 3, 4, 5, 6, 7, 8}
+	return span
+}
+
+// Ensures JSONSpanExporter writes each span as a line of JSON.
+func TestJSONSpanExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter := NewJSONSpanExporter(&buf)
+	exporter.ExportSpan(testSpan())
+	root := testSpan()
+	root.ParentID = SpanID{}
+	root.Err = nil
+	exporter.ExportSpan(root)
+	assert.Nil(t, exporter.Close())
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	assert.Equal(t, 2, len(lines))
+	var span map[string]interface{}
+	assert.Nil(t, json.Unmarshal(lines[0], &span))
+	assert.Equal(t, map[string]interface{}{
+		"trace_id":       "4bf92f3577b34da6a3ce929d0e0e4736",
+		"span_id":        "0102030405060708",
+		"parent_id":      "00f067aa0ba902b7",
+		"name":           "ping",
+		"kind":           "server",
+		"correlation_id": "cid",
+		"start":          "2017-01-02T03:04:05Z",
+		"duration_us":    float64(1500),
+		"error":          "error",
+	}, span)
+	span = nil
+	assert.Nil(t, json.Unmarshal(lines[1], &span))
+	assert.NotContains(t, span, "parent_id")
+	assert.NotContains(t, span, "error")
+}
+
+// Ensures NewJSONFileSpanExporter appends spans to the file.
+func TestJSONFileSpanExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frugal")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.jsonl")
+
+	for i := 0; i < 2; i++ {
+		exporter, err := NewJSONFileSpanExporter(path)
+		assert.Nil(t, err)
+		exporter.ExportSpan(testSpan())
+		assert.Nil(t, exporter.Close())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+
+	_, err = NewJSONFileSpanExporter(filepath.Join(dir, "missing", "spans.jsonl"))
+	assert.NotNil(t, err)
+}
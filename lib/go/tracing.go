@@ -0,0 +1,261 @@
+package frugal
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header containing the W3C trace context of the current span, formatted as
+// version-traceid-spanid-flags, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+const traceparentHeader = "_traceparent"
+
+const (
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+)
+
+var (
+	exporter   SpanExporter
+	exporterMu sync.RWMutex
+
+	// idRand generates trace and span ids. It's seeded so ids differ between
+	// processes.
+	idRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+	idRandMu sync.Mutex
+)
+
+// SpanExporter receives spans when they finish. Implementations must be safe
+// for concurrent use and should not block, since spans are exported by the
+// goroutine which finished them.
+type SpanExporter interface {
+	// ExportSpan exports the finished span. The span must not be modified.
+	ExportSpan(span *Span)
+}
+
+// SetSpanExporter sets the SpanExporter which receives finished spans and
+// enables tracing. Generated clients, processors, publishers and subscribers
+// start a span for each request and message, which is a child of the span in
+// the FContext's trace context, if any, and propagate the new span in the
+// trace context so remote services continue the trace. Setting a nil
+// SpanExporter disables tracing, which is the default.
+func SetSpanExporter(spanExporter SpanExporter) {
+	exporterMu.Lock()
+	exporter = spanExporter
+	exporterMu.Unlock()
+}
+
+func spanExporter() SpanExporter {
+	exporterMu.RLock()
+	spanExporter := exporter
+	exporterMu.RUnlock()
+	return spanExporter
+}
+
+// SpanKind is the role of the span in a request or message.
+type SpanKind int
+
+const (
+	// SpanKindClient is a request made by a client.
+	SpanKindClient SpanKind = iota
+
+	// SpanKindServer is a request processed by a server.
+	SpanKindServer
+
+	// SpanKindProducer is a message sent by a publisher.
+	SpanKindProducer
+
+	// SpanKindConsumer is a message received by a subscriber.
+	SpanKindConsumer
+)
+
+// String returns the name of the kind.
+func (s SpanKind) String() string {
+	switch s {
+	case SpanKindClient:
+		return "client"
+	case SpanKindServer:
+		return "server"
+	case SpanKindProducer:
+		return "producer"
+	case SpanKindConsumer:
+		return "consumer"
+	default:
+		return fmt.Sprintf("SpanKind(%d)", int(s))
+	}
+}
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns the ID as lowercase hex.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span within a trace.
+type SpanID [8]byte
+
+// String returns the ID as lowercase hex.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsZero returns true if the ID is all zeros, which is the case for the
+// parent of a root span.
+func (s SpanID) IsZero() bool {
+	return s == SpanID{}
+}
+
+// Span is a timed operation in a trace, such as a request made by a client or
+// a message received by a subscriber.
+type Span struct {
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentID      SpanID
+	Name          string
+	Kind          SpanKind
+	CorrelationID string
+	Start         time.Time
+	End           time.Time
+	Err           error
+
+	ctx        FContext
+	prevHeader string
+	hadHeader  bool
+	sampled    bool
+	exporter   SpanExporter
+}
+
+// StartSpan starts a span for the named method or operation which is a child
+// of the span in the FContext's trace context, or a new trace if there is
+// none, and sets the FContext's trace context to the new span. It returns nil
+// if tracing is disabled. This is called by generated code.
+func StartSpan(ctx FContext, name string, kind SpanKind) *Span {
+	spanExporter := spanExporter()
+	if spanExporter == nil {
+		return nil
+	}
+
+	span := &Span{
+		Name:          name,
+		Kind:          kind,
+		CorrelationID: ctx.CorrelationID(),
+		Start:         time.Now(),
+		ctx:           ctx,
+		sampled:       true,
+		exporter:      spanExporter,
+	}
+	span.prevHeader, span.hadHeader = ctx.RequestHeader(traceparentHeader)
+	if traceID, parentID, flags, ok := parseTraceparent(span.prevHeader); ok {
+		span.TraceID = traceID
+		span.ParentID = parentID
+		span.sampled = flags&flagSampled != 0
+	} else {
+		randomID(span.TraceID[:])
+	}
+	randomID(span.SpanID[:])
+	ctx.AddRequestHeader(traceparentHeader, span.traceparent())
+	return span
+}
+
+// Finish ends the span with the error, if any, of its operation, restores
+// the FContext's trace context to the span's parent and exports the span if
+// it's sampled. Finish is a no-op on a nil Span. This is called by generated
+// code.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Err = err
+	if s.hadHeader {
+		s.ctx.AddRequestHeader(traceparentHeader, s.prevHeader)
+	} else {
+		removeRequestHeader(s.ctx, traceparentHeader)
+	}
+	if s.sampled {
+		s.exporter.ExportSpan(s)
+	}
+}
+
+// SetResponseError records the error of the response to the request in the
+// FContext, such as an error returned by the handler, so the server span of
+// the request finishes with it even if the response was written
+// successfully. This is called by generated code.
+func SetResponseError(ctx FContext, err error) {
+	if impl := unwrapFContext(ctx); impl != nil {
+		impl.mu.Lock()
+		impl.responseErr = err
+		impl.mu.Unlock()
+	}
+}
+
+// responseError returns the error set by SetResponseError, if any.
+func responseError(ctx FContext) error {
+	impl := unwrapFContext(ctx)
+	if impl == nil {
+		return nil
+	}
+	impl.mu.RLock()
+	defer impl.mu.RUnlock()
+	return impl.responseErr
+}
+
+// Duration returns how long the span took.
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+func (s *Span) traceparent() string {
+	flags := byte(0)
+	if s.sampled {
+		flags = flagSampled
+	}
+	return fmt.Sprintf("%s-%s-%s-%02x", traceparentVersion, s.TraceID, s.SpanID, flags)
+}
+
+// parseTraceparent parses the trace id, span id and flags from a W3C
+// traceparent value. Returns false if the value is invalid.
+func parseTraceparent(traceparent string) (traceID TraceID, spanID SpanID, flags byte, ok bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return
+	}
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return
+	}
+	var flagBytes [1]byte
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(flagBytes[:], []byte(parts[3])); err != nil {
+		return
+	}
+	if traceID == (TraceID{}) || spanID.IsZero() {
+		return
+	}
+	return traceID, spanID, flagBytes[0], true
+}
+
+// randomID fills the ID with random bytes, ensuring it's not all zeros.
+func randomID(id []byte) {
+	idRandMu.Lock()
+	defer idRandMu.Unlock()
+	for {
+		idRand.Read(id)
+		for _, b := range id {
+			if b != 0 {
+				return
+			}
+		}
+	}
+}
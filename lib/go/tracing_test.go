@@ -0,0 +1,123 @@
+package frugal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Ensures StartSpan returns nil and leaves the FContext unchanged when no
+// SpanExporter is set.
+func TestStartSpanDisabled(t *testing.T) {
+	ctx := NewFContext("")
+	span := StartSpan(ctx, "ping", SpanKindClient)
+	assert.Nil(t, span)
+	span.Finish(nil)
+	_, ok := ctx.RequestHeader(traceparentHeader)
+	assert.False(t, ok)
+}
+
+// Ensures a span started without a trace context starts a new trace, is set
+// as the FContext's trace context until it finishes, and is exported.
+func TestStartSpanRoot(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	ctx := NewFContext("cid")
+	span := StartSpan(ctx, "ping", SpanKindClient)
+	traceparent, ok := ctx.RequestHeader(traceparentHeader)
+	assert.True(t, ok)
+	assert.Equal(t, "00-"+span.TraceID.String()+"-"+span.SpanID.String()+"-01", traceparent)
+	assert.True(t, span.ParentID.IsZero())
+	assert.Equal(t, "cid", span.CorrelationID)
+
+	err := errors.New("error")
+	span.Finish(err)
+	_, ok = ctx.RequestHeader(traceparentHeader)
+	assert.False(t, ok)
+	assert.Equal(t, []*Span{span}, exporter.Spans())
+	assert.Equal(t, err, span.Err)
+	assert.True(t, span.Duration() >= 0)
+
+	exporter.Reset()
+	assert.Empty(t, exporter.Spans())
+}
+
+// Ensures a span started with a trace context is a child of its span and the
+// trace context is restored when the span finishes.
+func TestStartSpanChild(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	ctx := NewFContext("")
+	ctx.AddRequestHeader(traceparentHeader, testTraceparent)
+	span := StartSpan(ctx, "ping", SpanKindServer)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", span.ParentID.String())
+	assert.NotEqual(t, span.ParentID, span.SpanID)
+
+	child := StartSpan(ctx, "blah", SpanKindClient)
+	assert.Equal(t, span.TraceID, child.TraceID)
+	assert.Equal(t, span.SpanID, child.ParentID)
+	child.Finish(nil)
+	span.Finish(nil)
+
+	traceparent, _ := ctx.RequestHeader(traceparentHeader)
+	assert.Equal(t, testTraceparent, traceparent)
+	assert.Equal(t, []*Span{child, span}, exporter.Spans())
+}
+
+// Ensures spans in traces which aren't sampled propagate the flag and aren't
+// exported.
+func TestStartSpanNotSampled(t *testing.T) {
+	exporter := NewInMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	ctx := NewFContext("")
+	ctx.AddRequestHeader(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	span := StartSpan(ctx, "ping", SpanKindClient)
+	traceparent, _ := ctx.RequestHeader(traceparentHeader)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanID.String()+"-00", traceparent)
+	span.Finish(nil)
+	assert.Empty(t, exporter.Spans())
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, flags, ok := parseTraceparent(testTraceparent)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", spanID.String())
+	assert.Equal(t, byte(1), flags)
+
+	// Future versions may have additional fields.
+	_, _, _, ok = parseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	assert.True(t, ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0z",
+	} {
+		_, _, _, ok := parseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestSpanKindString(t *testing.T) {
+	assert.Equal(t, "client", SpanKindClient.String())
+	assert.Equal(t, "server", SpanKindServer.String())
+	assert.Equal(t, "producer", SpanKindProducer.String())
+	assert.Equal(t, "consumer", SpanKindConsumer.String())
+	assert.Equal(t, "SpanKind(9)", SpanKind(9).String())
+}
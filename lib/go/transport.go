@@ -82,13 +82,15 @@ type FTransport interface {
 	Close() error
 
 	// Oneway transmits the given data and doesn't wait for a response.
-	// Implementations of oneway should be threadsafe and respect the timeout
-	// present on the context.
+	// Implementations of oneway should be threadsafe, respect the timeout
+	// present on the context, and abort when the context's context.Context
+	// is done.
 	Oneway(ctx FContext, payload []byte) error
 
 	// Request transmits the given data and waits for a response.
-	// Implementations of request should be threadsafe and respect the timeout
-	// present on the context.
+	// Implementations of request should be threadsafe, respect the timeout
+	// present on the context, and abort when the context's context.Context
+	// is done.
 	Request(ctx FContext, payload []byte) (thrift.TTransport, error)
 
 	// GetRequestSizeLimit returns the maximum number of bytes that can be
@@ -142,8 +144,11 @@ func (f *fBaseTransport) Closed() <-chan error {
 	return f.closed
 }
 
+// prependFrameSize returns a new frame containing the frame size followed by
+// the given payload.
 func prependFrameSize(buf []byte) []byte {
-	frame := make([]byte, 4)
+	frame := make([]byte, len(buf)+4)
 	binary.BigEndian.PutUint32(frame, uint32(len(buf)))
-	return append(frame, buf...)
+	copy(frame[4:], buf)
+	return frame
 }
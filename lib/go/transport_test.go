@@ -17,3 +17,9 @@ func TestIsErrTooLarge(t *testing.T) {
 	assert.False(t, IsErrTooLarge(thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN, "error")))
 	assert.False(t, IsErrTooLarge(thrift.NewTApplicationException(0, "error")))
 }
+
+// Ensures prependFrameSize returns the payload prefixed with its size.
+func TestPrependFrameSize(t *testing.T) {
+	assert.Equal(t, []byte{0, 0, 0, 3, 1, 2, 3}, prependFrameSize([]byte{1, 2, 3}))
+	assert.Equal(t, []byte{0, 0, 0, 0}, prependFrameSize(nil))
+}
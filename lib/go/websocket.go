@@ -0,0 +1,484 @@
+package frugal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the subset of the WebSocket protocol, RFC 6455, used
+// by the WebSocket transports: the opening handshake, binary and text
+// messages, which may be fragmented, and the ping, pong, and close control
+// frames. Extensions aren't supported.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsCloseNormal       = 1000
+	wsCloseGoingAway    = 1001
+	wsCloseProtocol     = 1002
+	wsClosePolicy       = 1008
+	wsCloseTooLarge     = 1009
+	wsMaxControlPayload = 125
+
+	// wsSubprotocol is the subprotocol negotiated by clients which send
+	// Frugal frames.
+	wsSubprotocol = "frugal"
+	wsVersion     = "13"
+	wsGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	defaultWebSocketHandshakeTimeout = 10 * time.Second
+
+	// wsWriteTimeout bounds how long the server waits to write a message to
+	// a client, so a slow client can't block responses or publishers.
+	wsWriteTimeout = 10 * time.Second
+
+	// wsMaxMessageSize limits the size of messages read from connections
+	// which are configured without a limit, so a peer can't exhaust memory.
+	wsMaxMessageSize = 64 * 1024 * 1024
+
+	// wsReadChunkSize is the size of the buffer a payload is initially read
+	// into. The buffer grows as the payload arrives rather than trusting the
+	// peer's length.
+	wsReadChunkSize = 64 * 1024
+)
+
+// errWebSocketClosed is returned when reading from a WebSocket connection
+// which the peer closed.
+var errWebSocketClosed = errors.New("frugal: websocket closed by peer")
+
+// wsConn is a WebSocket connection. Messages may be written concurrently, but
+// must be read by a single goroutine.
+type wsConn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	client         bool
+	maxMessageSize int
+	writeMu        sync.Mutex
+	closeOnce      sync.Once
+	closeSent      bool
+}
+
+// newWSConn returns a wsConn for the given connection. If maxMessageSize is 0,
+// messages are limited to wsMaxMessageSize.
+func newWSConn(conn net.Conn, reader *bufio.Reader, client bool, maxMessageSize uint) *wsConn {
+	if maxMessageSize == 0 {
+		maxMessageSize = wsMaxMessageSize
+	}
+	return &wsConn{
+		conn:           conn,
+		reader:         reader,
+		client:         client,
+		maxMessageSize: int(maxMessageSize),
+	}
+}
+
+// wsAcceptKey returns the Sec-WebSocket-Accept value for the given
+// Sec-WebSocket-Key.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContainsToken returns true if the comma-separated header contains the
+// given token, ignoring case.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin returns true if the request has no Origin header or its Origin
+// matches the request's host, which prevents other sites from opening
+// connections with a browser's credentials.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// upgradeWebSocket completes the opening handshake of the WebSocket request
+// and returns the connection. If the request isn't a valid WebSocket request,
+// an error response is written and an error is returned.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, checkOrigin func(*http.Request) bool,
+	maxMessageSize uint) (*wsConn, error) {
+
+	if r.Method != "GET" {
+		http.Error(w, "WebSocket requests must use GET", http.StatusMethodNotAllowed)
+		return nil, errors.New("frugal: websocket request method not GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Not a WebSocket request", http.StatusBadRequest)
+		return nil, errors.New("frugal: not a websocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != wsVersion {
+		w.Header().Set("Sec-WebSocket-Version", wsVersion)
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("frugal: unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("frugal: missing websocket key")
+	}
+	if !checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, errors.New("frugal: websocket origin not allowed")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("frugal: http.ResponseWriter doesn't support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n"
+	if headerContainsToken(r.Header, "Sec-WebSocket-Protocol", wsSubprotocol) {
+		response += "Sec-WebSocket-Protocol: " + wsSubprotocol + "\r\n"
+	}
+	response += "\r\n"
+	conn.SetWriteDeadline(time.Now().Add(defaultWebSocketHandshakeTimeout))
+	if _, err := rw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return newWSConn(conn, rw.Reader, false, maxMessageSize), nil
+}
+
+// dialWebSocket opens a WebSocket connection to the ws or wss URL, sending
+// the given headers with the opening handshake.
+func dialWebSocket(ctx context.Context, rawurl string, header http.Header, tlsConfig *tls.Config,
+	maxMessageSize uint) (*wsConn, error) {
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	var secure bool
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "http"
+	case "wss", "https":
+		u.Scheme = "https"
+		secure = true
+	default:
+		return nil, fmt.Errorf("frugal: unsupported websocket URL scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if secure {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", wsVersion)
+	request.Header.Set("Sec-WebSocket-Protocol", wsSubprotocol)
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContainsToken(response.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(response.Header, "Connection", "upgrade") ||
+		response.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("frugal: websocket handshake failed with status %s", response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return newWSConn(conn, reader, true, maxMessageSize), nil
+}
+
+// readMessage reads the next text or binary message, reassembling fragmented
+// messages and answering control frames. It returns errWebSocketClosed if the
+// peer closed the connection. Messages larger than the maximum message size
+// close the connection.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var (
+		opcode  byte
+		message []byte
+		started bool
+	)
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload, time.Time{}); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.closeWithCode(code, "")
+			return 0, nil, errWebSocketClosed
+		case wsText, wsBinary:
+			if started {
+				return 0, nil, c.fail(wsCloseProtocol, "frugal: websocket message interrupted by new message")
+			}
+			opcode = frameOpcode
+			started = true
+		case wsContinuation:
+			if !started {
+				return 0, nil, c.fail(wsCloseProtocol, "frugal: websocket continuation without message")
+			}
+		default:
+			return 0, nil, c.fail(wsCloseProtocol, fmt.Sprintf("frugal: unknown websocket opcode %d", frameOpcode))
+		}
+
+		if len(message)+len(payload) > c.maxMessageSize {
+			return 0, nil, c.fail(wsCloseTooLarge,
+				fmt.Sprintf("frugal: websocket message exceeds %d bytes", c.maxMessageSize))
+		}
+		if message == nil && fin {
+			message = payload
+		} else {
+			message = append(message, payload...)
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads the next frame and unmasks its payload.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2, 8)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsCloseProtocol, "frugal: websocket extensions not supported")
+	}
+	if masked == c.client {
+		return false, 0, nil, c.fail(wsCloseProtocol, "frugal: websocket frame masking invalid")
+	}
+	if opcode >= wsClose && (!fin || length > wsMaxControlPayload) {
+		return false, 0, nil, c.fail(wsCloseProtocol, "frugal: websocket control frame invalid")
+	}
+
+	switch length {
+	case 126:
+		ext := header[:2]
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := header[:8]
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > uint64(c.maxMessageSize) {
+		return false, 0, nil, c.fail(wsCloseTooLarge,
+			fmt.Sprintf("frugal: websocket message exceeds %d bytes", c.maxMessageSize))
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	initial := length
+	if initial > wsReadChunkSize {
+		initial = wsReadChunkSize
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, initial))
+	if _, err := io.CopyN(buffer, c.reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, 0, nil, err
+	}
+	payload := buffer.Bytes()
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a final frame with the given opcode and payload, masking
+// it if this is the client end of the connection. Messages are always written
+// in a single frame. A zero deadline means the write doesn't time out.
+func (c *wsConn) writeFrame(opcode byte, payload []byte, deadline time.Time) error {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return errors.New("frugal: websocket closed")
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// fail closes the connection with the given status code and returns an error
+// with the given message.
+func (c *wsConn) fail(code int, message string) error {
+	c.closeWithCode(code, message)
+	return errors.New(message)
+}
+
+// close sends a normal close frame and closes the connection.
+func (c *wsConn) close() error {
+	return c.closeWithCode(wsCloseNormal, "")
+}
+
+// closeWithCode sends a close frame with the given status code and reason,
+// unless one was already sent, and closes the connection.
+func (c *wsConn) closeWithCode(code int, reason string) error {
+	var err error
+	c.closeOnce.Do(func() {
+		if len(reason) > wsMaxControlPayload-2 {
+			reason = reason[:wsMaxControlPayload-2]
+		}
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+		c.writeFrame(wsClose, payload, time.Now().Add(time.Second))
+		err = c.conn.Close()
+	})
+	return err
+}
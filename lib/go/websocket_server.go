@@ -0,0 +1,427 @@
+package frugal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	defaultWebSocketMaxInFlight      = 64
+	defaultWebSocketMaxSubscriptions = 32
+	defaultWebSocketPublishQueue     = 64
+)
+
+// wsServerConn tracks a client connection of an FWebSocketServer. Published
+// messages are queued and written by a goroutine of the connection, so a slow
+// subscriber doesn't hold up publishers or other subscribers.
+type wsServerConn struct {
+	*wsConn
+	request   *http.Request
+	topics    map[string]struct{}
+	published chan []byte
+	done      chan struct{}
+}
+
+// interrupt closes the connection with a going away status. The close frame
+// is written asynchronously since a response may be being written.
+func (c *wsServerConn) interrupt() {
+	go c.closeWithCode(wsCloseGoingAway, "")
+}
+
+// FWebSocketServer is an FServer which serves an FProcessor to WebSocket
+// clients, such as the FTransports built by FWebSocketTransportBuilder. Each
+// client keeps a connection open over which requests are multiplexed, and
+// requests on a connection are processed concurrently so responses are sent
+// as they complete. Clients can also subscribe to topics, making the server a
+// broker for the FPublisherTransports created with
+// NewFWebSocketPublisherTransport.
+//
+// A client subscribes to a topic by sending the topic in a text message. The
+// server acknowledges the subscription by echoing the topic and then sends
+// each message published to a matching topic as a binary message. Topics are
+// matched like the topics of an FInMemoryBroker. Connections which send a
+// subscription which isn't authorized, or exceed the maximum number of
+// subscriptions, are closed with a policy violation status.
+type FWebSocketServer struct {
+	server           *http.Server
+	processor        FProcessor
+	protocolFactory  *FProtocolFactory
+	checkOrigin      func(*http.Request) bool
+	authorize        func(r *http.Request, topic string) error
+	maxRequestSize   uint
+	maxInFlight      uint
+	maxSubscriptions uint
+	publishQueue     uint
+	conns            *connTracker
+	mu               sync.Mutex
+	subscribers      map[*wsServerConn]struct{}
+}
+
+// NewFWebSocketServer creates a new FWebSocketServer which serves the
+// FProcessor on the given http.Server. The http.Server's Handler is replaced
+// with the FWebSocketServer, all other settings, such as the address, are
+// left as configured. The FWebSocketServer is also an http.Handler, so it can
+// be added to another handler instead, in which case it's served and stopped
+// with that handler's http.Server.
+func NewFWebSocketServer(server *http.Server, processor FProcessor,
+	protocolFactory *FProtocolFactory) *FWebSocketServer {
+	f := &FWebSocketServer{
+		server:           server,
+		processor:        processor,
+		protocolFactory:  protocolFactory,
+		checkOrigin:      sameOrigin,
+		maxRequestSize:   defaultMaxLength,
+		maxInFlight:      defaultWebSocketMaxInFlight,
+		maxSubscriptions: defaultWebSocketMaxSubscriptions,
+		publishQueue:     defaultWebSocketPublishQueue,
+		conns:            newConnTracker(),
+		subscribers:      make(map[*wsServerConn]struct{}),
+	}
+	server.Handler = f
+	return f
+}
+
+// WithCheckOrigin sets the function which decides whether to accept a
+// connection from a browser based on the request's Origin header. By
+// default, only connections from the same host are accepted. Must be called
+// before Serve.
+func (f *FWebSocketServer) WithCheckOrigin(checkOrigin func(r *http.Request) bool) *FWebSocketServer {
+	f.checkOrigin = checkOrigin
+	return f
+}
+
+// WithMaxRequestSize sets the maximum size of request frames, excluding the
+// frame size. Connections which send larger frames are closed. If set to 0,
+// messages are limited to 64 MB to bound the memory a client can make the
+// server allocate. Defaults to 16384000 bytes. Must be called before Serve.
+func (f *FWebSocketServer) WithMaxRequestSize(maxRequestSize uint) *FWebSocketServer {
+	f.maxRequestSize = maxRequestSize
+	return f
+}
+
+// WithMaxInFlight limits the number of requests from a connection which are
+// processed at once. The server stops reading from the connection until a
+// request completes. Defaults to 64. Must be called before Serve.
+func (f *FWebSocketServer) WithMaxInFlight(maxInFlight uint) *FWebSocketServer {
+	if maxInFlight == 0 {
+		maxInFlight = defaultWebSocketMaxInFlight
+	}
+	f.maxInFlight = maxInFlight
+	return f
+}
+
+// WithSubscribeAuthorizer sets the function which authorizes a client's
+// subscription to a topic based on the request which opened the connection,
+// e.g. its cookies or headers. Subscriptions are rejected if it returns an
+// error. By default, all subscriptions are allowed. Must be called before
+// Serve.
+func (f *FWebSocketServer) WithSubscribeAuthorizer(authorize func(r *http.Request, topic string) error) *FWebSocketServer {
+	f.authorize = authorize
+	return f
+}
+
+// WithMaxSubscriptions limits the number of topics a connection can subscribe
+// to. Defaults to 32. Must be called before Serve.
+func (f *FWebSocketServer) WithMaxSubscriptions(maxSubscriptions uint) *FWebSocketServer {
+	if maxSubscriptions == 0 {
+		maxSubscriptions = defaultWebSocketMaxSubscriptions
+	}
+	f.maxSubscriptions = maxSubscriptions
+	return f
+}
+
+// WithPublishQueueLength sets the number of published messages queued for
+// each subscribed connection. Messages published while a connection's queue
+// is full are dropped for that connection. Defaults to 64. Must be called
+// before Serve.
+func (f *FWebSocketServer) WithPublishQueueLength(publishQueue uint) *FWebSocketServer {
+	if publishQueue == 0 {
+		publishQueue = defaultWebSocketPublishQueue
+	}
+	f.publishQueue = publishQueue
+	return f
+}
+
+// Serve starts the server.
+func (f *FWebSocketServer) Serve() error {
+	if err := f.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Stop the server and close its connections. Requests which are being
+// processed are abandoned.
+func (f *FWebSocketServer) Stop() error {
+	err := f.server.Close()
+	f.conns.interruptAll(true)
+	return err
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections, closes
+// idle connections, and waits for connections processing a request to finish
+// it until the context is done. If the context is done first, all remaining
+// connections are closed and the number of requests which were abandoned is
+// returned along with the context's error.
+func (f *FWebSocketServer) Shutdown(ctx context.Context) (int, error) {
+	// Hijacked connections aren't tracked by the http.Server, so it only
+	// waits for requests which haven't been upgraded.
+	serverErr := f.server.Shutdown(ctx)
+	abandoned, err := f.conns.drain(ctx)
+	if err == nil {
+		err = serverErr
+	}
+	if err != nil {
+		f.server.Close()
+	}
+	return abandoned, err
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and serves it
+// until it's closed.
+func (f *FWebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r, f.checkOrigin, maxMessageSize(f.maxRequestSize))
+	if err != nil {
+		logger().Debug("frugal: error upgrading websocket request: ", err)
+		return
+	}
+	serverConn := &wsServerConn{
+		wsConn:    conn,
+		request:   r,
+		topics:    make(map[string]struct{}),
+		published: make(chan []byte, f.publishQueue),
+		done:      make(chan struct{}),
+	}
+	if !f.conns.track(serverConn) {
+		conn.closeWithCode(wsCloseGoingAway, "")
+		return
+	}
+	defer f.conns.untrack(serverConn)
+
+	logger().Debug("frugal: websocket connection accepted")
+	go f.writePublished(serverConn)
+	f.serveConn(serverConn)
+}
+
+// serveConn reads messages from the connection until it's closed, processing
+// requests concurrently and subscribing the connection to topics.
+func (f *FWebSocketServer) serveConn(conn *wsServerConn) {
+	slots := make(chan struct{}, f.maxInFlight)
+	var wg sync.WaitGroup
+	// The connection is untracked once its requests are processed.
+	defer wg.Wait()
+	defer f.unsubscribe(conn)
+
+	for {
+		opcode, data, err := conn.readMessage()
+		if err != nil {
+			if err != errWebSocketClosed && !f.conns.isDraining() {
+				logger().Debug("frugal: error reading websocket message: ", err)
+			}
+			conn.close()
+			return
+		}
+
+		if opcode == wsText {
+			if err := f.subscribe(conn, string(data)); err != nil {
+				logger().Debug("frugal: error subscribing websocket connection: ", err)
+				conn.close()
+				return
+			}
+			continue
+		}
+		if len(data) < 4 {
+			logger().Warn("frugal: Discarding invalid websocket frame")
+			continue
+		}
+
+		slots <- struct{}{}
+		if !f.conns.begin(conn) {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.processFrame(conn, data)
+			<-slots
+			if !f.conns.finish(conn) {
+				conn.closeWithCode(wsCloseGoingAway, "")
+			}
+		}()
+	}
+}
+
+// processFrame processes the request frame and writes the response, if any,
+// to the connection. The connection is closed if the request can't be
+// processed or the response can't be written.
+func (f *FWebSocketServer) processFrame(conn *wsServerConn, frame []byte) {
+	input := acquireFrameTransport(frame[4:])
+	defer releaseFrameTransport(input)
+	output := NewTMemoryOutputBuffer(0)
+	defer output.Release()
+
+	if err := f.processor.Process(f.protocolFactory.GetProtocol(input), f.protocolFactory.GetProtocol(output)); err != nil {
+		logger().Printf("error processing request: %s", err)
+		conn.close()
+		return
+	}
+	if !output.HasWriteData() {
+		return
+	}
+
+	if err := conn.writeFrame(wsBinary, output.Bytes(), time.Now().Add(wsWriteTimeout)); err != nil {
+		logger().Printf("error writing response: %s", err)
+		conn.close()
+	}
+}
+
+// subscribe authorizes the connection's subscription to the topic, subscribes
+// it, and acknowledges the subscription. Connections whose subscription is
+// rejected are closed with a policy violation status.
+func (f *FWebSocketServer) subscribe(conn *wsServerConn, topic string) error {
+	if f.authorize != nil {
+		if err := f.authorize(conn.request, topic); err != nil {
+			return conn.fail(wsClosePolicy,
+				fmt.Sprintf("frugal: websocket subscription to %s not authorized: %s", topic, err))
+		}
+	}
+
+	f.mu.Lock()
+	if _, ok := conn.topics[topic]; !ok && uint(len(conn.topics)) >= f.maxSubscriptions {
+		f.mu.Unlock()
+		return conn.fail(wsClosePolicy,
+			fmt.Sprintf("frugal: websocket connection exceeds %d subscriptions", f.maxSubscriptions))
+	}
+	conn.topics[topic] = struct{}{}
+	f.subscribers[conn] = struct{}{}
+	f.mu.Unlock()
+
+	return conn.writeFrame(wsText, []byte(topic), time.Now().Add(wsWriteTimeout))
+}
+
+// unsubscribe removes the connection's subscriptions and stops the goroutine
+// writing published messages to it.
+func (f *FWebSocketServer) unsubscribe(conn *wsServerConn) {
+	f.mu.Lock()
+	delete(f.subscribers, conn)
+	f.mu.Unlock()
+	close(conn.done)
+}
+
+// publish queues the message for every connection subscribed to a matching
+// topic. The message is dropped for connections whose queue is full.
+func (f *FWebSocketServer) publish(topic string, data []byte) {
+	// The message is written after Publish returns, so it can't share the
+	// caller's memory.
+	data = append([]byte(nil), data...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.subscribers {
+		for subscription := range conn.topics {
+			if !matchTopic(subscription, topic) {
+				continue
+			}
+			select {
+			case conn.published <- data:
+			default:
+				logger().Warnf("frugal: websocket subscriber queue full, dropping message published to %s", topic)
+			}
+			break
+		}
+	}
+}
+
+// writePublished writes the messages queued for the connection until it's
+// closed. The connection is closed if a message can't be written.
+func (f *FWebSocketServer) writePublished(conn *wsServerConn) {
+	for {
+		select {
+		case data := <-conn.published:
+			if err := conn.writeFrame(wsBinary, data, time.Now().Add(wsWriteTimeout)); err != nil {
+				logger().Printf("error publishing to websocket subscriber: %s", err)
+				conn.close()
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// FWebSocketPublisherTransportFactory creates WebSocket FPublisherTransports.
+type FWebSocketPublisherTransportFactory struct {
+	server *FWebSocketServer
+}
+
+// NewFWebSocketPublisherTransportFactory creates an
+// FWebSocketPublisherTransportFactory which publishes to the clients of the
+// given FWebSocketServer.
+func NewFWebSocketPublisherTransportFactory(server *FWebSocketServer) *FWebSocketPublisherTransportFactory {
+	return &FWebSocketPublisherTransportFactory{server: server}
+}
+
+// GetTransport creates a new WebSocket FPublisherTransport.
+func (f *FWebSocketPublisherTransportFactory) GetTransport() FPublisherTransport {
+	return NewFWebSocketPublisherTransport(f.server)
+}
+
+// fWebSocketPublisherTransport implements FPublisherTransport.
+type fWebSocketPublisherTransport struct {
+	server *FWebSocketServer
+	mu     sync.RWMutex
+	isOpen bool
+}
+
+// NewFWebSocketPublisherTransport creates a new FPublisherTransport which
+// publishes to the clients of the given FWebSocketServer which are subscribed
+// to matching topics.
+func NewFWebSocketPublisherTransport(server *FWebSocketServer) FPublisherTransport {
+	return &fWebSocketPublisherTransport{server: server}
+}
+
+// Open initializes the transport.
+func (f *fWebSocketPublisherTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isOpen = true
+	return nil
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fWebSocketPublisherTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.isOpen
+}
+
+// Close closes the transport.
+func (f *fWebSocketPublisherTransport) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isOpen = false
+	return nil
+}
+
+// GetPublishSizeLimit returns the maximum allowable size of a payload
+// to be published. A non-positive number is returned to indicate an
+// unbounded allowable size.
+func (f *fWebSocketPublisherTransport) GetPublishSizeLimit() uint {
+	return 0
+}
+
+// Publish sends the given payload to the subscribed clients.
+func (f *fWebSocketPublisherTransport) Publish(topic string, data []byte) error {
+	if !f.IsOpen() {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: websocket FPublisherTransport not open")
+	}
+
+	f.server.publish(topic, data)
+	return nil
+}
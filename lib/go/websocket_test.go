@@ -0,0 +1,144 @@
+package frugal
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// maskedFrame returns a client frame with the given payload masked with a
+// zero key, which leaves the payload unchanged.
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	return append(frame, payload...)
+}
+
+// Ensures the accept key matches the example in RFC 6455.
+func TestWSAcceptKey(t *testing.T) {
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+// Ensures requests which aren't valid WebSocket requests are rejected.
+func TestUpgradeWebSocketRejects(t *testing.T) {
+	validRequest := func() *http.Request {
+		r, _ := http.NewRequest("GET", "http://example.com/frugal", nil)
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", wsVersion)
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+
+	post := validRequest()
+	post.Method = "POST"
+	notUpgrade := validRequest()
+	notUpgrade.Header.Del("Upgrade")
+	badVersion := validRequest()
+	badVersion.Header.Set("Sec-WebSocket-Version", "8")
+	noKey := validRequest()
+	noKey.Header.Del("Sec-WebSocket-Key")
+	crossOrigin := validRequest()
+	crossOrigin.Header.Set("Origin", "http://evil.com")
+
+	for request, code := range map[*http.Request]int{
+		post:        http.StatusMethodNotAllowed,
+		notUpgrade:  http.StatusBadRequest,
+		badVersion:  http.StatusUpgradeRequired,
+		noKey:       http.StatusBadRequest,
+		crossOrigin: http.StatusForbidden,
+	} {
+		w := httptest.NewRecorder()
+		conn, err := upgradeWebSocket(w, request, sameOrigin, 0)
+		assert.Nil(t, conn)
+		assert.NotNil(t, err)
+		assert.Equal(t, code, w.Code)
+	}
+
+	sameHost := validRequest()
+	sameHost.Header.Set("Origin", "https://example.com")
+	assert.True(t, sameOrigin(sameHost))
+}
+
+// Ensures fragmented messages are reassembled, pings are answered, and
+// messages larger than the maximum message size close the connection.
+func TestWSConnReadMessage(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	client := newWSConn(clientEnd, bufio.NewReader(clientEnd), true, 0)
+	server := newWSConn(serverEnd, bufio.NewReader(serverEnd), false, 10)
+
+	go func() {
+		clientEnd.Write(maskedFrame(false, wsBinary, []byte("abc")))
+		clientEnd.Write(maskedFrame(true, wsPing, []byte("ping")))
+		clientEnd.Write(maskedFrame(true, wsContinuation, []byte("de")))
+	}()
+	pongC := make(chan []byte, 1)
+	go func() {
+		_, opcode, payload, err := client.readFrame()
+		assert.Nil(t, err)
+		assert.Equal(t, byte(wsPong), opcode)
+		pongC <- payload
+	}()
+
+	opcode, message, err := server.readMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(wsBinary), opcode)
+	assert.Equal(t, []byte("abcde"), message)
+	select {
+	case pong := <-pongC:
+		assert.Equal(t, []byte("ping"), pong)
+	case <-time.After(time.Second):
+		t.Fatal("pong not received")
+	}
+
+	// Messages are written unfragmented and masked by clients.
+	go func() {
+		assert.Nil(t, client.writeFrame(wsText, []byte("topic"), time.Time{}))
+	}()
+	opcode, message, err = server.readMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(wsText), opcode)
+	assert.Equal(t, []byte("topic"), message)
+
+	// The server closes the connection with a close frame.
+	go clientEnd.Write(maskedFrame(true, wsBinary, make([]byte, 11)))
+	closeC := make(chan error, 1)
+	go func() {
+		_, _, err := client.readMessage()
+		closeC <- err
+	}()
+	_, _, err = server.readMessage()
+	assert.NotNil(t, err)
+	select {
+	case err := <-closeC:
+		assert.Equal(t, errWebSocketClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("close not received")
+	}
+}
+
+// Ensures connections without a maximum message size reject frames larger
+// than wsMaxMessageSize before allocating their payload.
+func TestWSConnReadFrameHardLimit(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	server := newWSConn(serverEnd, bufio.NewReader(serverEnd), false, 0)
+	assert.Equal(t, wsMaxMessageSize, server.maxMessageSize)
+
+	go func() {
+		clientEnd.Write([]byte{0x80 | wsBinary, 0x80 | 127, 0, 0, 1, 0, 0, 0, 0, 0})
+		// Drain the close frame.
+		newWSConn(clientEnd, bufio.NewReader(clientEnd), true, 0).readFrame()
+	}()
+	_, _, _, err := server.readFrame()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,439 @@
+package frugal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// FWebSocketTransportBuilder configures and builds WebSocket FTransport and
+// FSubscriberTransport instances.
+type FWebSocketTransportBuilder struct {
+	url               string
+	header            http.Header
+	tlsConfig         *tls.Config
+	requestSizeLimit  uint
+	responseSizeLimit uint
+	handshakeTimeout  time.Duration
+}
+
+// NewFWebSocketTransportBuilder creates a builder which configures and builds
+// WebSocket FTransport and FSubscriberTransport instances which connect to
+// the given ws or wss URL.
+func NewFWebSocketTransportBuilder(url string) *FWebSocketTransportBuilder {
+	return &FWebSocketTransportBuilder{
+		url:               url,
+		responseSizeLimit: defaultMaxLength,
+		handshakeTimeout:  defaultWebSocketHandshakeTimeout,
+	}
+}
+
+// WithHeader adds headers which are sent with the opening handshake, e.g. for
+// authentication.
+func (w *FWebSocketTransportBuilder) WithHeader(header http.Header) *FWebSocketTransportBuilder {
+	w.header = header
+	return w
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to wss URLs.
+func (w *FWebSocketTransportBuilder) WithTLSConfig(tlsConfig *tls.Config) *FWebSocketTransportBuilder {
+	w.tlsConfig = tlsConfig
+	return w
+}
+
+// WithRequestSizeLimit adds a request size limit. If set to 0 (the default),
+// there is no size limit on requests.
+func (w *FWebSocketTransportBuilder) WithRequestSizeLimit(requestSizeLimit uint) *FWebSocketTransportBuilder {
+	w.requestSizeLimit = requestSizeLimit
+	return w
+}
+
+// WithResponseSizeLimit limits the size of received frames, excluding the
+// frame size. The connection is closed if the server sends a larger frame.
+// If set to 0, messages are limited to 64 MB to bound the memory a server can
+// make the transport allocate. Defaults to 16384000 bytes.
+func (w *FWebSocketTransportBuilder) WithResponseSizeLimit(responseSizeLimit uint) *FWebSocketTransportBuilder {
+	w.responseSizeLimit = responseSizeLimit
+	return w
+}
+
+// WithHandshakeTimeout sets how long to wait for the connection to open.
+// Defaults to 10 seconds.
+func (w *FWebSocketTransportBuilder) WithHandshakeTimeout(timeout time.Duration) *FWebSocketTransportBuilder {
+	w.handshakeTimeout = timeout
+	return w
+}
+
+// Build a new configured WebSocket FTransport.
+func (w *FWebSocketTransportBuilder) Build() FTransport {
+	return &fWebSocketTransport{
+		fBaseTransport: newFBaseTransport(w.requestSizeLimit),
+		dialer:         w.dialer(),
+	}
+}
+
+// BuildSubscriberTransport builds a new configured WebSocket
+// FSubscriberTransport. Each subscription uses its own connection.
+func (w *FWebSocketTransportBuilder) BuildSubscriberTransport() FSubscriberTransport {
+	return &fWebSocketSubscriberTransport{dialer: w.dialer()}
+}
+
+func (w *FWebSocketTransportBuilder) dialer() *wsDialer {
+	return &wsDialer{
+		url:              w.url,
+		header:           w.header,
+		tlsConfig:        w.tlsConfig,
+		maxMessageSize:   maxMessageSize(w.responseSizeLimit),
+		handshakeTimeout: w.handshakeTimeout,
+	}
+}
+
+// maxMessageSize returns the maximum size of a WebSocket message carrying a
+// frame of at most the given size. If 0, the frame size isn't limited and
+// messages are limited to wsMaxMessageSize by the connection.
+func maxMessageSize(maxFrameSize uint) uint {
+	if maxFrameSize == 0 {
+		return 0
+	}
+	return maxFrameSize + 4
+}
+
+// wsDialer opens WebSocket connections to a server.
+type wsDialer struct {
+	url              string
+	header           http.Header
+	tlsConfig        *tls.Config
+	maxMessageSize   uint
+	handshakeTimeout time.Duration
+}
+
+func (d *wsDialer) dial() (*wsConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.handshakeTimeout)
+	defer cancel()
+	conn, err := dialWebSocket(ctx, d.url, d.header, d.tlsConfig, d.maxMessageSize)
+	if err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	return conn, nil
+}
+
+// fWebSocketTransport implements FTransport. It maintains a WebSocket
+// connection to a server over which requests are multiplexed. Each WebSocket
+// message is a single frame, including its frame size.
+type fWebSocketTransport struct {
+	*fBaseTransport
+	dialer             *wsDialer
+	mu                 sync.RWMutex
+	conn               *wsConn
+	monitorCloseSignal chan<- error
+}
+
+// Open connects to the server.
+func (f *fWebSocketTransport) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: websocket transport already open")
+	}
+
+	conn, err := f.dialer.dial()
+	if err != nil {
+		return err
+	}
+	f.conn = conn
+	f.fBaseTransport.Open()
+	go f.readLoop(conn)
+	return nil
+}
+
+// readLoop executes the frames received on the connection until it's closed.
+func (f *fWebSocketTransport) readLoop(conn *wsConn) {
+	for {
+		opcode, frame, err := conn.readMessage()
+		if err != nil {
+			if err == errWebSocketClosed {
+				err = thrift.NewTTransportException(TRANSPORT_EXCEPTION_END_OF_FILE, err.Error())
+			}
+			f.close(conn, err)
+			return
+		}
+		if opcode != wsBinary {
+			continue
+		}
+		if len(frame) < 4 {
+			logger().Warn("frugal: Discarding invalid websocket frame")
+			continue
+		}
+
+		if err := f.registry.Execute(frame[4:]); err != nil {
+			// An error here indicates an unrecoverable error, teardown transport.
+			logger().Error("frugal: closing transport due to unrecoverable error processing frame: ", err)
+			f.close(conn, err)
+			return
+		}
+	}
+}
+
+// IsOpen returns true if the transport is open, false otherwise.
+func (f *fWebSocketTransport) IsOpen() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.conn != nil
+}
+
+// Close closes the transport.
+func (f *fWebSocketTransport) Close() error {
+	f.mu.RLock()
+	conn := f.conn
+	f.mu.RUnlock()
+	if conn == nil {
+		return nil
+	}
+	f.close(conn, nil)
+	return nil
+}
+
+// close closes the given connection if it's the transport's current
+// connection, signaling the monitor with the cause.
+func (f *fWebSocketTransport) close(conn *wsConn, cause error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != conn {
+		// The connection was already closed.
+		return
+	}
+	f.conn = nil
+	conn.close()
+	f.fBaseTransport.Close(cause)
+
+	if cause == nil {
+		logger().Debug("frugal: transport closed")
+	} else {
+		logger().Debugf("frugal: transport closed with cause: %s", cause)
+	}
+
+	// Signal transport monitor of close.
+	select {
+	case f.monitorCloseSignal <- cause:
+	default:
+	}
+}
+
+// Oneway transmits the given data and doesn't wait for a response.
+// Implementations of oneway should be threadsafe and respect the timeout
+// present on the context.
+func (f *fWebSocketTransport) Oneway(ctx FContext, data []byte) error {
+	if len(data) == 4 {
+		return nil
+	}
+	return f.send(ctx, data)
+}
+
+// Request transmits the given data and waits for a response.
+// Implementations of request should be threadsafe and respect the timeout
+// present on the context. The data is expected to already be framed.
+func (f *fWebSocketTransport) Request(ctx FContext, data []byte) (thrift.TTransport, error) {
+	if len(data) == 4 {
+		return nil, nil
+	}
+
+	resultC := make(chan []byte, 1)
+	if err := f.registry.Register(ctx, resultC); err != nil {
+		return nil, thrift.NewTTransportExceptionFromError(err)
+	}
+	defer f.registry.Unregister(ctx)
+
+	if err := f.send(ctx, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-resultC:
+		return &thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(result)}, nil
+	case <-goContext(ctx).Done():
+		return nil, contextError(ctx)
+	case <-time.After(ctx.Timeout()):
+		return nil, thrift.NewTTransportException(TRANSPORT_EXCEPTION_TIMED_OUT, "frugal: websocket request timed out")
+	}
+}
+
+// send writes the frame to the connection as a binary message.
+func (f *fWebSocketTransport) send(ctx FContext, data []byte) error {
+	f.mu.RLock()
+	conn := f.conn
+	f.mu.RUnlock()
+	if conn == nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_NOT_OPEN,
+			"frugal: websocket transport not open")
+	}
+
+	if f.requestSizeLimit > 0 && len(data) > int(f.requestSizeLimit) {
+		return thrift.NewTTransportException(
+			TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE,
+			fmt.Sprintf("Message exceeds %d bytes, was %d bytes", f.requestSizeLimit, len(data)))
+	}
+
+	if goContext(ctx).Err() != nil {
+		return contextError(ctx)
+	}
+
+	if err := conn.writeFrame(wsBinary, data, time.Now().Add(ctx.Timeout())); err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
+
+// GetRequestSizeLimit returns the maximum number of bytes that can be
+// transmitted. Returns a non-positive number to indicate an unbounded
+// allowable size.
+func (f *fWebSocketTransport) GetRequestSizeLimit() uint {
+	return f.requestSizeLimit
+}
+
+// SetMonitor starts a monitor that can watch the health of, and reopen,
+// the transport.
+func (f *fWebSocketTransport) SetMonitor(monitor FTransportMonitor) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Stop the previous monitor, if any.
+	select {
+	case f.monitorCloseSignal <- nil:
+	default:
+	}
+
+	// Start the new monitor.
+	monitorClosedSignal := make(chan error, 1)
+	runner := &monitorRunner{
+		monitor:       monitor,
+		transport:     f,
+		closedChannel: monitorClosedSignal,
+	}
+	f.monitorCloseSignal = monitorClosedSignal
+	go runner.run()
+}
+
+// Closed channel receives the cause of an FTransport close (nil if clean
+// close).
+func (f *fWebSocketTransport) Closed() <-chan error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.fBaseTransport.Closed()
+}
+
+// fWebSocketSubscriberTransport implements FSubscriberTransport. It subscribes
+// to a topic by sending the topic to the server in a text message over its own
+// WebSocket connection, after which the server acknowledges the subscription
+// by echoing the topic and sends each message published to the topic as a
+// binary message.
+type fWebSocketSubscriberTransport struct {
+	dialer *wsDialer
+	openMu sync.RWMutex
+	conn   *wsConn
+}
+
+// Subscribe connects to the server and subscribes to the topic.
+func (f *fWebSocketSubscriberTransport) Subscribe(topic string, callback FAsyncCallback) error {
+	f.openMu.Lock()
+	defer f.openMu.Unlock()
+	if f.conn != nil {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_ALREADY_OPEN,
+			"frugal: websocket transport already open")
+	}
+
+	if topic == "" {
+		return thrift.NewTTransportException(TRANSPORT_EXCEPTION_UNKNOWN,
+			"cannot subscribe to empty subject")
+	}
+
+	conn, err := f.dialer.dial()
+	if err != nil {
+		return err
+	}
+	if err := f.subscribe(conn, topic); err != nil {
+		conn.close()
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	f.conn = conn
+	go f.readLoop(conn, callback)
+	return nil
+}
+
+// subscribe sends the topic to the server and waits for the acknowledgement.
+func (f *fWebSocketSubscriberTransport) subscribe(conn *wsConn, topic string) error {
+	deadline := time.Now().Add(f.dialer.handshakeTimeout)
+	if err := conn.writeFrame(wsText, []byte(topic), deadline); err != nil {
+		return err
+	}
+	conn.conn.SetReadDeadline(deadline)
+	opcode, ack, err := conn.readMessage()
+	if err != nil {
+		return err
+	}
+	if opcode != wsText || string(ack) != topic {
+		return fmt.Errorf("frugal: invalid websocket subscription acknowledgement for %s", topic)
+	}
+	conn.conn.SetReadDeadline(time.Time{})
+	return nil
+}
+
+// readLoop invokes the callback with each message received on the connection
+// until it's closed.
+func (f *fWebSocketSubscriberTransport) readLoop(conn *wsConn, callback FAsyncCallback) {
+	for {
+		opcode, data, err := conn.readMessage()
+		if err != nil {
+			f.openMu.Lock()
+			if f.conn == conn {
+				logger().Warn("frugal: websocket subscription closed: ", err)
+				f.conn = nil
+				conn.close()
+			}
+			f.openMu.Unlock()
+			return
+		}
+		if opcode != wsBinary {
+			continue
+		}
+		if len(data) < 4 {
+			logger().Warn("frugal: Discarding invalid scope message frame")
+			continue
+		}
+		transport := acquireFrameTransport(data[4:])
+		if err := callback(transport); err != nil {
+			logger().Warn("frugal: error executing callback: ", err)
+		}
+		releaseFrameTransport(transport)
+	}
+}
+
+// IsSubscribed returns true if the transport is subscribed to a topic, false
+// otherwise.
+func (f *fWebSocketSubscriberTransport) IsSubscribed() bool {
+	f.openMu.RLock()
+	defer f.openMu.RUnlock()
+	return f.conn != nil
+}
+
+// Unsubscribe unsubscribes from the topic and closes the connection.
+func (f *fWebSocketSubscriberTransport) Unsubscribe() error {
+	f.openMu.Lock()
+	defer f.openMu.Unlock()
+	if f.conn == nil {
+		return nil
+	}
+
+	err := f.conn.close()
+	f.conn = nil
+	if err != nil {
+		return thrift.NewTTransportExceptionFromError(err)
+	}
+	return nil
+}
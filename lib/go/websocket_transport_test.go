@@ -0,0 +1,313 @@
+package frugal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+// startWebSocketServer starts an FWebSocketServer with the given FProcessor on
+// a random port and returns it along with its URL.
+func startWebSocketServer(t *testing.T, processor FProcessor) (*FWebSocketServer, string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	server := NewFWebSocketServer(&http.Server{}, processor, protoFactory)
+	go server.server.Serve(listener)
+	return server, "ws://" + listener.Addr().String()
+}
+
+// Ensures requests are multiplexed over the connection and their responses
+// are received as they complete.
+func TestWebSocketTransportRequest(t *testing.T) {
+	server, url := startWebSocketServer(t, &echoProcessor{})
+	defer server.Stop()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFWebSocketTransportBuilder(url).Build()
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := compressibleString(i * 10000)
+			_, response := echo(t, transport, protoFactory, body)
+			assert.Equal(t, body, response)
+		}(i)
+	}
+	wg.Wait()
+
+	ctx := NewFContext("")
+	assert.Nil(t, transport.Oneway(ctx, stringMessage(t, protoFactory, ctx, "foo")))
+}
+
+// Ensures requests on a connection are processed concurrently.
+func TestWebSocketTransportConcurrentRequests(t *testing.T) {
+	processor := &slowProcessor{delay: 100 * time.Millisecond}
+	server, url := startWebSocketServer(t, processor)
+	defer server.Stop()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFWebSocketTransportBuilder(url).Build()
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := NewFContext("")
+			result, err := transport.Request(ctx, requestFrame(t, protoFactory, ctx))
+			assert.Nil(t, err)
+			resultProto := protoFactory.GetProtocol(result)
+			assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+			response, err := resultProto.ReadString()
+			assert.Nil(t, err)
+			assert.Equal(t, "foo", response)
+		}()
+	}
+	wg.Wait()
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+// Ensures requests fail when the transport isn't open or they're too large.
+func TestWebSocketTransportRequestErrors(t *testing.T) {
+	server, url := startWebSocketServer(t, &echoProcessor{})
+	defer server.Stop()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFWebSocketTransportBuilder(url).WithRequestSizeLimit(100).Build()
+
+	ctx := NewFContext("")
+	_, err := transport.Request(ctx, stringMessage(t, protoFactory, ctx, "foo"))
+	assert.Equal(t, TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+	err = transport.Open()
+	assert.Equal(t, TRANSPORT_EXCEPTION_ALREADY_OPEN, err.(thrift.TTransportException).TypeId())
+
+	ctx = NewFContext("")
+	_, err = transport.Request(ctx, stringMessage(t, protoFactory, ctx, compressibleString(100)))
+	assert.Equal(t, TRANSPORT_EXCEPTION_REQUEST_TOO_LARGE, err.(thrift.TTransportException).TypeId())
+
+	// The handshake fails with servers which don't accept WebSockets.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	for _, badURL := range []string{ts.URL, "ftp" + ts.URL[len("http"):]} {
+		bad := NewFWebSocketTransportBuilder(badURL).Build()
+		assert.NotNil(t, bad.Open())
+		assert.False(t, bad.IsOpen())
+	}
+}
+
+type reopenMonitor struct {
+	BaseFTransportMonitor
+	reopened chan struct{}
+}
+
+func (m *reopenMonitor) OnReopenSucceeded() {
+	m.reopened <- struct{}{}
+}
+
+// Ensures the FTransportMonitor reopens the transport when the server closes
+// the connection.
+func TestWebSocketTransportMonitorReopen(t *testing.T) {
+	server, url := startWebSocketServer(t, &echoProcessor{})
+	defer server.Stop()
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFWebSocketTransportBuilder(url).Build()
+	monitor := &reopenMonitor{
+		BaseFTransportMonitor: BaseFTransportMonitor{
+			MaxReopenAttempts: 5,
+			InitialWait:       10 * time.Millisecond,
+			MaxWait:           10 * time.Millisecond,
+		},
+		reopened: make(chan struct{}, 1),
+	}
+	transport.SetMonitor(monitor)
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+	closed := transport.Closed()
+
+	server.conns.interruptAll(false)
+
+	select {
+	case cause := <-closed:
+		assert.NotNil(t, cause)
+	case <-time.After(time.Second):
+		t.Fatal("transport not closed")
+	}
+	select {
+	case <-monitor.reopened:
+	case <-time.After(time.Second):
+		t.Fatal("transport not reopened")
+	}
+
+	assert.True(t, transport.IsOpen())
+	_, response := echo(t, transport, protoFactory, "foo")
+	assert.Equal(t, "foo", response)
+}
+
+// Ensures published messages are received by the subscribers of matching
+// topics.
+func TestWebSocketSubscriberTransport(t *testing.T) {
+	server, url := startWebSocketServer(t, &echoProcessor{})
+	defer server.Stop()
+
+	subscribe := func(topic string) (FSubscriberTransport, chan []byte) {
+		received := make(chan []byte, 1)
+		sub := NewFWebSocketTransportBuilder(url).BuildSubscriberTransport()
+		assert.Nil(t, sub.Subscribe(topic, func(transport thrift.TTransport) error {
+			buff := new(bytes.Buffer)
+			_, err := buff.ReadFrom(transport)
+			received <- buff.Bytes()
+			return err
+		}))
+		assert.True(t, sub.IsSubscribed())
+		return sub, received
+	}
+	matching, matchingC := subscribe("foo.*")
+	defer matching.Unsubscribe()
+	other, otherC := subscribe("bar")
+	defer other.Unsubscribe()
+
+	factory := NewFWebSocketPublisherTransportFactory(server)
+	pub := factory.GetTransport()
+	frame := []byte("hello")
+	err := pub.Publish("foo.baz", prependFrameSize(frame))
+	assert.Equal(t, TRANSPORT_EXCEPTION_NOT_OPEN, err.(thrift.TTransportException).TypeId())
+	assert.Nil(t, pub.Open())
+	defer pub.Close()
+	assert.Nil(t, pub.Publish("foo.baz", prependFrameSize(frame)))
+
+	select {
+	case data := <-matchingC:
+		assert.Equal(t, frame, data)
+	case <-time.After(time.Second):
+		t.Fatal("published message not received")
+	}
+	select {
+	case data := <-otherC:
+		t.Fatalf("unexpected message %v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Nil(t, matching.Unsubscribe())
+	assert.False(t, matching.IsSubscribed())
+}
+
+// Ensures subscriptions which aren't authorized or exceed the maximum number
+// of subscriptions are rejected.
+func TestWebSocketSubscriberTransportRejected(t *testing.T) {
+	server, url := startWebSocketServer(t, &echoProcessor{})
+	defer server.Stop()
+	server.WithMaxSubscriptions(1).WithSubscribeAuthorizer(func(r *http.Request, topic string) error {
+		if topic == "secret" {
+			return errors.New("forbidden")
+		}
+		return nil
+	})
+	callback := func(thrift.TTransport) error { return nil }
+
+	sub := NewFWebSocketTransportBuilder(url).BuildSubscriberTransport()
+	assert.NotNil(t, sub.Subscribe("secret", callback))
+	assert.False(t, sub.IsSubscribed())
+
+	// A second subscription on a connection exceeds the maximum.
+	conn, err := dialWebSocket(context.Background(), url, nil, nil, 0)
+	assert.Nil(t, err)
+	defer conn.close()
+	assert.Nil(t, conn.writeFrame(wsText, []byte("foo"), time.Time{}))
+	_, ack, err := conn.readMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), ack)
+	assert.Nil(t, conn.writeFrame(wsText, []byte("bar"), time.Time{}))
+	_, _, err = conn.readMessage()
+	assert.Equal(t, errWebSocketClosed, err)
+}
+
+// Ensures publishing doesn't wait for subscribers which aren't reading and
+// drops messages once their queue is full.
+func TestWebSocketPublishSlowSubscriber(t *testing.T) {
+	server, url := startWebSocketServer(t, &echoProcessor{})
+	defer server.Stop()
+	server.WithPublishQueueLength(1)
+
+	conn, err := dialWebSocket(context.Background(), url, nil, nil, 0)
+	assert.Nil(t, err)
+	defer conn.close()
+	assert.Nil(t, conn.writeFrame(wsText, []byte("foo"), time.Time{}))
+	_, ack, err := conn.readMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("foo"), ack)
+
+	pub := NewFWebSocketPublisherTransport(server)
+	assert.Nil(t, pub.Open())
+	payload := make([]byte, 1024*1024)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, pub.Publish("foo", payload))
+	}
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+// Ensures Shutdown waits for the request being processed to finish and
+// reports abandoned requests when the context is done first.
+func TestFWebSocketServerShutdown(t *testing.T) {
+	processor := &slowProcessor{delay: 50 * time.Millisecond}
+	server, url := startWebSocketServer(t, processor)
+	protoFactory := NewFProtocolFactory(thrift.NewTBinaryProtocolFactoryDefault())
+	transport := NewFWebSocketTransportBuilder(url).Build()
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+
+	resultC := make(chan thrift.TTransport, 1)
+	ctx := NewFContext("")
+	go func() {
+		result, err := transport.Request(ctx, requestFrame(t, protoFactory, ctx))
+		assert.Nil(t, err)
+		resultC <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	abandoned, err := server.Shutdown(shutdownCtx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, abandoned)
+
+	resultProto := protoFactory.GetProtocol(<-resultC)
+	assert.Nil(t, resultProto.ReadResponseHeader(ctx))
+	result, err := resultProto.ReadString()
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", result)
+
+	processor = &slowProcessor{delay: 100 * time.Millisecond}
+	server, url = startWebSocketServer(t, processor)
+	transport = NewFWebSocketTransportBuilder(url).Build()
+	assert.Nil(t, transport.Open())
+	defer transport.Close()
+	ctx = NewFContext("")
+	go transport.Request(ctx, requestFrame(t, protoFactory, ctx))
+	time.Sleep(10 * time.Millisecond)
+
+	shutdownCtx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	abandoned, err = server.Shutdown(shutdownCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, abandoned)
+}
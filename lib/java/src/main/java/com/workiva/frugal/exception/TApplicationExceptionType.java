@@ -28,4 +28,19 @@ public class TApplicationExceptionType {
      * Indicates the response was too large for the transport.
      */
     public static final int RESPONSE_TOO_LARGE = 100;
+
+    /**
+     * Indicates the request timed out before the server processed it.
+     */
+    public static final int DEADLINE_EXCEEDED = 101;
+
+    /**
+     * Indicates the request was not authenticated or not authorized to call the method.
+     */
+    public static final int UNAUTHORIZED = 102;
+
+    /**
+     * Indicates the server rejected the request without processing it because it's overloaded.
+     */
+    public static final int OVERLOADED = 103;
 }
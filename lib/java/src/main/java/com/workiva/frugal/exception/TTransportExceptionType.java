@@ -27,4 +27,9 @@ public class TTransportExceptionType {
      */
     public static final int RESPONSE_TOO_LARGE = 101;
 
+    /**
+     * TTransportException code which indicates the circuit breaker rejected the request.
+     */
+    public static final int CIRCUIT_OPEN = 102;
+
 }
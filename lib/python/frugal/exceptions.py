@@ -12,6 +12,7 @@ class TTransportExceptionType(object):
 
     REQUEST_TOO_LARGE = 100
     RESPONSE_TOO_LARGE = 101
+    CIRCUIT_OPEN = 102
 
 
 class TApplicationExceptionType(object):
@@ -29,3 +30,6 @@ class TApplicationExceptionType(object):
     UNSUPPORTED_CLIENT_TYPE = TApplicationException.UNSUPPORTED_CLIENT_TYPE
 
     RESPONSE_TOO_LARGE = 100
+    DEADLINE_EXCEEDED = 101
+    UNAUTHORIZED = 102
+    OVERLOADED = 103
@@ -22,6 +22,21 @@ func TestValidGoWithAsync(t *testing.T) {
 	compareFiles(t, "expected/go/variety_async/f_foo_service.txt", fooServicePath)
 }
 
+func TestValidGoWithContext(t *testing.T) {
+	options := compiler.Options{
+		File:  frugalGenFile,
+		Gen:   "go:package_prefix=github.com/Workiva/frugal/test/out/context/,context",
+		Out:   outputDir + "/context",
+		Delim: delim,
+	}
+	if err := compiler.Compile(options); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	fooServicePath := filepath.Join(outputDir, "context", "variety", "f_foo_service.go")
+	compareFiles(t, "expected/go/variety_context/f_foo_service.txt", fooServicePath)
+}
+
 func TestValidGoFrugalCompiler(t *testing.T) {
 	options := compiler.Options{
 		File:    frugalGenFile,